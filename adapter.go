@@ -0,0 +1,87 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+)
+
+// Executor is the set of methods ORMs and query builders (such as GORM, sqlx
+// and squirrel) need to run statements, as implemented by sql.DB, sql.Tx and
+// sql.Conn. The handle returned by DB.Unwrap() implements it.
+type Executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+var (
+	_ Executor = (*sql.DB)(nil)
+	_ Executor = (*sql.Tx)(nil)
+	_ Executor = (*sql.Conn)(nil)
+)
+
+// Unwrap returns a plain *sql.DB whose connections are taken under the limits
+// of the DB, for libraries that insist on *sql.DB or return sql.Rows, such as
+// ORMs. Connections handed out by the handle count against the limit, and are
+// subject to the rate limits, quotas and circuit breaker of the DB, while
+// waits are reported in its PoolStats() and events as usual. Connections are
+// made as those of the DB, so comments, statement timeouts and the limit guard
+// are applied, and they follow the DB on Reconfigure() and failover. Other
+// features, such as retries, digests and slow query logging, only apply to
+// statements run through the DB itself. The handle keeps its own idle
+// connections, and is closed along with the DB, so it should not be closed
+// directly. Calls return the same handle.
+func (db *DB) Unwrap() *sql.DB {
+	db.unwrapMux.Lock()
+	defer db.unwrapMux.Unlock()
+
+	if db.unwrapped == nil {
+		db.unwrapped = sql.OpenDB(&limitedConnector{
+			Connector: currentConnector{db},
+			acquire:   db.conn,
+			driver:    db.pool().Driver(),
+		})
+		db.limitMux.Lock()
+		db.unwrapped.SetMaxIdleConns(db.idleConns())
+		db.limitMux.Unlock()
+
+		select {
+		case <-db.done:
+			// Closed meanwhile
+			db.unwrapped.Close()
+		default:
+		}
+	}
+	return db.unwrapped
+}
+
+// closeUnwrapped closes the handle returned by Unwrap(), if any.
+func (db *DB) closeUnwrapped() {
+	db.unwrapMux.Lock()
+	defer db.unwrapMux.Unlock()
+
+	if db.unwrapped != nil {
+		db.unwrapped.Close()
+	}
+}
+
+// currentConnector makes connections with the connector of the sql.DB in use by
+// a DB.
+type currentConnector struct {
+	db *DB
+}
+
+func (c currentConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.db.poolMux.RLock()
+	conn := c.db.connector
+	c.db.poolMux.RUnlock()
+	return conn.Connect(ctx)
+}
+
+func (c currentConnector) Driver() driver.Driver {
+	return c.db.pool().Driver()
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer chooses the replica to send each read-only query to in a Cluster.
+// Implementations must be safe for concurrent use. See SetBalancer().
+type Balancer interface {
+	// Pick returns one of the replicas, which is never an empty list.
+	Pick(replicas []*DB) *DB
+
+	// Observe is called after each query sent to a replica, with the time it
+	// took to get results and the error returned, if any.
+	Observe(replica *DB, latency time.Duration, err error)
+}
+
+// RoundRobin returns a Balancer that picks replicas in turn.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint32 // Accessed atomically
+}
+
+func (b *roundRobin) Pick(replicas []*DB) *DB {
+	n := atomic.AddUint32(&b.next, 1)
+	return replicas[int(n-1)%len(replicas)]
+}
+
+func (b *roundRobin) Observe(*DB, time.Duration, error) {}
+
+// LeastInUse returns a Balancer that picks the replica with the fewest
+// connections in use.
+func LeastInUse() Balancer {
+	return leastInUse{}
+}
+
+type leastInUse struct{}
+
+func (leastInUse) Pick(replicas []*DB) *DB {
+	best := replicas[0]
+	for _, r := range replicas[1:] {
+		if atomic.LoadInt32(&r.inUse) < atomic.LoadInt32(&best.inUse) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (leastInUse) Observe(*DB, time.Duration, error) {}
+
+// LowestLatency returns a Balancer that picks the replica with the lowest
+// average latency over recent queries. Replicas not queried yet are preferred,
+// so that all of them get a chance. Failed queries count as the slowest ones.
+func LowestLatency() Balancer {
+	return &lowestLatency{latency: make(map[*DB]time.Duration)}
+}
+
+type lowestLatency struct {
+	mu      sync.RWMutex
+	latency map[*DB]time.Duration
+}
+
+func (b *lowestLatency) Pick(replicas []*DB) *DB {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	best, bestLatency := replicas[0], b.latency[replicas[0]]
+	for _, r := range replicas[1:] {
+		if l := b.latency[r]; l < bestLatency {
+			best, bestLatency = r, l
+		}
+	}
+	return best
+}
+
+func (b *lowestLatency) Observe(replica *DB, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		// Penalize failures, so that the replica is avoided for a while
+		latency = 2*b.latency[replica] + time.Second
+	}
+
+	if avg, ok := b.latency[replica]; ok {
+		b.latency[replica] = avg + (latency-avg)/8
+	} else {
+		b.latency[replica] = latency
+	}
+}
+
+// TwoRandomChoices returns a Balancer that picks two replicas at random and
+// takes the one with fewer connections in use. This spreads load nearly as
+// well as LeastInUse(), while avoiding the herd behavior of always choosing
+// the least loaded replica.
+func TwoRandomChoices() Balancer {
+	return &twoRandomChoices{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+type twoRandomChoices struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (b *twoRandomChoices) Pick(replicas []*DB) *DB {
+	if len(replicas) == 1 {
+		return replicas[0]
+	}
+
+	b.mu.Lock()
+	i := b.rnd.Intn(len(replicas))
+	j := b.rnd.Intn(len(replicas) - 1)
+	b.mu.Unlock()
+
+	if j >= i {
+		j++
+	}
+
+	if atomic.LoadInt32(&replicas[j].inUse) < atomic.LoadInt32(&replicas[i].inUse) {
+		return replicas[j]
+	}
+	return replicas[i]
+}
+
+func (b *twoRandomChoices) Observe(*DB, time.Duration, error) {}
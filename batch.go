@@ -0,0 +1,47 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Statement is a statement to run with ExecBatch().
+type Statement struct {
+	Query string
+	Args  []interface{}
+}
+
+// BatchResult is the outcome of a statement run with ExecBatch().
+type BatchResult struct {
+	Result sql.Result
+	Err    error
+}
+
+// ExecBatch runs independent statements, in order, over a single connection
+// taken from the limit once, rather than once per statement. This saves the
+// overhead of acquiring connections when issuing bursts of writes. Statements
+// are not run in a transaction, so a statement failing doesn't prevent others
+// from running; see the result of each one. If ctx is canceled, remaining
+// statements fail with its error. The error returned is set if no connection
+// could be obtained, in which case no statement was run.
+func (db *DB) ExecBatch(ctx context.Context, stmts []Statement) ([]BatchResult, error) {
+	results := make([]BatchResult, len(stmts))
+
+	err := db.WithConn(ctx, func(c *Conn) error {
+		for i, stmt := range stmts {
+			if err := ctx.Err(); err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].Result, results[i].Err = c.ExecContext(ctx, stmt.Query, stmt.Args...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// fieldMaps caches the field mapping of struct types.
+var fieldMaps sync.Map // Of reflect.Type to map[string][]int
+
+// fieldMap returns the index path of the fields of a struct type, keyed by name.
+// Names are taken from the "db" tag, or are the lowercase field names if not
+// tagged. Fields tagged "-" and unexported ones are skipped, whereas those of
+// embedded structs are included as if they belonged to t, unless tagged.
+func fieldMap(t reflect.Type) map[string][]int {
+	if m, ok := fieldMaps.Load(t); ok {
+		return m.(map[string][]int)
+	}
+
+	m := make(map[string][]int)
+	addFields(m, t, nil)
+	fieldMaps.Store(t, m)
+	return m
+}
+
+func addFields(m map[string][]int, t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("db"), ",")[0]
+		if tag == "-" || f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		path := append(append([]int(nil), index...), i)
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			addFields(m, ft, path)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := tag
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if _, ok := m[name]; !ok {
+			// Shallower fields take precedence, as in Go
+			m[name] = path
+		}
+	}
+}
+
+// fieldByPath returns the field of v at the given index path, or the zero Value
+// if it goes through a nil pointer. If alloc is set, nil pointers are
+// allocated instead.
+func fieldByPath(v reflect.Value, path []int, alloc bool) reflect.Value {
+	for i, x := range path {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// structField returns the field of v for the given name, as mapped by
+// fieldMap(), or the zero Value if not found. Names not mapped as such are
+// also looked up in lowercase.
+func structField(v reflect.Value, name string) reflect.Value {
+	m := fieldMap(v.Type())
+	path, ok := m[name]
+	if !ok {
+		if path, ok = m[strings.ToLower(name)]; !ok {
+			return reflect.Value{}
+		}
+	}
+	return fieldByPath(v, path, false)
+}
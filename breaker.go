@@ -0,0 +1,226 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through. This is the normal state.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen rejects all requests with ErrCircuitOpen.
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single probe request through, to find out
+	// whether the database has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerSettings configures the circuit breaker. See SetCircuitBreaker().
+type BreakerSettings struct {
+	ConsecutiveFailures int           // Failures in a row that open the circuit (zero to disable)
+	FailureRate         float64       // Ratio of failures that opens the circuit (zero to disable)
+	MinRequests         int           // Requests needed within Window for FailureRate to apply
+	Window              time.Duration // Period over which FailureRate is computed
+	CoolDown            time.Duration // Time to remain open before probing
+}
+
+type breaker struct {
+	mu          sync.Mutex
+	db          *DB
+	settings    BreakerSettings
+	state       BreakerState
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probedAt    time.Time
+	probe       uint64 // Ticket of the probe let through while half-open
+	tickets     uint64
+}
+
+// SetCircuitBreaker installs a circuit breaker on the DB. Once too many
+// requests fail with transient errors (see SetRetryable()), either in a row or
+// as a ratio of the requests within a time window, the circuit opens and new
+// requests are rejected right away with ErrCircuitOpen, without taking a
+// connection. After the cool-down period, a single probe request is let
+// through: the circuit closes again once the probe is done with its connection
+// if it succeeded, or remains open for another period if it failed. Successes
+// of requests let through before the circuit opened don't count for that, but
+// their transient failures do reopen the circuit. A BreakerEvent is sent each
+// time the state changes (see SetEventCh()). Passing zero settings (the
+// default) removes the breaker.
+func (db *DB) SetCircuitBreaker(settings BreakerSettings) {
+	db.breakerMux.Lock()
+	defer db.breakerMux.Unlock()
+
+	if settings.ConsecutiveFailures <= 0 && settings.FailureRate <= 0 {
+		db.breaker = nil
+		return
+	}
+
+	db.breaker = &breaker{
+		db:          db,
+		settings:    settings,
+		windowStart: db.Clock().Now(),
+	}
+}
+
+// BreakerState returns the current state of the circuit breaker. It's always
+// BreakerClosed if no breaker is set.
+func (db *DB) BreakerState() BreakerState {
+	db.breakerMux.RLock()
+	defer db.breakerMux.RUnlock()
+
+	if db.breaker == nil {
+		return BreakerClosed
+	}
+
+	db.breaker.mu.Lock()
+	defer db.breaker.mu.Unlock()
+	return db.breaker.state
+}
+
+// allow checks whether the circuit breaker lets a new request through. If the
+// request is let through as a probe, it also returns a function to call once
+// the probe is done with its connection. The function is nil otherwise.
+func (db *DB) allow() (func(), error) {
+	db.breakerMux.RLock()
+	defer db.breakerMux.RUnlock()
+
+	if db.breaker == nil {
+		return nil, nil
+	}
+	return db.breaker.allow()
+}
+
+func (b *breaker) allow() (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.db.Clock().Now()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.settings.CoolDown {
+			return nil, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen, nil)
+		return b.admitProbe(now), nil
+
+	case BreakerHalfOpen:
+		// Allow for another probe if the previous one got lost, e.g., if it
+		// was canceled before reaching the database
+		if now.Sub(b.probedAt) < b.settings.CoolDown {
+			return nil, ErrCircuitOpen
+		}
+		return b.admitProbe(now), nil
+	}
+
+	return nil, nil
+}
+
+// admitProbe lets a probe through, returning the function to call when done.
+// Must be called with b.mu held.
+func (b *breaker) admitProbe(now time.Time) func() {
+	b.tickets++
+	ticket := b.tickets
+	b.probe, b.probedAt = ticket, now
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		// The probe would have reopened the circuit if it failed, and a later
+		// probe takes over if this one was given up on
+		if b.state == BreakerHalfOpen && b.probe == ticket {
+			b.reset()
+			b.setState(BreakerClosed, nil)
+		}
+	}
+}
+
+// record accounts for the outcome of a request.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failed := b.db.isTransient(err)
+
+	if b.state == BreakerHalfOpen {
+		// Successes close the circuit only when coming from the probe, once
+		// it's done (see admitProbe())
+		if failed {
+			b.open(err)
+		}
+		return
+	}
+
+	if b.state != BreakerClosed {
+		return
+	}
+
+	now := b.db.Clock().Now()
+	if b.settings.Window > 0 && now.Sub(b.windowStart) >= b.settings.Window {
+		b.requests, b.failures = 0, 0
+		b.windowStart = now
+	}
+
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+
+	b.consecutive++
+	b.failures++
+
+	if n := b.settings.ConsecutiveFailures; n > 0 && b.consecutive >= n {
+		b.open(err)
+		return
+	}
+
+	if r := b.settings.FailureRate; r > 0 && b.requests >= b.settings.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= r {
+		b.open(err)
+	}
+}
+
+func (b *breaker) open(cause error) {
+	b.reset()
+	b.openedAt = b.db.Clock().Now()
+	b.setState(BreakerOpen, cause)
+}
+
+func (b *breaker) reset() {
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.windowStart = b.db.Clock().Now()
+}
+
+// setState changes the state, notifying the change. Must be called with b.mu
+// held.
+func (b *breaker) setState(state BreakerState, cause error) {
+	if state == b.state {
+		return
+	}
+
+	b.state = state
+	b.db.emit(BreakerEvent{Time: time.Now(), State: state, Cause: redactError(cause)})
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+// TestBreakerProbe checks that only the outcome of the probe closes the
+// circuit, and not that of requests let through before it opened.
+func TestBreakerProbe(t *testing.T) {
+	f := dbcontroltest.New()
+	defer f.Close()
+	boom := errors.New("boom")
+	block := make(chan struct{})
+	f.On("SELECT boom", dbcontroltest.Result{Err: boom})
+	f.On("SELECT slow", dbcontroltest.Result{Block: block})
+
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetRetryable(dbcontrol.RetryableFunc(func(err error) bool {
+		return err != nil && err.Error() == boom.Error()
+	}))
+	db.SetCircuitBreaker(dbcontrol.BreakerSettings{
+		ConsecutiveFailures: 1,
+		CoolDown:            20 * time.Millisecond,
+	})
+
+	// A request is under way when the circuit opens
+	straggler := make(chan error, 1)
+	go func() {
+		_, err := db.Exec("SELECT slow")
+		straggler <- err
+	}()
+	for f.InUse() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	db.Exec("SELECT boom")
+	if s := db.BreakerState(); s != dbcontrol.BreakerOpen {
+		t.Fatalf("breaker %v, want open", s)
+	}
+
+	// A transaction is let through as the probe after the cool-down
+	time.Sleep(30 * time.Millisecond)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := db.BreakerState(); s != dbcontrol.BreakerHalfOpen {
+		t.Fatalf("breaker %v, want half-open", s)
+	}
+
+	// The straggler succeeding doesn't close the circuit
+	close(block)
+	if err := <-straggler; err != nil {
+		t.Fatal(err)
+	}
+	if s := db.BreakerState(); s != dbcontrol.BreakerHalfOpen {
+		t.Fatalf("breaker %v after the straggler, want half-open", s)
+	}
+
+	// The probe does, once done
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.BreakerState(); s != dbcontrol.BreakerClosed {
+		t.Fatalf("breaker %v after the probe, want closed", s)
+	}
+}
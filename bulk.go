@@ -0,0 +1,208 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// RowSource supplies rows for BulkInsert(). Next returns the values for the
+// next row, in column order, or io.EOF when there are no more rows.
+type RowSource interface {
+	Next() ([]interface{}, error)
+}
+
+// SliceSource returns a RowSource that supplies the given rows.
+func SliceSource(rows [][]interface{}) RowSource {
+	return &sliceSource{rows: rows}
+}
+
+type sliceSource struct {
+	rows [][]interface{}
+}
+
+func (s *sliceSource) Next() ([]interface{}, error) {
+	if len(s.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	return row, nil
+}
+
+// defaultBatchSize is the number of rows inserted per statement by default.
+const defaultBatchSize = 1000
+
+// BulkOptions configures BulkInsert().
+type BulkOptions struct {
+	BatchSize int                // Rows per statement (zero for the default)
+	Tx        bool               // Whether to insert all rows in one transaction
+	Progress  func(BulkProgress) // Called after each batch, if set
+}
+
+// BulkProgress reports the progress of BulkInsert() after each batch.
+type BulkProgress struct {
+	Batch    int           // Number of the batch, starting at 1
+	Rows     int           // Rows in the batch
+	Total    int64         // Rows inserted so far
+	Duration time.Duration // Time taken by the batch
+}
+
+// BulkInsert inserts the rows supplied by src into table, using multi-row
+// INSERT statements. Rows are sent in batches of the given size (1000 by
+// default), reduced if needed to stay within the number of arguments supported
+// by the DB dialect. Each batch takes a connection under the limit as any
+// other statement, unless opts.Tx is set, in which case all batches run in a
+// single transaction that's rolled back on failure. Identifiers are quoted as
+// required by the dialect. BulkInsert returns the number of rows inserted,
+// which may be non-zero on error if not running in a transaction.
+func (db *DB) BulkInsert(ctx context.Context, table string, columns []string, src RowSource, opts BulkOptions) (int64, error) {
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("dbcontrol: no columns to insert into %s", table)
+	}
+
+	d := db.Dialect()
+	size := opts.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	max := d.maxParams() / len(columns)
+	if max == 0 {
+		return 0, fmt.Errorf("dbcontrol: %d columns exceed the %d arguments supported by the dialect", len(columns), d.maxParams())
+	}
+	if size > max {
+		size = max
+	}
+
+	exec := db.ExecContext
+	var tx *Tx
+	if opts.Tx {
+		var err error
+		if tx, err = db.BeginTx(ctx, nil); err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		exec = tx.ExecContext
+	}
+
+	var total int64
+	ins := newInsert(d, table, columns)
+	for batch := 1; ; batch++ {
+		args, n, err := ins.fill(src, size)
+		if err != nil {
+			if opts.Tx {
+				total = 0
+			}
+			return total, err
+		}
+		if n == 0 {
+			break
+		}
+
+		start := db.now()
+		if _, err := exec(ctx, ins.query(n), args...); err != nil {
+			if opts.Tx {
+				total = 0
+			}
+			return total, err
+		}
+		total += int64(n)
+
+		if opts.Progress != nil {
+			opts.Progress(BulkProgress{
+				Batch:    batch,
+				Rows:     n,
+				Total:    total,
+				Duration: db.since(start),
+			})
+		}
+
+		if n < size {
+			break
+		}
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// insert builds multi-row INSERT statements.
+type insert struct {
+	d       Dialect
+	prefix  string
+	columns int
+	queries map[int]string // By number of rows
+	args    []interface{}
+}
+
+func newInsert(d Dialect, table string, columns []string) *insert {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = d.quote(col)
+	}
+
+	return &insert{
+		d:       d,
+		prefix:  "INSERT INTO " + d.quote(table) + " (" + strings.Join(quoted, ", ") + ") VALUES ",
+		columns: len(columns),
+		queries: make(map[int]string),
+	}
+}
+
+// fill reads up to size rows from src, returning their values and the number
+// of rows read. The slice returned is reused by later calls.
+func (ins *insert) fill(src RowSource, size int) ([]interface{}, int, error) {
+	ins.args = ins.args[:0]
+	n := 0
+
+	for ; n < size; n++ {
+		row, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(row) != ins.columns {
+			return nil, 0, fmt.Errorf("dbcontrol: row has %d values, expected %d", len(row), ins.columns)
+		}
+		ins.args = append(ins.args, row...)
+	}
+
+	return ins.args, n, nil
+}
+
+// query returns the statement to insert n rows.
+func (ins *insert) query(n int) string {
+	if q, ok := ins.queries[n]; ok {
+		return q
+	}
+
+	var b strings.Builder
+	b.WriteString(ins.prefix)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for j := 0; j < ins.columns; j++ {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(ins.d.placeholder(i*ins.columns + j + 1))
+		}
+		b.WriteByte(')')
+	}
+
+	q := b.String()
+	ins.queries[n] = q
+	return q
+}
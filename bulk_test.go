@@ -0,0 +1,157 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+// openBulk opens a DB on a new Fake for BulkInsert() tests.
+func openBulk(t *testing.T) (*dbcontrol.DB, *dbcontroltest.Fake) {
+	t.Helper()
+
+	f := dbcontroltest.New()
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		f.Close()
+	})
+	return db, f
+}
+
+// bulkRows returns n rows of the given number of columns.
+func bulkRows(n, columns int) [][]interface{} {
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = make([]interface{}, columns)
+		for j := range rows[i] {
+			rows[i][j] = int64(i)
+		}
+	}
+	return rows
+}
+
+// bulkColumns returns n column names.
+func bulkColumns(n int) []string {
+	cols := make([]string, n)
+	for i := range cols {
+		cols[i] = "c" + strconv.Itoa(i)
+	}
+	return cols
+}
+
+// statements returns the statements run on f, with INSERT statements reduced
+// to the number of rows they insert.
+func statements(f *dbcontroltest.Fake, columns int) []string {
+	var stmts []string
+	for _, c := range f.Calls() {
+		if strings.HasPrefix(c.Query, "INSERT") {
+			stmts = append(stmts, "INSERT "+strconv.Itoa(len(c.Args)/columns))
+			continue
+		}
+		stmts = append(stmts, c.Query)
+	}
+	return stmts
+}
+
+func TestBulkInsertBatches(t *testing.T) {
+	db, f := openBulk(t)
+
+	var progress []dbcontrol.BulkProgress
+	n, err := db.BulkInsert(context.Background(), "t", bulkColumns(2), dbcontrol.SliceSource(bulkRows(7, 2)), dbcontrol.BulkOptions{
+		BatchSize: 3,
+		Progress:  func(p dbcontrol.BulkProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Fatalf("inserted %d rows, want 7", n)
+	}
+
+	got := strings.Join(statements(f, 2), ", ")
+	if want := "INSERT 3, INSERT 3, INSERT 1"; got != want {
+		t.Fatalf("ran %s, want %s", got, want)
+	}
+	if len(progress) != 3 || progress[2].Batch != 3 || progress[2].Rows != 1 || progress[2].Total != 7 {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+	if q := f.Calls()[0].Query; q != `INSERT INTO "t" ("c0", "c1") VALUES (?, ?), (?, ?), (?, ?)` {
+		t.Fatalf("unexpected statement: %s", q)
+	}
+}
+
+func TestBulkInsertParamCap(t *testing.T) {
+	db, f := openBulk(t)
+
+	// The generic dialect takes up to 999 arguments: 3 rows of 300 columns
+	n, err := db.BulkInsert(context.Background(), "t", bulkColumns(300), dbcontrol.SliceSource(bulkRows(7, 300)), dbcontrol.BulkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Fatalf("inserted %d rows, want 7", n)
+	}
+	got := strings.Join(statements(f, 300), ", ")
+	if want := "INSERT 3, INSERT 3, INSERT 1"; got != want {
+		t.Fatalf("ran %s, want %s", got, want)
+	}
+
+	// A row that can't fit in a statement is an error
+	n, err = db.BulkInsert(context.Background(), "t", bulkColumns(1000), dbcontrol.SliceSource(bulkRows(1, 1000)), dbcontrol.BulkOptions{})
+	if err == nil || n != 0 {
+		t.Fatalf("inserted %d rows with error %v, want an error", n, err)
+	}
+	if len(f.Calls()) != 3 {
+		t.Fatalf("ran %d statements, want 3", len(f.Calls()))
+	}
+}
+
+func TestBulkInsertTx(t *testing.T) {
+	db, f := openBulk(t)
+	boom := errors.New("boom")
+	f.On(`INSERT INTO "t" ("c0") VALUES (?), (?)`, dbcontroltest.Result{}, dbcontroltest.Result{Err: boom})
+
+	n, err := db.BulkInsert(context.Background(), "t", bulkColumns(1), dbcontrol.SliceSource(bulkRows(5, 1)), dbcontrol.BulkOptions{
+		BatchSize: 2,
+		Tx:        true,
+	})
+	if err == nil || err.Error() != boom.Error() {
+		t.Fatalf("got error %v, want %v", err, boom)
+	}
+	if n != 0 {
+		t.Fatalf("reported %d rows inserted in a rolled back transaction", n)
+	}
+	got := strings.Join(statements(f, 1), ", ")
+	if want := "BEGIN, INSERT 2, INSERT 2, ROLLBACK"; got != want {
+		t.Fatalf("ran %s, want %s", got, want)
+	}
+}
+
+func TestBulkInsertTxBadRow(t *testing.T) {
+	db, f := openBulk(t)
+	rows := bulkRows(3, 1)
+	rows[2] = append(rows[2], "extra")
+
+	n, err := db.BulkInsert(context.Background(), "t", bulkColumns(1), dbcontrol.SliceSource(rows), dbcontrol.BulkOptions{
+		BatchSize: 2,
+		Tx:        true,
+	})
+	if err == nil || n != 0 {
+		t.Fatalf("inserted %d rows with error %v, want an error and none", n, err)
+	}
+	got := strings.Join(statements(f, 1), ", ")
+	if want := "BEGIN, INSERT 2, ROLLBACK"; got != want {
+		t.Fatalf("ran %s, want %s", got, want)
+	}
+}
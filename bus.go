@@ -0,0 +1,206 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EventCategory is a set of event types, to subscribe to with Subscribe().
+// Categories can be combined with the | operator. Events not listed under any
+// other category belong to QueryEvents.
+type EventCategory uint32
+
+const (
+	WaitEvents         EventCategory = 1 << iota // WaitEvent
+	UsageTimeoutEvents                           // UsageTimeoutEvent
+	LimitEvents                                  // SoftLimitEvent and LimitChangeEvent
+	AvailabilityEvents                           // BreakerEvent, FailoverEvent and HealthEvent
+	LeakEvents                                   // TxTimeoutEvent and StmtLeakEvent
+	QueryEvents                                  // SlowQueryEvent, DigestEvent and other events on statements
+	PolicyEvents                                 // PolicyEvent
+
+	AllEvents = WaitEvents | UsageTimeoutEvents | LimitEvents |
+		AvailabilityEvents | LeakEvents | QueryEvents | PolicyEvents
+)
+
+// categoryOf returns the category an event belongs to.
+func categoryOf(e Event) EventCategory {
+	switch e.(type) {
+	case WaitEvent:
+		return WaitEvents
+	case UsageTimeoutEvent:
+		return UsageTimeoutEvents
+	case SoftLimitEvent, LimitChangeEvent:
+		return LimitEvents
+	case BreakerEvent, FailoverEvent, HealthEvent:
+		return AvailabilityEvents
+	case TxTimeoutEvent, StmtLeakEvent:
+		return LeakEvents
+	case PolicyEvent:
+		return PolicyEvents
+	default:
+		return QueryEvents
+	}
+}
+
+// DropPolicy sets what happens to events for a subscriber whose buffer is full.
+type DropPolicy int
+
+const (
+	BlockOnFull DropPolicy = iota // Wait for room, delaying operations on the DB
+	DropNewest                    // Drop the event being sent
+	DropOldest                    // Drop the oldest buffered event to make room
+)
+
+// subscriber receives the events in its categories through deliver. Done is
+// closed once unsubscribed, so that deliveries blocked on a consumer give up.
+type subscriber struct {
+	categories EventCategory
+	deliver    func(e Event, done <-chan struct{})
+	done       chan struct{}
+	closeOnce  sync.Once
+	mu         sync.RWMutex // Held for reading while delivering
+	closed     bool
+}
+
+// send delivers e, unless s was unsubscribed.
+func (s *subscriber) send(e Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.closed {
+		s.deliver(e, s.done)
+	}
+}
+
+// eventBus fans events out to subscribers. The zero value is ready to use.
+type eventBus struct {
+	subs []*subscriber // Replaced on changes, never modified in place
+	mu   sync.RWMutex
+}
+
+func (b *eventBus) subscribe(categories EventCategory, deliver func(Event, <-chan struct{})) *subscriber {
+	s := &subscriber{categories: categories, deliver: deliver, done: make(chan struct{})}
+
+	b.mu.Lock()
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], s)
+	b.mu.Unlock()
+	return s
+}
+
+// unsubscribe removes s from the bus. Once it returns, s is guaranteed not to
+// receive further events. Deliveries to s blocked at the time are abandoned.
+func (b *eventBus) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	for i := range b.subs {
+		if b.subs[i] == s {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	// Let go of blocked deliveries, then wait for those in progress
+	s.closeOnce.Do(func() { close(s.done) })
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+// publish delivers e to the subscribers interested in it. Subscribers are
+// called without holding the lock on the bus, so that a blocked one doesn't
+// keep others from subscribing or unsubscribing.
+func (b *eventBus) publish(e Event) {
+	category := categoryOf(e)
+
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		if s.categories&category != 0 {
+			s.send(e)
+		}
+	}
+}
+
+// Subscription is a subscription to DB events, created with Subscribe().
+// Events are received from C.
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	policy  DropPolicy
+	db      *DB
+	sub     *subscriber
+	once    sync.Once
+	dropped uint64 // Accessed atomically
+}
+
+// Subscribe returns a subscription to the events in the given categories. Any
+// number of subscriptions can be active at once, each with its own buffer
+// holding up to buffer events, and policy setting what happens when it's full
+// (dropping policies buffer at least one event). With BlockOnFull, events are
+// delivered synchronously once the buffer fills up, so make sure the channel is
+// drained promptly or operations on the DB may be delayed. Note that WaitEvents
+// are only sent for DBs limited with SetConcurrency(), and UsageTimeoutEvents
+// only while enabled with SetUsageTimeout(). Close the subscription when no
+// longer needed.
+func (db *DB) Subscribe(categories EventCategory, buffer int, policy DropPolicy) *Subscription {
+	if buffer < 0 {
+		buffer = 0
+	}
+	if policy != BlockOnFull && buffer == 0 {
+		buffer = 1 // Something must be buffered to be dropped
+	}
+
+	ch := make(chan Event, buffer)
+	s := &Subscription{C: ch, ch: ch, policy: policy, db: db}
+	s.sub = db.bus.subscribe(categories, s.deliver)
+	return s
+}
+
+func (s *Subscription) deliver(e Event, done <-chan struct{}) {
+	switch s.policy {
+	case DropNewest:
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- e:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- e:
+		case <-done:
+		}
+	}
+}
+
+// Dropped returns the number of events dropped so far for a full buffer.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close cancels the subscription and closes C. Events already buffered can
+// still be received from C before it's seen closed. Events blocked waiting for
+// room in the buffer are dropped, so it's safe to stop reading from C first.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.db.bus.unsubscribe(s.sub)
+		close(s.ch)
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CallSiteStats holds statistics for the connections acquired from a call site.
+// See DB.CallSiteStats().
+type CallSiteStats struct {
+	Caller       string        // Function, with its location
+	Acquisitions uint64        // Connections acquired
+	Wait         time.Duration // Cumulative time waited for connections
+	Hold         time.Duration // Cumulative time connections were held
+}
+
+// callSite tracks the connections acquired from a call site.
+type callSite struct {
+	pc           uintptr
+	acquisitions uint64 // Accessed atomically
+	wait         int64  // Accessed atomically
+	hold         int64  // Accessed atomically
+}
+
+// SetCallSiteStats enables statistics per call site, that is, per location in
+// the code that acquires connections (see CallSiteStats()). Only the program
+// counter of the caller is recorded for each acquisition, and resolved to a
+// function and location when reported, which makes it a cheap alternative to
+// the stack traces of SetUsageTimeout(). Calls made through other packages
+// wrapping the DB are attributed to the wrapper. Disabling statistics discards
+// those collected so far.
+func (db *DB) SetCallSiteStats(enabled bool) {
+	db.callSitesMux.Lock()
+	defer db.callSitesMux.Unlock()
+
+	if !enabled {
+		db.callSites = nil
+	} else if db.callSites == nil {
+		db.callSites = make(map[uintptr]*callSite)
+	}
+}
+
+// CallSiteStats returns the statistics per call site, longest held first.
+func (db *DB) CallSiteStats() []CallSiteStats {
+	db.callSitesMux.RLock()
+	sites := make([]*callSite, 0, len(db.callSites))
+	for _, s := range db.callSites {
+		sites = append(sites, s)
+	}
+	db.callSitesMux.RUnlock()
+
+	stats := make([]CallSiteStats, len(sites))
+	for i, s := range sites {
+		stats[i] = CallSiteStats{
+			Caller:       resolvePC(s.pc),
+			Acquisitions: atomic.LoadUint64(&s.acquisitions),
+			Wait:         time.Duration(atomic.LoadInt64(&s.wait)),
+			Hold:         time.Duration(atomic.LoadInt64(&s.hold)),
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Hold > stats[j].Hold
+	})
+	return stats
+}
+
+// callSite returns the call site acquiring a connection, or nil if statistics
+// are disabled. It must be called from the goroutine acquiring it.
+func (db *DB) callSite() *callSite {
+	db.callSitesMux.RLock()
+	enabled := db.callSites != nil
+	db.callSitesMux.RUnlock()
+	if !enabled {
+		return nil
+	}
+
+	pc := callerPC()
+	if pc == 0 {
+		return nil
+	}
+
+	db.callSitesMux.RLock()
+	s := db.callSites[pc]
+	db.callSitesMux.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	db.callSitesMux.Lock()
+	defer db.callSitesMux.Unlock()
+	if db.callSites == nil {
+		return nil
+	}
+	if s = db.callSites[pc]; s == nil {
+		s = &callSite{pc: pc}
+		db.callSites[pc] = s
+	}
+	return s
+}
+
+// acquired records a connection acquired from the call site, returning a
+// release function that records the time it was held.
+func (s *callSite) acquired(wait time.Duration, release func()) func() {
+	if s == nil {
+		return release
+	}
+
+	atomic.AddUint64(&s.acquisitions, 1)
+	atomic.AddInt64(&s.wait, int64(wait))
+	start := time.Now()
+
+	return func() {
+		atomic.AddInt64(&s.hold, int64(time.Since(start)))
+		release()
+	}
+}
+
+// internalPCs caches whether program counters belong to this package, or to
+// database/sql, so that each is only resolved once.
+var internalPCs sync.Map
+
+// callerPC returns the program counter of the first caller outside this
+// package, or zero if none is found.
+func callerPC() uintptr {
+	var pcs [16]uintptr
+	n := runtime.Callers(3, pcs[:])
+
+	for _, pc := range pcs[:n] {
+		internal, ok := internalPCs.Load(pc)
+		if !ok {
+			internal = internalFrame(outermostFrame(pc).Function)
+			internalPCs.Store(pc, internal)
+		}
+		if !internal.(bool) {
+			return pc
+		}
+	}
+	return 0
+}
+
+// outermostFrame returns the frame of the function pc belongs to, skipping any
+// inlined into it.
+func outermostFrame(pc uintptr) runtime.Frame {
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := frames.Next()
+		if !more {
+			return frame
+		}
+	}
+}
+
+// resolvePC formats the function and location of pc, as reported for callers.
+func resolvePC(pc uintptr) string {
+	return formatFrame(outermostFrame(pc))
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+)
+
+// CanaryRoute sends a percentage of the statements it matches to another DB.
+// See SetCanaryRoutes().
+type CanaryRoute struct {
+	Name     string     // Reported in CanaryStats()
+	Match    PolicyRule // Statements to match, by fingerprint (zero for all)
+	TagKey   string     // Tag to match, if not empty (see WithTag())
+	TagValue string     // Value of the tag to match
+	Target   *DB        // DB to send statements to
+	Percent  float64    // Percentage of matching statements sent, up to 100
+}
+
+// CanaryStats holds the statistics of a canary route. See DB.CanaryStats().
+type CanaryStats struct {
+	Name    string
+	Matched uint64 // Statements matching the route
+	Routed  uint64 // Statements sent to the target
+}
+
+// canaryRoute is a CanaryRoute in effect, with its statistics.
+type canaryRoute struct {
+	CanaryRoute
+	matched uint64 // Accessed atomically
+	routed  uint64 // Accessed atomically
+}
+
+// canaries holds the routes set with SetCanaryRoutes().
+type canaries struct {
+	routes []*canaryRoute
+}
+
+// SetCanaryRoutes sets routes that send a percentage of the statements run
+// directly on the DB (through Exec(), Query() and QueryRow() and their
+// variants) to other DBs, so that a new index, server version or proxy can be
+// tried on part of the traffic. Each statement is checked against the routes
+// in order, and the first one matching it decides: the statement is sent to
+// its target with the given probability, or run on the DB otherwise. Routed
+// statements run entirely on the target, under its own limits and settings,
+// so its PoolStats() and digests can be compared with those of the DB.
+// Transactions, dedicated connections and prepared statements are never
+// routed. Routes without a target, or targeting the DB itself, are ignored.
+// Calling SetCanaryRoutes() with no routes removes them.
+func (db *DB) SetCanaryRoutes(routes ...CanaryRoute) {
+	var c canaries
+	for _, r := range routes {
+		if r.Target == nil || r.Target == db {
+			continue
+		}
+		if r.Match.Fingerprint != "" {
+			r.Match.Fingerprint = Fingerprint(r.Match.Fingerprint)
+		}
+		c.routes = append(c.routes, &canaryRoute{CanaryRoute: r})
+	}
+
+	if len(c.routes) == 0 {
+		db.canaries.Store(nil)
+		return
+	}
+	db.canaries.Store(&c)
+}
+
+// CanaryStats returns the statistics of the routes in effect, in order.
+func (db *DB) CanaryStats() []CanaryStats {
+	c := db.canaries.Load()
+	if c == nil {
+		return nil
+	}
+
+	stats := make([]CanaryStats, len(c.routes))
+	for i, r := range c.routes {
+		stats[i] = CanaryStats{
+			Name:    r.Name,
+			Matched: atomic.LoadUint64(&r.matched),
+			Routed:  atomic.LoadUint64(&r.routed),
+		}
+	}
+	return stats
+}
+
+// canaryTarget returns the DB to send a statement to according to the canary
+// routes in effect, or nil to run it on the DB.
+func (db *DB) canaryTarget(ctx context.Context, query string) *DB {
+	c := db.canaries.Load()
+	if c == nil {
+		return nil
+	}
+
+	var fp string
+	var tags map[string]string
+	for _, r := range c.routes {
+		if r.Match.Fingerprint != "" || r.Match.Regexp != nil {
+			if fp == "" {
+				fp = Fingerprint(query)
+			}
+			if !r.Match.matches(fp) {
+				continue
+			}
+		}
+		if r.TagKey != "" {
+			if tags == nil {
+				tags = TagsFromContext(ctx)
+			}
+			if v, ok := tags[r.TagKey]; !ok || v != r.TagValue {
+				continue
+			}
+		}
+
+		atomic.AddUint64(&r.matched, 1)
+		if rand.Float64()*100 >= r.Percent {
+			return nil
+		}
+		atomic.AddUint64(&r.routed, 1)
+		return r.Target
+	}
+
+	return nil
+}
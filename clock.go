@@ -0,0 +1,117 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ClockSource identifies the clock used to measure durations reported by a DB,
+// such as block durations (see SetBlockDurationCh()).
+type ClockSource int32
+
+const (
+	// MonotonicClock measures durations with the monotonic clock, so that they
+	// are not affected by changes to the system time. This is the default.
+	MonotonicClock ClockSource = iota
+
+	// WallClock measures durations as differences in wall-clock time, so that
+	// they match the timestamps of other systems, at the expense of being
+	// affected by changes to the system time.
+	WallClock
+)
+
+func (c ClockSource) String() string {
+	switch c {
+	case MonotonicClock:
+		return "monotonic"
+	case WallClock:
+		return "wall"
+	}
+	return "unknown"
+}
+
+// SetClockSource sets the clock used to measure durations. Note that the
+// timestamps included in events are always wall-clock times, regardless of
+// this setting.
+func (db *DB) SetClockSource(c ClockSource) {
+	atomic.StoreInt32((*int32)(&db.clock), int32(c))
+}
+
+// ClockSource returns the clock used to measure durations. See
+// SetClockSource().
+func (db *DB) ClockSource() ClockSource {
+	return ClockSource(atomic.LoadInt32((*int32)(&db.clock)))
+}
+
+// Clock tells the time and runs timers for a DB. It can be replaced with
+// SetClock(), so that tests can advance time deterministically, rather than
+// sleeping.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine once d elapses, as in
+	// time.AfterFunc().
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by a Clock.
+type Timer interface {
+	// Stop prevents the timer from firing, reporting whether it did so, as in
+	// time.Timer.
+	Stop() bool
+}
+
+// systemClock is the Clock of the system, used by default.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// clockRef holds the Clock set with SetClock().
+type clockRef struct {
+	Clock
+}
+
+// SetClock sets the clock used for durations and internal timers, such as
+// those for usage timeouts (see SetUsageTimeout()), transaction timeouts (see
+// SetTxTimeout()) and connection lifetimes (see SetLifetimeJitter()). Timers
+// already started keep the clock they were started with. A nil clock restores
+// the system clock, which is the default. Timestamps in events are always
+// taken from the system clock.
+func (db *DB) SetClock(c Clock) {
+	if c == nil {
+		db.customClock.Store(nil)
+		return
+	}
+	db.customClock.Store(&clockRef{c})
+}
+
+// Clock returns the clock set with SetClock(), or the system clock.
+func (db *DB) Clock() Clock {
+	if c := db.customClock.Load(); c != nil {
+		return c.Clock
+	}
+	return systemClock{}
+}
+
+// now returns the current time, as a starting point for measurements.
+func (db *DB) now() time.Time {
+	now := db.Clock().Now()
+	if db.ClockSource() == WallClock {
+		// Strip the monotonic reading
+		return now.Round(0)
+	}
+	return now
+}
+
+// since returns the time elapsed since t, obtained from db.now().
+func (db *DB) since(t time.Time) time.Duration {
+	return db.now().Sub(t)
+}
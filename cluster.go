@@ -0,0 +1,283 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Cluster routes requests among a primary database and its read replicas.
+// Writes and transactions go to the primary, whereas read-only queries are
+// spread across replicas. Each database is a DB of its own, thus having its own
+// connection limit and settings.
+type Cluster struct {
+	readYourWrites int64 // Accessed atomically; keep at the top for alignment
+	degradedMode   int32 // Accessed atomically
+
+	primary     *DB
+	replicas    []*DB
+	balancer    Balancer
+	hedging     HedgeSettings
+	balancerMux sync.RWMutex
+	latency     *histogram // Latency of queries on replicas
+}
+
+// NewCluster returns a cluster for the primary and replica DBs provided. With
+// no replicas, all requests go to the primary. Replicas are chosen in turn,
+// unless changed with SetBalancer().
+func NewCluster(primary *DB, replicas ...*DB) *Cluster {
+	return &Cluster{
+		primary:  primary,
+		replicas: append([]*DB(nil), replicas...),
+		balancer: RoundRobin(),
+		latency:  new(histogram),
+	}
+}
+
+// SetBalancer sets the strategy to choose replicas for read-only queries.
+// Setting it to nil restores the default RoundRobin().
+func (c *Cluster) SetBalancer(b Balancer) {
+	if b == nil {
+		b = RoundRobin()
+	}
+
+	c.balancerMux.Lock()
+	defer c.balancerMux.Unlock()
+	c.balancer = b
+}
+
+func (c *Cluster) getBalancer() Balancer {
+	c.balancerMux.RLock()
+	defer c.balancerMux.RUnlock()
+	return c.balancer
+}
+
+// Primary returns the primary DB for the cluster.
+func (c *Cluster) Primary() *DB {
+	return c.primary
+}
+
+// Replicas returns the replica DBs for the cluster.
+func (c *Cluster) Replicas() []*DB {
+	return append([]*DB(nil), c.replicas...)
+}
+
+type routeKey struct{}
+
+// WithPrimary returns a copy of ctx that makes queries on a Cluster go to the
+// primary, even if they are read-only. This is useful when reads must observe
+// previous writes.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, routeKey{}, true)
+}
+
+// WithReadOnly returns a copy of ctx that marks queries on a Cluster as
+// read-only, so that they go to a replica, even if not recognized as such.
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, routeKey{}, false)
+}
+
+// isReadOnly tells whether query reads data only, judging from its first word.
+// Locking reads (SELECT ... FOR UPDATE/SHARE) are not considered read-only.
+func isReadOnly(query string) bool {
+	query = strings.TrimLeftFunc(query, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '('
+	})
+
+	end := strings.IndexFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if end < 0 {
+		end = len(query)
+	}
+
+	switch strings.ToUpper(query[:end]) {
+	case "SELECT", "SHOW", "DESCRIBE", "DESC", "EXPLAIN", "VALUES":
+	default:
+		return false
+	}
+
+	upper := strings.ToUpper(query)
+	return !strings.Contains(upper, "FOR UPDATE") && !strings.Contains(upper, "FOR SHARE") &&
+		!strings.Contains(upper, "LOCK IN SHARE MODE")
+}
+
+// toReplica tells whether query should go to a replica.
+func (c *Cluster) toReplica(ctx context.Context, query string) bool {
+	if len(c.replicas) == 0 {
+		return false
+	}
+	if primary, ok := ctx.Value(routeKey{}).(bool); ok {
+		return !primary
+	}
+	return isReadOnly(query) && (c.Degraded() || !c.recentWrite(ctx))
+}
+
+func (c *Cluster) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext runs a statement on the primary.
+func (c *Cluster) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if c.Degraded() {
+		return nil, ErrPrimaryUnavailable
+	}
+	defer markWrite(ctx)
+	return c.primary.ExecContext(ctx, query, args...)
+}
+
+func (c *Cluster) Query(query string, args ...interface{}) (*Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query on a replica if it's read-only, or on the primary
+// otherwise. See WithPrimary() and WithReadOnly() to override the decision.
+func (c *Cluster) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	if !c.toReplica(ctx, query) {
+		if c.Degraded() {
+			return nil, ErrPrimaryUnavailable
+		}
+		if !isReadOnly(query) {
+			defer markWrite(ctx)
+		}
+		return c.primary.QueryContext(ctx, query, args...)
+	}
+
+	if settings := c.getHedging(); settings.Percentile > 0 && len(c.replicas) > 1 {
+		v, cancel, err := c.hedge(ctx, settings, func(ctx context.Context, replica *DB) (interface{}, error) {
+			rows, err := replica.QueryContext(ctx, query, args...)
+			if err != nil {
+				return nil, err
+			}
+			return rows, nil
+		}, func(v interface{}) {
+			v.(*Rows).Close()
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		rows := v.(*Rows)
+		release := rows.release
+		rows.release = func() {
+			release()
+			cancel()
+		}
+		return rows, nil
+	}
+
+	b := c.getBalancer()
+	replica := b.Pick(c.replicas)
+	start := time.Now()
+	rows, err := replica.QueryContext(ctx, query, args...)
+	elapsed := time.Since(start)
+	b.Observe(replica, elapsed, err)
+	if err == nil {
+		c.latency.observe(elapsed)
+	}
+	return rows, err
+}
+
+func (c *Cluster) QueryRow(query string, args ...interface{}) *Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext is like QueryContext(), for queries returning a single row.
+func (c *Cluster) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	if !c.toReplica(ctx, query) {
+		if c.Degraded() {
+			return &Row{err: ErrPrimaryUnavailable, closed: true}
+		}
+		if !isReadOnly(query) {
+			defer markWrite(ctx)
+		}
+		return c.primary.QueryRowContext(ctx, query, args...)
+	}
+
+	if settings := c.getHedging(); settings.Percentile > 0 && len(c.replicas) > 1 {
+		v, cancel, err := c.hedge(ctx, settings, func(ctx context.Context, replica *DB) (interface{}, error) {
+			row := replica.QueryRowContext(ctx, query, args...)
+			return row, row.Err()
+		}, func(v interface{}) {
+			v.(*Row).close()
+		})
+		if err != nil {
+			return &Row{err: err, closed: true}
+		}
+
+		row := v.(*Row)
+		release := row.release
+		row.release = func() {
+			release()
+			cancel()
+		}
+		return row
+	}
+
+	b := c.getBalancer()
+	replica := b.Pick(c.replicas)
+	start := time.Now()
+	row := replica.QueryRowContext(ctx, query, args...)
+	elapsed := time.Since(start)
+	b.Observe(replica, elapsed, row.Err())
+	if row.Err() == nil {
+		c.latency.observe(elapsed)
+	}
+	return row
+}
+
+func (c *Cluster) Begin() (*Tx, error) {
+	return c.BeginTx(context.Background(), nil)
+}
+
+// BeginTx begins a transaction on the primary. If ctx is bound to a session,
+// committing the transaction counts as a write for it.
+func (c *Cluster) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	if c.Degraded() {
+		return nil, ErrPrimaryUnavailable
+	}
+	tx, err := c.primary.BeginTx(ctx, opts)
+	if err == nil {
+		tx.session = sessionFromContext(ctx)
+	}
+	return tx, err
+}
+
+func (c *Cluster) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+// PingContext pings all databases in the cluster, returning the first error
+// found, if any.
+func (c *Cluster) PingContext(ctx context.Context) error {
+	if err := c.primary.PingContext(ctx); err != nil {
+		return err
+	}
+
+	for _, r := range c.replicas {
+		if err := r.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes all databases in the cluster, returning the first error found,
+// if any.
+func (c *Cluster) Close() error {
+	err := c.primary.Close()
+
+	for _, r := range c.replicas {
+		if e := r.Close(); err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+// SetCoalescing enables coalescing of identical read queries run concurrently
+// on the DB with QueryAll() or QueryOne(). While a query is running, callers
+// issuing the same one (same text, arguments and result type) wait for it to
+// finish and get its results, rather than running the query again. This
+// reduces both the connections needed and the load on the database when many
+// callers ask for the same data at once. Only use it when all callers can
+// accept results fetched by a concurrent query, i.e., not with queries that
+// must observe writes made right before they are run. Coalescing is disabled
+// by default.
+func (db *DB) SetCoalescing(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&db.coalescing, v)
+}
+
+// Coalescing tells whether coalescing is enabled. See SetCoalescing().
+func (db *DB) Coalescing() bool {
+	return atomic.LoadInt32(&db.coalescing) != 0
+}
+
+var errCoalescedPanic = errors.New("dbcontrol: coalesced query panicked")
+
+// flight is the execution of a query shared by concurrent callers.
+type flight struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// coalesceKey identifies a query returning T.
+func coalesceKey[T any](query string, args []interface{}) string {
+	return fmt.Sprintf("%v\x00%s\x00%#v", reflect.TypeOf((*T)(nil)).Elem(), query, args)
+}
+
+// coalesce runs fn, unless a call with the same key is already running, in
+// which case its results are returned instead.
+func (db *DB) coalesce(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	db.flightsMux.Lock()
+	if f, ok := db.flights[key]; ok {
+		db.flightsMux.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// Don't let a canceled caller fail the others
+		if ctx.Err() == nil && (errors.Is(f.err, context.Canceled) ||
+			errors.Is(f.err, context.DeadlineExceeded)) {
+			return fn()
+		}
+
+		atomic.AddUint64(&db.coalesced, 1)
+		return f.val, f.err
+	}
+
+	f := &flight{done: make(chan struct{})}
+	if db.flights == nil {
+		db.flights = make(map[string]*flight)
+	}
+	db.flights[key] = f
+	db.flightsMux.Unlock()
+
+	defer func() {
+		db.flightsMux.Lock()
+		delete(db.flights, key)
+		db.flightsMux.Unlock()
+		close(f.done)
+	}()
+
+	// Reported to waiters if fn panics
+	f.err = errCoalescedPanic
+
+	f.val, f.err = fn()
+	return f.val, f.err
+}
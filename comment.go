@@ -0,0 +1,122 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// CommentFunc returns key/value pairs to comment statements run with ctx, such
+// as "traceparent" for the trace in ctx. See SetQueryComments().
+type CommentFunc func(ctx context.Context) map[string]string
+
+type commentKey struct{}
+
+// commentTag is a key/value pair set with WithComment(), linked to those set
+// on parent contexts.
+type commentTag struct {
+	key, value string
+	parent     *commentTag
+}
+
+// WithComment returns a copy of ctx that adds the given key/value pair to the
+// comments of statements using it, when enabled with SetQueryComments().
+// Common keys include "traceparent", "route", "controller" and "action".
+// Setting a key already set on ctx overrides it.
+func WithComment(ctx context.Context, key, value string) context.Context {
+	parent, _ := ctx.Value(commentKey{}).(*commentTag)
+	return context.WithValue(ctx, commentKey{}, &commentTag{key, value, parent})
+}
+
+// commenter holds the settings made with SetQueryComments().
+type commenter struct {
+	fn CommentFunc
+}
+
+// SetQueryComments makes the DB append a comment to each statement sent to the
+// database, following the sqlcommenter format (e.g., "SELECT 1
+// /*route='%2Fusers',traceparent='00-...'*/"). This allows slow logs and
+// monitoring tools on the database side to be correlated with application
+// traces. Comments hold the pairs set on the context with WithComment(), and
+// those returned by fn, if not nil, for keys not set on the context. Statements
+// already holding a comment, and those with no pairs to add, are left alone.
+// Note that commented statements may defeat caches keyed by query text, and
+// that prepared statements keep the comment for the context they were
+// prepared with.
+func (db *DB) SetQueryComments(enabled bool, fn CommentFunc) {
+	if !enabled {
+		db.comments.Store(nil)
+		return
+	}
+	db.comments.Store(&commenter{fn: fn})
+}
+
+// comment returns query with the comment for ctx appended, if enabled.
+func (db *DB) comment(ctx context.Context, query string) string {
+	c := db.comments.Load()
+	if c == nil || strings.Contains(query, "/*") {
+		return query
+	}
+
+	pairs := make(map[string]string)
+	if c.fn != nil {
+		for k, v := range c.fn(ctx) {
+			pairs[k] = v
+		}
+	}
+
+	// Walk up from the most recent pairs, which take precedence
+	seen := make(map[string]bool)
+	for t, _ := ctx.Value(commentKey{}).(*commentTag); t != nil; t = t.parent {
+		if !seen[t.key] {
+			pairs[t.key] = t.value
+			seen[t.key] = true
+		}
+	}
+
+	if len(pairs) == 0 {
+		return query
+	}
+	return appendComment(query, pairs)
+}
+
+// appendComment appends the sqlcommenter comment for pairs to query, before
+// any trailing semicolon.
+func appendComment(query string, pairs map[string]string) string {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	query = strings.TrimRight(query, " \t\r\n")
+	semicolon := strings.HasSuffix(query, ";")
+	query = strings.TrimSuffix(query, ";")
+
+	var b strings.Builder
+	b.WriteString(query)
+	b.WriteString(" /*")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(commentEscape(k))
+		b.WriteString("='")
+		b.WriteString(commentEscape(pairs[k]))
+		b.WriteByte('\'')
+	}
+	b.WriteString("*/")
+	if semicolon {
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// commentEscape URL-encodes s, as sqlcommenter requires. Quotes and comment
+// delimiters are always encoded, so they need no further escaping.
+func commentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
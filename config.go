@@ -0,0 +1,248 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Config is a snapshot of the effective configuration of a DB, as returned by
+// DB.Config(). Being a plain value, it can be stored and compared against later
+// snapshots using Diff().
+type Config struct {
+	Dialect         Dialect              // SQL dialect
+	MaxConns        int                  // Token limit (zero if not limiting)
+	HostGroup       string               // Host whose limit is shared (see SetHostGrouping())
+	Limit           int                  // Effective token limit, after automatic changes
+	SoftLimit       int                  // Soft limit (zero if disabled)
+	MaxWaiters      int                  // Maximum number of waiters (zero if unbounded)
+	BudgetAware     bool                 // Whether deadlines are checked against waits
+	ClockSource     ClockSource          // Clock used to measure durations
+	CustomClock     bool                 // Whether a clock is set with SetClock()
+	CustomTokens    bool                 // Whether SetAcquireReleaser() is in effect
+	Fairness        Fairness             // Order waiters are served in
+	RateLimit       RateLimit            // Rate limit for the whole DB (zero if none)
+	ClassRateLimits map[string]RateLimit // Rate limits per class (nil if none)
+	TenantQuotas    map[string]Quota     // Quotas per tenant (nil if none)
+	ClassLimits     map[string]Quota     // Connection limits per class (nil if none)
+	SubPools        SubPools             // Limits for transactions and statements
+	Breaker         BreakerSettings      // Circuit breaker settings (zero if none)
+	Retry           RetryPolicy          // Retry policy (zero if not retrying)
+	CustomRetryable bool                 // Whether SetRetryable() was called with non-nil
+	Credentials     bool                 // Whether opened with OpenWithCredentials()
+	AutoShrink      time.Duration        // Auto-shrink recovery period (zero if disabled)
+	Schedule        []Period             // Limit schedule (nil if none)
+	Endpoints       int                  // Number of DSNs (see OpenFailover())
+	Endpoint        int                  // Index of the DSN in use
+	FailoverCheck   time.Duration        // Health check interval (zero if disabled)
+	FailoverAfter   int                  // Failed checks before failing over
+	HealthCheck     HealthSettings       // Health checker settings (zero if disabled)
+	BlockReports    bool                 // Whether block durations are being reported
+	UsageTimeout    time.Duration        // Usage timeout (zero if disabled)
+	Validation      time.Duration        // Idle time before validating (zero if disabled)
+	StmtCache       int                  // Statement cache size (zero if disabled)
+	StmtLeaks       time.Duration        // Statement leak threshold (zero if disabled)
+	RowLimit        RowLimit             // Row limit for queries (zero if unlimited)
+	LimitGuard      int                  // LIMIT added to queries lacking one (zero if disabled)
+	Policy          bool                 // Whether a query policy is enforced
+	DryRun          bool                 // Whether statements run in dry-run mode
+	Mirroring       float64              // Percentage of reads mirrored (zero if disabled)
+	DualWrite       bool                 // Whether writes are duplicated to a secondary
+	CanaryRoutes    int                  // Number of canary routes in effect
+	Faults          Faults               // Faults injected for testing
+	Coalescing      bool                 // Whether identical queries are coalesced
+	QueryComments   bool                 // Whether statements are commented
+	ProfileLabels   bool                 // Whether pprof labels are applied
+	Digests         DigestSettings       // Digest statistics settings (zero if disabled)
+	SlowQueries     SlowQuerySettings    // Slow query log settings (zero if disabled)
+	CallSiteStats   bool                 // Whether statistics per call site are kept
+	StackDepth      int                  // Maximum stack depth (zero if unlimited)
+	StackFilter     bool                 // Whether stack frames are filtered
+	WaitWindow      time.Duration        // Wait histogram reset period (zero if disabled)
+	WaitAlert       bool                 // Whether OnWaitExceeds() was called with non-nil
+	WaitThreshold   time.Duration        // Threshold for OnWaitExceeds()
+	ConnMaxLifetime time.Duration        // Maximum connection lifetime (zero if unlimited)
+	ConnMaxIdleTime time.Duration        // Maximum connection idle time (zero if unlimited)
+	LifetimeJitter  time.Duration        // Jitter applied to connection lifetimes
+	IdleReaper      time.Duration        // Idle reaper period (zero if disabled)
+	TxTimeout       time.Duration        // Transaction timeout (zero if disabled)
+	StmtTimeout     time.Duration        // Server-side statement timeout (zero if disabled)
+	UsageReports    bool                 // Whether usage timeouts are being reported
+	EventReports    bool                 // Whether events are being reported
+	EventWriter     bool                 // Whether events are being written
+	SlowLogFile     string               // Path of the slow-log file, if any
+	Logging         bool                 // Whether a logger is set
+}
+
+// ConfigChange describes a setting that differs between two Config values.
+type ConfigChange struct {
+	Field    string
+	Old, New interface{}
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+}
+
+// Config returns a snapshot of the configuration currently in effect for the
+// DB. It's safe to call it in parallel with other operations, although the
+// configuration may change right after it returns.
+func (db *DB) Config() Config {
+	c := Config{
+		Dialect:       db.Dialect(),
+		MaxConns:      db.maxConns,
+		HostGroup:     db.hostGroup,
+		SoftLimit:     int(atomic.LoadInt32(&db.softLimit)),
+		MaxWaiters:    int(atomic.LoadInt32(&db.maxWaiters)),
+		BudgetAware:   atomic.LoadInt32(&db.budgetAware) != 0,
+		ClockSource:   db.ClockSource(),
+		CustomClock:   db.customClock.Load() != nil,
+		CustomTokens:  db.customTokens() != nil,
+		Fairness:      db.Fairness(),
+		TxTimeout:     db.TxTimeout(),
+		Validation:    db.Validation(),
+		TenantQuotas:  db.TenantQuotas(),
+		ClassLimits:   db.ClassLimits(),
+		SubPools:      db.SubPools(),
+		Credentials:   db.creds != nil,
+		RowLimit:      db.RowLimit(),
+		LimitGuard:    db.LimitGuard(),
+		Policy:        db.policy.Load() != nil,
+		DryRun:        db.dryRun.Load() != nil,
+		Mirroring:     db.Mirroring().Percent,
+		DualWrite:     db.dualWrite.Load() != nil,
+		CanaryRoutes:  len(db.CanaryStats()),
+		Faults:        db.Faults(),
+		Coalescing:    db.Coalescing(),
+		StmtTimeout:   db.StatementTimeout(),
+		QueryComments: db.comments.Load() != nil,
+		ProfileLabels: db.profileLabels.Load() != nil,
+		SlowQueries:   db.getSlowQueryLog(),
+		Logging:       db.getLogger() != nil,
+	}
+
+	if db.sem != nil {
+		c.Limit = db.sem.limit()
+	}
+
+	db.limitMux.Lock()
+	c.AutoShrink = db.shrinkRecovery
+	if len(db.schedule) > 0 {
+		c.Schedule = append([]Period(nil), db.schedule...)
+	}
+	db.limitMux.Unlock()
+
+	db.blockChMux.RLock()
+	c.BlockReports = db.blockCh != nil
+	db.blockChMux.RUnlock()
+
+	db.usageTimeoutMux.RLock()
+	c.UsageTimeout = db.usageTimeout
+	c.UsageReports = db.usageTimeoutCh != nil
+	db.usageTimeoutMux.RUnlock()
+
+	db.rateMux.RLock()
+	if db.rateLimiter != nil {
+		c.RateLimit = db.rateLimiter.limit
+	}
+	for class, rl := range db.classRateLimiters {
+		if c.ClassRateLimits == nil {
+			c.ClassRateLimits = make(map[string]RateLimit)
+		}
+		c.ClassRateLimits[class] = rl.limit
+	}
+	db.rateMux.RUnlock()
+
+	db.breakerMux.RLock()
+	if db.breaker != nil {
+		c.Breaker = db.breaker.settings
+	}
+	db.breakerMux.RUnlock()
+
+	db.retryMux.RLock()
+	c.Retry = db.retryPolicy
+	c.CustomRetryable = db.retryable != nil
+	db.retryMux.RUnlock()
+
+	db.poolMux.RLock()
+	c.ConnMaxLifetime = time.Duration(atomic.LoadInt64(&db.maxLifetime))
+	c.ConnMaxIdleTime = db.maxIdleTime
+	c.LifetimeJitter = time.Duration(atomic.LoadInt64(&db.lifetimeJitter))
+	c.Endpoints = len(db.dsns)
+	c.Endpoint = db.endpoint
+	db.poolMux.RUnlock()
+
+	db.failoverMux.Lock()
+	c.FailoverCheck = db.failoverInterval
+	c.FailoverAfter = db.failoverFailures
+	db.failoverMux.Unlock()
+
+	db.healthMux.Lock()
+	c.HealthCheck = db.healthSettings
+	db.healthMux.Unlock()
+
+	if sc := db.getStmtCache(); sc != nil {
+		c.StmtCache = sc.size
+	}
+
+	db.stmtsMux.Lock()
+	c.StmtLeaks = db.stmtLeakThreshold
+	db.stmtsMux.Unlock()
+
+	db.digestsMux.Lock()
+	c.Digests = db.digestSettings
+	db.digestsMux.Unlock()
+
+	db.waitWindowMux.Lock()
+	c.WaitWindow = db.waitWindow
+	db.waitWindowMux.Unlock()
+
+	db.waitAlertMux.RLock()
+	if db.waitAlert != nil {
+		c.WaitAlert, c.WaitThreshold = true, db.waitAlert.threshold
+	}
+	db.waitAlertMux.RUnlock()
+
+	stacks := db.getStackSettings()
+	c.StackDepth, c.StackFilter = stacks.MaxDepth, stacks.Filter != nil
+
+	db.callSitesMux.RLock()
+	c.CallSiteStats = db.callSites != nil
+	db.callSitesMux.RUnlock()
+
+	db.reaperMux.Lock()
+	c.IdleReaper = db.reaperIdle
+	db.reaperMux.Unlock()
+
+	db.eventChMux.RLock()
+	c.EventReports = db.eventCh != nil
+	c.EventWriter = db.eventWriter != nil
+	c.SlowLogFile = db.slowLogPath()
+	db.eventChMux.RUnlock()
+
+	return c
+}
+
+// Diff returns the list of settings that differ from old to new, in the order
+// they are declared in Config. An empty result means both configurations are
+// equivalent.
+func Diff(old, new Config) []ConfigChange {
+	var changes []ConfigChange
+	vo, vn := reflect.ValueOf(old), reflect.ValueOf(new)
+
+	for i := 0; i < vo.NumField(); i++ {
+		fo, fn := vo.Field(i).Interface(), vn.Field(i).Interface()
+		if !reflect.DeepEqual(fo, fn) {
+			changes = append(changes, ConfigChange{
+				Field: vo.Type().Field(i).Name,
+				Old:   fo,
+				New:   fn,
+			})
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Conn is a single connection pinned for session-scoped work, such as that
+// involving temporary tables or session variables. It wraps sql.Conn, holding
+// a connection from the limit until closed. Statements, transactions and
+// queries on a Conn run on the connection already held.
+type Conn struct {
+	*sql.Conn
+	db      *DB
+	mu      sync.Mutex
+	closed  bool
+	release func()
+}
+
+// Conn returns a dedicated connection, blocking until one is available as
+// usual. It overrides sql.DB.Conn(). The connection counts against the limit
+// until Close() is called.
+func (db *DB) Conn(ctx context.Context) (*Conn, error) {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := db.pool().Conn(ctx)
+	if err = db.check(err); err != nil {
+		release()
+		return nil, err
+	}
+
+	return &Conn{Conn: c, db: db, release: release}, nil
+}
+
+// Close returns the connection to the pool, releasing it from the limit.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.release()
+		c.closed = true
+	}
+
+	return err
+}
+
+func (c *Conn) PingContext(ctx context.Context) error {
+	return c.db.check(c.Conn.PingContext(ctx))
+}
+
+func (c *Conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+func (c *Conn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := c.db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+	if err := c.db.throttle(ctx); err != nil {
+		return nil, err
+	}
+
+	res, err := c.Conn.ExecContext(ctx, query, args...)
+	return res, c.db.check(err)
+}
+
+func (c *Conn) Query(query string, args ...interface{}) (*Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c *Conn) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	if err := c.db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+	if err := c.db.throttle(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := c.Conn.QueryContext(ctx, query, args...)
+	if err = c.db.check(err); err != nil {
+		return nil, err
+	}
+
+	// The connection is held by the Conn, not by the rows
+	return c.db.newRows(ctx, rows, func() {}), nil
+}
+
+func (c *Conn) QueryRow(query string, args ...interface{}) *Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+func (c *Conn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	if err := c.db.checkPolicy(ctx, query); err != nil {
+		return &Row{err: err, closed: true}
+	}
+	if err := c.db.throttle(ctx); err != nil {
+		return &Row{err: err, closed: true}
+	}
+
+	rows, err := c.Conn.QueryContext(ctx, query, args...)
+	return newRow(c.db, rows, err, func() {})
+}
+
+func (c *Conn) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	if err := c.db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+
+	stmt, err := c.Conn.PrepareContext(ctx, query)
+	if err = c.db.check(err); err != nil {
+		return nil, err
+	}
+
+	return &Stmt{Stmt: stmt, db: c.db, pinned: true}, nil
+}
+
+// BeginTx begins a transaction on the connection. Transaction settings, such as
+// timeouts and hooks, apply as usual.
+func (c *Conn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := c.Conn.BeginTx(ctx, opts)
+	if err = c.db.check(err); err != nil {
+		return nil, err
+	}
+
+	return c.db.newTx(ctx, tx, func() {}), nil
+}
+
+// Raw runs f with the underlying driver connection, as sql.Conn.Raw() does.
+func (c *Conn) Raw(f func(driverConn interface{}) error) error {
+	return c.Conn.Raw(func(dc interface{}) error {
+		if w, ok := dc.(*driverConn); ok {
+			dc = w.Conn
+		}
+		return f(dc)
+	})
+}
+
+// WithConn runs fn with a dedicated connection (see Conn()), which is closed
+// when fn returns, even if it panics. This is safer than handling the Conn
+// directly, since the connection can't be leaked. The error from fn is
+// returned, or that from closing the connection otherwise.
+func (db *DB) WithConn(ctx context.Context, fn func(*Conn) error) (err error) {
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	return fn(c)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// copyQuery returns the COPY statement for the given table and columns, as
+// built by lib/pq's CopyIn().
+func copyQuery(table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = PostgresDialect.quote(col)
+	}
+	return "COPY " + PostgresDialect.quote(table) + " (" + strings.Join(quoted, ", ") +
+		") FROM STDIN"
+}
+
+// CopyIn loads the rows supplied by src into table with the COPY protocol,
+// within the transaction. It follows the conventions of lib/pq: a COPY
+// statement is prepared and executed once per row, buffering data, and then
+// once more with no arguments to flush it. Drivers not implementing them (such
+// as pgx, which offers CopyFrom() on its own connections instead; see
+// Conn.Raw()) fail when preparing the statement. Since the connection is held
+// by the transaction, COPY runs under the connection limit like any other
+// statement. CopyIn returns the number of rows sent.
+func (tx *Tx) CopyIn(ctx context.Context, table string, columns []string, src RowSource) (int64, error) {
+	if tx.db.Dialect() != PostgresDialect {
+		return 0, ErrCopyUnsupported
+	}
+
+	stmt, err := tx.PrepareContext(ctx, copyQuery(table, columns))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var n int64
+	for {
+		row, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// CopyFrom is like Tx.CopyIn(), but runs in a transaction of its own, which is
+// committed if all rows were loaded, or rolled back otherwise.
+func (db *DB) CopyFrom(ctx context.Context, table string, columns []string, src RowSource) (int64, error) {
+	if db.Dialect() != PostgresDialect {
+		return 0, ErrCopyUnsupported
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := tx.CopyIn(ctx, table, columns, src)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential is a password (or authentication token) to connect to a database,
+// together with the time it expires. A zero Expiry means it never does.
+type Credential struct {
+	Password string
+	Expiry   time.Time
+}
+
+// CredentialProvider supplies short-lived credentials, as issued by systems
+// such as Vault or AWS IAM authentication. See OpenWithCredentials().
+type CredentialProvider interface {
+	Credential(ctx context.Context) (Credential, error)
+}
+
+// CredentialFunc adapts an ordinary function to the CredentialProvider
+// interface.
+type CredentialFunc func(ctx context.Context) (Credential, error)
+
+func (f CredentialFunc) Credential(ctx context.Context) (Credential, error) {
+	return f(ctx)
+}
+
+// credentialRetry is the time to wait before retrying a failed refresh.
+const credentialRetry = time.Second
+
+// OpenWithCredentials is like Open(), but the password used for new connections
+// is obtained from p, replacing the one in the DSN, if any. URL-style DSNs,
+// MySQL-style DSNs and Postgres key/value DSNs are supported. The credential is
+// cached and refreshed in the background once 80% of its lifetime has elapsed,
+// so that connections don't have to wait for it. Note that connections already
+// open are not affected when the credential expires; use SetConnMaxLifetime()
+// if they must be renewed.
+func OpenWithCredentials(driver, dsn string, p CredentialProvider) (*DB, error) {
+	creds := &credentials{provider: p}
+	db, err := open(driver, dsn, HostGrouping(), creds)
+	if err != nil {
+		return nil, err
+	}
+
+	go creds.refresh(db.done)
+	return db, nil
+}
+
+// credentials caches the credential from a provider.
+type credentials struct {
+	provider CredentialProvider
+	cred     Credential
+	fetched  time.Time
+	valid    bool
+	mux      sync.Mutex
+}
+
+// refreshAt returns the time the credential should be refreshed. Must be called
+// with c.mux held.
+func (c *credentials) refreshAt() time.Time {
+	if !c.valid {
+		return time.Time{}
+	}
+	if c.cred.Expiry.IsZero() {
+		return c.cred.Expiry
+	}
+	return c.fetched.Add(c.cred.Expiry.Sub(c.fetched) * 4 / 5)
+}
+
+// get returns the credential, fetching it if not cached or about to expire. The
+// cached credential is returned if the fetch fails, unless already expired.
+func (c *credentials) get(ctx context.Context) (Credential, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.valid {
+		if at := c.refreshAt(); at.IsZero() || time.Now().Before(at) {
+			return c.cred, nil
+		}
+	}
+
+	err := c.fetch(ctx)
+	if err != nil && (!c.valid || c.expired()) {
+		return Credential{}, err
+	}
+	return c.cred, nil
+}
+
+// fetch gets a new credential from the provider. Must be called with c.mux
+// held.
+func (c *credentials) fetch(ctx context.Context) error {
+	now := time.Now()
+	cred, err := c.provider.Credential(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.cred, c.fetched, c.valid = cred, now, true
+	return nil
+}
+
+// expired tells whether the cached credential has expired. Must be called with
+// c.mux held.
+func (c *credentials) expired() bool {
+	return !c.cred.Expiry.IsZero() && !time.Now().Before(c.cred.Expiry)
+}
+
+// refresh keeps the cached credential fresh until done is closed.
+func (c *credentials) refresh(done <-chan struct{}) {
+	var err error
+
+	for {
+		c.mux.Lock()
+		at := c.refreshAt()
+		valid := c.valid
+		c.mux.Unlock()
+
+		wait := credentialRetry
+		if valid && err == nil {
+			if at.IsZero() {
+				// Never expires
+				return
+			}
+			wait = time.Until(at)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+
+		c.mux.Lock()
+		err = c.fetch(context.Background())
+		c.mux.Unlock()
+	}
+}
+
+// credentialConnector makes connections with the current credential.
+type credentialConnector struct {
+	driver driver.Driver
+	dsn    string
+	creds  *credentials
+}
+
+func (c *credentialConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cred, err := c.creds.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn := withPassword(c.dsn, cred.Password)
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		conn, err := dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, redactError(err)
+		}
+		return conn.Connect(ctx)
+	}
+
+	conn, err := c.driver.Open(dsn)
+	if err != nil {
+		// The DSN now holds the password, which may show up in errors
+		return nil, redactError(err)
+	}
+	return conn, nil
+}
+
+func (c *credentialConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// withPassword returns dsn with its password replaced. DSNs are recognized as
+// in dsnHost().
+func withPassword(dsn, password string) string {
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		var user string
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		u.User = url.UserPassword(user, password)
+		return u.String()
+	}
+
+	if i := strings.LastIndex(dsn, "@"); i >= 0 {
+		user := dsn[:i]
+		if j := strings.Index(user, ":"); j >= 0 {
+			user = user[:j]
+		}
+		return user + ":" + password + dsn[i:]
+	}
+
+	quoted := "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password) + "'"
+	fields := strings.Fields(dsn)
+	for i, field := range fields {
+		if strings.HasPrefix(field, "password=") {
+			fields[i] = "password=" + quoted
+			return strings.Join(fields, " ")
+		}
+	}
+	return strings.Join(append(fields, "password="+quoted), " ")
+}
@@ -77,6 +77,7 @@ package dbcontrol
 import (
 	"database/sql"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -84,42 +85,324 @@ import (
 // sql.DB. If a connection is required and not available, the statement using
 // the type will block until another connection is returned to the pool.
 type DB struct {
+	softLimitBreaches uint64      // Accessed atomically, kept first for alignment
+	txBegun           uint64      // Accessed atomically
+	txCommitted       uint64      // Accessed atomically
+	txRolledBack      uint64      // Accessed atomically
+	txCommitFailures  uint64      // Accessed atomically
+	shed              uint64      // Accessed atomically
+	stmtCacheHits     uint64      // Accessed atomically
+	stmtCacheMisses   uint64      // Accessed atomically
+	staleConns        uint64      // Accessed atomically
+	reaped            uint64      // Accessed atomically
+	coalesced         uint64      // Accessed atomically
+	limitGuarded      uint64      // Accessed atomically
+	dryRuns           uint64      // Accessed atomically
+	mirrored          uint64      // Accessed atomically
+	mirrorMismatches  uint64      // Accessed atomically
+	secondaryFailures uint64      // Accessed atomically
+	divergences       uint64      // Accessed atomically
+	quotaRejections   uint64      // Accessed atomically
+	faultsInjected    uint64      // Accessed atomically
+	eventsDropped     uint64      // Accessed atomically; by past event writers
+	validateIdle      int64       // Accessed atomically
+	lastActive        int64       // Accessed atomically
+	lastExplain       int64       // Accessed atomically
+	lastWaitAlert     int64       // Accessed atomically
+	maxLifetime       int64       // Accessed atomically
+	lifetimeJitter    int64       // Accessed atomically
+	txTimeout         int64       // Accessed atomically
+	stmtTimeout       int64       // Accessed atomically
+	limitGuard        int64       // Accessed atomically
+	inUse             int32       // Accessed atomically
+	peakInUse         int32       // Accessed atomically
+	softLimit         int32       // Accessed atomically
+	maxWaiters        int32       // Accessed atomically
+	budgetAware       int32       // Accessed atomically
+	coalescing        int32       // Accessed atomically
+	clock             ClockSource // Accessed atomically
+	health            HealthState // Accessed atomically
+
 	*sql.DB
 	maxConns        int
-	sem             chan bool
+	hostGroup       string
+	sem             *semaphore
+	bus             eventBus
 	blockCh         chan<- time.Duration
+	blockSub        *subscriber
 	blockChMux      sync.RWMutex
 	usageTimeout    time.Duration
 	usageTimeoutCh  chan<- string
+	usageSub        *subscriber
 	usageTimeoutMux sync.RWMutex
+	eventCh         chan<- Event
+	eventSub        *subscriber
+	eventWriter     *eventWriter
+	slowLog         *eventWriter
+	eventChMux      sync.RWMutex
+	limit           int // Current limit; see setLimit()
+	target          int // Limit before shrinking
+	shrinking       *shrinkState
+	shrinkRecovery  time.Duration
+	schedule        []Period
+	scheduleLoc     *time.Location
+	scheduleTimer   Timer
+	scheduleGen     int
+	limitMux        sync.Mutex
+
+	rateLimiter       *rateLimiter
+	classRateLimiters map[string]*rateLimiter
+	rateMux           sync.RWMutex
+
+	tenantQuotas quotaPool
+	classQuotas  quotaPool
+	subPools     quotaPool
+
+	breaker    *breaker
+	breakerMux sync.RWMutex
+
+	rowLimit    RowLimit
+	rowLimitMux sync.RWMutex
+
+	flights    map[string]*flight // Coalesced queries running, by key
+	flightsMux sync.Mutex
+
+	digests        map[string]*digest // By fingerprint; nil if disabled
+	digestSettings DigestSettings
+	digestStop     chan struct{}
+	digestsMux     sync.Mutex
+
+	slowSettings SlowQuerySettings
+	slowMux      sync.RWMutex
+
+	callSites    map[uintptr]*callSite // By caller PC; nil if disabled
+	callSitesMux sync.RWMutex
+
+	stackSettings StackSettings
+	stackMux      sync.RWMutex
+
+	retryPolicy RetryPolicy
+	retryable   Retryable
+	retryMux    sync.RWMutex
+
+	dialect    Dialect
+	dialectMux sync.RWMutex
+
+	commitLatency *histogram
+
+	waitTime       atomic.Pointer[histogram]     // Swapped on reset
+	comments       atomic.Pointer[commenter]     // Nil if disabled
+	profileLabels  atomic.Pointer[profileLabels] // Nil if disabled
+	policy         atomic.Pointer[policy]        // Nil if disabled
+	dryRun         atomic.Pointer[dryRun]        // Nil if disabled
+	mirroring      atomic.Pointer[mirroring]     // Nil if disabled
+	dualWrite      atomic.Pointer[dualWriter]    // Nil if disabled
+	canaries       atomic.Pointer[canaries]      // Nil if none
+	customClock    atomic.Pointer[clockRef]      // Nil for the system clock
+	faults         atomic.Pointer[faults]        // Nil if none
+	recorder       atomic.Pointer[Recorder]      // Nil if not recording
+	tokens         atomic.Pointer[tokensRef]     // Nil for the built-in pool
+	waitWindows    windowRing
+	waitWindow     time.Duration
+	waitWindowStop chan struct{}
+	waitWindowMux  sync.Mutex
+
+	waitAlert    *waitAlert
+	waitAlertMux sync.RWMutex
+
+	logger    Logger
+	loggerMux sync.RWMutex
+
+	txHooks    TxHooks
+	txHooksMux sync.RWMutex
+
+	poolMux     sync.RWMutex // Guards the embedded sql.DB, which may be replaced
+	connector   *connector   // Of the embedded sql.DB
+	driver      string
+	creds       *credentials // Set for DBs opened with OpenWithCredentials()
+	dsns        []string     // Set for DBs opened with OpenFailover()
+	endpoint    int          // Index into dsns of the endpoint in use
+	maxOpen     int
+	maxIdleTime time.Duration
+	maxIdle     int         // Guarded by limitMux
+	maxIdleSet  bool        // Guarded by limitMux
+	gen         *generation // Connections held on the current sql.DB
+	leasesMux   sync.Mutex
+
+	failoverInterval time.Duration
+	failoverFailures int
+	failoverStop     chan struct{}
+	failoverMux      sync.Mutex
+
+	healthSettings HealthSettings
+	healthStop     chan struct{}
+	healthMux      sync.Mutex
+
+	stmtCache    *stmtCache
+	stmtCacheMux sync.RWMutex
+
+	stmts             map[*stmtStats]struct{} // Statements prepared on the DB
+	stmtLeakThreshold time.Duration
+	stmtLeakStop      chan struct{}
+	stmtsMux          sync.Mutex
+
+	reaperIdle time.Duration
+	reaperStop chan struct{}
+	reaperMux  sync.Mutex
+
+	unwrapped *sql.DB // See Unwrap()
+	unwrapMux sync.Mutex
+
+	name string // Guarded by registryMux
+
+	done      chan struct{} // Closed by Close()
+	closeOnce sync.Once
 }
 
 func Open(driver, dsn string) (*DB, error) {
-	sqldb, err := sql.Open(driver, dsn)
-	if err != nil {
-		return nil, err
-	}
+	return open(driver, dsn, HostGrouping(), nil)
+}
 
+func open(driver, dsn string, grouping bool, creds *credentials) (*DB, error) {
 	// We wrap *sql.DB into our DB
-	db := &DB{DB: sqldb}
+	db := &DB{
+		driver:        driver,
+		creds:         creds,
+		dialect:       dialectFor(driver),
+		commitLatency: new(histogram),
+		done:          make(chan struct{}),
+	}
 
-	if c := Concurrency(); c > 0 {
-		// Let's create a token channel and feed it with c tokens
-		db.sem = make(chan bool, c)
+	sqldb, c, err := db.openPool(dsn)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	db.DB = sqldb
+	db.connector = c
+	db.gen = newGeneration(sqldb)
+	db.waitTime.Store(new(histogram))
+	db.touch()
 
-		for i := 0; i < c; i++ {
-			db.sem <- true
+	if c := Concurrency(); c > 0 {
+		if host := dsnHost(dsn); host != "" && grouping {
+			// Share the semaphore with other DBs on the same host
+			l := hostLimitFor(host, c)
+			db.sem, db.shrinking = l.sem, l.shrink
+			db.hostGroup = host
+			c = db.sem.limit()
+		} else {
+			db.sem, db.shrinking = newSemaphore(c), newShrinkState()
 		}
+		db.shrinking.join(db)
 
 		// This is actually required, otherwise connections are quickly
 		// discarded, even if new ones have to be immediately opened.
 		db.DB.SetMaxIdleConns(c)
 		db.maxConns = c
+		db.limit = c
+		db.target = c
 	}
 
 	return db, nil
 }
 
+// Close closes the database, stopping any background activity. It overrides
+// sql.DB.Close().
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.done)
+	})
+	db.stopTimers()
+	db.closeUnwrapped()
+	db.unregister()
+	return db.pool().Close()
+}
+
+// closed tells whether Close() was called.
+func (db *DB) closed() bool {
+	select {
+	case <-db.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopTimers stops the timers changing the limit, for schedules and
+// auto-shrinking, so that a closed DB doesn't keep resizing a semaphore
+// shared with others on the host. Auto-shrinking goes on for those others, if
+// any.
+func (db *DB) stopTimers() {
+	db.limitMux.Lock()
+	defer db.limitMux.Unlock()
+
+	if db.scheduleTimer != nil {
+		db.scheduleTimer.Stop()
+		db.scheduleTimer = nil
+	}
+	db.scheduleGen++
+	if db.shrinking != nil {
+		db.shrinking.leave(db)
+	}
+}
+
+// SetMaxOpenConns sets the maximum number of open connections to the database.
+// It overrides sql.DB.SetMaxOpenConns(), so that the setting is preserved when
+// the underlying sql.DB is replaced (see Reconfigure() and OpenFailover()).
+func (db *DB) SetMaxOpenConns(n int) {
+	db.poolMux.Lock()
+	defer db.poolMux.Unlock()
+	db.maxOpen = n
+	db.DB.SetMaxOpenConns(n)
+}
+
+// SetConnMaxLifetime sets the maximum time a connection may be reused. It
+// overrides sql.DB.SetConnMaxLifetime(), so that the setting is preserved when
+// the underlying sql.DB is replaced, and jitter can be applied to it (see
+// SetLifetimeJitter()).
+func (db *DB) SetConnMaxLifetime(d time.Duration) {
+	db.poolMux.Lock()
+	defer db.poolMux.Unlock()
+	atomic.StoreInt64(&db.maxLifetime, int64(d))
+	db.DB.SetConnMaxLifetime(db.lifetimeCap())
+}
+
+// SetConnMaxIdleTime sets the maximum time a connection may be idle. It
+// overrides sql.DB.SetConnMaxIdleTime(), so that the setting is preserved when
+// the underlying sql.DB is replaced.
+func (db *DB) SetConnMaxIdleTime(d time.Duration) {
+	db.poolMux.Lock()
+	defer db.poolMux.Unlock()
+	db.maxIdleTime = d
+	db.DB.SetConnMaxIdleTime(d)
+}
+
+// SetLifetimeJitter spreads the expiration of connections set with
+// SetConnMaxLifetime(), so that connections opened at the same time don't
+// expire all at once, causing a burst of reconnections. Each connection gets a
+// lifetime chosen at random within the given jitter around the maximum. Expired
+// connections are closed when next used or returned to the pool.
+func (db *DB) SetLifetimeJitter(jitter time.Duration) {
+	db.poolMux.Lock()
+	defer db.poolMux.Unlock()
+	atomic.StoreInt64(&db.lifetimeJitter, int64(jitter))
+	db.DB.SetConnMaxLifetime(db.lifetimeCap())
+}
+
+// lifetimeCap returns the lifetime for database/sql to enforce, i.e., the
+// longest any connection may live. Must be called with db.poolMux held.
+func (db *DB) lifetimeCap() time.Duration {
+	lifetime := time.Duration(atomic.LoadInt64(&db.maxLifetime))
+	if lifetime <= 0 {
+		return 0
+	}
+
+	if jitter := time.Duration(atomic.LoadInt64(&db.lifetimeJitter)); jitter > 0 {
+		lifetime += jitter
+	}
+	return lifetime
+}
+
 // MaxConn returns the maximum number of connections for the DB.
 func (db *DB) MaxConns() int {
 	return db.maxConns
@@ -0,0 +1,103 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontroltest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+)
+
+// Clock is a dbcontrol.Clock whose time only moves when told to, so that
+// timeouts can be tested without sleeping:
+//
+//	clock := dbcontroltest.NewClock(time.Now())
+//	db.SetClock(clock)
+//	db.SetTxTimeout(time.Minute)
+//	tx, _ := db.Begin()
+//	clock.Advance(time.Minute) // The transaction times out
+//
+// It's safe for concurrent use.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*clockTimer
+}
+
+var _ dbcontrol.Clock = (*Clock)(nil)
+
+// NewClock returns a Clock set to the given time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc starts a timer that calls f in its own goroutine once the clock is
+// advanced by d or more.
+func (c *Clock) AfterFunc(d time.Duration, f func()) dbcontrol.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &clockTimer{clock: c, when: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due meanwhile.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+
+	var due, pending []*clockTimer
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+// Timers returns the number of timers waiting to fire.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// clockTimer is a timer started by a Clock.
+type clockTimer struct {
+	clock *Clock
+	when  time.Time
+	f     func()
+}
+
+func (t *clockTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontroltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+func init() {
+	sql.Register(DriverName, fakeDriver{})
+}
+
+// fakeDriver makes connections to the Fake named by the DSN.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakesMu.Lock()
+	f, ok := fakes[dsn]
+	fakesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dbcontroltest: unknown fake %q", dsn)
+	}
+
+	f.mu.Lock()
+	f.conns++
+	f.open++
+	id := f.conns
+	delay := f.connectDelay
+	f.mu.Unlock()
+
+	time.Sleep(delay)
+
+	// New connections are handed out right away
+	f.acquire(id)
+	return &fakeConn{fake: f, id: id, acquired: true}, nil
+}
+
+// fakeConn is a connection to a Fake. Database/sql calls ResetSession() before
+// handing out a connection that was used before, and IsValid() when it's
+// returned to the pool, which is how acquisitions are recorded.
+type fakeConn struct {
+	fake     *Fake
+	id       int
+	acquired bool
+	closed   bool
+}
+
+func (c *fakeConn) ResetSession(ctx context.Context) error {
+	if !c.acquired {
+		c.acquired = true
+		c.fake.acquire(c.id)
+	}
+	return nil
+}
+
+func (c *fakeConn) IsValid() bool {
+	c.released()
+	return true
+}
+
+func (c *fakeConn) Close() error {
+	c.released()
+	if !c.closed {
+		c.closed = true
+		c.fake.mu.Lock()
+		c.fake.open--
+		c.fake.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *fakeConn) released() {
+	if c.acquired {
+		c.acquired = false
+		c.fake.release(c.id)
+	}
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if _, err := c.run(ctx, "BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return fakeTx{conn: c}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r, err := c.run(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{r}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := c.run(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: r.Columns, rows: r.Rows}, nil
+}
+
+// run runs a statement, returning its scripted result once it's done.
+func (c *fakeConn) run(ctx context.Context, query string, args []driver.NamedValue) (Result, error) {
+	call := Call{Query: query, Conn: c.id, Start: time.Now()}
+	for _, arg := range args {
+		call.Args = append(call.Args, arg.Value)
+	}
+
+	r := c.fake.result(query)
+	err := wait(ctx, r)
+	if err == nil {
+		err = r.Err
+	}
+
+	call.End, call.Err = time.Now(), err
+	c.fake.record(call)
+	return r, err
+}
+
+// wait waits for the delay of r and for its Block channel to be closed, unless
+// ctx is done first.
+func wait(ctx context.Context, r Result) error {
+	if r.Delay > 0 {
+		t := time.NewTimer(r.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if r.Block != nil {
+		select {
+		case <-r.Block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (tx fakeTx) Commit() error {
+	_, err := tx.conn.run(context.Background(), "COMMIT", nil)
+	return err
+}
+
+func (tx fakeTx) Rollback() error {
+	_, err := tx.conn.run(context.Background(), "ROLLBACK", nil)
+	return err
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("dbcontroltest: Exec() without context")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("dbcontroltest: Query() without context")
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+type fakeResult struct {
+	r Result
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.r.LastInsertID, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.r.RowsAffected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
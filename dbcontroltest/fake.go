@@ -0,0 +1,268 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+/*
+Package dbcontroltest provides an in-memory fake database to test code using
+dbcontrol without a real server. A Fake is opened as a regular *dbcontrol.DB,
+so code under test uses the same DB, Tx, Stmt and Rows types as in production,
+and connection limits, waits and everything else in dbcontrol work as usual.
+Statements return scripted results, and may be made to take some time or to
+block, so that tests can exercise contention on the pool deterministically:
+
+	func TestContention(t *testing.T) {
+		dbcontrol.SetConcurrency(1)
+		f := dbcontroltest.New()
+		release := make(chan struct{})
+		f.On("SELECT name FROM users WHERE id = ?", dbcontroltest.Result{
+			Columns: []string{"name"},
+			Rows:    [][]driver.Value{{"alice"}},
+			Block:   release,
+		})
+
+		db, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		go db.QueryRow("SELECT name FROM users WHERE id = ?", 1).Scan(new(string))
+		// ... check that others wait for the connection, then
+		close(release)
+	}
+
+The Fake records the statements run and the connections handed out by the
+pool (see Calls() and Acquisitions()), so tests can check what ran and how many
+connections were in use at once.
+*/
+package dbcontroltest
+
+import (
+	"database/sql/driver"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+)
+
+// DriverName is the name the fake driver is registered with in database/sql.
+const DriverName = "dbcontroltest"
+
+var (
+	fakes   = make(map[string]*Fake) // By DSN
+	fakesMu sync.Mutex
+	nextID  int
+)
+
+// Result is the scripted outcome of a statement.
+type Result struct {
+	Columns      []string // Columns of the rows returned by queries
+	Rows         [][]driver.Value
+	RowsAffected int64           // Returned by statements run with Exec()
+	LastInsertID int64           // Returned by statements run with Exec()
+	Err          error           // Error to fail with, if any
+	Delay        time.Duration   // Time the statement takes, holding its connection
+	Block        <-chan struct{} // If not nil, the statement waits for it to be closed
+}
+
+// Call is a statement run on the Fake.
+type Call struct {
+	Query string
+	Args  []driver.Value
+	Conn  int // Connection the statement ran on, numbered from 1
+	Start time.Time
+	End   time.Time
+	Err   error
+}
+
+// Acquisition is a period a connection was handed out by the pool. Release is
+// zero while the connection is still in use.
+type Acquisition struct {
+	Conn    int // Numbered from 1
+	Acquire time.Time
+	Release time.Time
+}
+
+// Fake is an in-memory fake database. It's safe for concurrent use.
+type Fake struct {
+	dsn string
+
+	mu           sync.Mutex
+	script       map[string][]Result // By fingerprint
+	def          Result
+	connectDelay time.Duration
+	conns        int
+	open         int
+	inUse        int
+	peakInUse    int
+	calls        []Call
+	acquisitions []Acquisition
+}
+
+// New returns an empty Fake. Statements not scripted with On() succeed with no
+// rows, unless a default is set with SetDefault().
+func New() *Fake {
+	fakesMu.Lock()
+	defer fakesMu.Unlock()
+
+	nextID++
+	f := &Fake{
+		dsn:    "fake-" + strconv.Itoa(nextID),
+		script: make(map[string][]Result),
+	}
+	fakes[f.dsn] = f
+	return f
+}
+
+// DSN returns the data source name of the Fake, to open it with the fake driver
+// directly, as in dbcontrol.Open(dbcontroltest.DriverName, f.DSN()).
+func (f *Fake) DSN() string {
+	return f.dsn
+}
+
+// Open opens a DB on the Fake, under the current dbcontrol settings.
+func (f *Fake) Open() (*dbcontrol.DB, error) {
+	return dbcontrol.Open(DriverName, f.dsn)
+}
+
+// On scripts the results of a statement, matched by fingerprint (see
+// dbcontrol.Fingerprint()), so that literal values and comments don't matter.
+// Results are returned in order as the statement is run, the last one being
+// returned from then on. Calling On() again for the same statement replaces its
+// results. Transactions run "BEGIN", "COMMIT" and "ROLLBACK", which can be
+// scripted as well.
+func (f *Fake) On(query string, results ...Result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fp := dbcontrol.Fingerprint(query)
+	if len(results) == 0 {
+		delete(f.script, fp)
+		return
+	}
+	f.script[fp] = append([]Result(nil), results...)
+}
+
+// SetDefault sets the result of statements not scripted with On().
+func (f *Fake) SetDefault(r Result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.def = r
+}
+
+// SetConnectDelay sets the time it takes to make new connections.
+func (f *Fake) SetConnectDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connectDelay = d
+}
+
+// Calls returns the statements run so far, in the order they finished.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Acquisitions returns the periods connections were handed out by the pool so
+// far, in the order they began.
+func (f *Fake) Acquisitions() []Acquisition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Acquisition(nil), f.acquisitions...)
+}
+
+// OpenConns returns the number of connections currently open, whether in use
+// or idle in the pool.
+func (f *Fake) OpenConns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.open
+}
+
+// InUse returns the number of connections currently handed out by the pool.
+func (f *Fake) InUse() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inUse
+}
+
+// PeakInUse returns the maximum number of connections handed out at once.
+func (f *Fake) PeakInUse() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peakInUse
+}
+
+// Reset clears the calls and acquisitions recorded, and the peak of
+// connections in use. Scripted results are kept.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = nil
+	f.peakInUse = f.inUse
+	var open []Acquisition
+	for _, a := range f.acquisitions {
+		if a.Release.IsZero() {
+			open = append(open, a)
+		}
+	}
+	f.acquisitions = open
+}
+
+// Close forgets the Fake, so that it can no longer be opened. DBs already
+// open fail to make new connections.
+func (f *Fake) Close() {
+	fakesMu.Lock()
+	defer fakesMu.Unlock()
+	delete(fakes, f.dsn)
+}
+
+// result returns the scripted result for query.
+func (f *Fake) result(query string) Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fp := dbcontrol.Fingerprint(query)
+	results, ok := f.script[fp]
+	if !ok {
+		return f.def
+	}
+	r := results[0]
+	if len(results) > 1 {
+		f.script[fp] = results[1:]
+	}
+	return r
+}
+
+func (f *Fake) record(c Call) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, c)
+}
+
+// acquire records a connection being handed out.
+func (f *Fake) acquire(conn int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inUse++
+	if f.inUse > f.peakInUse {
+		f.peakInUse = f.inUse
+	}
+	f.acquisitions = append(f.acquisitions, Acquisition{Conn: conn, Acquire: time.Now()})
+}
+
+// release records a connection being returned to the pool.
+func (f *Fake) release(conn int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inUse--
+	for i := len(f.acquisitions) - 1; i >= 0; i-- {
+		if a := &f.acquisitions[i]; a.Conn == conn && a.Release.IsZero() {
+			a.Release = time.Now()
+			break
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync/atomic"
+)
+
+// SetDegradedMode enables or disables the degraded mode of the Cluster, for
+// partial availability during primary outages. While enabled, and the primary
+// is down according to its health checker (see DB.SetHealthCheck(), which must
+// be set on the primary for this to work), the Cluster is degraded: read-only
+// queries go to replicas, even for sessions that wrote recently (see
+// SetReadYourWrites()), and requests that need the primary, such as writes,
+// transactions and queries sent there with WithPrimary(), fail right away with
+// ErrPrimaryUnavailable, rather than waiting for the primary to time out. The
+// Cluster recovers on its own once the primary is reported up again. It's
+// disabled by default.
+func (c *Cluster) SetDegradedMode(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.degradedMode, v)
+}
+
+// Degraded tells whether the Cluster is currently degraded. See
+// SetDegradedMode().
+func (c *Cluster) Degraded() bool {
+	return atomic.LoadInt32(&c.degradedMode) != 0 && c.primary.Health() == HealthDown
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect identifies the SQL flavor spoken by a database, for the features that
+// need to generate SQL on their own.
+type Dialect int
+
+const (
+	// GenericDialect sticks to standard SQL.
+	GenericDialect Dialect = iota
+	MySQLDialect
+	PostgresDialect
+	SQLiteDialect
+	SQLServerDialect
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case GenericDialect:
+		return "generic"
+	case MySQLDialect:
+		return "mysql"
+	case PostgresDialect:
+		return "postgres"
+	case SQLiteDialect:
+		return "sqlite"
+	case SQLServerDialect:
+		return "sqlserver"
+	}
+	return "unknown"
+}
+
+// dialectFor guesses the dialect from the name of the driver.
+func dialectFor(driver string) Dialect {
+	driver = strings.ToLower(driver)
+
+	switch {
+	case strings.Contains(driver, "mysql"):
+		return MySQLDialect
+	case strings.Contains(driver, "postgres"), driver == "pgx", driver == "pq":
+		return PostgresDialect
+	case strings.Contains(driver, "sqlite"):
+		return SQLiteDialect
+	case driver == "mssql", driver == "sqlserver":
+		return SQLServerDialect
+	}
+	return GenericDialect
+}
+
+// SetDialect sets the SQL dialect for the DB. The dialect is guessed from the
+// driver name when the DB is opened, so this is only required for drivers not
+// recognized that way.
+func (db *DB) SetDialect(d Dialect) {
+	db.dialectMux.Lock()
+	defer db.dialectMux.Unlock()
+	db.dialect = d
+}
+
+// Dialect returns the SQL dialect for the DB. See SetDialect().
+func (db *DB) Dialect() Dialect {
+	db.dialectMux.RLock()
+	defer db.dialectMux.RUnlock()
+	return db.dialect
+}
+
+// placeholder returns the positional placeholder for the nth argument of a
+// statement, starting at 1.
+func (d Dialect) placeholder(n int) string {
+	switch d {
+	case PostgresDialect:
+		return "$" + strconv.Itoa(n)
+	case SQLServerDialect:
+		return "@p" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// quote quotes an identifier, which may be qualified with dots.
+func (d Dialect) quote(ident string) string {
+	open, close := `"`, `"`
+	switch d {
+	case MySQLDialect:
+		open, close = "`", "`"
+	case SQLServerDialect:
+		open, close = "[", "]"
+	}
+
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = open + strings.ReplaceAll(part, close, close+close) + close
+	}
+	return strings.Join(parts, ".")
+}
+
+// maxParams returns the maximum number of arguments a statement can take.
+func (d Dialect) maxParams() int {
+	switch d {
+	case MySQLDialect, PostgresDialect:
+		return 65535
+	case SQLServerDialect:
+		return 2100
+	}
+	// Older SQLite versions are limited to 999
+	return 999
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DigestSettings configures per-fingerprint statistics. See SetDigestStats().
+type DigestSettings struct {
+	Max    int           // Fingerprints tracked (zero to disable)
+	Report time.Duration // Interval between DigestEvents (zero to disable)
+}
+
+// DigestStats holds statistics for the queries sharing a fingerprint. See
+// DB.DigestStats().
+type DigestStats struct {
+	Fingerprint string
+	Executions  uint64        // Times queries were run
+	Errors      uint64        // Executions that failed
+	Rows        uint64        // Rows returned
+	Wait        time.Duration // Cumulative time waited for connections
+	Latency     Histogram     // Distribution of execution times
+}
+
+// digest tracks the queries sharing a fingerprint.
+type digest struct {
+	mu       sync.Mutex
+	stats    DigestStats // Latency kept apart
+	latency  *histogram
+	reported uint64 // Executions at the time of the last report
+}
+
+func (d *digest) record(wait, latency time.Duration, err error) {
+	if d == nil {
+		return
+	}
+
+	d.latency.observe(latency)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats.Executions++
+	d.stats.Wait += wait
+	if err != nil {
+		d.stats.Errors++
+	}
+}
+
+func (d *digest) addRows(n int) {
+	if d == nil || n == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats.Rows += uint64(n)
+}
+
+func (d *digest) snapshot() DigestStats {
+	d.mu.Lock()
+	s := d.stats
+	d.mu.Unlock()
+
+	s.Latency = d.latency.snapshot()
+	return s
+}
+
+// SetDigestStats enables statistics per query fingerprint (see Fingerprint())
+// for statements run directly on the DB: executions, errors, rows returned,
+// time waited for connections, and the distribution of execution times.
+// Execution times don't include the time to read rows. Up to settings.Max
+// fingerprints are tracked, so that queries built with literals can't exhaust
+// memory; further ones are ignored. If settings.Report is set, a DigestEvent is
+// sent at that interval for each fingerprint run since the previous report
+// (see SetEventCh()). Statistics are reset each time this is called. Passing
+// zero settings (the default) disables them.
+func (db *DB) SetDigestStats(settings DigestSettings) {
+	db.digestsMux.Lock()
+	defer db.digestsMux.Unlock()
+
+	if db.digestStop != nil {
+		close(db.digestStop)
+		db.digestStop = nil
+	}
+
+	if settings.Max <= 0 {
+		db.digestSettings, db.digests = DigestSettings{}, nil
+		return
+	}
+
+	db.digestSettings = settings
+	db.digests = make(map[string]*digest)
+
+	if settings.Report > 0 {
+		db.digestStop = make(chan struct{})
+		go db.reportDigests(settings.Report, db.digestStop)
+	}
+}
+
+// DigestStats returns the statistics per fingerprint, most executed first.
+func (db *DB) DigestStats() []DigestStats {
+	db.digestsMux.Lock()
+	digests := make([]*digest, 0, len(db.digests))
+	for _, d := range db.digests {
+		digests = append(digests, d)
+	}
+	db.digestsMux.Unlock()
+
+	stats := make([]DigestStats, len(digests))
+	for i, d := range digests {
+		stats[i] = d.snapshot()
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Executions != stats[j].Executions {
+			return stats[i].Executions > stats[j].Executions
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+	return stats
+}
+
+// DigestLatency returns the distribution of execution times for the queries
+// sharing the fingerprint of query, which may be given as is or already
+// fingerprinted, so that percentiles can be tracked per statement. It returns
+// false if the fingerprint is not tracked. See SetDigestStats().
+func (db *DB) DigestLatency(query string) (Histogram, bool) {
+	db.digestsMux.Lock()
+	d, ok := db.digests[query]
+	db.digestsMux.Unlock()
+
+	if !ok {
+		fp := Fingerprint(query)
+		db.digestsMux.Lock()
+		d, ok = db.digests[fp]
+		db.digestsMux.Unlock()
+	}
+
+	if !ok {
+		return Histogram{}, false
+	}
+	return d.latency.snapshot(), true
+}
+
+// digest returns the digest for query, or nil if not tracked.
+func (db *DB) digest(query string) *digest {
+	db.digestsMux.Lock()
+	enabled := db.digests != nil
+	db.digestsMux.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	// Fingerprint without holding the lock
+	fp := Fingerprint(query)
+
+	db.digestsMux.Lock()
+	defer db.digestsMux.Unlock()
+	if db.digests == nil {
+		return nil
+	}
+
+	d, ok := db.digests[fp]
+	if !ok {
+		if len(db.digests) >= db.digestSettings.Max {
+			return nil
+		}
+		d = &digest{stats: DigestStats{Fingerprint: fp}, latency: new(histogram)}
+		db.digests[fp] = d
+	}
+	return d
+}
+
+func (db *DB) reportDigests(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-db.done:
+			return
+		}
+
+		db.digestsMux.Lock()
+		digests := make([]*digest, 0, len(db.digests))
+		for _, d := range db.digests {
+			digests = append(digests, d)
+		}
+		db.digestsMux.Unlock()
+
+		for _, d := range digests {
+			s := d.snapshot()
+
+			d.mu.Lock()
+			changed := s.Executions != d.reported
+			d.reported = s.Executions
+			d.mu.Unlock()
+
+			if changed {
+				db.emit(DigestEvent{
+					Time:        time.Now(),
+					Fingerprint: s.Fingerprint,
+					Executions:  s.Executions,
+					Errors:      s.Errors,
+					Rows:        s.Rows,
+					Wait:        s.Wait,
+					Mean:        s.Latency.Mean(),
+					P99:         s.Latency.Percentile(99),
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// openPool opens a new underlying sql.DB for dsn, using the driver and
+// credentials of the DB. Connections are made through a connector of our own,
+// so that settings database/sql doesn't support can be applied to them. The
+// connector is returned as well, for Unwrap().
+func (db *DB) openPool(dsn string) (*sql.DB, *connector, error) {
+	pool, err := sql.Open(db.driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Use the registered driver to make connections on our own
+	drv := pool.Driver()
+	pool.Close()
+
+	var base driver.Connector
+	switch dc, ok := drv.(driver.DriverContext); {
+	case db.creds != nil:
+		base = &credentialConnector{driver: drv, dsn: dsn, creds: db.creds}
+	case ok:
+		if base, err = dc.OpenConnector(dsn); err != nil {
+			return nil, nil, err
+		}
+	default:
+		base = dsnConnector{driver: drv, dsn: dsn}
+	}
+
+	c := &connector{Connector: base, db: db}
+	return sql.OpenDB(c), c, nil
+}
+
+// dsnConnector makes connections for drivers that don't implement
+// driver.DriverContext.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// connector wraps the connections made by another one.
+type connector struct {
+	driver.Connector
+	db *DB
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driverConn{
+		Conn:    conn,
+		db:      c.db,
+		created: c.db.Clock().Now(),
+		jitter:  2*rand.Float64() - 1,
+	}, nil
+}
+
+// driverConn wraps a driver connection. It implements all optional interfaces,
+// falling back to the behavior of database/sql if the underlying connection
+// doesn't.
+type driverConn struct {
+	driver.Conn
+	db      *DB
+	created time.Time
+	jitter  float64 // Fraction of the lifetime jitter applied, in [-1, 1)
+
+	// Session statement_timeout, in milliseconds, or -1 if unknown. See
+	// applyTimeout().
+	stmtTimeout   int64
+	txStmtTimeout int64 // As when the transaction in progress began
+}
+
+// expired tells whether the connection has outlived its lifetime, as set with
+// SetConnMaxLifetime() and SetLifetimeJitter().
+func (c *driverConn) expired() bool {
+	lifetime := time.Duration(atomic.LoadInt64(&c.db.maxLifetime))
+	if lifetime <= 0 {
+		return false
+	}
+
+	jitter := time.Duration(atomic.LoadInt64(&c.db.lifetimeJitter))
+	age := c.db.Clock().Now().Sub(c.created)
+	return age > lifetime+time.Duration(c.jitter*float64(jitter))
+}
+
+func (c *driverConn) ResetSession(ctx context.Context) error {
+	if c.expired() {
+		return driver.ErrBadConn
+	}
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *driverConn) IsValid() bool {
+	if c.expired() {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *driverConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *driverConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *driverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	// Prepared statements may be queries or not, but the limit guard only
+	// applies to SELECTs anyway
+	query, err := c.rewrite(ctx, query, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+
+	stmt, err := c.Conn.Prepare(query)
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			stmt.Close()
+			return nil, ctx.Err()
+		default:
+		}
+	}
+	return stmt, err
+}
+
+func (c *driverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := beginTx(ctx, c.Conn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c.txStmtTimeout = c.stmtTimeout
+	return &driverTx{Tx: tx, conn: c}, nil
+}
+
+// beginTx begins a transaction on conn, as database/sql would.
+func beginTx(ctx context.Context, conn driver.Conn, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, errors.New("sql: driver does not support non-default isolation level")
+	}
+	if opts.ReadOnly {
+		return nil, errors.New("sql: driver does not support read-only transactions")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return conn.Begin()
+}
+
+func (c *driverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	e, _ := c.Conn.(driver.Execer)
+	if !ok && e == nil {
+		// Statements are rewritten once prepared instead
+		return nil, driver.ErrSkip
+	}
+
+	query, err := c.rewrite(ctx, query, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if ec != nil {
+		return ec.ExecContext(ctx, query, args)
+	}
+
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return e.Exec(query, values)
+}
+
+func (c *driverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	q, _ := c.Conn.(driver.Queryer)
+	if !ok && q == nil {
+		// Queries are rewritten once prepared instead
+		return nil, driver.ErrSkip
+	}
+
+	query, err := c.rewrite(ctx, query, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if qc != nil {
+		return qc.QueryContext(ctx, query, args)
+	}
+
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return q.Query(query, values)
+}
+
+// rewrite prepares a statement about to run on the connection, returning the
+// query to run instead. The limit guard only applies to queries.
+func (c *driverConn) rewrite(ctx context.Context, query string, isQuery bool) (string, error) {
+	if isQuery {
+		query = c.db.guardLimit(ctx, query)
+	}
+	query = c.db.comment(ctx, query)
+	return c.applyTimeout(ctx, query)
+}
+
+// driverTx wraps a driver transaction, to keep track of session settings.
+type driverTx struct {
+	driver.Tx
+	conn *driverConn
+}
+
+func (tx *driverTx) Rollback() error {
+	// Settings changed during the transaction are rolled back as well
+	if tx.conn.stmtTimeout != tx.conn.txStmtTimeout {
+		tx.conn.stmtTimeout = -1
+	}
+	return tx.Tx.Rollback()
+}
+
+// namedValues converts arguments for drivers that don't support names.
+func namedValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = nv.Value
+	}
+	return values, nil
+}
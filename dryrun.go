@@ -0,0 +1,170 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DryRunResult is the canned result of a statement in dry-run mode. Queries
+// return Rows, with the given Columns, and other statements report
+// RowsAffected and LastInsertID. If Err is set, the statement fails with it
+// instead.
+type DryRunResult struct {
+	Columns      []string
+	Rows         [][]interface{}
+	RowsAffected int64
+	LastInsertID int64
+	Err          error
+}
+
+// DryRunFunc returns the canned result for a statement in dry-run mode.
+type DryRunFunc func(query string, args []interface{}) DryRunResult
+
+// dryRun holds the settings made with SetDryRun().
+type dryRun struct {
+	results DryRunFunc
+}
+
+// dryRunPool returns the results found in the context of each statement. It's
+// shared by all DBs, and only opened once needed.
+var dryRunPool = sync.OnceValue(func() *sql.DB {
+	return sql.OpenDB(dryRunConnector{})
+})
+
+type dryRunResultKey struct{}
+
+// SetDryRun enables dry-run mode, where statements run directly on the DB
+// (through Exec(), Query() and QueryRow() and their variants) don't touch the
+// database, nor take a connection. Instead, a DryRunEvent is sent for each
+// (see SetEventCh()), holding the statement, its arguments and the caller that
+// would have taken a connection, and the result returned by results is
+// returned, or an empty one if results is nil. The number of statements is
+// reported in PoolStats().DryRuns, as a measure of demand for connections. This
+// is useful to check what migrations would do, or to model capacity.
+// Transactions, dedicated connections and prepared statements are not
+// affected, so they still run on the database.
+func (db *DB) SetDryRun(enabled bool, results DryRunFunc) {
+	if !enabled {
+		db.dryRun.Store(nil)
+		return
+	}
+
+	if results == nil {
+		results = func(string, []interface{}) DryRunResult {
+			return DryRunResult{}
+		}
+	}
+
+	db.dryRun.Store(&dryRun{results: results})
+}
+
+// dryRunTarget returns the pool to run a statement on in dry-run mode, along
+// with the context to use, reporting the statement. If dry-run mode is not
+// enabled, it returns nil.
+func (db *DB) dryRunTarget(ctx context.Context, query string, args []interface{}) (*sql.DB, context.Context) {
+	dr := db.dryRun.Load()
+	if dr == nil {
+		return nil, ctx
+	}
+
+	atomic.AddUint64(&db.dryRuns, 1)
+	db.emit(DryRunEvent{
+		Time:   time.Now(),
+		Query:  query,
+		Args:   formatArgs(args, true),
+		Caller: caller(),
+		Tags:   TagsFromContext(ctx),
+	})
+
+	result := dr.results(query, args)
+	return dryRunPool(), context.WithValue(ctx, dryRunResultKey{}, result)
+}
+
+// dryRunConnector makes connections returning the results found in the
+// context of each statement.
+type dryRunConnector struct{}
+
+func (dryRunConnector) Connect(context.Context) (driver.Conn, error) {
+	return dryRunConn{}, nil
+}
+
+func (dryRunConnector) Driver() driver.Driver {
+	return dryRunDriver{}
+}
+
+type dryRunDriver struct{}
+
+func (dryRunDriver) Open(string) (driver.Conn, error) {
+	return dryRunConn{}, nil
+}
+
+var errDryRunPrepare = errors.New("dbcontrol: statements can't be prepared in dry-run mode")
+
+type dryRunConn struct{}
+
+func (dryRunConn) Prepare(string) (driver.Stmt, error) { return nil, errDryRunPrepare }
+func (dryRunConn) Close() error                        { return nil }
+func (dryRunConn) Begin() (driver.Tx, error)           { return nil, errDryRunPrepare }
+
+// CheckNamedValue accepts any argument, since they are never sent anywhere.
+func (dryRunConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (dryRunConn) ExecContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Result, error) {
+	result, _ := ctx.Value(dryRunResultKey{}).(DryRunResult)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return dryRunExecResult{result}, nil
+}
+
+func (dryRunConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	result, _ := ctx.Value(dryRunResultKey{}).(DryRunResult)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return &dryRunRows{result: result}, nil
+}
+
+type dryRunExecResult struct {
+	result DryRunResult
+}
+
+func (r dryRunExecResult) LastInsertId() (int64, error) { return r.result.LastInsertID, nil }
+func (r dryRunExecResult) RowsAffected() (int64, error) { return r.result.RowsAffected, nil }
+
+type dryRunRows struct {
+	result DryRunResult
+	next   int
+}
+
+func (r *dryRunRows) Columns() []string { return r.result.Columns }
+func (r *dryRunRows) Close() error      { return nil }
+
+func (r *dryRunRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		return io.EOF
+	}
+
+	row := r.result.Rows[r.next]
+	r.next++
+	for i := range dest {
+		if i >= len(row) {
+			dest[i] = nil
+			continue
+		}
+		v, err := driver.DefaultParameterConverter.ConvertValue(row[i])
+		if err != nil {
+			return err
+		}
+		dest[i] = v
+	}
+	return nil
+}
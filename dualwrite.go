@@ -0,0 +1,282 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDualWriteQueue = 1000
+	defaultDualWriteRetry = time.Second
+)
+
+// SecondaryPolicy sets what happens to writes that fail on the secondary DB.
+// See SetDualWrite().
+type SecondaryPolicy int
+
+const (
+	// SecondaryLog reports the failure and carries on.
+	SecondaryLog SecondaryPolicy = iota
+
+	// SecondaryQueue reports the failure and queues the write, to retry it
+	// in the background until it succeeds.
+	SecondaryQueue
+
+	// SecondaryFail reports the failure and returns a SecondaryWriteError.
+	SecondaryFail
+)
+
+func (p SecondaryPolicy) String() string {
+	switch p {
+	case SecondaryLog:
+		return "log"
+	case SecondaryQueue:
+		return "queue"
+	case SecondaryFail:
+		return "fail"
+	}
+	return "unknown"
+}
+
+// DualWriteSettings configures dual writes. See SetDualWrite().
+type DualWriteSettings struct {
+	Secondary  *DB             // DB to duplicate writes to (nil to disable)
+	OnFailure  SecondaryPolicy // What to do with writes failing on the secondary
+	QueueSize  int             // Maximum writes queued (zero for 1000)
+	RetryEvery time.Duration   // Interval between retries of queued writes (zero for a second)
+}
+
+// SecondaryWriteError is returned for writes that succeeded on the DB but
+// failed on the secondary, with the SecondaryFail policy. The write is not
+// undone on the DB.
+type SecondaryWriteError struct {
+	Err error
+}
+
+func (e *SecondaryWriteError) Error() string {
+	return "dbcontrol: write failed on secondary: " + e.Err.Error()
+}
+
+func (e *SecondaryWriteError) Unwrap() error {
+	return e.Err
+}
+
+// dualWriter duplicates writes to the secondary, queuing them as needed.
+type dualWriter struct {
+	settings DualWriteSettings
+	queue    []*queuedWrite
+	mu       sync.Mutex
+	wake     chan struct{}
+	stop     chan struct{}
+}
+
+// queuedWrite is a write queued to be retried on the secondary.
+type queuedWrite struct {
+	query    string
+	args     []interface{}
+	rows     int64 // Rows affected on the DB
+	tags     map[string]string
+	attempts int
+}
+
+// SetDualWrite makes the DB duplicate writes run with Exec() and its variants
+// to a secondary DB, once they succeed on the DB, to support live migrations
+// between databases. Writes run in transactions, on dedicated connections or
+// through prepared statements are not duplicated. Writes failing on the
+// secondary are reported with a DualWriteEvent (see SetEventCh()), and then
+// handled according to settings.OnFailure. With SecondaryQueue, further writes
+// are queued behind them as well, so that the secondary applies writes in
+// order; writes exceeding settings.QueueSize are dropped. Writes affecting a
+// different number of rows on each DB are reported as diverging. Counts are
+// reported in PoolStats(). Calling SetDualWrite() again discards queued writes.
+// A nil secondary disables dual writes.
+func (db *DB) SetDualWrite(settings DualWriteSettings) {
+	var w *dualWriter
+	if settings.Secondary != nil {
+		if settings.QueueSize <= 0 {
+			settings.QueueSize = defaultDualWriteQueue
+		}
+		if settings.RetryEvery <= 0 {
+			settings.RetryEvery = defaultDualWriteRetry
+		}
+		w = &dualWriter{
+			settings: settings,
+			wake:     make(chan struct{}, 1),
+			stop:     make(chan struct{}),
+		}
+	}
+
+	if old := db.dualWrite.Swap(w); old != nil {
+		close(old.stop)
+	}
+	if w != nil && settings.OnFailure == SecondaryQueue {
+		go w.drain(db)
+	}
+}
+
+// DualWrite returns the settings made with SetDualWrite(), or the zero value if
+// dual writes are disabled.
+func (db *DB) DualWrite() DualWriteSettings {
+	if w := db.dualWrite.Load(); w != nil {
+		return w.settings
+	}
+	return DualWriteSettings{}
+}
+
+// writeSecondary duplicates a write that succeeded on the DB with the given
+// result to the secondary, if enabled.
+func (db *DB) writeSecondary(ctx context.Context, query string, args []interface{}, res sql.Result) error {
+	w := db.dualWrite.Load()
+	if w == nil {
+		return nil
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		rows = -1
+	}
+
+	// Preserve the order of writes behind those already queued
+	if w.settings.OnFailure == SecondaryQueue && w.pending() > 0 {
+		if !w.enqueue(&queuedWrite{query, args, rows, TagsFromContext(ctx), 0}) {
+			db.emit(DualWriteEvent{
+				Time:          time.Now(),
+				Fingerprint:   Fingerprint(query),
+				Rows:          rows,
+				SecondaryRows: -1,
+				Dropped:       true,
+				Tags:          TagsFromContext(ctx),
+			})
+		}
+		return nil
+	}
+
+	e := DualWriteEvent{
+		Time:          time.Now(),
+		Fingerprint:   Fingerprint(query),
+		Rows:          rows,
+		SecondaryRows: -1,
+		Attempts:      1,
+		Tags:          TagsFromContext(ctx),
+	}
+
+	secondary, err := w.settings.Secondary.ExecContext(ctx, query, args...)
+	if err == nil {
+		db.compareWrites(e, secondary)
+		return nil
+	}
+
+	atomic.AddUint64(&db.secondaryFailures, 1)
+	e.Cause = err
+	switch w.settings.OnFailure {
+	case SecondaryQueue:
+		e.Queued = w.enqueue(&queuedWrite{query, args, rows, e.Tags, 1})
+		e.Dropped = !e.Queued
+	case SecondaryFail:
+		db.emit(e)
+		return &SecondaryWriteError{Err: err}
+	}
+	db.emit(e)
+	return nil
+}
+
+// compareWrites reports a write that succeeded on both DBs, as described by e,
+// if they affected a different number of rows.
+func (db *DB) compareWrites(e DualWriteEvent, secondary sql.Result) {
+	rows, err := secondary.RowsAffected()
+	if err != nil {
+		rows = -1
+	}
+
+	e.SecondaryRows = rows
+	if rows >= 0 && e.Rows >= 0 && rows != e.Rows {
+		atomic.AddUint64(&db.divergences, 1)
+		db.emit(e)
+	} else if e.Attempts > 1 {
+		db.emit(e) // Report a queued write that finally went through
+	}
+}
+
+func (w *dualWriter) pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queue)
+}
+
+// enqueue queues a write, unless the queue is full.
+func (w *dualWriter) enqueue(qw *queuedWrite) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.queue) >= w.settings.QueueSize {
+		return false
+	}
+	w.queue = append(w.queue, qw)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// drain retries queued writes in order, until the writer is replaced or the DB
+// is closed.
+func (w *dualWriter) drain(db *DB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+		case <-db.done:
+		}
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			w.mu.Lock()
+			if len(w.queue) == 0 {
+				w.mu.Unlock()
+				break
+			}
+			qw := w.queue[0]
+			w.mu.Unlock()
+
+			qw.attempts++
+			res, err := w.settings.Secondary.ExecContext(ctx, qw.query, qw.args...)
+			if err != nil {
+				select {
+				case <-time.After(w.settings.RetryEvery):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			w.mu.Lock()
+			w.queue[0] = nil
+			w.queue = w.queue[1:]
+			w.mu.Unlock()
+
+			db.compareWrites(DualWriteEvent{
+				Time:        time.Now(),
+				Fingerprint: Fingerprint(qw.query),
+				Rows:        qw.rows,
+				Attempts:    qw.attempts,
+				Tags:        qw.tags,
+			}, res)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+// EncodeText writes the text encoding of e to w, followed by a newline. Unlike
+// e.MarshalText(), this function doesn't allocate memory, as it uses pooled
+// buffers internally.
+func EncodeText(w io.Writer, e Event) error {
+	return encode(w, e, false)
+}
+
+// EncodeJSON writes the JSON encoding of e to w, followed by a newline. Unlike
+// e.MarshalJSON(), this function doesn't allocate memory, as it uses pooled
+// buffers internally.
+func EncodeJSON(w io.Writer, e Event) error {
+	return encode(w, e, true)
+}
+
+func encode(w io.Writer, e Event, asJSON bool) error {
+	bp := bufPool.Get().(*[]byte)
+	b := (*bp)[:0]
+
+	if asJSON {
+		b = e.appendJSON(b)
+	} else {
+		b = e.appendText(b)
+	}
+
+	b = append(b, '\n')
+	_, err := w.Write(b)
+	*bp = b
+	bufPool.Put(bp)
+	return err
+}
+
+func marshalText(e Event) ([]byte, error) {
+	return e.appendText(nil), nil
+}
+
+func marshalJSON(e Event) ([]byte, error) {
+	return e.appendJSON(nil), nil
+}
+
+// appendTextHeader appends the event name and time, common to all events.
+func appendTextHeader(b []byte, name string, t time.Time) []byte {
+	b = append(b, "event="...)
+	b = append(b, name...)
+	b = append(b, " time="...)
+	return t.UTC().AppendFormat(b, time.RFC3339Nano)
+}
+
+// appendJSONHeader opens a JSON object with the event name and time, common to
+// all events.
+func appendJSONHeader(b []byte, name string, t time.Time) []byte {
+	b = append(b, `{"event":"`...)
+	b = append(b, name...)
+	b = append(b, `","time":"`...)
+	b = t.UTC().AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// appendDuration appends d as a number of seconds, e.g., "1.5s".
+func appendDuration(b []byte, d time.Duration) []byte {
+	b = strconv.AppendFloat(b, d.Seconds(), 'f', -1, 64)
+	return append(b, 's')
+}
+
+// appendJSONString appends s to b as a quoted JSON string.
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, '\\', 'n')
+			case c == '\r':
+				b = append(b, '\\', 'r')
+			case c == '\t':
+				b = append(b, '\\', 't')
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `�`...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+
+	return append(b, '"')
+}
+
+// sortedKeys returns the keys of tags in order, so that encodings are stable.
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appendTextTags appends tags as "tag.key=value" fields, if any.
+func appendTextTags(b []byte, tags map[string]string) []byte {
+	if len(tags) == 0 {
+		return b
+	}
+	for _, k := range sortedKeys(tags) {
+		b = append(b, " tag."...)
+		b = append(b, k...)
+		b = append(b, '=')
+		b = strconv.AppendQuote(b, tags[k])
+	}
+	return b
+}
+
+// appendJSONTags appends tags as a "tags" object, if any.
+func appendJSONTags(b []byte, tags map[string]string) []byte {
+	if len(tags) == 0 {
+		return b
+	}
+	b = append(b, `,"tags":{`...)
+	for i, k := range sortedKeys(tags) {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+		b = appendJSONString(b, tags[k])
+	}
+	return append(b, '}')
+}
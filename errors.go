@@ -0,0 +1,66 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"errors"
+)
+
+var (
+	// ErrTooManyWaiters is returned when a connection is requested but the
+	// maximum number of callers waiting for one has been reached. See
+	// SetMaxWaiters().
+	ErrTooManyWaiters = errors.New("dbcontrol: too many waiters")
+
+	// ErrInsufficientBudget is returned when the estimated time to wait for a
+	// connection exceeds the deadline set by the caller. See SetBudgetAware().
+	ErrInsufficientBudget = errors.New("dbcontrol: deadline too short to wait for a connection")
+
+	// ErrNoRequestTx is returned by TxFromContext() when the context doesn't
+	// belong to a request served through TxMiddleware().
+	ErrNoRequestTx = errors.New("dbcontrol: no request transaction in context")
+
+	// ErrCircuitOpen is returned when requests are rejected because too many
+	// of them failed recently. See SetCircuitBreaker().
+	ErrCircuitOpen = errors.New("dbcontrol: circuit breaker open")
+
+	// ErrNoDSN is returned by OpenFailover() when no DSN is provided.
+	ErrNoDSN = errors.New("dbcontrol: no DSN provided")
+
+	// ErrCopyUnsupported is returned by CopyIn() and CopyFrom() when the DB
+	// doesn't use the Postgres dialect.
+	ErrCopyUnsupported = errors.New("dbcontrol: COPY requires the Postgres dialect")
+
+	// ErrQueryDenied is returned for queries rejected by the policy in effect.
+	// See SetPolicy().
+	ErrQueryDenied = errors.New("dbcontrol: query denied by policy")
+
+	// ErrNoShardKey is returned by requests on a Sharded whose context has
+	// no shard key. See WithShardKey().
+	ErrNoShardKey = errors.New("dbcontrol: no shard key in context")
+
+	// ErrNoShards is returned by OpenSharded() and topology changes on a
+	// Sharded when no shards are given.
+	ErrNoShards = errors.New("dbcontrol: no shards")
+
+	// ErrQuotaExceeded is returned when a request would exceed its quota of
+	// connections, whose overflow policy is OverflowReject. See
+	// SetTenantQuota().
+	ErrQuotaExceeded = errors.New("dbcontrol: connection quota exceeded")
+
+	// ErrInjectedFault is the default error of requests failed on purpose.
+	// See SetFaults().
+	ErrInjectedFault = errors.New("dbcontrol: injected fault")
+
+	// ErrLeaseReleased is returned for statements run on a Lease already
+	// released. See DB.Acquire().
+	ErrLeaseReleased = errors.New("dbcontrol: lease already released")
+
+	// ErrNameInUse is returned when naming a DB after another one that's
+	// still open. See OpenNamed().
+	ErrNameInUse = errors.New("dbcontrol: DB name already in use")
+
+	// ErrPrimaryUnavailable is returned by a degraded Cluster for requests
+	// that need the primary. See Cluster.SetDegradedMode().
+	ErrPrimaryUnavailable = errors.New("dbcontrol: primary unavailable")
+)
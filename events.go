@@ -0,0 +1,817 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"strconv"
+	"time"
+)
+
+// Event is the interface implemented by all notifications delivered through the
+// channel set with SetEventCh(). Receivers should use a type switch to tell the
+// different events apart, ignoring those they don't care about. All events
+// carry the wall-clock time at which they were generated. All events can
+// be encoded as text (key=value pairs) or JSON, either through the standard
+// encoding interfaces or with EncodeText() and EncodeJSON(), which avoid
+// allocations altogether.
+type Event interface {
+	MarshalText() ([]byte, error)
+	MarshalJSON() ([]byte, error)
+	appendText(b []byte) []byte
+	appendJSON(b []byte) []byte
+}
+
+// SoftLimitEvent is sent when the number of connections in use rises above the
+// soft limit set with SetSoftLimit().
+type SoftLimitEvent struct {
+	Time      time.Time
+	InUse     int // Connections in use, including the one that crossed the limit
+	SoftLimit int
+}
+
+func (e SoftLimitEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e SoftLimitEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e SoftLimitEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "soft_limit", e.Time)
+	b = append(b, " in_use="...)
+	b = strconv.AppendInt(b, int64(e.InUse), 10)
+	b = append(b, " soft_limit="...)
+	return strconv.AppendInt(b, int64(e.SoftLimit), 10)
+}
+
+func (e SoftLimitEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "soft_limit", e.Time)
+	b = append(b, `,"in_use":`...)
+	b = strconv.AppendInt(b, int64(e.InUse), 10)
+	b = append(b, `,"soft_limit":`...)
+	b = strconv.AppendInt(b, int64(e.SoftLimit), 10)
+	return append(b, '}')
+}
+
+// LimitChangeEvent is sent when the connection limit of the DB changes while in
+// use, e.g., due to SetAutoShrink(). Cause holds the error that triggered the
+// change, if any.
+type LimitChangeEvent struct {
+	Time     time.Time
+	Old, New int
+	Cause    error
+}
+
+func (e LimitChangeEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e LimitChangeEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e LimitChangeEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "limit_change", e.Time)
+	b = append(b, " old="...)
+	b = strconv.AppendInt(b, int64(e.Old), 10)
+	b = append(b, " new="...)
+	b = strconv.AppendInt(b, int64(e.New), 10)
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return b
+}
+
+func (e LimitChangeEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "limit_change", e.Time)
+	b = append(b, `,"old":`...)
+	b = strconv.AppendInt(b, int64(e.Old), 10)
+	b = append(b, `,"new":`...)
+	b = strconv.AppendInt(b, int64(e.New), 10)
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	return append(b, '}')
+}
+
+// BreakerEvent is sent when the state of the circuit breaker changes. See
+// SetCircuitBreaker().
+type BreakerEvent struct {
+	Time  time.Time
+	State BreakerState
+	Cause error // Error that caused the change, if any
+}
+
+func (e BreakerEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e BreakerEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e BreakerEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "breaker", e.Time)
+	b = append(b, " state="...)
+	b = append(b, e.State.String()...)
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return b
+}
+
+func (e BreakerEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "breaker", e.Time)
+	b = append(b, `,"state":"`...)
+	b = append(b, e.State.String()...)
+	b = append(b, '"')
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	return append(b, '}')
+}
+
+// TxTimeoutEvent is sent when a transaction is rolled back for being open for
+// too long. See SetTxTimeout(). Stack holds the stack trace of the caller that
+// began the transaction, and Tags those set on its context (see WithTag()).
+type TxTimeoutEvent struct {
+	Time    time.Time
+	Timeout time.Duration
+	Stack   string
+	Tags    map[string]string
+}
+
+func (e TxTimeoutEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e TxTimeoutEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e TxTimeoutEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "tx_timeout", e.Time)
+	b = append(b, " timeout="...)
+	b = appendDuration(b, e.Timeout)
+	b = append(b, " stack="...)
+	b = strconv.AppendQuote(b, e.Stack)
+	return appendTextTags(b, e.Tags)
+}
+
+func (e TxTimeoutEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "tx_timeout", e.Time)
+	b = append(b, `,"timeout":`...)
+	b = strconv.AppendInt(b, int64(e.Timeout), 10)
+	b = append(b, `,"stack":`...)
+	b = appendJSONString(b, e.Stack)
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// FailoverEvent is sent when a DB opened with OpenFailover() switches to
+// another endpoint. From and To hold the hosts involved, as found in the DSNs.
+// Cause holds the error from the last failed health check.
+type FailoverEvent struct {
+	Time     time.Time
+	From, To string
+	Cause    error
+}
+
+func (e FailoverEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e FailoverEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e FailoverEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "failover", e.Time)
+	b = append(b, " from="...)
+	b = strconv.AppendQuote(b, e.From)
+	b = append(b, " to="...)
+	b = strconv.AppendQuote(b, e.To)
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return b
+}
+
+func (e FailoverEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "failover", e.Time)
+	b = append(b, `,"from":`...)
+	b = appendJSONString(b, e.From)
+	b = append(b, `,"to":`...)
+	b = appendJSONString(b, e.To)
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	return append(b, '}')
+}
+
+// HealthEvent is sent when the health of the DB changes. See
+// SetHealthCheck(). Latency is that of the probe that caused the change, and
+// Cause holds its error, if any.
+type HealthEvent struct {
+	Time    time.Time
+	State   HealthState
+	Latency time.Duration
+	Cause   error
+}
+
+func (e HealthEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e HealthEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e HealthEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "health", e.Time)
+	b = append(b, " state="...)
+	b = append(b, e.State.String()...)
+	b = append(b, " latency="...)
+	b = appendDuration(b, e.Latency)
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return b
+}
+
+func (e HealthEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "health", e.Time)
+	b = append(b, `,"state":"`...)
+	b = append(b, e.State.String()...)
+	b = append(b, `","latency":`...)
+	b = strconv.AppendInt(b, int64(e.Latency), 10)
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	return append(b, '}')
+}
+
+// StmtLeakEvent is sent when a statement prepared on the DB is left unused and
+// open for too long. See SetStmtLeakThreshold(). Idle is the time elapsed
+// since the statement was last used (or prepared), and Stack holds the stack
+// trace of the caller that prepared it, if available.
+type StmtLeakEvent struct {
+	Time  time.Time
+	Query string
+	Idle  time.Duration
+	Stack string
+}
+
+func (e StmtLeakEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e StmtLeakEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e StmtLeakEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "stmt_leak", e.Time)
+	b = append(b, " query="...)
+	b = strconv.AppendQuote(b, e.Query)
+	b = append(b, " idle="...)
+	b = appendDuration(b, e.Idle)
+	b = append(b, " stack="...)
+	return strconv.AppendQuote(b, e.Stack)
+}
+
+func (e StmtLeakEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "stmt_leak", e.Time)
+	b = append(b, `,"query":`...)
+	b = appendJSONString(b, e.Query)
+	b = append(b, `,"idle":`...)
+	b = strconv.AppendInt(b, int64(e.Idle), 10)
+	b = append(b, `,"stack":`...)
+	b = appendJSONString(b, e.Stack)
+	return append(b, '}')
+}
+
+// ImportEvent is sent after each chunk loaded by Import() and friends. Chunk
+// is the number of the chunk, starting at 1, and Rows the number of rows in
+// it. Cause holds the error if loading the chunk failed.
+type ImportEvent struct {
+	Time     time.Time
+	Table    string
+	Chunk    int
+	Rows     int
+	Duration time.Duration
+	Cause    error
+}
+
+func (e ImportEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e ImportEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e ImportEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "import", e.Time)
+	b = append(b, " table="...)
+	b = strconv.AppendQuote(b, e.Table)
+	b = append(b, " chunk="...)
+	b = strconv.AppendInt(b, int64(e.Chunk), 10)
+	b = append(b, " rows="...)
+	b = strconv.AppendInt(b, int64(e.Rows), 10)
+	b = append(b, " duration="...)
+	b = appendDuration(b, e.Duration)
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return b
+}
+
+func (e ImportEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "import", e.Time)
+	b = append(b, `,"table":`...)
+	b = appendJSONString(b, e.Table)
+	b = append(b, `,"chunk":`...)
+	b = strconv.AppendInt(b, int64(e.Chunk), 10)
+	b = append(b, `,"rows":`...)
+	b = strconv.AppendInt(b, int64(e.Rows), 10)
+	b = append(b, `,"duration":`...)
+	b = strconv.AppendInt(b, int64(e.Duration), 10)
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	return append(b, '}')
+}
+
+// DigestEvent reports the statistics for a query fingerprint, as returned by
+// DB.DigestStats(). It's sent periodically for fingerprints run since the
+// previous report; see SetDigestStats(). Counters are cumulative, and Mean and
+// P99 summarize the distribution of execution times.
+type DigestEvent struct {
+	Time        time.Time
+	Fingerprint string
+	Executions  uint64
+	Errors      uint64
+	Rows        uint64
+	Wait        time.Duration
+	Mean        time.Duration
+	P99         time.Duration
+}
+
+func (e DigestEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e DigestEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e DigestEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "digest", e.Time)
+	b = append(b, " fingerprint="...)
+	b = strconv.AppendQuote(b, e.Fingerprint)
+	b = append(b, " executions="...)
+	b = strconv.AppendUint(b, e.Executions, 10)
+	b = append(b, " errors="...)
+	b = strconv.AppendUint(b, e.Errors, 10)
+	b = append(b, " rows="...)
+	b = strconv.AppendUint(b, e.Rows, 10)
+	b = append(b, " wait="...)
+	b = appendDuration(b, e.Wait)
+	b = append(b, " mean="...)
+	b = appendDuration(b, e.Mean)
+	b = append(b, " p99="...)
+	return appendDuration(b, e.P99)
+}
+
+func (e DigestEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "digest", e.Time)
+	b = append(b, `,"fingerprint":`...)
+	b = appendJSONString(b, e.Fingerprint)
+	b = append(b, `,"executions":`...)
+	b = strconv.AppendUint(b, e.Executions, 10)
+	b = append(b, `,"errors":`...)
+	b = strconv.AppendUint(b, e.Errors, 10)
+	b = append(b, `,"rows":`...)
+	b = strconv.AppendUint(b, e.Rows, 10)
+	b = append(b, `,"wait":`...)
+	b = strconv.AppendInt(b, int64(e.Wait), 10)
+	b = append(b, `,"mean":`...)
+	b = strconv.AppendInt(b, int64(e.Mean), 10)
+	b = append(b, `,"p99":`...)
+	b = strconv.AppendInt(b, int64(e.P99), 10)
+	return append(b, '}')
+}
+
+// SlowQueryEvent is sent for statements that take too long to execute. See
+// SetSlowQueryLog(). Rows holds the number of rows returned by queries, or
+// affected by other statements. Caller holds the function that issued the
+// statement, with its location. Plan holds the execution plan, if EXPLAIN was
+// requested for the query, or else ExplainErr the reason it couldn't be
+// obtained. Tags holds those set on the context of the query (see WithTag()).
+type SlowQueryEvent struct {
+	Time       time.Time
+	Query      string
+	Args       []string
+	Duration   time.Duration
+	Wait       time.Duration
+	Rows       int64
+	Caller     string
+	Plan       string
+	ExplainErr error
+	Tags       map[string]string
+}
+
+func (e SlowQueryEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e SlowQueryEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e SlowQueryEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "slow_query", e.Time)
+	b = append(b, " query="...)
+	b = strconv.AppendQuote(b, e.Query)
+	for _, arg := range e.Args {
+		b = append(b, " arg="...)
+		b = strconv.AppendQuote(b, arg)
+	}
+	b = append(b, " duration="...)
+	b = appendDuration(b, e.Duration)
+	b = append(b, " wait="...)
+	b = appendDuration(b, e.Wait)
+	b = append(b, " rows="...)
+	b = strconv.AppendInt(b, e.Rows, 10)
+	b = append(b, " caller="...)
+	b = strconv.AppendQuote(b, e.Caller)
+	if e.Plan != "" {
+		b = append(b, " plan="...)
+		b = strconv.AppendQuote(b, e.Plan)
+	}
+	if e.ExplainErr != nil {
+		b = append(b, " explain_error="...)
+		b = strconv.AppendQuote(b, e.ExplainErr.Error())
+	}
+	return appendTextTags(b, e.Tags)
+}
+
+func (e SlowQueryEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "slow_query", e.Time)
+	b = append(b, `,"query":`...)
+	b = appendJSONString(b, e.Query)
+	b = append(b, `,"args":[`...)
+	for i, arg := range e.Args {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, arg)
+	}
+	b = append(b, `],"duration":`...)
+	b = strconv.AppendInt(b, int64(e.Duration), 10)
+	b = append(b, `,"wait":`...)
+	b = strconv.AppendInt(b, int64(e.Wait), 10)
+	b = append(b, `,"rows":`...)
+	b = strconv.AppendInt(b, e.Rows, 10)
+	b = append(b, `,"caller":`...)
+	b = appendJSONString(b, e.Caller)
+	if e.Plan != "" {
+		b = append(b, `,"plan":`...)
+		b = appendJSONString(b, e.Plan)
+	}
+	if e.ExplainErr != nil {
+		b = append(b, `,"explain_error":`...)
+		b = appendJSONString(b, e.ExplainErr.Error())
+	}
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// WaitEvent is sent each time a caller has to wait for a connection, as also
+// reported through SetBlockDurationCh(). Tags holds those set on the context of
+// the caller (see WithTag()). It's not sent through the channel set with
+// SetEventCh(), only to event writers and subscribers (see SetEventWriter() and
+// Subscribe()).
+type WaitEvent struct {
+	Time time.Time
+	Wait time.Duration
+	Tags map[string]string
+}
+
+func (e WaitEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e WaitEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e WaitEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "wait", e.Time)
+	b = append(b, " wait="...)
+	b = appendDuration(b, e.Wait)
+	return appendTextTags(b, e.Tags)
+}
+
+func (e WaitEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "wait", e.Time)
+	b = append(b, `,"wait":`...)
+	b = strconv.AppendInt(b, int64(e.Wait), 10)
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// UsageTimeoutEvent is sent each time a connection is held for longer than the
+// usage timeout, as also reported through SetUsageTimeout(). Stack holds the
+// stack trace of the caller that took the connection, and Tags those set on
+// its context (see WithTag()). It's not sent through the channel set with
+// SetEventCh(), only to event writers and subscribers (see SetEventWriter()
+// and Subscribe()).
+type UsageTimeoutEvent struct {
+	Time    time.Time
+	Timeout time.Duration
+	Stack   string
+	Tags    map[string]string
+}
+
+func (e UsageTimeoutEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e UsageTimeoutEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e UsageTimeoutEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "usage_timeout", e.Time)
+	b = append(b, " timeout="...)
+	b = appendDuration(b, e.Timeout)
+	b = append(b, " stack="...)
+	b = strconv.AppendQuote(b, e.Stack)
+	return appendTextTags(b, e.Tags)
+}
+
+func (e UsageTimeoutEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "usage_timeout", e.Time)
+	b = append(b, `,"timeout":`...)
+	b = strconv.AppendInt(b, int64(e.Timeout), 10)
+	b = append(b, `,"stack":`...)
+	b = appendJSONString(b, e.Stack)
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// PolicyEvent is sent when a query is rejected by the policy in effect. See
+// SetPolicy(). Rule holds the name of the deny rule the query matched, unless
+// Unlisted is set, meaning that it matched no rule in the allowlist. Tags holds
+// those set on the context of the query (see WithTag()).
+type PolicyEvent struct {
+	Time        time.Time
+	Fingerprint string
+	Rule        string
+	Unlisted    bool
+	Tags        map[string]string
+}
+
+func (e PolicyEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e PolicyEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e PolicyEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "policy", e.Time)
+	b = append(b, " fingerprint="...)
+	b = strconv.AppendQuote(b, e.Fingerprint)
+	b = append(b, " rule="...)
+	b = strconv.AppendQuote(b, e.Rule)
+	b = append(b, " unlisted="...)
+	b = strconv.AppendBool(b, e.Unlisted)
+	return appendTextTags(b, e.Tags)
+}
+
+func (e PolicyEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "policy", e.Time)
+	b = append(b, `,"fingerprint":`...)
+	b = appendJSONString(b, e.Fingerprint)
+	b = append(b, `,"rule":`...)
+	b = appendJSONString(b, e.Rule)
+	b = append(b, `,"unlisted":`...)
+	b = strconv.AppendBool(b, e.Unlisted)
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// DryRunEvent is sent for each statement run in dry-run mode. See SetDryRun().
+// Caller holds the function that would have taken a connection, with its
+// location, and Tags those set on the context of the statement (see
+// WithTag()). Arguments are reported after going through the redactor (see
+// SetRedactor()).
+type DryRunEvent struct {
+	Time   time.Time
+	Query  string
+	Args   []string
+	Caller string
+	Tags   map[string]string
+}
+
+func (e DryRunEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e DryRunEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e DryRunEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "dry_run", e.Time)
+	b = append(b, " query="...)
+	b = strconv.AppendQuote(b, e.Query)
+	for _, arg := range e.Args {
+		b = append(b, " arg="...)
+		b = strconv.AppendQuote(b, arg)
+	}
+	b = append(b, " caller="...)
+	b = strconv.AppendQuote(b, e.Caller)
+	return appendTextTags(b, e.Tags)
+}
+
+func (e DryRunEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "dry_run", e.Time)
+	b = append(b, `,"query":`...)
+	b = appendJSONString(b, e.Query)
+	b = append(b, `,"args":[`...)
+	for i, arg := range e.Args {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, arg)
+	}
+	b = append(b, `],"caller":`...)
+	b = appendJSONString(b, e.Caller)
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// MirrorEvent is sent for each query replayed on the shadow DB set with
+// SetMirroring(), comparing its Latency on the DB with ShadowLatency. If
+// results were compared, Compared is set, Rows and ShadowRows hold the number
+// of rows on each side, and Mismatch tells whether they differed. Cause holds
+// the error of the replayed query, if any. Tags holds those set on the context
+// of the query (see WithTag()).
+type MirrorEvent struct {
+	Time          time.Time
+	Fingerprint   string
+	Latency       time.Duration
+	ShadowLatency time.Duration
+	Compared      bool
+	Rows          int
+	ShadowRows    int
+	Mismatch      bool
+	Cause         error
+	Tags          map[string]string
+}
+
+func (e MirrorEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e MirrorEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e MirrorEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "mirror", e.Time)
+	b = append(b, " fingerprint="...)
+	b = strconv.AppendQuote(b, e.Fingerprint)
+	b = append(b, " latency="...)
+	b = appendDuration(b, e.Latency)
+	b = append(b, " shadow_latency="...)
+	b = appendDuration(b, e.ShadowLatency)
+	if e.Compared {
+		b = append(b, " rows="...)
+		b = strconv.AppendInt(b, int64(e.Rows), 10)
+		b = append(b, " shadow_rows="...)
+		b = strconv.AppendInt(b, int64(e.ShadowRows), 10)
+		b = append(b, " mismatch="...)
+		b = strconv.AppendBool(b, e.Mismatch)
+	}
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return appendTextTags(b, e.Tags)
+}
+
+func (e MirrorEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "mirror", e.Time)
+	b = append(b, `,"fingerprint":`...)
+	b = appendJSONString(b, e.Fingerprint)
+	b = append(b, `,"latency":`...)
+	b = strconv.AppendInt(b, int64(e.Latency), 10)
+	b = append(b, `,"shadow_latency":`...)
+	b = strconv.AppendInt(b, int64(e.ShadowLatency), 10)
+	if e.Compared {
+		b = append(b, `,"rows":`...)
+		b = strconv.AppendInt(b, int64(e.Rows), 10)
+		b = append(b, `,"shadow_rows":`...)
+		b = strconv.AppendInt(b, int64(e.ShadowRows), 10)
+		b = append(b, `,"mismatch":`...)
+		b = strconv.AppendBool(b, e.Mismatch)
+	}
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// DualWriteEvent is sent for writes that failed on the secondary DB set with
+// SetDualWrite(), with Cause holding the error, or affected a different number
+// of rows on each DB, held in Rows and SecondaryRows (-1 if unknown). Attempts
+// is the number of times the write was tried on the secondary. Queued is set
+// if the write was queued for retry, and Dropped if it was dropped instead,
+// for a full queue. Events are also sent for queued writes that went through
+// in the end. Tags holds those set on the context of the write (see
+// WithTag()).
+type DualWriteEvent struct {
+	Time          time.Time
+	Fingerprint   string
+	Rows          int64
+	SecondaryRows int64
+	Attempts      int
+	Queued        bool
+	Dropped       bool
+	Cause         error
+	Tags          map[string]string
+}
+
+func (e DualWriteEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e DualWriteEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e DualWriteEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "dual_write", e.Time)
+	b = append(b, " fingerprint="...)
+	b = strconv.AppendQuote(b, e.Fingerprint)
+	b = append(b, " rows="...)
+	b = strconv.AppendInt(b, e.Rows, 10)
+	b = append(b, " secondary_rows="...)
+	b = strconv.AppendInt(b, e.SecondaryRows, 10)
+	b = append(b, " attempts="...)
+	b = strconv.AppendInt(b, int64(e.Attempts), 10)
+	b = append(b, " queued="...)
+	b = strconv.AppendBool(b, e.Queued)
+	b = append(b, " dropped="...)
+	b = strconv.AppendBool(b, e.Dropped)
+	if e.Cause != nil {
+		b = append(b, " cause="...)
+		b = strconv.AppendQuote(b, e.Cause.Error())
+	}
+	return appendTextTags(b, e.Tags)
+}
+
+func (e DualWriteEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "dual_write", e.Time)
+	b = append(b, `,"fingerprint":`...)
+	b = appendJSONString(b, e.Fingerprint)
+	b = append(b, `,"rows":`...)
+	b = strconv.AppendInt(b, e.Rows, 10)
+	b = append(b, `,"secondary_rows":`...)
+	b = strconv.AppendInt(b, e.SecondaryRows, 10)
+	b = append(b, `,"attempts":`...)
+	b = strconv.AppendInt(b, int64(e.Attempts), 10)
+	b = append(b, `,"queued":`...)
+	b = strconv.AppendBool(b, e.Queued)
+	b = append(b, `,"dropped":`...)
+	b = strconv.AppendBool(b, e.Dropped)
+	if e.Cause != nil {
+		b = append(b, `,"cause":`...)
+		b = appendJSONString(b, e.Cause.Error())
+	}
+	b = appendJSONTags(b, e.Tags)
+	return append(b, '}')
+}
+
+// TopologyEvent is sent when the shards of a Sharded change. See
+// Sharded.Reload(). Changed holds the indexes of the shards whose DB changed,
+// including those added or removed, and Draining the number of DBs no longer
+// in use, which are closed once drained.
+type TopologyEvent struct {
+	Time      time.Time
+	OldShards int
+	Shards    int
+	Changed   []int
+	Draining  int
+}
+
+func (e TopologyEvent) MarshalText() ([]byte, error) { return marshalText(e) }
+func (e TopologyEvent) MarshalJSON() ([]byte, error) { return marshalJSON(e) }
+
+func (e TopologyEvent) appendText(b []byte) []byte {
+	b = appendTextHeader(b, "topology", e.Time)
+	b = append(b, " old_shards="...)
+	b = strconv.AppendInt(b, int64(e.OldShards), 10)
+	b = append(b, " shards="...)
+	b = strconv.AppendInt(b, int64(e.Shards), 10)
+	b = append(b, " changed="...)
+	for i, shard := range e.Changed {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(shard), 10)
+	}
+	b = append(b, " draining="...)
+	return strconv.AppendInt(b, int64(e.Draining), 10)
+}
+
+func (e TopologyEvent) appendJSON(b []byte) []byte {
+	b = appendJSONHeader(b, "topology", e.Time)
+	b = append(b, `,"old_shards":`...)
+	b = strconv.AppendInt(b, int64(e.OldShards), 10)
+	b = append(b, `,"shards":`...)
+	b = strconv.AppendInt(b, int64(e.Shards), 10)
+	b = append(b, `,"changed":[`...)
+	for i, shard := range e.Changed {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(shard), 10)
+	}
+	b = append(b, `],"draining":`...)
+	b = strconv.AppendInt(b, int64(e.Draining), 10)
+	return append(b, '}')
+}
+
+// SetEventCh sets a channel to receive events from the DB (see the types
+// implementing Event). Events are sent synchronously, so make sure the channel
+// is drained promptly or operations on the DB may be delayed. Setting the
+// channel to nil disables notifications. The previously set channel is
+// guaranteed not to be used again after SetEventCh() returns, thus allowing to
+// safely close it if appropriate. Use Subscribe() instead to have several
+// consumers, or to avoid delaying operations.
+func (db *DB) SetEventCh(c chan<- Event) {
+	db.eventChMux.Lock()
+	defer db.eventChMux.Unlock()
+
+	if db.eventSub != nil {
+		db.bus.unsubscribe(db.eventSub)
+		db.eventSub = nil
+	}
+
+	db.eventCh = c
+	if c != nil {
+		categories := AllEvents &^ (WaitEvents | UsageTimeoutEvents)
+		db.eventSub = db.bus.subscribe(categories, func(e Event, done <-chan struct{}) {
+			select {
+			case c <- e:
+			case <-done:
+			}
+		})
+	}
+}
+
+func (db *DB) emit(e Event) {
+	db.logEvent(e)
+
+	db.emitExtra(e)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// eventWriterBuffer is the number of events an event writer can hold before
+// dropping them.
+const eventWriterBuffer = 1024
+
+// eventWriter writes events in the background.
+type eventWriter struct {
+	w       io.Writer
+	encode  func(io.Writer, Event) error
+	ch      chan Event
+	done    chan struct{}
+	dropped uint64 // Accessed atomically
+}
+
+func newEventWriter(w io.Writer, encode func(io.Writer, Event) error) *eventWriter {
+	ew := &eventWriter{
+		w:      w,
+		encode: encode,
+		ch:     make(chan Event, eventWriterBuffer),
+		done:   make(chan struct{}),
+	}
+	go ew.run()
+	return ew
+}
+
+func (ew *eventWriter) run() {
+	defer close(ew.done)
+	for e := range ew.ch {
+		ew.encode(ew.w, e)
+	}
+}
+
+// send queues an event, dropping it if the buffer is full.
+func (ew *eventWriter) send(e Event) {
+	select {
+	case ew.ch <- e:
+	default:
+		atomic.AddUint64(&ew.dropped, 1)
+	}
+}
+
+// close stops the writer, once pending events are written.
+func (ew *eventWriter) close() {
+	close(ew.ch)
+	<-ew.done
+}
+
+// SetEventWriter makes the DB write all events to w as JSON lines (see
+// EncodeJSON()), ready to be shipped to a log pipeline. Besides the events sent
+// through SetEventCh(), WaitEvents and UsageTimeoutEvents are also written,
+// reporting what's otherwise sent to the channels set with SetBlockDurationCh()
+// and SetUsageTimeout(). Events are written in the background, so that writing
+// can't delay operations on the DB; if w can't keep up, events are dropped
+// and counted in PoolStats().EventsDropped. Setting a nil writer stops writing,
+// once pending events are written. Note that w is written from a single
+// goroutine.
+func (db *DB) SetEventWriter(w io.Writer) {
+	var ew *eventWriter
+	if w != nil {
+		ew = newEventWriter(w, EncodeJSON)
+	}
+
+	db.eventChMux.Lock()
+	old := db.eventWriter
+	db.eventWriter = ew
+	db.eventChMux.Unlock()
+
+	if old != nil {
+		old.close()
+		atomic.AddUint64(&db.eventsDropped, atomic.LoadUint64(&old.dropped))
+	}
+}
+
+// eventsDroppedNow returns the number of events dropped by event writers so
+// far.
+func (db *DB) eventsDroppedNow() uint64 {
+	n := atomic.LoadUint64(&db.eventsDropped)
+
+	db.eventChMux.RLock()
+	if db.eventWriter != nil {
+		n += atomic.LoadUint64(&db.eventWriter.dropped)
+	}
+	if db.slowLog != nil {
+		n += atomic.LoadUint64(&db.slowLog.dropped)
+	}
+	db.eventChMux.RUnlock()
+	return n
+}
+
+// emitExtra sends an event to event writers and subscribers, without logging
+// it, as for events logged by other means.
+func (db *DB) emitExtra(e Event) {
+	db.eventChMux.RLock()
+	db.write(e)
+	db.eventChMux.RUnlock()
+
+	db.bus.publish(e)
+}
+
+// write sends an event to the event writers interested in it. The caller must
+// hold eventChMux.
+func (db *DB) write(e Event) {
+	if db.eventWriter != nil {
+		db.eventWriter.send(e)
+	}
+	if db.slowLog != nil {
+		switch e.(type) {
+		case SlowQueryEvent, UsageTimeoutEvent:
+			db.slowLog.send(e)
+		}
+	}
+}
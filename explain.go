@@ -0,0 +1,111 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// explainTimeout bounds the time taken to get a plan.
+const explainTimeout = 10 * time.Second
+
+// explainDue tells whether a query may be explained now, given the minimum
+// interval between EXPLAINs, recording it if so.
+func (db *DB) explainDue(interval time.Duration) bool {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&db.lastExplain)
+	if last != 0 && now-last < int64(interval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&db.lastExplain, last, now)
+}
+
+// explain returns the execution plan for a query, as reported by the EXPLAIN
+// statement of the dialect, with one line per row and columns separated by
+// tabs. It takes a connection under the limit, but bypasses statistics and
+// the slow query log.
+func (db *DB) explain(query string, args []interface{}) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+
+	release, err := db.conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if db.Dialect() == SQLServerDialect {
+		return explainSQLServer(ctx, db.pool(), query, args)
+	}
+
+	prefix := "EXPLAIN "
+	if db.Dialect() == SQLiteDialect {
+		prefix = "EXPLAIN QUERY PLAN "
+	}
+
+	rows, err := db.pool().QueryContext(ctx, prefix+query, args...)
+	if err != nil {
+		return "", err
+	}
+	return formatPlan(rows)
+}
+
+// explainSQLServer gets the plan for a query with SHOWPLAN_TEXT, which only
+// applies to the session, and keeps the query from running.
+func explainSQLServer(ctx context.Context, pool *sql.DB, query string, args []interface{}) (string, error) {
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET SHOWPLAN_TEXT ON"); err != nil {
+		return "", err
+	}
+	defer conn.ExecContext(context.Background(), "SET SHOWPLAN_TEXT OFF")
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	return formatPlan(rows)
+}
+
+// formatPlan reads a plan from rows, closing them.
+func formatPlan(rows *sql.Rows) (string, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	values := newRowValues(len(columns))
+	for rows.Next() {
+		if err := rows.Scan(values.ptrs...); err != nil {
+			return "", err
+		}
+		for i, v := range values.values {
+			if i > 0 {
+				b.WriteByte('\t')
+			}
+			switch v := v.(type) {
+			case nil:
+				b.WriteString("NULL")
+			case []byte:
+				b.Write(v)
+			default:
+				fmt.Fprint(&b, v)
+			}
+		}
+		b.WriteByte('\n')
+	}
+
+	return b.String(), rows.Err()
+}
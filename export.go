@@ -0,0 +1,150 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WriteCSV writes the remaining rows to w as CSV, preceded by a header with the
+// column names. Rows are written as they are read, so memory use doesn't grow
+// with the size of the result set. NULL values are written as empty fields,
+// byte slices as strings and times in RFC 3339 format. The rows are closed
+// (thus releasing the connection) once done, even if writing fails.
+func (rows *Rows) WriteCSV(w io.Writer) error {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	values := newRowValues(len(columns))
+	record := make([]string, len(columns))
+	for rows.Next() {
+		if err := rows.Rows.Scan(values.ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values.values {
+			record[i] = csvField(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes the remaining rows to w as a JSON array, with one object per
+// row keyed by column name. Rows are written as they are read, as in
+// WriteCSV(). Byte slices are written as strings. The rows are closed once
+// done, even if writing fails.
+func (rows *Rows) WriteJSON(w io.Writer) error {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	keys := make([][]byte, len(columns))
+	for i, col := range columns {
+		keys[i] = strconv.AppendQuote(nil, col)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('[')
+
+	values := newRowValues(len(columns))
+	var b []byte
+	for n := 0; rows.Next(); n++ {
+		if err := rows.Rows.Scan(values.ptrs...); err != nil {
+			return err
+		}
+
+		b = b[:0]
+		if n > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '{')
+		for i, v := range values.values {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, keys[i]...)
+			b = append(b, ':')
+			if b, err = appendJSONValue(b, v); err != nil {
+				return err
+			}
+		}
+		b = append(b, '}')
+
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	bw.WriteByte(']')
+	return bw.Flush()
+}
+
+// rowValues holds the values of a row scanned as returned by the driver.
+type rowValues struct {
+	values []interface{}
+	ptrs   []interface{}
+}
+
+func newRowValues(n int) rowValues {
+	rv := rowValues{values: make([]interface{}, n), ptrs: make([]interface{}, n)}
+	for i := range rv.values {
+		rv.ptrs[i] = &rv.values[i]
+	}
+	return rv
+}
+
+func csvField(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+func appendJSONValue(b []byte, v interface{}) ([]byte, error) {
+	if s, ok := v.([]byte); ok {
+		v = string(s)
+	}
+
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return b, err
+	}
+	return append(b, enc...), nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"time"
+)
+
+// OpenFailover opens a DB that can fail over among several endpoints. The DSNs
+// are tried in order, starting with the first one. Once health checks are
+// enabled with SetFailover(), the DB switches to the next endpoint that
+// responds when the active one stops doing so, reopening the pool transparently.
+// DBs opened this way always get a connection limit of their own, regardless of
+// SetHostGrouping(), since the host changes on failover.
+func OpenFailover(driver string, dsns ...string) (*DB, error) {
+	if len(dsns) == 0 {
+		return nil, ErrNoDSN
+	}
+
+	db, err := open(driver, dsns[0], false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	db.dsns = append([]string(nil), dsns...)
+	return db, nil
+}
+
+// SetFailover enables health checks for DBs opened with OpenFailover(). The
+// active endpoint is pinged at the given interval, and after the given number
+// of consecutive failures, the DB fails over to the next endpoint (in the order
+// given to OpenFailover(), wrapping around) that can be reached. Connections in
+// use on the failed endpoint are then returned to the connection limit right
+// away, so they don't count against the new endpoint, and the old pool is
+// closed. Statements prepared on the old pool can no longer be used. A
+// FailoverEvent is sent each time the endpoint changes. Setting a zero interval
+// disables health checks.
+func (db *DB) SetFailover(interval time.Duration, failures int) {
+	db.failoverMux.Lock()
+	defer db.failoverMux.Unlock()
+
+	if db.failoverStop != nil {
+		close(db.failoverStop)
+		db.failoverStop = nil
+	}
+
+	if interval <= 0 || len(db.dsns) < 2 {
+		db.failoverInterval, db.failoverFailures = 0, 0
+		return
+	}
+	if failures < 1 {
+		failures = 1
+	}
+
+	db.failoverInterval, db.failoverFailures = interval, failures
+
+	db.failoverStop = make(chan struct{})
+	go db.watchEndpoint(interval, failures, db.failoverStop)
+}
+
+// Endpoint returns the index of the DSN in use, as given to OpenFailover().
+func (db *DB) Endpoint() int {
+	db.poolMux.RLock()
+	defer db.poolMux.RUnlock()
+	return db.endpoint
+}
+
+func (db *DB) watchEndpoint(interval time.Duration, failures int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failed := 0
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-db.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := db.pool().PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			failed = 0
+			continue
+		}
+
+		if failed++; failed >= failures && db.failover(err, interval) {
+			failed = 0
+		}
+	}
+}
+
+// failover switches to the next endpoint that responds to a ping within
+// timeout, reporting whether it succeeded.
+func (db *DB) failover(cause error, timeout time.Duration) bool {
+	db.poolMux.RLock()
+	from := db.endpoint
+	dsns := append([]string(nil), db.dsns...)
+	db.poolMux.RUnlock()
+
+	for i := 1; i < len(dsns); i++ {
+		to := (from + i) % len(dsns)
+
+		pool, c, err := db.openPool(dsns[to])
+		if err != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = pool.PingContext(ctx)
+		cancel()
+		if err != nil {
+			pool.Close()
+			continue
+		}
+
+		db.switchPool(pool, c, to, true)
+		db.emit(FailoverEvent{
+			Time:  time.Now(),
+			From:  dsnHost(dsns[from]),
+			To:    dsnHost(dsns[to]),
+			Cause: redactError(cause),
+		})
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+func TestFailover(t *testing.T) {
+	prev := dbcontrol.Concurrency()
+	dbcontrol.SetConcurrency(1)
+	defer dbcontrol.SetConcurrency(prev)
+
+	primary, secondary := dbcontroltest.New(), dbcontroltest.New()
+	defer secondary.Close()
+
+	db, err := dbcontrol.OpenFailover(dbcontroltest.DriverName, primary.DSN(), secondary.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A transaction holds the only connection on the primary
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := primary.OpenConns(); n != 1 {
+		t.Fatalf("%d connections open on the primary, want 1", n)
+	}
+
+	// The primary goes away, so new connections fail
+	primary.Close()
+	sub := db.Subscribe(dbcontrol.AvailabilityEvents, 1, dbcontrol.DropNewest)
+	defer sub.Close()
+	db.SetFailover(20*time.Millisecond, 1)
+
+	select {
+	case e := <-sub.C:
+		if _, ok := e.(dbcontrol.FailoverEvent); !ok {
+			t.Fatalf("got %T, want FailoverEvent", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no failover")
+	}
+	if n := db.Endpoint(); n != 1 {
+		t.Fatalf("endpoint %d, want 1", n)
+	}
+
+	// The connection held by the transaction was released on failover
+	if n := db.PoolStats().InUse; n != 0 {
+		t.Fatalf("%d connections in use after failover, want 0", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Exec() after failover: %v", err)
+	}
+	if calls := secondary.Calls(); len(calls) == 0 || calls[len(calls)-1].Query != "UPDATE t SET a = 1" {
+		t.Fatalf("statement not run on the secondary: %v", calls)
+	}
+
+	// Ending the transaction doesn't give back the connection twice, and
+	// closes it along with the old pool
+	tx.Rollback()
+	if n := db.PoolStats().InUse; n != 0 {
+		t.Fatalf("%d connections in use after rollback, want 0", n)
+	}
+	if n := primary.OpenConns(); n != 0 {
+		t.Fatalf("%d connections open on the old pool, want 0", n)
+	}
+}
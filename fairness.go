@@ -0,0 +1,89 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+)
+
+// Fairness sets the order callers waiting for a connection are served in. See
+// SetFairness().
+type Fairness int32
+
+const (
+	// FIFO serves callers in the order they arrived. A caller taking more
+	// tokens than available (see WithWeight()) holds up those after it,
+	// so that it's not starved. This is the default.
+	FIFO Fairness = iota
+
+	// LIFO serves the callers that arrived last first, which keeps latency
+	// low for most callers under overload, at the expense of those that
+	// waited longest, which are more likely to have given up anyway.
+	LIFO
+
+	// FirstFit serves callers in the order they arrived, skipping those
+	// taking more tokens than available, so that heavy callers don't hold
+	// up light ones, but may be starved by them.
+	FirstFit
+)
+
+func (f Fairness) String() string {
+	switch f {
+	case FIFO:
+		return "fifo"
+	case LIFO:
+		return "lifo"
+	case FirstFit:
+		return "first-fit"
+	}
+	return "unknown"
+}
+
+// SetFairness sets the order callers waiting for a connection are served in.
+// For DBs sharing their limit with others on the same host (see
+// SetHostGrouping()), it applies to all of them. It has no effect on DBs with
+// no limit, or using a pool of tokens of their own (see SetAcquireReleaser()).
+func (db *DB) SetFairness(f Fairness) {
+	if db.sem != nil {
+		db.sem.setFairness(f)
+	}
+}
+
+// Fairness returns the order callers waiting for a connection are served in.
+// See SetFairness().
+func (db *DB) Fairness() Fairness {
+	if db.sem == nil {
+		return FIFO
+	}
+	return db.sem.getFairness()
+}
+
+type weightKey struct{}
+
+// WithWeight returns a copy of ctx that makes requests using it take weight
+// tokens from the limit, rather than one, so that heavy requests such as
+// reports leave room for fewer others. Weights are capped to the limit in
+// effect when requests are made, and ignored on DBs using a pool of tokens of
+// their own (see SetAcquireReleaser()). Requests still take a single
+// connection, and count as one in PoolStats().InUse.
+func WithWeight(ctx context.Context, weight int) context.Context {
+	return context.WithValue(ctx, weightKey{}, weight)
+}
+
+// WeightFromContext returns the weight set with WithWeight(), if any.
+func WeightFromContext(ctx context.Context) (int, bool) {
+	weight, ok := ctx.Value(weightKey{}).(int)
+	return weight, ok
+}
+
+// weight returns the number of tokens to take for a request.
+func (db *DB) weight(ctx context.Context) int {
+	weight, ok := WeightFromContext(ctx)
+	if !ok || weight <= 1 {
+		return 1
+	}
+	if limit := db.sem.limit(); weight > limit {
+		return limit
+	}
+	return weight
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Faults configures the faults injected into a DB, to check how applications
+// behave when the database is under stress. See SetFaults().
+type Faults struct {
+	BeforeAcquire time.Duration // Latency added before taking a connection
+	AfterAcquire  time.Duration // Latency added after, while holding it
+	ErrorPercent  float64       // Percentage of requests failed, up to 100
+	Err           error         // Error to fail with (ErrInjectedFault if nil)
+	Exhausted     bool          // Whether to act as if no connections were free
+}
+
+// faults holds the Faults in effect. Done is closed once they are replaced, to
+// let go of callers held by Exhausted.
+type faults struct {
+	Faults
+	done chan struct{}
+}
+
+// SetFaults injects faults into the requests that take a connection from the
+// DB: latency before or after taking the connection, errors for a percentage
+// of requests, or simulated pool exhaustion, where requests wait for a
+// connection until their context is done, or faults are changed. Except for
+// AfterAcquire, faults are injected before taking a connection, so they don't
+// hold any. The number of faults injected is reported in
+// PoolStats().FaultsInjected. Faults can be changed at any time, and the zero
+// Faults disables them. This is meant
+// for chaos testing; make sure not to leave faults in production by accident.
+func (db *DB) SetFaults(f Faults) {
+	var next *faults
+	if f.BeforeAcquire > 0 || f.AfterAcquire > 0 || f.ErrorPercent > 0 || f.Exhausted {
+		if f.Err == nil {
+			f.Err = ErrInjectedFault
+		}
+		next = &faults{Faults: f, done: make(chan struct{})}
+	}
+
+	if prev := db.faults.Swap(next); prev != nil {
+		close(prev.done)
+	}
+}
+
+// Faults returns the faults set with SetFaults().
+func (db *DB) Faults() Faults {
+	if f := db.faults.Load(); f != nil {
+		return f.Faults
+	}
+	return Faults{}
+}
+
+// injectFaults applies the faults in effect before taking a connection.
+func (db *DB) injectFaults(ctx context.Context) error {
+	f := db.faults.Load()
+	if f == nil {
+		return nil
+	}
+
+	if f.BeforeAcquire > 0 {
+		atomic.AddUint64(&db.faultsInjected, 1)
+		if err := sleep(ctx, f.BeforeAcquire); err != nil {
+			return err
+		}
+	}
+	if f.ErrorPercent > 0 && rand.Float64()*100 < f.ErrorPercent {
+		atomic.AddUint64(&db.faultsInjected, 1)
+		return f.Err
+	}
+
+	if f.Exhausted {
+		atomic.AddUint64(&db.faultsInjected, 1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-f.done:
+			// Faults changed. Those in effect now apply.
+			return db.injectFaults(ctx)
+		}
+	}
+	return nil
+}
+
+// injectLatency applies the latency in effect after taking a connection.
+func (db *DB) injectLatency(ctx context.Context) error {
+	f := db.faults.Load()
+	if f == nil || f.AfterAcquire <= 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&db.faultsInjected, 1)
+	return sleep(ctx, f.AfterAcquire)
+}
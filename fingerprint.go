@@ -0,0 +1,143 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// listRe matches lists of placeholders, such as those in IN clauses
+	listRe = regexp.MustCompile(`\(\?(?:, \?)*\)`)
+
+	// tuplesRe matches repeated tuples, as in multi-row INSERT statements
+	tuplesRe = regexp.MustCompile(`(\(\?\+?\))(?:, \(\?\+?\))+`)
+)
+
+// Fingerprint normalizes a query, so that queries differing only in literal
+// values share the same fingerprint. String and numeric literals, as well as
+// placeholders, are replaced with "?", lists of them are collapsed to "(?+)",
+// and so are the tuples of multi-row INSERT statements. Comments are removed,
+// whitespace is collapsed and the text is lowercased, except for quoted
+// identifiers.
+func Fingerprint(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+
+	// Tokens are separated by a single space, regardless of the original
+	// whitespace, except around parentheses, commas and dots
+	emit := func(s string) {
+		if b.Len() > 0 {
+			last := b.String()[b.Len()-1]
+			switch {
+			case last == '(' || last == '.':
+			case s == ")" || s == "," || s == ".":
+			case s == "(" && isNameChar(last):
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(s)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+
+		case c == '\'':
+			i = skipString(query, i)
+			emit("?")
+
+		case c == '"' || c == '`' || c == '[':
+			// Quoted identifier, kept as is
+			end := len(query)
+			if j := strings.IndexByte(query[i+1:], closingQuote(c)); j >= 0 {
+				end = i + j + 2
+			}
+			emit(query[i:end])
+			i = end
+
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			i++
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+			emit("?")
+
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			for i < len(query) && (isNameChar(query[i]) || query[i] == '.' ||
+				((query[i] == '+' || query[i] == '-') && (query[i-1] == 'e' || query[i-1] == 'E'))) {
+				i++
+			}
+			emit("?")
+
+		default:
+			j := i + 1
+			switch {
+			case isNameChar(c):
+				for j < len(query) && isNameChar(query[j]) {
+					j++
+				}
+			case isOperator(c):
+				for j < len(query) && isOperator(query[j]) {
+					j++
+				}
+			}
+			emit(strings.ToLower(query[i:j]))
+			i = j
+		}
+	}
+
+	fp := listRe.ReplaceAllString(b.String(), "(?+)")
+	return tuplesRe.ReplaceAllString(fp, "$1")
+}
+
+// skipString returns the position after the string literal starting at i,
+// allowing for both doubled quotes and backslash escapes.
+func skipString(query string, i int) int {
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case '\'':
+			if i+1 < len(query) && query[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+func closingQuote(c byte) byte {
+	if c == '[' {
+		return ']'
+	}
+	return c
+}
+
+func isOperator(c byte) bool {
+	return strings.IndexByte("<>=!|&+-*/%^~:", c) >= 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
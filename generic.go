@@ -0,0 +1,80 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+)
+
+// QueryAll runs a query on q (a DB, Tx, Conn, Cluster or Sharded) and scans all
+// rows into a slice of T. If T is a struct, columns are matched to its fields by
+// their "db" tag, or their lowercase name if not tagged, and an error is
+// returned for columns without a matching field. Otherwise, the query must
+// return a single column. The result set is always closed, so the connection
+// can't be leaked. Queries on a DB may be coalesced; see SetCoalescing().
+func QueryAll[T any](ctx context.Context, q Querier, query string, args ...interface{}) ([]T, error) {
+	if db, ok := q.(*DB); ok && db.Coalescing() {
+		v, err := db.coalesce(ctx, coalesceKey[[]T](query, args), func() (interface{}, error) {
+			return queryAll[T](ctx, q, query, args)
+		})
+		// Callers get a slice of their own, though elements may be shared
+		all, _ := v.([]T)
+		return append([]T(nil), all...), err
+	}
+	return queryAll[T](ctx, q, query, args)
+}
+
+func queryAll[T any](ctx context.Context, q Querier, query string, args []interface{}) ([]T, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []T
+	for rows.Next() {
+		var v T
+		if err := scanInto(rows.Rows, &v); err != nil {
+			return nil, err
+		}
+		all = append(all, v)
+	}
+
+	return all, rows.Err()
+}
+
+// QueryOne is like QueryAll(), but scans only the first row, returning
+// sql.ErrNoRows if there's none.
+func QueryOne[T any](ctx context.Context, q Querier, query string, args ...interface{}) (T, error) {
+	if db, ok := q.(*DB); ok && db.Coalescing() {
+		v, err := db.coalesce(ctx, coalesceKey[T](query, args), func() (interface{}, error) {
+			return queryOne[T](ctx, q, query, args)
+		})
+		one, _ := v.(T)
+		return one, err
+	}
+	return queryOne[T](ctx, q, query, args)
+}
+
+func queryOne[T any](ctx context.Context, q Querier, query string, args []interface{}) (T, error) {
+	var v T
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return v, err
+		}
+		return v, sql.ErrNoRows
+	}
+
+	if err := scanInto(rows.Rows, &v); err != nil {
+		return v, err
+	}
+	return v, rows.Close()
+}
@@ -1,3 +1,3 @@
 module github.com/VividCortex/dbcontrol
 
-go 1.12
+go 1.23
@@ -0,0 +1,160 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// HealthState is the health of a DB, as determined by the health checker. See
+// SetHealthCheck().
+type HealthState int32
+
+const (
+	// HealthUp means that probes succeed in a timely fashion. This is also
+	// the state of DBs without health checks.
+	HealthUp HealthState = iota
+
+	// HealthDegraded means that probes are slow, or have failed recently, but
+	// not enough times in a row to consider the DB down.
+	HealthDegraded
+
+	// HealthDown means that probes have failed repeatedly.
+	HealthDown
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthUp:
+		return "up"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+// HealthSettings configures the health checker. See SetHealthCheck().
+type HealthSettings struct {
+	Interval time.Duration // Time between probes (zero to disable)
+	Timeout  time.Duration // Time to wait for a probe (defaults to Interval)
+	Query    string        // Probe query (empty to ping)
+	Slow     time.Duration // Probe latency above which the DB is degraded (zero to disable)
+	Failures int           // Failures in a row to consider the DB down (defaults to 3)
+}
+
+// SetHealthCheck starts a background health checker for the DB. The database
+// is probed at the given interval, either pinging it or running the probe
+// query, on connections that don't count against the connection limit, so that
+// checks work even if the DB is saturated. The resulting state is available
+// through Health(), and a HealthEvent is sent each time it changes. Passing
+// zero settings (the default) stops the checker, and the DB is reported up
+// from then on.
+func (db *DB) SetHealthCheck(settings HealthSettings) {
+	db.healthMux.Lock()
+	defer db.healthMux.Unlock()
+
+	if db.healthStop != nil {
+		close(db.healthStop)
+		db.healthStop = nil
+	}
+
+	if settings.Interval <= 0 {
+		db.healthSettings = HealthSettings{}
+		atomic.StoreInt32((*int32)(&db.health), int32(HealthUp))
+		return
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = settings.Interval
+	}
+	if settings.Failures <= 0 {
+		settings.Failures = 3
+	}
+
+	db.healthSettings = settings
+	db.healthStop = make(chan struct{})
+	go db.checkHealth(settings, db.healthStop)
+}
+
+// Health returns the health of the DB. See SetHealthCheck().
+func (db *DB) Health() HealthState {
+	return HealthState(atomic.LoadInt32((*int32)(&db.health)))
+}
+
+func (db *DB) checkHealth(settings HealthSettings, stop <-chan struct{}) {
+	ticker := time.NewTicker(settings.Interval)
+	defer ticker.Stop()
+	failed := 0
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-db.done:
+			return
+		}
+
+		latency, err := db.probe(settings)
+
+		state := HealthUp
+		switch {
+		case err != nil:
+			if failed++; failed >= settings.Failures {
+				state = HealthDown
+			} else {
+				state = HealthDegraded
+			}
+		case settings.Slow > 0 && latency > settings.Slow:
+			failed = 0
+			state = HealthDegraded
+		default:
+			failed = 0
+		}
+
+		// Don't report a change if the checker was stopped meanwhile
+		db.healthMux.Lock()
+		select {
+		case <-stop:
+			db.healthMux.Unlock()
+			return
+		default:
+		}
+		old := HealthState(atomic.SwapInt32((*int32)(&db.health), int32(state)))
+		db.healthMux.Unlock()
+
+		if state != old {
+			db.emit(HealthEvent{
+				Time:    time.Now(),
+				State:   state,
+				Latency: latency,
+				Cause:   redactError(err),
+			})
+		}
+	}
+}
+
+// probe checks the database bypassing the connection limit, returning the time
+// it took.
+func (db *DB) probe(settings HealthSettings) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	start := db.now()
+	var err error
+	if settings.Query != "" {
+		var rows *sql.Rows
+		rows, err = db.pool().QueryContext(ctx, settings.Query)
+		if err == nil {
+			err = rows.Close()
+		}
+	} else {
+		err = db.pool().PingContext(ctx)
+	}
+
+	return db.since(start), err
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"time"
+)
+
+// HedgeSettings configures hedged reads. See Cluster.SetHedging().
+type HedgeSettings struct {
+	Percentile float64       // Latency percentile to wait for before hedging, e.g., 95
+	MinDelay   time.Duration // Lower bound for the delay
+}
+
+// SetHedging enables hedged reads on the cluster. Read-only queries still go
+// to a single replica at first, but if no response is received within the
+// given percentile of replica latencies observed so far (or MinDelay, if
+// longer), the same query is sent to a second replica. The first successful
+// response is taken, and the other request is canceled. Each request takes a
+// connection from its own replica, so both are accounted for in the
+// corresponding limits until the loser is canceled. Hedging requires at least
+// two replicas, and is disabled by setting a zero Percentile (the default).
+// Note that hedged queries are run twice, so they should be free of side
+// effects.
+func (c *Cluster) SetHedging(settings HedgeSettings) {
+	c.balancerMux.Lock()
+	defer c.balancerMux.Unlock()
+	c.hedging = settings
+}
+
+func (c *Cluster) getHedging() HedgeSettings {
+	c.balancerMux.RLock()
+	defer c.balancerMux.RUnlock()
+	return c.hedging
+}
+
+// hedgeDelay returns the time to wait for a response before hedging.
+func (c *Cluster) hedgeDelay(settings HedgeSettings) time.Duration {
+	d := c.latency.snapshot().Percentile(settings.Percentile)
+	if d < settings.MinDelay {
+		d = settings.MinDelay
+	}
+	return d
+}
+
+type hedgeResult struct {
+	i     int // Index of the request
+	value interface{}
+	err   error
+}
+
+// hedge calls run on one replica and, if it takes too long, on a second one,
+// returning the first successful result together with the function to cancel
+// its context once done with it. Any other result is passed to discard, if not
+// nil, so that its connection is released.
+func (c *Cluster) hedge(ctx context.Context, settings HedgeSettings,
+	run func(context.Context, *DB) (interface{}, error), discard func(interface{})) (interface{}, context.CancelFunc, error) {
+
+	b := c.getBalancer()
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+
+	launch := func(replica *DB) {
+		rctx, cancel := context.WithCancel(ctx)
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			v, err := run(rctx, replica)
+			elapsed := time.Since(start)
+			b.Observe(replica, elapsed, err)
+			if err == nil {
+				c.latency.observe(elapsed)
+			}
+			results <- hedgeResult{i: i, value: v, err: err}
+		}()
+	}
+
+	lose := func(res hedgeResult) {
+		cancels[res.i]()
+		if res.value != nil {
+			discard(res.value)
+		}
+	}
+
+	first := b.Pick(c.replicas)
+	launch(first)
+
+	timer := time.NewTimer(c.hedgeDelay(settings))
+	defer timer.Stop()
+
+	for received := 0; ; {
+		select {
+		case <-timer.C:
+			others := make([]*DB, 0, len(c.replicas)-1)
+			for _, r := range c.replicas {
+				if r != first {
+					others = append(others, r)
+				}
+			}
+			launch(b.Pick(others))
+
+		case res := <-results:
+			received++
+
+			if res.err == nil {
+				if received < len(cancels) {
+					// Cancel the loser and release its connection when done
+					cancels[1-res.i]()
+					go func() { lose(<-results) }()
+				}
+				return res.value, cancels[res.i], nil
+			}
+
+			lose(res)
+
+			// Failures are not hedged, since the DB already retries them
+			// if transient. But if a hedge is running, we wait for it.
+			if received == len(cancels) {
+				return nil, nil, res.err
+			}
+		}
+	}
+}
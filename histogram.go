@@ -0,0 +1,108 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// histogramBounds are the upper bounds of histogram buckets, doubling from 50µs
+// up to about 105s. Durations above the last bound go to an overflow bucket.
+var histogramBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 22)
+	d := 50 * time.Microsecond
+	for i := range bounds {
+		bounds[i] = d
+		d *= 2
+	}
+	return bounds
+}()
+
+// histogram accumulates durations into exponential buckets. It's safe for
+// concurrent use, and cheap to update. Histograms should be allocated on their
+// own (rather than embedded), to guarantee the alignment of their counters.
+type histogram struct {
+	counts [23]uint64 // Accessed atomically; last one for overflow
+	sum    int64      // Accessed atomically
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: histogramBounds,
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+
+	return s
+}
+
+// Histogram is a snapshot of a distribution of durations. Counts[i] holds the
+// number of durations up to Bounds[i] (and above Bounds[i-1]), with an extra
+// count at the end for durations above the last bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64        // Total number of durations
+	Sum    time.Duration // Sum of all durations
+}
+
+// Mean returns the average duration, or zero if the histogram is empty.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns an estimate of the duration below which the given
+// percentage of durations fall (e.g., 99 for the 99th percentile). The upper
+// bound of the bucket holding the percentile is returned, so the estimate is
+// never below the actual value. Durations in the overflow bucket are reported
+// as twice the last bound.
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(p / 100 * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank {
+			if i < len(h.Bounds) {
+				return h.Bounds[i]
+			}
+			break
+		}
+	}
+
+	return 2 * h.Bounds[len(h.Bounds)-1]
+}
+
+// P50 is a shorthand for Percentile(50).
+func (h Histogram) P50() time.Duration { return h.Percentile(50) }
+
+// P95 is a shorthand for Percentile(95).
+func (h Histogram) P95() time.Duration { return h.Percentile(95) }
+
+// P99 is a shorthand for Percentile(99).
+func (h Histogram) P99() time.Duration { return h.Percentile(99) }
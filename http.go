@@ -0,0 +1,137 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type requestTxKey struct{}
+
+// requestTx is a transaction begun lazily on behalf of an HTTP request.
+type requestTx struct {
+	mu  sync.Mutex
+	db  *DB
+	ctx context.Context
+	tx  *Tx
+	err error
+}
+
+func (rt *requestTx) get() (*Tx, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.tx == nil && rt.err == nil {
+		rt.tx, rt.err = rt.db.BeginTx(rt.ctx, nil)
+	}
+
+	return rt.tx, rt.err
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends buffered data to the client, if the underlying writer supports
+// it, so that streaming responses work through TxMiddleware().
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it, as
+// for WebSocket upgrades. Status codes written afterwards aren't seen, so the
+// transaction is committed.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TxMiddleware wraps an HTTP handler so that each request gets its own
+// transaction, available to the handler through TxFromContext(). The
+// transaction is begun lazily, the first time it's requested, so that requests
+// not touching the database don't take a connection. Once the handler returns,
+// the transaction is committed if the response status is below 400, and rolled
+// back otherwise. It's also rolled back if the handler panics, in which case
+// the panic is propagated after rolling back. Errors from Commit() can't be
+// reported to the client at that point, given that the response has already
+// been written; handlers needing that should commit explicitly. The
+// transaction is begun with the request path as the "route" tag (see
+// WithTag()), so that events on it, such as TxTimeoutEvent, tell which route
+// it belongs to. The response writer given to the handler supports flushing,
+// hijacking and http.ResponseController if the original one does.
+func (db *DB) TxMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := &requestTx{db: db, ctx: WithTag(r.Context(), "route", r.URL.Path)}
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+
+			if rt.tx == nil {
+				return
+			}
+
+			if p := recover(); p != nil {
+				rt.tx.Rollback()
+				panic(p)
+			}
+
+			if rec.status < http.StatusBadRequest {
+				rt.tx.Commit()
+			} else {
+				rt.tx.Rollback()
+			}
+		}()
+
+		ctx := context.WithValue(r.Context(), requestTxKey{}, rt)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+	})
+}
+
+// TxFromContext returns the transaction for the HTTP request whose context is
+// provided, beginning it if this is the first call for the request. It returns
+// ErrNoRequestTx if the request is not being served through TxMiddleware().
+func TxFromContext(ctx context.Context) (*Tx, error) {
+	rt, ok := ctx.Value(requestTxKey{}).(*requestTx)
+	if !ok {
+		return nil, ErrNoRequestTx
+	}
+	return rt.get()
+}
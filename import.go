@@ -0,0 +1,190 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ImportOptions configures Import() and friends.
+type ImportOptions struct {
+	Workers         int  // Chunks loaded in parallel (zero for the connection limit)
+	ChunkSize       int  // Rows per chunk (zero for the default of BulkInsert())
+	ContinueOnError bool // Whether to keep loading chunks after one fails
+}
+
+// Import loads the rows supplied by src into table, splitting them into chunks
+// that are inserted in parallel by several workers, each with BulkInsert().
+// The number of workers defaults to the connection limit of the DB (or the
+// number of CPUs if not limiting), so that the import can't take more than the
+// connections available; note that workers compete for them with other users
+// of the DB. An ImportEvent is sent after each chunk (see SetEventCh()). Unless
+// opts.ContinueOnError is set, the import stops at the first error. Import
+// returns the number of rows inserted, and the first error found, if any.
+func (db *DB) Import(ctx context.Context, table string, columns []string, src RowSource, opts ImportOptions) (int64, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		if db.sem != nil {
+			workers = db.sem.limit()
+		} else {
+			workers = runtime.NumCPU()
+		}
+	}
+	size := opts.ChunkSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type chunk struct {
+		n    int
+		rows [][]interface{}
+	}
+	chunks := make(chan chunk)
+
+	var (
+		total    int64
+		firstErr error
+		mux      sync.Mutex
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mux.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mux.Unlock()
+		if !opts.ContinueOnError {
+			cancel()
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				start := time.Now()
+				n, err := db.BulkInsert(ctx, table, columns, SliceSource(c.rows),
+					BulkOptions{BatchSize: len(c.rows)})
+
+				mux.Lock()
+				total += n
+				mux.Unlock()
+
+				db.emit(ImportEvent{
+					Time:     time.Now(),
+					Table:    table,
+					Chunk:    c.n,
+					Rows:     len(c.rows),
+					Duration: time.Since(start),
+					Cause:    redactError(err),
+				})
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	for n := 1; ; n++ {
+		rows, err := readChunk(src, size)
+		if err != nil {
+			fail(err)
+			break
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		select {
+		case chunks <- chunk{n: n, rows: rows}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	close(chunks)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return total, firstErr
+}
+
+// readChunk reads up to size rows from src.
+func readChunk(src RowSource, size int) ([][]interface{}, error) {
+	var rows [][]interface{}
+	for len(rows) < size {
+		row, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ImportCSV is like Import(), but rows are read from CSV data. The first record
+// must hold the names of the columns. Values are inserted as strings.
+func (db *DB) ImportCSV(ctx context.Context, table string, r io.Reader, opts ImportOptions) (int64, error) {
+	cr := csv.NewReader(r)
+	columns, err := cr.Read()
+	if err != nil {
+		return 0, err
+	}
+	return db.Import(ctx, table, columns, csvSource{cr}, opts)
+}
+
+type csvSource struct {
+	r *csv.Reader
+}
+
+func (s csvSource) Next() ([]interface{}, error) {
+	record, err := s.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	row := make([]interface{}, len(record))
+	for i, v := range record {
+		row[i] = v
+	}
+	return row, nil
+}
+
+// ImportChan is like Import(), but rows are received from a channel until it's
+// closed.
+func (db *DB) ImportChan(ctx context.Context, table string, columns []string, rows <-chan []interface{}, opts ImportOptions) (int64, error) {
+	return db.Import(ctx, table, columns, chanSource{ctx, rows}, opts)
+}
+
+type chanSource struct {
+	ctx  context.Context
+	rows <-chan []interface{}
+}
+
+func (s chanSource) Next() ([]interface{}, error) {
+	select {
+	case row, ok := <-s.rows:
+		if !ok {
+			return nil, io.EOF
+		}
+		return row, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"iter"
+)
+
+// All returns an iterator over the rows of the result set, to be used with a
+// range loop. The rows are closed (thus releasing the connection) when the loop
+// ends, even if early (due to break, return or a panic). Each iteration yields
+// the Rows themselves, ready to Scan() the current row. If iteration fails, a
+// final iteration yields a nil Rows and the error, e.g.:
+//
+//	for row, err := range rows.All() {
+//		if err != nil {
+//			return err
+//		}
+//		if err := row.Scan(&id); err != nil {
+//			return err
+//		}
+//	}
+func (rows *Rows) All() iter.Seq2[*Rows, error] {
+	return func(yield func(*Rows, error) bool) {
+		defer rows.Close()
+
+		for rows.Next() {
+			if !yield(rows, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Iter returns an iterator over the rows of the result set, scanning each one
+// into a T, as QueryAll() does. Rows are closed when the loop ends, as with
+// Rows.All(). If scanning or iteration fails, a final iteration yields the
+// error.
+func Iter[T any](rows *Rows) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for row, err := range rows.All() {
+			var v T
+			if err == nil {
+				err = scanInto(row.Rows, &v)
+			}
+			if !yield(v, err) || err != nil {
+				return
+			}
+		}
+	}
+}
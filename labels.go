@@ -0,0 +1,49 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// profileLabels holds the settings made with SetProfileLabels().
+type profileLabels struct {
+	name string
+}
+
+// SetProfileLabels makes statements run directly on the DB apply pprof labels
+// to the calling goroutine while they hold a connection, so that CPU and
+// goroutine profiles taken during incidents show which queries are
+// responsible. Labels are "dbcontrol.query", holding the fingerprint of the
+// query (see Fingerprint()), and "dbcontrol.db", holding name, if not empty.
+// Labels are added to those set on the context of the statement (see
+// pprof.Do()), which are restored once the statement returns. For queries,
+// that is before rows are read, since they may be read from another goroutine.
+// Labeling costs a fingerprint per statement, so it's disabled by default.
+func (db *DB) SetProfileLabels(enabled bool, name string) {
+	if !enabled {
+		db.profileLabels.Store(nil)
+		return
+	}
+	db.profileLabels.Store(&profileLabels{name: name})
+}
+
+// label applies profile labels for query to the calling goroutine, if
+// enabled, returning a function to restore those of ctx.
+func (db *DB) label(ctx context.Context, query string) func() {
+	p := db.profileLabels.Load()
+	if p == nil {
+		return func() {}
+	}
+
+	labels := []string{"dbcontrol.query", Fingerprint(query)}
+	if p.name != "" {
+		labels = append(labels, "dbcontrol.db", p.name)
+	}
+
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(labels...)))
+	return func() {
+		pprof.SetGoroutineLabels(ctx)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Lease is a connection from the limit taken by hand, so that several
+// statements making up one logical operation are charged a single connection,
+// and don't wait for one each. Statements run on the Lease itself don't take
+// connections from the limit, though they take them from the pool as usual,
+// so they should run one at a time. Unlike Conn, statements may run on
+// different connections of the pool, so a Lease is cheaper to hold, but not
+// fit for session-scoped work. A Lease must be released once done.
+type Lease struct {
+	db       *DB
+	acquired time.Time
+	tags     map[string]string
+	weight   int // Set with WithWeight(), if any
+
+	mu       sync.Mutex
+	wait     time.Duration
+	deadline time.Time // Of the usage timeout, by the DB clock; zero if none
+	release  func()
+	released time.Time // Zero until released
+	yielding bool      // Whether waiting in Yield() for a new connection
+}
+
+// Acquire takes a connection from the limit, waiting for one as usual, and
+// returns a Lease holding it until released.
+func (db *DB) Acquire(ctx context.Context) (*Lease, error) {
+	release, wait, usageTimeout, err := db.grant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Lease{
+		db:       db,
+		acquired: time.Now(),
+		wait:     wait,
+		tags:     TagsFromContext(ctx),
+		release:  release,
+	}
+	l.weight, _ = WeightFromContext(ctx)
+	l.setDeadline(usageTimeout)
+	return l, nil
+}
+
+// setDeadline sets the deadline for the usage timeout of a grant made just
+// now. Must be called with l.mu held, if shared.
+func (l *Lease) setDeadline(usageTimeout time.Duration) {
+	l.deadline = time.Time{}
+	if usageTimeout != 0 {
+		l.deadline = l.db.now().Add(usageTimeout)
+	}
+}
+
+// Yield gives back the connection and queues right away for another one, as
+// any other caller, so that long jobs holding a Lease let others through
+// between chunks of work on a saturated pool. The new connection is taken with
+// the weight and tags of the Lease, and its own usage timeout (see
+// Remaining()). If none can be taken before ctx is done, the Lease is left
+// released and the error is returned. Statements on the Lease must not be
+// running meanwhile, but Release() may be called while waiting (e.g., on
+// shutdown), in which case the new connection is given back as soon as taken,
+// and ErrLeaseReleased is returned.
+func (l *Lease) Yield(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.released.IsZero() {
+		l.mu.Unlock()
+		return ErrLeaseReleased
+	}
+	if l.yielding {
+		l.mu.Unlock()
+		return errors.New("dbcontrol: Yield() called while already yielding")
+	}
+	l.release()
+	l.release, l.deadline, l.yielding = func() {}, time.Time{}, true
+	l.mu.Unlock()
+
+	if l.weight != 0 {
+		ctx = WithWeight(ctx, l.weight)
+	}
+	current := TagsFromContext(ctx)
+	for key, value := range l.tags {
+		if _, ok := current[key]; !ok {
+			ctx = WithTag(ctx, key, value)
+		}
+	}
+
+	// Not holding l.mu, so that the Lease can be inspected or released
+	// while waiting
+	release, wait, usageTimeout, err := l.db.grant(ctx)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.yielding = false
+	if err != nil {
+		if l.released.IsZero() {
+			l.released = time.Now()
+		}
+		return err
+	}
+	if !l.released.IsZero() {
+		release()
+		return ErrLeaseReleased
+	}
+
+	l.release = release
+	l.wait += wait
+	l.setDeadline(usageTimeout)
+	return nil
+}
+
+// Release gives back the connection. Further statements on the Lease fail
+// with ErrLeaseReleased. It's safe to call Release() more than once.
+func (l *Lease) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.released.IsZero() {
+		l.release()
+		l.released = time.Now()
+	}
+}
+
+// HeldFor returns the time the Lease has been held, or was held if already
+// released.
+func (l *Lease) HeldFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.released.IsZero() {
+		return time.Since(l.acquired)
+	}
+	return l.released.Sub(l.acquired)
+}
+
+// Remaining returns the time left before the usage timeout the Lease was
+// granted with expires (see SetUsageTimeout()), so that long operations can
+// checkpoint or stop cleanly before it's reported. It's zero once expired, and
+// it returns false if no usage timeout applied when the Lease was taken.
+func (l *Lease) Remaining() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.deadline.IsZero() {
+		return 0, false
+	}
+	left := l.deadline.Sub(l.db.now())
+	if left < 0 {
+		left = 0
+	}
+	return left, true
+}
+
+// Acquired returns the time the Lease was taken.
+func (l *Lease) Acquired() time.Time {
+	return l.acquired
+}
+
+// Wait returns the time waited for the connection, including the time waited
+// again in Yield().
+func (l *Lease) Wait() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wait
+}
+
+// Tags returns the tags on the context the Lease was taken with (see
+// WithTag()).
+func (l *Lease) Tags() map[string]string {
+	return l.tags
+}
+
+// Released tells whether the Lease was released.
+func (l *Lease) Released() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.released.IsZero()
+}
+
+// check returns the error for statements about to run on the Lease, if any.
+func (l *Lease) check(ctx context.Context, query string) error {
+	if l.Released() {
+		return ErrLeaseReleased
+	}
+	return l.db.checkPolicy(ctx, query)
+}
+
+func (l *Lease) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return l.ExecContext(context.Background(), query, args...)
+}
+
+func (l *Lease) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := l.check(ctx, query); err != nil {
+		return nil, err
+	}
+
+	res, err := l.db.exec(ctx, query, args)
+	return res, l.db.check(err)
+}
+
+func (l *Lease) Query(query string, args ...interface{}) (*Rows, error) {
+	return l.QueryContext(context.Background(), query, args...)
+}
+
+func (l *Lease) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	if err := l.check(ctx, query); err != nil {
+		return nil, err
+	}
+
+	rows, err := l.db.query(ctx, query, args)
+	if err = l.db.check(err); err != nil {
+		return nil, err
+	}
+
+	// The connection is held by the Lease, not by the rows
+	return l.db.newRows(ctx, rows, func() {}), nil
+}
+
+func (l *Lease) QueryRow(query string, args ...interface{}) *Row {
+	return l.QueryRowContext(context.Background(), query, args...)
+}
+
+func (l *Lease) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	if err := l.check(ctx, query); err != nil {
+		return &Row{err: err, closed: true}
+	}
+
+	rows, err := l.db.query(ctx, query, args)
+	return newRow(l.db, rows, err, func() {})
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+// TestLeaseYieldRelease checks that a Lease can be inspected and released while
+// waiting in Yield().
+func TestLeaseYieldRelease(t *testing.T) {
+	prev := dbcontrol.Concurrency()
+	dbcontrol.SetConcurrency(1)
+	defer dbcontrol.SetConcurrency(prev)
+
+	f := dbcontroltest.New()
+	defer f.Close()
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	l, err := db.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction queues behind the Lease, and takes the connection once
+	// the Lease yields
+	txCh := make(chan *dbcontrol.Tx, 1)
+	go func() {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		txCh <- tx
+	}()
+	waitUntil(t, func() bool { return db.PoolStats().Waiting == 1 })
+
+	yielded := make(chan error, 1)
+	go func() {
+		yielded <- l.Yield(ctx)
+	}()
+	tx := <-txCh
+	waitUntil(t, func() bool { return db.PoolStats().Waiting == 1 })
+
+	done := make(chan struct{})
+	go func() {
+		l.Remaining()
+		l.Release()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lease blocked while yielding")
+	}
+
+	// The connection taken by Yield() is given back
+	tx.Rollback()
+	if err := <-yielded; err != dbcontrol.ErrLeaseReleased {
+		t.Fatalf("Yield() returned %v, want ErrLeaseReleased", err)
+	}
+	if n := db.PoolStats().InUse; n != 0 {
+		t.Fatalf("%d connections in use, want 0", n)
+	}
+}
+
+// waitUntil waits until cond holds, failing the test if it takes too long.
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
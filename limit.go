@@ -3,7 +3,11 @@
 package dbcontrol
 
 import (
+	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -32,3 +36,136 @@ func Concurrency() int {
 	defer concurrencyMux.RUnlock()
 	return concurrency
 }
+
+var (
+	hostGrouping    bool
+	hostGroupingMux sync.RWMutex
+	hostGroups      = make(map[string]*hostLimit)
+)
+
+// hostLimit is the connection limit shared by the DBs on a host, along with its
+// auto-shrinking state, so that DBs don't undo each other's changes.
+type hostLimit struct {
+	sem    *semaphore
+	shrink *shrinkState
+}
+
+// SetHostGrouping enables or disables sharing of connection limits among
+// databases that point to the same server. When enabled, all DBs opened
+// afterwards whose DSN resolves to the same host:port will draw connections
+// from a common pool, sized after the concurrency setting at the time the first
+// DB for that host was opened. DBs whose host can't be determined from the DSN
+// get their own independent limit, as usual. As with SetConcurrency(), this setting
+// has no effect on already-opened databases.
+func SetHostGrouping(enabled bool) {
+	hostGroupingMux.Lock()
+	defer hostGroupingMux.Unlock()
+	hostGrouping = enabled
+}
+
+// HostGrouping returns the host grouping setting. See SetHostGrouping().
+func HostGrouping() bool {
+	hostGroupingMux.RLock()
+	defer hostGroupingMux.RUnlock()
+	return hostGrouping
+}
+
+// hostLimitFor returns the limit shared by all DBs connected to host, making it
+// with count tokens if this is the first DB for that host.
+func hostLimitFor(host string, count int) *hostLimit {
+	hostGroupingMux.Lock()
+	defer hostGroupingMux.Unlock()
+
+	l, ok := hostGroups[host]
+	if !ok {
+		l = &hostLimit{sem: newSemaphore(count), shrink: newShrinkState()}
+		hostGroups[host] = l
+	}
+
+	return l
+}
+
+// dsnHost extracts the host:port a DSN points to. Postgres key/value DSNs
+// ("host=x port=y"), URL-style DSNs (as used by Postgres and others) and
+// MySQL-style DSNs ("user:pass@tcp(host:port)/db") are recognized, in that
+// order, so that passwords including "@" don't get in the way. An empty
+// string is returned if the host can't be determined.
+func dsnHost(dsn string) string {
+	if host, port := dsnKeyValues(dsn); host != "" {
+		if port != "" {
+			return strings.ToLower(net.JoinHostPort(host, port))
+		}
+		return strings.ToLower(host)
+	}
+
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return ""
+		}
+		return strings.ToLower(u.Host)
+	}
+
+	if i := strings.LastIndex(dsn, "@"); i >= 0 {
+		addr := dsn[i+1:]
+		open, end := strings.Index(addr, "("), strings.Index(addr, ")")
+		if open < 0 || end < open {
+			return ""
+		}
+		return strings.ToLower(addr[open+1 : end])
+	}
+	return ""
+}
+
+// dsnKeyValues returns the host and port of a key/value DSN, which are empty
+// if not set (or if dsn is not a key/value DSN).
+func dsnKeyValues(dsn string) (host, port string) {
+	for _, field := range strings.Fields(dsn) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "host":
+			host = strings.Trim(kv[1], "'")
+		case "port":
+			port = strings.Trim(kv[1], "'")
+		}
+	}
+	return host, port
+}
+
+// updateLimit sets the number of tokens to the target limit, minus those taken
+// by auto-shrinking, returning the change to notify, if any. Must be called
+// with db.limitMux held.
+func (db *DB) updateLimit(cause error) *LimitChangeEvent {
+	n := db.target - db.shrinking.taken()
+	if n < 1 {
+		n = 1
+	}
+	return db.setLimit(n, cause)
+}
+
+// setLimit changes the number of tokens, returning the change to notify, if
+// any. It's notified with notifyLimit() once db.limitMux is released, so that
+// subscribers don't hold up further changes. Must be called with db.limitMux
+// held.
+func (db *DB) setLimit(n int, cause error) *LimitChangeEvent {
+	old := db.limit
+	if n == old {
+		return nil
+	}
+
+	db.limit = n
+	db.sem.resize(n)
+	db.pool().SetMaxIdleConns(n)
+	return &LimitChangeEvent{Time: time.Now(), Old: old, New: n, Cause: redactError(cause)}
+}
+
+// notifyLimit sends the change returned by setLimit(), if any.
+func (db *DB) notifyLimit(e *LimitChangeEvent) {
+	if e != nil {
+		db.emit(*e)
+	}
+}
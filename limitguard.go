@@ -0,0 +1,130 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type limitGuardKey struct{}
+
+// WithLimitGuard returns a context that makes queries run with it use the
+// given limit guard, instead of the one set with SetLimitGuard(). A zero limit
+// lifts the guard for those queries, which is the way to run the few that are
+// meant to be unbounded.
+func WithLimitGuard(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, limitGuardKey{}, limit)
+}
+
+// SetLimitGuard makes the DB append a LIMIT clause to SELECT statements that
+// lack one, protecting against accidentally unbounded result sets. Unlike
+// SetRowLimit(), which stops reading rows on the client side, this keeps the
+// database from producing them in the first place, although it can't tell
+// callers that rows were left out. Statements with a top-level LIMIT, OFFSET,
+// FETCH, FOR, LOCK or INTO clause are left alone, since a LIMIT can't simply be
+// appended to them, as well as those not starting with SELECT, such as those
+// with common table expressions. The guard is not applied on SQL Server, which
+// doesn't support LIMIT. The number of statements limited is reported in
+// PoolStats().LimitGuarded. A zero limit (the default) disables the guard.
+func (db *DB) SetLimitGuard(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	atomic.StoreInt64(&db.limitGuard, int64(limit))
+}
+
+// LimitGuard returns the limit set with SetLimitGuard().
+func (db *DB) LimitGuard() int {
+	return int(atomic.LoadInt64(&db.limitGuard))
+}
+
+// guardLimit returns query with the limit guard for ctx applied, if needed.
+func (db *DB) guardLimit(ctx context.Context, query string) string {
+	limit, ok := ctx.Value(limitGuardKey{}).(int)
+	if !ok {
+		limit = db.LimitGuard()
+	}
+	if limit <= 0 || db.Dialect() == SQLServerDialect || !unlimited(query) {
+		return query
+	}
+
+	atomic.AddUint64(&db.limitGuarded, 1)
+	return appendLimit(query, limit)
+}
+
+// limitingWords are those that keep a LIMIT from being appended when found at
+// the top level of a SELECT statement.
+var limitingWords = map[string]bool{
+	"limit":  true,
+	"offset": true,
+	"fetch":  true,
+	"for":    true,
+	"lock":   true,
+	"into":   true,
+}
+
+// unlimited tells whether query is a SELECT statement with no limiting clause
+// at the top level, and thus in need of a guard.
+func unlimited(query string) bool {
+	// Fingerprints are free from comments and literals, which could
+	// otherwise be mistaken for keywords
+	fp := Fingerprint(query)
+	depth, first := 0, true
+
+	for i := 0; i < len(fp); {
+		c := fp[i]
+		switch {
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == '"' || c == '`' || c == '[':
+			end := strings.IndexByte(fp[i+1:], closingQuote(c))
+			if end < 0 {
+				return false
+			}
+			i += end + 2
+		case isNameChar(c):
+			j := i + 1
+			for j < len(fp) && isNameChar(fp[j]) {
+				j++
+			}
+			word := fp[i:j]
+			if first && word != "select" {
+				return false
+			}
+			if depth == 0 && limitingWords[word] {
+				return false
+			}
+			first = false
+			i = j
+		default:
+			i++
+		}
+	}
+	return !first
+}
+
+// appendLimit appends a LIMIT clause to query, before any trailing semicolon.
+func appendLimit(query string, limit int) string {
+	query = strings.TrimRight(query, " \t\r\n")
+	semicolon := strings.HasSuffix(query, ";")
+	query = strings.TrimSuffix(query, ";")
+
+	// A trailing line comment would swallow the clause
+	sep := " "
+	if strings.Contains(query, "--") {
+		sep = "\n"
+	}
+
+	query += sep + "LIMIT " + strconv.Itoa(limit)
+	if semicolon {
+		query += ";"
+	}
+	return query
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Logger receives log entries about noteworthy conditions found by the DB,
+// such as leaks, failovers, circuit breaker changes or idle connections being
+// reaped. Entries carry a level, a message and alternating key/value pairs, as
+// with slog. Events (see SetEventCh()) are logged with the key "event", whose
+// value implements encoding.TextMarshaler and json.Marshaler. See SetLogger().
+type Logger interface {
+	Log(level slog.Level, msg string, args ...interface{})
+}
+
+// LoggerFunc adapts an ordinary function to the Logger interface. This is the
+// easiest way to plug in loggers other than slog, such as zap's SugaredLogger.
+type LoggerFunc func(level slog.Level, msg string, args ...interface{})
+
+func (f LoggerFunc) Log(level slog.Level, msg string, args ...interface{}) {
+	f(level, msg, args...)
+}
+
+// SlogLogger returns a Logger writing to l.
+func SlogLogger(l *slog.Logger) Logger {
+	return LoggerFunc(func(level slog.Level, msg string, args ...interface{}) {
+		l.Log(context.Background(), level, msg, args...)
+	})
+}
+
+// StdLogger returns a Logger writing to l, a logger from the standard log
+// package, with entries formatted as the level, the message and the key/value
+// pairs, e.g., "WARN dbcontrol: stmt_leak event=...". Values are written in
+// their text encoding, if available. Entries below minLevel are discarded.
+func StdLogger(l *log.Logger, minLevel slog.Level) Logger {
+	return LoggerFunc(func(level slog.Level, msg string, args ...interface{}) {
+		if level < minLevel {
+			return
+		}
+
+		var b strings.Builder
+		b.WriteString(level.String())
+		b.WriteByte(' ')
+		b.WriteString(msg)
+		for i := 0; i+1 < len(args); i += 2 {
+			v := args[i+1]
+			if m, ok := v.(encoding.TextMarshaler); ok {
+				if text, err := m.MarshalText(); err == nil {
+					v = string(text)
+				}
+			}
+			fmt.Fprintf(&b, " %v=%v", args[i], v)
+		}
+		l.Print(b.String())
+	})
+}
+
+// SetLogger sets the logger for the DB. No logging takes place by default.
+// Events are logged whether or not an event channel is set, each with the
+// level that suits it (e.g., slow queries and leaks are warnings, whereas
+// digest reports are for debugging).
+func (db *DB) SetLogger(l Logger) {
+	db.loggerMux.Lock()
+	defer db.loggerMux.Unlock()
+	db.logger = l
+}
+
+func (db *DB) getLogger() Logger {
+	db.loggerMux.RLock()
+	defer db.loggerMux.RUnlock()
+	return db.logger
+}
+
+// log logs an entry, if a logger is set.
+func (db *DB) log(level slog.Level, msg string, args ...interface{}) {
+	if l := db.getLogger(); l != nil {
+		l.Log(level, msg, args...)
+	}
+}
+
+// logEvent logs an event, if a logger is set.
+func (db *DB) logEvent(e Event) {
+	l := db.getLogger()
+	if l == nil {
+		return
+	}
+
+	level, name := slog.LevelWarn, ""
+	switch e := e.(type) {
+	case SoftLimitEvent:
+		name = "soft_limit"
+	case LimitChangeEvent:
+		name = "limit_change"
+		if e.New > e.Old {
+			level = slog.LevelInfo
+		}
+	case BreakerEvent:
+		name = "breaker"
+		if e.State != BreakerOpen {
+			level = slog.LevelInfo
+		}
+	case TxTimeoutEvent:
+		name = "tx_timeout"
+	case FailoverEvent:
+		name = "failover"
+	case HealthEvent:
+		name = "health"
+		if e.State == HealthUp {
+			level = slog.LevelInfo
+		}
+	case StmtLeakEvent:
+		name = "stmt_leak"
+	case ImportEvent:
+		name = "import"
+		if e.Cause == nil {
+			level = slog.LevelDebug
+		}
+	case DigestEvent:
+		name, level = "digest", slog.LevelDebug
+	case SlowQueryEvent:
+		name = "slow_query"
+	case PolicyEvent:
+		name = "policy"
+	case DryRunEvent:
+		name, level = "dry_run", slog.LevelInfo
+	case DualWriteEvent:
+		name = "dual_write"
+		if e.Cause == nil && !e.Dropped && e.Rows == e.SecondaryRows {
+			level = slog.LevelInfo
+		}
+	case MirrorEvent:
+		name = "mirror"
+		if !e.Mismatch && e.Cause == nil {
+			level = slog.LevelDebug
+		}
+	default:
+		name = fmt.Sprintf("%T", e)
+	}
+
+	l.Log(level, "dbcontrol: "+name, "event", e)
+}
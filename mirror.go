@@ -0,0 +1,251 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMirrorTimeout is the timeout for replayed queries if none is set.
+const defaultMirrorTimeout = time.Minute
+
+// MirrorSettings configures the mirroring of read queries to a shadow DB. See
+// SetMirroring().
+type MirrorSettings struct {
+	Shadow   *DB           // DB to replay queries on (nil to disable)
+	Percent  float64       // Percentage of read queries to replay, up to 100
+	Checksum bool          // Whether results are compared, besides latencies
+	Timeout  time.Duration // Timeout for replayed queries (zero for a minute)
+}
+
+// mirroring holds the settings made with SetMirroring().
+type mirroring struct {
+	settings MirrorSettings
+}
+
+// SetMirroring makes the DB replay a percentage of read queries (those run with
+// Query() and QueryRow() and their variants, and found read-only as described
+// for Cluster) against a shadow DB, asynchronously, to evaluate a new database
+// version or hardware under real traffic. Queries are replayed once they
+// complete on the DB, without affecting the caller, and a MirrorEvent is sent
+// for each (see SetEventCh()), comparing latencies and, if settings.Checksum
+// is set, the results. The shadow DB takes connections under its own limits,
+// so configure it to protect the server being evaluated.
+//
+// Results are compared once read in full by the caller. If all rows were read
+// with Scan(), a checksum of the scanned values is compared with that of the
+// shadow results, scanned into values of the same types; otherwise, only the
+// number of rows is compared. Note that the shadow query holds its connection
+// until the results are compared. A nil shadow, or a zero percentage, disables
+// mirroring.
+func (db *DB) SetMirroring(settings MirrorSettings) {
+	if settings.Shadow == nil || settings.Percent <= 0 {
+		db.mirroring.Store(nil)
+		return
+	}
+
+	if settings.Percent > 100 {
+		settings.Percent = 100
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = defaultMirrorTimeout
+	}
+	db.mirroring.Store(&mirroring{settings: settings})
+}
+
+// Mirroring returns the settings made with SetMirroring(), or the zero value if
+// mirroring is disabled.
+func (db *DB) Mirroring() MirrorSettings {
+	if m := db.mirroring.Load(); m != nil {
+		return m.settings
+	}
+	return MirrorSettings{}
+}
+
+// mirroredQuery is a query being replayed on the shadow DB. The outcome of the
+// query on the DB is collected by its Rows or Row, and handed over to the
+// replaying goroutine with finish().
+type mirroredQuery struct {
+	db       *DB
+	settings *MirrorSettings
+	query    string
+	args     []interface{}
+	single   bool // Whether only the first row is read, as in QueryRow()
+	latency  time.Duration
+	tags     map[string]string
+	types    []reflect.Type // Types scanned into, known after the first row
+	sum      hash.Hash64
+	scans    int
+	invalid  bool // Set if scanned values can't be compared
+	finished bool
+	result   chan mirrorResult
+}
+
+// mirrorResult is the outcome of a query on the DB.
+type mirrorResult struct {
+	rows     int
+	complete bool // Whether all rows were read
+}
+
+// mirror starts replaying a read query that completed on the DB with the given
+// latency, if sampled for mirroring. It returns nil if not.
+func (db *DB) mirror(ctx context.Context, query string, args []interface{}, single bool, latency time.Duration) *mirroredQuery {
+	mr := db.mirroring.Load()
+	if mr == nil || rand.Float64()*100 >= mr.settings.Percent || !isReadOnly(query) {
+		return nil
+	}
+
+	m := &mirroredQuery{
+		db:       db,
+		settings: &mr.settings,
+		query:    query,
+		args:     args,
+		single:   single,
+		latency:  latency,
+		tags:     TagsFromContext(ctx),
+		sum:      fnv.New64a(),
+		result:   make(chan mirrorResult, 1),
+	}
+	go m.replay()
+	return m
+}
+
+// scanned adds a row scanned into dest to the checksum.
+func (m *mirroredQuery) scanned(dest []interface{}, err error) {
+	if m == nil || m.invalid {
+		return
+	}
+	if err != nil {
+		m.invalid = true
+		return
+	}
+
+	types := scanTypes(dest)
+	if m.types == nil {
+		m.types = types
+	} else if !reflect.DeepEqual(m.types, types) {
+		m.invalid = true
+		return
+	}
+
+	hashValues(m.sum, dest)
+	m.scans++
+}
+
+// finish hands the outcome of the query on the DB over to the replay.
+func (m *mirroredQuery) finish(rows int, complete bool) {
+	if m == nil || m.finished {
+		return
+	}
+	m.finished = true
+	m.result <- mirrorResult{rows: rows, complete: complete}
+}
+
+// replay runs the query on the shadow DB, reporting how it compares.
+func (m *mirroredQuery) replay() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.settings.Timeout)
+	defer cancel()
+
+	e := MirrorEvent{
+		Time:        time.Now(),
+		Fingerprint: Fingerprint(m.query),
+		Latency:     m.latency,
+		Tags:        m.tags,
+	}
+
+	start := time.Now()
+	rows, err := m.settings.Shadow.QueryContext(ctx, m.query, m.args...)
+	e.ShadowLatency = time.Since(start)
+	if err != nil {
+		e.Cause = err
+		m.report(e)
+		return
+	}
+	defer rows.Close()
+
+	if !m.settings.Checksum {
+		m.report(e)
+		return
+	}
+
+	var result mirrorResult
+	select {
+	case result = <-m.result:
+	case <-ctx.Done():
+	}
+	if !result.complete {
+		m.report(e)
+		return
+	}
+
+	// Compare values if they were all scanned, and the row count otherwise
+	compareValues := m.types != nil && !m.invalid && m.scans == result.rows
+	sum := fnv.New64a()
+	n := 0
+	for rows.Next() {
+		n++
+		if compareValues {
+			dest := newScanDest(m.types)
+			if err := rows.Scan(dest...); err != nil {
+				e.Cause = err
+				m.report(e)
+				return
+			}
+			hashValues(sum, dest)
+		}
+		if m.single {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		e.Cause = err
+		m.report(e)
+		return
+	}
+
+	e.Compared = true
+	e.Rows, e.ShadowRows = result.rows, n
+	e.Mismatch = n != result.rows || (compareValues && sum.Sum64() != m.sum.Sum64())
+	m.report(e)
+}
+
+func (m *mirroredQuery) report(e MirrorEvent) {
+	atomic.AddUint64(&m.db.mirrored, 1)
+	if e.Mismatch {
+		atomic.AddUint64(&m.db.mirrorMismatches, 1)
+	}
+	m.db.emit(e)
+}
+
+// scanTypes returns the types of the values dest points to.
+func scanTypes(dest []interface{}) []reflect.Type {
+	types := make([]reflect.Type, len(dest))
+	for i, d := range dest {
+		types[i] = reflect.TypeOf(d).Elem()
+	}
+	return types
+}
+
+// newScanDest returns pointers to new values of the given types.
+func newScanDest(types []reflect.Type) []interface{} {
+	dest := make([]interface{}, len(types))
+	for i, t := range types {
+		dest[i] = reflect.New(t).Interface()
+	}
+	return dest
+}
+
+// hashValues adds the values dest points to to h.
+func hashValues(h hash.Hash64, dest []interface{}) {
+	for _, d := range dest {
+		fmt.Fprintf(h, "%v\x00", reflect.ValueOf(d).Elem().Interface())
+	}
+	h.Write([]byte{'\n'})
+}
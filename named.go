@@ -0,0 +1,330 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// expandNamed replaces the :name placeholders in query with the positional
+// placeholders of the dialect, returning the names in the order arguments are
+// expected. String literals, quoted identifiers, comments and Postgres casts
+// (::type) are left untouched.
+func expandNamed(d Dialect, query string) (string, []string) {
+	return expand(d, query, true)
+}
+
+// expand is like expandNamed(), but placeholders are only reused for repeated
+// names if reuse is set.
+func expand(d Dialect, query string, reuse bool) (string, []string) {
+	var b strings.Builder
+	var names []string
+	index := make(map[string]int) // Position of each name, for reuse
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if query[end] == '\\' && d == MySQLDialect {
+					// MySQL supports backslash escapes in literals
+					end++
+				}
+				end++
+			}
+			if end < len(query) {
+				end++
+			} else {
+				end = len(query)
+			}
+			b.WriteString(query[i:end])
+			i = end
+
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query)
+			} else {
+				end += i
+			}
+			b.WriteString(query[i:end])
+			i = end
+
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query)
+			} else {
+				end += i + 4
+			}
+			b.WriteString(query[i:end])
+			i = end
+
+		case strings.HasPrefix(query[i:], "::"):
+			b.WriteString("::")
+			i += 2
+
+		case c == ':' && i+1 < len(query) && isNameStart(query[i+1]):
+			end := i + 1
+			for end < len(query) && isNameChar(query[end]) {
+				end++
+			}
+			name := query[i+1 : end]
+
+			n, ok := index[name]
+			if !ok || !reuse || d != PostgresDialect && d != SQLServerDialect {
+				// Positional placeholders can't be reused
+				names = append(names, name)
+				n = len(names)
+				index[name] = n
+			}
+			b.WriteString(d.placeholder(n))
+			i = end
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return b.String(), names
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || '0' <= c && c <= '9'
+}
+
+// bindNamed expands query and collects the arguments for it from arg, which
+// must be a map with string keys or a struct (or a pointer to either). Struct
+// fields are matched by their "db" tag if present, or by name otherwise,
+// ignoring case. Fields of embedded structs are matched as well.
+func bindNamed(d Dialect, query string, arg interface{}) (string, []interface{}, error) {
+	query, names := expandNamed(d, query)
+	args := make([]interface{}, len(names))
+
+	for i, name := range names {
+		value, err := namedValue(arg, name)
+		if err != nil {
+			return "", nil, err
+		}
+		args[i] = value
+	}
+
+	return query, args, nil
+}
+
+// ExecNamed is like Exec(), but takes the arguments by name from a map or
+// struct. The query refers to them as :name, and is rewritten with the
+// placeholders of the DB dialect (see SetDialect()). Struct fields are matched
+// by their "db" tag, or by name otherwise, ignoring case. Note that sql.Named()
+// arguments can also be passed to Exec() and others, for drivers supporting
+// them.
+func (db *DB) ExecNamed(query string, arg interface{}) (sql.Result, error) {
+	return db.ExecNamedContext(context.Background(), query, arg)
+}
+
+func (db *DB) ExecNamedContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	query, args, err := bindNamed(db.Dialect(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecContext(ctx, query, args...)
+}
+
+// QueryNamed is like Query(), but takes the arguments by name. See
+// ExecNamed().
+func (db *DB) QueryNamed(query string, arg interface{}) (*Rows, error) {
+	return db.QueryNamedContext(context.Background(), query, arg)
+}
+
+func (db *DB) QueryNamedContext(ctx context.Context, query string, arg interface{}) (*Rows, error) {
+	query, args, err := bindNamed(db.Dialect(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+// QueryRowNamed is like QueryRow(), but takes the arguments by name. See
+// ExecNamed().
+func (db *DB) QueryRowNamed(query string, arg interface{}) *Row {
+	return db.QueryRowNamedContext(context.Background(), query, arg)
+}
+
+func (db *DB) QueryRowNamedContext(ctx context.Context, query string, arg interface{}) *Row {
+	query, args, err := bindNamed(db.Dialect(), query, arg)
+	if err != nil {
+		return &Row{err: err, closed: true}
+	}
+	return db.QueryRowContext(ctx, query, args...)
+}
+
+// valuesRe finds the start of the VALUES clause of an INSERT statement.
+var valuesRe = regexp.MustCompile(`(?i)\bVALUES\s*\(`)
+
+// bindBatch is like bindNamed(), but for a slice of maps or structs. The tuple
+// following VALUES in query is repeated for each element, so that all of them
+// are inserted with a single statement. Names elsewhere in the query are bound
+// from the first element.
+func bindBatch(d Dialect, query string, arg interface{}) (string, []interface{}, error) {
+	v := reflect.ValueOf(arg)
+	if v.Len() == 0 {
+		return "", nil, fmt.Errorf("dbcontrol: no elements to bind")
+	}
+
+	loc := valuesRe.FindStringIndex(query)
+	if loc == nil {
+		return "", nil, fmt.Errorf("dbcontrol: no VALUES clause to bind a batch to")
+	}
+
+	// Find the parenthesis closing the tuple
+	start, end, depth := loc[1]-1, -1, 0
+	for i := start; i < len(query) && end < 0; i++ {
+		switch query[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				end = i + 1
+			}
+		}
+	}
+	if end < 0 {
+		return "", nil, fmt.Errorf("dbcontrol: unterminated VALUES clause")
+	}
+
+	prefix, tuple, suffix := query[:start], query[start:end], query[end:]
+	_, prefixNames := expand(d, prefix, false)
+	_, tupleNames := expand(d, tuple, false)
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(tuple)
+	}
+	b.WriteString(suffix)
+
+	query, names := expand(d, b.String(), false)
+	args := make([]interface{}, len(names))
+
+	for i, name := range names {
+		elem := 0
+		if j := i - len(prefixNames); j >= 0 && j < v.Len()*len(tupleNames) {
+			elem = j / len(tupleNames)
+		}
+
+		value, err := namedValue(v.Index(elem).Interface(), name)
+		if err != nil {
+			return "", nil, err
+		}
+		args[i] = value
+	}
+
+	return query, args, nil
+}
+
+// namedValue returns the value for name from arg, a map or struct.
+func namedValue(arg interface{}, name string) (interface{}, error) {
+	v := reflect.Indirect(reflect.ValueOf(arg))
+
+	var value reflect.Value
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		value = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+	case v.Kind() == reflect.Struct:
+		value = structField(v, name)
+	default:
+		return nil, fmt.Errorf("dbcontrol: unsupported type for named arguments: %T", arg)
+	}
+
+	if !value.IsValid() {
+		return nil, fmt.Errorf("dbcontrol: missing named argument %q", name)
+	}
+	return value.Interface(), nil
+}
+
+// bind binds arg to query for NamedExec() and NamedQuery(), as a batch if arg
+// is a slice or array.
+func bind(d Dialect, query string, arg interface{}) (string, []interface{}, error) {
+	switch reflect.Indirect(reflect.ValueOf(arg)).Kind() {
+	case reflect.Slice, reflect.Array:
+		return bindBatch(d, query, reflect.Indirect(reflect.ValueOf(arg)).Interface())
+	}
+	return bindNamed(d, query, arg)
+}
+
+// NamedExec runs a statement with its arguments bound from the fields of a
+// struct (or the keys of a map), referred to as :name in the query, in the
+// fashion of sqlx. Fields are named after their "db" tag, or their lowercase
+// name if not tagged. A slice of structs (or maps) can be passed to insert
+// several rows at once: the tuple following VALUES is repeated for each
+// element, e.g.:
+//
+//	db.NamedExec("INSERT INTO t (a, b) VALUES (:a, :b)", []T{{1, 2}, {3, 4}})
+//
+// The statement runs through the DB as usual, so it's subject to the connection
+// limit and other settings.
+func (db *DB) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return db.NamedExecContext(context.Background(), query, arg)
+}
+
+func (db *DB) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	query, args, err := bind(db.Dialect(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecContext(ctx, query, args...)
+}
+
+// NamedQuery is like NamedExec(), for queries.
+func (db *DB) NamedQuery(query string, arg interface{}) (*Rows, error) {
+	return db.NamedQueryContext(context.Background(), query, arg)
+}
+
+func (db *DB) NamedQueryContext(ctx context.Context, query string, arg interface{}) (*Rows, error) {
+	query, args, err := bind(db.Dialect(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+// NamedExec is like DB.NamedExec(), within the transaction.
+func (tx *Tx) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return tx.NamedExecContext(context.Background(), query, arg)
+}
+
+func (tx *Tx) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	query, args, err := bind(tx.db.Dialect(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return tx.ExecContext(ctx, query, args...)
+}
+
+// NamedQuery is like DB.NamedQuery(), within the transaction.
+func (tx *Tx) NamedQuery(query string, arg interface{}) (*Rows, error) {
+	return tx.NamedQueryContext(context.Background(), query, arg)
+}
+
+func (tx *Tx) NamedQueryContext(ctx context.Context, query string, arg interface{}) (*Rows, error) {
+	query, args, err := bind(tx.db.Dialect(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return tx.QueryContext(ctx, query, args...)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		reuse   bool
+		want    string
+		names   []string
+	}{
+		{
+			name:    "generic",
+			dialect: GenericDialect,
+			query:   "SELECT * FROM t WHERE a = :a AND b = :b_1",
+			want:    "SELECT * FROM t WHERE a = ? AND b = ?",
+			names:   []string{"a", "b_1"},
+		},
+		{
+			name:    "postgres",
+			dialect: PostgresDialect,
+			query:   "SELECT * FROM t WHERE a = :a AND b = :b",
+			want:    "SELECT * FROM t WHERE a = $1 AND b = $2",
+			names:   []string{"a", "b"},
+		},
+		{
+			name:    "sqlserver",
+			dialect: SQLServerDialect,
+			query:   "SELECT * FROM t WHERE a = :a AND b = :b",
+			want:    "SELECT * FROM t WHERE a = @p1 AND b = @p2",
+			names:   []string{"a", "b"},
+		},
+		{
+			name:    "repeated, postgres",
+			dialect: PostgresDialect,
+			query:   "SELECT :a, :b, :a",
+			reuse:   true,
+			want:    "SELECT $1, $2, $1",
+			names:   []string{"a", "b"},
+		},
+		{
+			name:    "repeated, sqlserver",
+			dialect: SQLServerDialect,
+			query:   "SELECT :a, :b, :a",
+			reuse:   true,
+			want:    "SELECT @p1, @p2, @p1",
+			names:   []string{"a", "b"},
+		},
+		{
+			name:    "repeated, mysql",
+			dialect: MySQLDialect,
+			query:   "SELECT :a, :b, :a",
+			reuse:   true,
+			want:    "SELECT ?, ?, ?",
+			names:   []string{"a", "b", "a"},
+		},
+		{
+			name:    "repeated, no reuse",
+			dialect: PostgresDialect,
+			query:   "SELECT :a, :a",
+			want:    "SELECT $1, $2",
+			names:   []string{"a", "a"},
+		},
+		{
+			name:    "string literals",
+			dialect: PostgresDialect,
+			query:   "SELECT ':a', 'it''s :b', :c",
+			want:    "SELECT ':a', 'it''s :b', $1",
+			names:   []string{"c"},
+		},
+		{
+			name:    "backslash escapes, mysql",
+			dialect: MySQLDialect,
+			query:   `SELECT 'a\' :b', :c`,
+			want:    `SELECT 'a\' :b', ?`,
+			names:   []string{"c"},
+		},
+		{
+			name:    "quoted identifiers",
+			dialect: MySQLDialect,
+			query:   "SELECT \"x:a\", `y:b` FROM t WHERE c = :c",
+			want:    "SELECT \"x:a\", `y:b` FROM t WHERE c = ?",
+			names:   []string{"c"},
+		},
+		{
+			name:    "line comments",
+			dialect: PostgresDialect,
+			query:   "SELECT :a -- and :b\nFROM t WHERE c = :c",
+			want:    "SELECT $1 -- and :b\nFROM t WHERE c = $2",
+			names:   []string{"a", "c"},
+		},
+		{
+			name:    "block comments",
+			dialect: PostgresDialect,
+			query:   "SELECT /* :a */ :b /* :c",
+			want:    "SELECT /* :a */ $1 /* :c",
+			names:   []string{"b"},
+		},
+		{
+			name:    "casts",
+			dialect: PostgresDialect,
+			query:   "SELECT :a::int, b::text FROM t",
+			want:    "SELECT $1::int, b::text FROM t",
+			names:   []string{"a"},
+		},
+		{
+			name:    "not names",
+			dialect: GenericDialect,
+			query:   "SELECT '10:30', :1, a: FROM t",
+			want:    "SELECT '10:30', :1, a: FROM t",
+		},
+		{
+			name:    "unterminated literal",
+			dialect: GenericDialect,
+			query:   "SELECT :a, ':b",
+			want:    "SELECT ?, ':b",
+			names:   []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, names := expand(tt.dialect, tt.query, tt.reuse)
+			if got != tt.want {
+				t.Errorf("query = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("names = %q, want %q", names, tt.names)
+			}
+		})
+	}
+}
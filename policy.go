@@ -0,0 +1,109 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"regexp"
+	"time"
+)
+
+// PolicyRule matches queries for a Policy, either by fingerprint or by a
+// regular expression matched against the fingerprint (see Fingerprint()).
+// Matching fingerprints makes rules independent of literals, comments,
+// whitespace and case; e.g., `^delete from \S+$` matches DELETE statements
+// without a WHERE clause.
+type PolicyRule struct {
+	Name        string         // Reported when the rule denies a query
+	Fingerprint string         // Query to match, normalized with Fingerprint()
+	Regexp      *regexp.Regexp // Expression to match, if Fingerprint is empty
+}
+
+// Policy sets which queries the DB may run. See SetPolicy().
+type Policy struct {
+	Deny  []PolicyRule // Queries rejected
+	Allow []PolicyRule // Queries allowed, if not empty; all others are rejected
+}
+
+// policy is a Policy ready to be enforced.
+type policy struct {
+	deny, allow []PolicyRule
+}
+
+// SetPolicy enforces a policy on the queries run on the DB, including those in
+// transactions and on dedicated connections. Queries matching a rule in
+// p.Deny are rejected, as well as those matching none in p.Allow if that's not
+// empty. Rejected queries fail with ErrQueryDenied before taking a
+// connection, and a PolicyEvent is sent (see SetEventCh()). Enforcing a policy
+// costs a fingerprint per query, so it's disabled by default. A zero policy
+// disables it.
+func (db *DB) SetPolicy(p Policy) {
+	if len(p.Deny) == 0 && len(p.Allow) == 0 {
+		db.policy.Store(nil)
+		return
+	}
+
+	compiled := &policy{
+		deny:  normalizeRules(p.Deny),
+		allow: normalizeRules(p.Allow),
+	}
+	db.policy.Store(compiled)
+}
+
+// normalizeRules copies rules, fingerprinting the queries to match.
+func normalizeRules(rules []PolicyRule) []PolicyRule {
+	normalized := make([]PolicyRule, len(rules))
+	for i, r := range rules {
+		if r.Fingerprint != "" {
+			r.Fingerprint = Fingerprint(r.Fingerprint)
+		}
+		normalized[i] = r
+	}
+	return normalized
+}
+
+func (r *PolicyRule) matches(fp string) bool {
+	if r.Fingerprint != "" {
+		return r.Fingerprint == fp
+	}
+	return r.Regexp != nil && r.Regexp.MatchString(fp)
+}
+
+// match returns the first rule matching fp, if any.
+func match(rules []PolicyRule, fp string) (PolicyRule, bool) {
+	for _, r := range rules {
+		if r.matches(fp) {
+			return r, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+// checkPolicy returns ErrQueryDenied if the policy in effect rejects query,
+// reporting it.
+func (db *DB) checkPolicy(ctx context.Context, query string) error {
+	p := db.policy.Load()
+	if p == nil {
+		return nil
+	}
+
+	fp := Fingerprint(query)
+	rule, denied := match(p.deny, fp)
+	unlisted := false
+	if !denied && len(p.allow) > 0 {
+		_, allowed := match(p.allow, fp)
+		denied, unlisted = !allowed, !allowed
+	}
+	if !denied {
+		return nil
+	}
+
+	db.emit(PolicyEvent{
+		Time:        time.Now(),
+		Fingerprint: fp,
+		Rule:        rule.Name,
+		Unlisted:    unlisted,
+		Tags:        TagsFromContext(ctx),
+	})
+	return ErrQueryDenied
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"database/sql"
+	"sync/atomic"
+)
+
+// Reconfigure switches the DB to a new DSN, e.g., to rotate credentials,
+// without interrupting service. A new underlying sql.DB is opened and pinged;
+// if that fails, the error is returned and the DB is left unchanged. Otherwise,
+// new connections are taken from the new sql.DB right away, whereas the old one
+// is closed as soon as all connections acquired from it are released. The
+// connection limit and other settings are preserved. Statements prepared before
+// the switch stop working once the old sql.DB is closed, so they should be
+// prepared again. For DBs opened with OpenFailover(), the DSN of the endpoint in
+// use is replaced.
+func (db *DB) Reconfigure(dsn string) error {
+	pool, c, err := db.openPool(dsn)
+	if err != nil {
+		return redactError(err)
+	}
+
+	if err := pool.Ping(); err != nil {
+		pool.Close()
+		return redactError(err)
+	}
+
+	db.poolMux.Lock()
+	endpoint := db.endpoint
+	if len(db.dsns) > 0 {
+		db.dsns[endpoint] = dsn
+	}
+	db.poolMux.Unlock()
+
+	db.switchPool(pool, c, endpoint, false)
+	return nil
+}
+
+// pool returns the underlying sql.DB currently in use.
+func (db *DB) pool() *sql.DB {
+	db.poolMux.RLock()
+	defer db.poolMux.RUnlock()
+	return db.DB
+}
+
+// generation tracks the connections acquired while an underlying sql.DB was in
+// use, so that it's closed only once they are released.
+type generation struct {
+	pool    *sql.DB
+	leases  map[*lease]struct{}
+	retired bool // Set once the sql.DB is replaced
+	closed  bool
+}
+
+func newGeneration(pool *sql.DB) *generation {
+	return &generation{pool: pool, leases: make(map[*lease]struct{})}
+}
+
+// switchPool replaces the underlying sql.DB. If force is set, connections held
+// on the previous one are released right away, rather than waiting for callers
+// to do so.
+func (db *DB) switchPool(pool *sql.DB, c *connector, endpoint int, force bool) {
+	// Hold the limit so that it's not changed on the old pool meanwhile
+	db.limitMux.Lock()
+	pool.SetMaxIdleConns(db.idleConns())
+
+	db.poolMux.Lock()
+	if db.maxOpen != 0 {
+		pool.SetMaxOpenConns(db.maxOpen)
+	}
+	pool.SetConnMaxLifetime(db.lifetimeCap())
+	pool.SetConnMaxIdleTime(db.maxIdleTime)
+	db.DB = pool
+	db.connector = c
+	db.endpoint = endpoint
+	db.poolMux.Unlock()
+	db.limitMux.Unlock()
+
+	db.leasesMux.Lock()
+	old := db.gen
+	db.gen = newGeneration(pool)
+	old.retired = true
+	var forced map[*lease]struct{}
+	if force {
+		forced, old.leases = old.leases, make(map[*lease]struct{})
+	}
+	drained := db.drained(old)
+	db.leasesMux.Unlock()
+
+	for l := range forced {
+		l.release()
+	}
+
+	// Cached statements belong to the old sql.DB
+	db.resetStmtCache()
+
+	if drained {
+		old.pool.Close()
+	}
+}
+
+// drained tells whether the sql.DB for gen can be closed, marking it as such.
+// Must be called with db.leasesMux held.
+func (db *DB) drained(gen *generation) bool {
+	if gen.retired && !gen.closed && len(gen.leases) == 0 {
+		gen.closed = true
+		return true
+	}
+	return false
+}
+
+// lease is a connection held by a caller, that may be released early on
+// failover.
+type lease struct {
+	released int32 // Accessed atomically
+	fn       func()
+}
+
+func (l *lease) release() {
+	if atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+		l.fn()
+	}
+}
+
+// track wraps the release function for a connection, so that it's accounted
+// for in the current generation.
+func (db *DB) track(release func()) func() {
+	l := &lease{fn: release}
+
+	db.leasesMux.Lock()
+	gen := db.gen
+	gen.leases[l] = struct{}{}
+	db.leasesMux.Unlock()
+
+	return func() {
+		db.leasesMux.Lock()
+		delete(gen.leases, l)
+		drained := db.drained(gen)
+		db.leasesMux.Unlock()
+
+		l.release()
+		if drained {
+			gen.pool.Close()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// CallProc calls the stored procedure with the given name, which is inserted
+// verbatim in the statement and must therefore be trusted. Arguments are
+// passed in order; OUT and INOUT parameters are given as sql.Out values, whose
+// Dest is set to the output of the procedure. The call is built as required by
+// the DB dialect:
+//
+//   - SQL Server: the name is run as the statement, with the arguments as is,
+//     so they are usually given with sql.Named(), as expected by the driver.
+//   - MySQL: output parameters are bound to session variables, read once the
+//     procedure returns. The call runs on a dedicated connection for that.
+//   - Postgres: output values are read from the row returned by CALL.
+//   - Others: a CALL statement is run with the arguments as is, so sql.Out
+//     values are left for the driver to handle.
+//
+// In all cases, the call takes a connection under the limit as any other
+// statement.
+func (db *DB) CallProc(ctx context.Context, name string, args ...interface{}) error {
+	d := db.Dialect()
+
+	switch d {
+	case SQLServerDialect:
+		_, err := db.ExecContext(ctx, name, args...)
+		return err
+	case MySQLDialect:
+		return db.callMySQL(ctx, name, args)
+	case PostgresDialect:
+		return db.callPostgres(ctx, name, args)
+	}
+
+	_, err := db.ExecContext(ctx, callQuery(d, name, args, nil), args...)
+	return err
+}
+
+// callQuery builds a CALL statement for the arguments, using params for those
+// at the given positions, if any, instead of placeholders.
+func callQuery(d Dialect, name string, args []interface{}, params map[int]string) string {
+	var b strings.Builder
+	b.WriteString("CALL ")
+	b.WriteString(name)
+	b.WriteByte('(')
+
+	n := 0
+	for i := range args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if p, ok := params[i]; ok {
+			b.WriteString(p)
+		} else {
+			n++
+			b.WriteString(d.placeholder(n))
+		}
+	}
+
+	b.WriteByte(')')
+	return b.String()
+}
+
+// outValue returns the value to send for an sql.Out argument: the current
+// value of Dest for INOUT parameters, or NULL otherwise.
+func outValue(out sql.Out) interface{} {
+	if !out.In {
+		return nil
+	}
+	v := reflect.ValueOf(out.Dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return out.Dest
+	}
+	return v.Elem().Interface()
+}
+
+func (db *DB) callPostgres(ctx context.Context, name string, args []interface{}) error {
+	values := make([]interface{}, len(args))
+	var dests []interface{}
+	for i, arg := range args {
+		if out, ok := arg.(sql.Out); ok {
+			values[i] = outValue(out)
+			dests = append(dests, out.Dest)
+			continue
+		}
+		values[i] = arg
+	}
+
+	query := callQuery(PostgresDialect, name, args, nil)
+	if len(dests) == 0 {
+		_, err := db.ExecContext(ctx, query, values...)
+		return err
+	}
+	return db.QueryRowContext(ctx, query, values...).Scan(dests...)
+}
+
+func (db *DB) callMySQL(ctx context.Context, name string, args []interface{}) error {
+	var (
+		values []interface{}
+		vars   []string
+		dests  []interface{}
+		inouts []interface{}
+		params = make(map[int]string)
+	)
+	for i, arg := range args {
+		out, ok := arg.(sql.Out)
+		if !ok {
+			values = append(values, arg)
+			continue
+		}
+
+		v := "@dbcontrol_out" + strconv.Itoa(len(vars)+1)
+		params[i] = v
+		vars = append(vars, v)
+		dests = append(dests, out.Dest)
+		inouts = append(inouts, outValue(out))
+	}
+
+	query := callQuery(MySQLDialect, name, args, params)
+	if len(vars) == 0 {
+		_, err := db.ExecContext(ctx, query, values...)
+		return err
+	}
+
+	return db.WithConn(ctx, func(c *Conn) error {
+		set := make([]string, len(vars))
+		for i, v := range vars {
+			set[i] = v + " = ?"
+		}
+		if _, err := c.ExecContext(ctx, "SET "+strings.Join(set, ", "), inouts...); err != nil {
+			return err
+		}
+
+		if _, err := c.ExecContext(ctx, query, values...); err != nil {
+			return err
+		}
+
+		return c.QueryRowContext(ctx, "SELECT "+strings.Join(vars, ", ")).Scan(dests...)
+	})
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"time"
+)
+
+type waitProgressKey struct{}
+
+// WaitProgress describes the state of a request waiting for a connection. The
+// estimated wait is derived from the rate at which connections have recently
+// been released, and may well be zero if no such information is available yet.
+type WaitProgress struct {
+	Position      int // Position in the queue, starting at 1
+	EstimatedWait time.Duration
+}
+
+// WithWaitProgress returns a copy of ctx that makes operations using it report
+// their progress while waiting for a connection. If the operation has to wait,
+// fn is called as soon as it's queued and again each time it moves up the
+// queue. It's not called at all if a connection is readily available. fn is
+// called from the goroutine doing the operation, thus delaying it, so it
+// should return quickly. Callers wanting to give up waiting based on the
+// progress reported should cancel the context.
+func WithWaitProgress(ctx context.Context, fn func(WaitProgress)) context.Context {
+	return context.WithValue(ctx, waitProgressKey{}, fn)
+}
+
+// progressFunc returns the function to report queue positions to, as set with
+// WithWaitProgress(), or nil if none was.
+func (db *DB) progressFunc(ctx context.Context) func(int) {
+	fn, ok := ctx.Value(waitProgressKey{}).(func(WaitProgress))
+	if !ok || fn == nil {
+		return nil
+	}
+
+	return func(pos int) {
+		fn(WaitProgress{
+			Position:      pos,
+			EstimatedWait: time.Duration(pos) * db.sem.releaseInterval(),
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Querier runs statements and queries. It's implemented by DB, Tx, Conn,
+// Cluster and Sharded, so that application code written against it can run
+// inside or outside transactions unchanged.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error)
+	QueryRow(query string, args ...interface{}) *Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row
+}
+
+var (
+	_ Querier = (*DB)(nil)
+	_ Querier = (*Tx)(nil)
+	_ Querier = (*Conn)(nil)
+	_ Querier = (*Cluster)(nil)
+	_ Querier = (*Sharded)(nil)
+	_ Querier = (*Lease)(nil)
+)
@@ -0,0 +1,218 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy sets what happens to requests beyond a quota.
+type OverflowPolicy int
+
+const (
+	OverflowWait   OverflowPolicy = iota // Wait for a connection within the quota
+	OverflowReject                       // Fail with ErrQuotaExceeded
+)
+
+// Quota limits the connections a group of requests may hold at once. See
+// SetTenantQuota().
+type Quota struct {
+	MaxConns int            // Connections held at once (zero for no limit)
+	Overflow OverflowPolicy // What happens to requests beyond MaxConns
+}
+
+// quotaPool accounts connections against quotas, by key. Semaphores are only
+// kept for keys holding or waiting for connections, so that keys can have
+// high cardinality.
+type quotaPool struct {
+	mu     sync.Mutex
+	quotas map[string]Quota // Quota for "" applies to keys with none
+	slots  map[string]*quotaSlot
+}
+
+type quotaSlot struct {
+	sem   *semaphore
+	quota Quota
+	refs  int // Callers holding or waiting for a token
+}
+
+// set sets the quota for key, or removes it for a zero MaxConns.
+func (p *quotaPool) set(key string, q Quota) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if q.MaxConns <= 0 {
+		delete(p.quotas, key)
+		return
+	}
+	if p.quotas == nil {
+		p.quotas = make(map[string]Quota)
+		p.slots = make(map[string]*quotaSlot)
+	}
+	p.quotas[key] = q
+}
+
+// get returns a copy of the quotas set, or nil if none.
+func (p *quotaPool) get() map[string]Quota {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.quotas) == 0 {
+		return nil
+	}
+	quotas := make(map[string]Quota, len(p.quotas))
+	for k, q := range p.quotas {
+		quotas[k] = q
+	}
+	return quotas
+}
+
+// acquire takes a token from the quota for key, if any, returning the function
+// to give it back. If fallback is set, keys with no quota use that for "". It
+// fails with ErrQuotaExceeded if the quota is exhausted and rejects overflow.
+func (p *quotaPool) acquire(ctx context.Context, key string, fallback bool) (func(), error) {
+	p.mu.Lock()
+	q, ok := p.quotas[key]
+	if !ok && fallback {
+		q, ok = p.quotas[""]
+	}
+	if !ok {
+		p.mu.Unlock()
+		return func() {}, nil
+	}
+
+	slot := p.slots[key]
+	if slot == nil {
+		slot = &quotaSlot{sem: newSemaphore(q.MaxConns), quota: q}
+		p.slots[key] = slot
+	} else if slot.quota != q {
+		slot.sem.resize(q.MaxConns)
+		slot.quota = q
+	}
+	slot.refs++
+	p.mu.Unlock()
+
+	var err error
+	if q.Overflow == OverflowReject {
+		if !slot.sem.tryAcquire(1) {
+			err = ErrQuotaExceeded
+		}
+	} else {
+		err = slot.sem.acquire(ctx, 1, 0, nil)
+	}
+	if err != nil {
+		p.unref(key, slot)
+		return nil, err
+	}
+
+	return func() {
+		slot.sem.release(1)
+		p.unref(key, slot)
+	}, nil
+}
+
+func (p *quotaPool) unref(key string, slot *quotaSlot) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if slot.refs--; slot.refs == 0 {
+		delete(p.slots, key)
+	}
+}
+
+// SetClassLimit caps the connections that requests of a class (see
+// WithClass()) may hold at once, within the limit for the whole DB. Capping
+// background classes, such as "batch", guarantees other classes some
+// headroom under load. The limit for the empty class applies to requests with
+// no class. Overflow is handled as described for SetTenantQuota(). A zero
+// MaxConns removes the limit.
+func (db *DB) SetClassLimit(class string, q Quota) {
+	db.classQuotas.set(class, q)
+}
+
+// ClassLimits returns the limits set with SetClassLimit(), or nil if none.
+func (db *DB) ClassLimits() map[string]Quota {
+	return db.classQuotas.get()
+}
+
+// SubPools carves the connections of a DB into separate pools for transactions
+// and single statements. See SetSubPools().
+type SubPools struct {
+	Transactions int // Connections for transactions (zero for no limit)
+	Statements   int // Connections for other requests (zero for no limit)
+}
+
+// Keys of the sub-pools in DB.subPools.
+const (
+	txSubPool   = "transactions"
+	stmtSubPool = "statements"
+)
+
+type txSubPoolKey struct{}
+
+// SetSubPools limits the connections transactions and other requests may hold
+// at once, separately, within the limit for the whole DB. Transactions hold
+// connections much longer than single statements, so carving the limit into
+// sub-pools (e.g., 8 connections for transactions and 12 for statements, on
+// a DB limited to 20) keeps a burst of transactions from starving simple
+// queries, and the other way around. Requests beyond the limit of their pool
+// wait for one of its connections. Dedicated connections (see Conn()) count as
+// statements. A zero limit lifts that of the pool.
+func (db *DB) SetSubPools(p SubPools) {
+	db.subPools.set(txSubPool, Quota{MaxConns: p.Transactions})
+	db.subPools.set(stmtSubPool, Quota{MaxConns: p.Statements})
+}
+
+// SubPools returns the limits set with SetSubPools().
+func (db *DB) SubPools() SubPools {
+	pools := db.subPools.get()
+	return SubPools{
+		Transactions: pools[txSubPool].MaxConns,
+		Statements:   pools[stmtSubPool].MaxConns,
+	}
+}
+
+// acquireQuotas takes tokens from the sub-pool for the request, and the quotas
+// of the tenant and class in ctx, if any, returning the function to give them
+// back.
+func (db *DB) acquireQuotas(ctx context.Context) (func(), error) {
+	pool := stmtSubPool
+	if ctx.Value(txSubPoolKey{}) != nil {
+		pool = txSubPool
+	}
+	releasePool, err := db.subPools.acquire(ctx, pool, false)
+	if err != nil {
+		return nil, err
+	}
+
+	releaseTenant := func() {}
+	if tenant, ok := TenantFromContext(ctx); ok {
+		if releaseTenant, err = db.tenantQuotas.acquire(ctx, tenant, true); err != nil {
+			releasePool()
+			db.quotaRejected(err)
+			return nil, err
+		}
+	}
+
+	releaseClass, err := db.classQuotas.acquire(ctx, ClassFromContext(ctx), false)
+	if err != nil {
+		releaseTenant()
+		releasePool()
+		db.quotaRejected(err)
+		return nil, err
+	}
+
+	return func() {
+		releaseClass()
+		releaseTenant()
+		releasePool()
+	}, nil
+}
+
+func (db *DB) quotaRejected(err error) {
+	if err == ErrQuotaExceeded {
+		atomic.AddUint64(&db.quotaRejections, 1)
+	}
+}
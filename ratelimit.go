@@ -0,0 +1,142 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type classKey struct{}
+
+// WithClass returns a copy of ctx that assigns operations using it to the given
+// class. Classes are arbitrary names, used to apply different settings to
+// different kinds of requests (see SetClassRateLimit() and SetClassLimit()).
+func WithClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, classKey{}, class)
+}
+
+// ClassFromContext returns the class set with WithClass(), or an empty string
+// if none was.
+func ClassFromContext(ctx context.Context) string {
+	class, _ := ctx.Value(classKey{}).(string)
+	return class
+}
+
+// RateLimit is a limit on the rate of operations, as set with SetRateLimit().
+type RateLimit struct {
+	PerSecond float64 // Sustained rate
+	Burst     int     // Operations allowed at once, above the sustained rate
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	clock  Clock
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit, clock Clock) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{
+		clock:  clock,
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   clock.Now(),
+	}
+}
+
+// wait blocks until an operation is allowed or ctx is done.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	rl.mu.Lock()
+	now := rl.clock.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.limit.PerSecond
+	if max := float64(rl.limit.Burst); rl.tokens > max {
+		rl.tokens = max
+	}
+	rl.last = now
+	rl.tokens--
+	tokens := rl.tokens
+	rl.mu.Unlock()
+
+	if tokens >= 0 {
+		return nil
+	}
+
+	ready := make(chan struct{})
+	t := rl.clock.AfterFunc(time.Duration(-tokens/rl.limit.PerSecond*float64(time.Second)), func() {
+		close(ready)
+	})
+	defer t.Stop()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		// Give back the reservation
+		rl.mu.Lock()
+		rl.tokens++
+		rl.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// SetRateLimit limits the rate of operations on the DB, which will be delayed
+// as necessary to keep up with it, regardless of the connections available.
+// Operations wait for their turn before requesting a connection, so they don't
+// hold one while delayed. Statements in a transaction or on a Conn are each
+// subject to the limit too, besides beginning the transaction or getting the
+// Conn, so they are delayed while holding their connection. Passing a zero
+// rate (the default) removes the limit.
+// The limit can be changed at any time; operations already waiting keep their
+// turn according to the previous setting, though.
+func (db *DB) SetRateLimit(limit RateLimit) {
+	db.rateMux.Lock()
+	defer db.rateMux.Unlock()
+
+	if limit.PerSecond > 0 {
+		db.rateLimiter = newRateLimiter(limit, db.Clock())
+	} else {
+		db.rateLimiter = nil
+	}
+}
+
+// SetClassRateLimit is like SetRateLimit(), but limits only the operations
+// assigned to the given class (see WithClass()). Operations under a class
+// limit are also subject to the limit for the whole DB, if any.
+func (db *DB) SetClassRateLimit(class string, limit RateLimit) {
+	db.rateMux.Lock()
+	defer db.rateMux.Unlock()
+
+	if limit.PerSecond > 0 {
+		if db.classRateLimiters == nil {
+			db.classRateLimiters = make(map[string]*rateLimiter)
+		}
+		db.classRateLimiters[class] = newRateLimiter(limit, db.Clock())
+	} else {
+		delete(db.classRateLimiters, class)
+	}
+}
+
+// throttle waits as required by the rate limits in effect for ctx.
+func (db *DB) throttle(ctx context.Context) error {
+	db.rateMux.RLock()
+	rl := db.rateLimiter
+	crl := db.classRateLimiters[ClassFromContext(ctx)]
+	db.rateMux.RUnlock()
+
+	if crl != nil {
+		if err := crl.wait(ctx); err != nil {
+			return err
+		}
+	}
+	if rl != nil {
+		return rl.wait(ctx)
+	}
+	return nil
+}
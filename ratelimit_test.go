@@ -0,0 +1,80 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+// TestRateLimitTx checks that statements in a transaction are rate limited,
+// not only beginning it.
+func TestRateLimitTx(t *testing.T) {
+	f := dbcontroltest.New()
+	defer f.Close()
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetRateLimit(dbcontrol.RateLimit{PerSecond: 20, Burst: 1})
+
+	start := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.QueryRow("SELECT a FROM t").Scan(new(int)); err == nil {
+		t.Fatal("Scan() found a row")
+	}
+
+	// Begin() takes the burst, then each statement waits 50ms
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("took %v for 3 operations at 20 per second", d)
+	}
+}
+
+// TestRateLimitClock checks that delays are timed with the clock of the DB.
+func TestRateLimitClock(t *testing.T) {
+	f := dbcontroltest.New()
+	defer f.Close()
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	clock := dbcontroltest.NewClock(time.Now())
+	db.SetClock(clock)
+	db.SetRateLimit(dbcontrol.RateLimit{PerSecond: 1, Burst: 1})
+
+	if _, err := db.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Exec("SELECT 1")
+		done <- err
+	}()
+
+	// The second statement waits for a second to go by on the clock
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("not delayed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
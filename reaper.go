@@ -0,0 +1,94 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// SetIdleReaper starts a background task that closes connections that have not
+// been needed for the given time. Every period, the pool is trimmed down to
+// the peak number of connections used during the previous one. This works even
+// for DBs limited with SetConcurrency(), whose idle connections are otherwise
+// kept up to the limit, so that few connections remain open off-peak. The
+// number of connections closed is reported in PoolStats().Reaped. A zero period
+// (the default) stops the reaper.
+func (db *DB) SetIdleReaper(idle time.Duration) {
+	db.reaperMux.Lock()
+	defer db.reaperMux.Unlock()
+
+	if db.reaperStop != nil {
+		close(db.reaperStop)
+		db.reaperStop = nil
+	}
+
+	db.reaperIdle = idle
+	if idle <= 0 {
+		db.reaperIdle = 0
+		return
+	}
+
+	db.reaperStop = make(chan struct{})
+	go db.reap(idle, db.reaperStop)
+}
+
+// observeInUse records the number of connections in use, to track the peak.
+func (db *DB) observeInUse(n int32) {
+	for {
+		peak := atomic.LoadInt32(&db.peakInUse)
+		if n <= peak || atomic.CompareAndSwapInt32(&db.peakInUse, peak, n) {
+			return
+		}
+	}
+}
+
+func (db *DB) reap(idle time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-db.done:
+			return
+		}
+
+		inUse := atomic.LoadInt32(&db.inUse)
+		peak := atomic.SwapInt32(&db.peakInUse, inUse)
+		if peak < inUse {
+			peak = inUse
+		}
+
+		db.trimIdle(int(peak))
+	}
+}
+
+// trimIdle closes idle connections beyond those needed to have the given number
+// open.
+func (db *DB) trimIdle(needed int) {
+	db.limitMux.Lock()
+	defer db.limitMux.Unlock()
+
+	pool := db.pool()
+	stats := pool.Stats()
+	keep := needed - stats.InUse
+	if keep < 0 {
+		keep = 0
+	}
+	if stats.Idle <= keep {
+		return
+	}
+
+	pool.SetMaxIdleConns(keep)
+	pool.SetMaxIdleConns(db.idleConns())
+
+	closed := pool.Stats().MaxIdleClosed - stats.MaxIdleClosed
+	if closed > 0 {
+		atomic.AddUint64(&db.reaped, uint64(closed))
+		db.log(slog.LevelInfo, "dbcontrol: reaped idle connections", "closed", closed, "kept", keep)
+	}
+}
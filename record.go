@@ -0,0 +1,219 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// RecordedStatement is a statement captured by a Recorder, as written on each
+// line of a recording in JSON.
+type RecordedStatement struct {
+	Time     time.Time     `json:"time"` // When issued, before waiting
+	Query    string        `json:"query"`
+	Args     []interface{} `json:"args,omitempty"`
+	Exec     bool          `json:"exec,omitempty"` // Run with Exec(), rather than as a query
+	Wait     time.Duration `json:"wait"`           // Time waited for a connection
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// Recorder captures the statements run on a DB. See DB.Record().
+type Recorder struct {
+	db      *DB
+	mu      sync.Mutex
+	w       *bufio.Writer
+	enc     *json.Encoder
+	err     error // First error writing
+	stopped bool
+}
+
+// Record starts capturing the statements run directly on the DB (through
+// Exec(), Query() and QueryRow() and their variants) to w, one JSON object per
+// line, with their arguments, timings and the time waited for a connection.
+// Recordings can be replayed with Replay(), to load test pool settings with
+// real traffic. Arguments are written as is, except for byte slices, that are
+// written as strings, so make sure to keep recordings safe; note that numbers
+// are read back as float64, and times as strings. Statements are written as
+// they finish, under a lock, so w should be fast (it's buffered anyway).
+// Recording goes on until Stop() is called on the Recorder returned, or
+// Record() is called again.
+func (db *DB) Record(w io.Writer) *Recorder {
+	bw := bufio.NewWriter(w)
+	r := &Recorder{db: db, w: bw, enc: json.NewEncoder(bw)}
+	if prev := db.recorder.Swap(r); prev != nil {
+		prev.Stop()
+	}
+	return r
+}
+
+// Stop stops recording, flushing the statements captured. It returns the
+// first error found writing them, if any.
+func (r *Recorder) Stop() error {
+	r.db.recorder.CompareAndSwap(r, nil)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && !r.stopped {
+		r.err = r.w.Flush()
+	}
+	r.stopped = true
+	return r.err
+}
+
+// recordStatement captures a statement that started running at start, if
+// recording.
+func (db *DB) recordStatement(start time.Time, query string, args []interface{}, exec bool, wait, latency time.Duration, err error) {
+	r := db.recorder.Load()
+	if r == nil {
+		return
+	}
+
+	s := RecordedStatement{
+		Time:     start.Add(-wait),
+		Query:    query,
+		Exec:     exec,
+		Wait:     wait,
+		Duration: latency,
+	}
+	for _, arg := range args {
+		if b, ok := arg.([]byte); ok {
+			arg = string(b)
+		}
+		s.Args = append(s.Args, arg)
+	}
+	if err != nil {
+		s.Err = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && !r.stopped {
+		r.err = r.enc.Encode(s)
+	}
+}
+
+// ReplaySettings configures Replay().
+type ReplaySettings struct {
+	// Speed scales the pace at which statements are issued: 2 replays them
+	// twice as fast as recorded. Zero means 1, and negative values issue
+	// them all at once.
+	Speed float64
+
+	// Simulate makes statements take a connection for as long as they ran
+	// when recorded, without running them, to model pool settings
+	// without a database.
+	Simulate bool
+}
+
+// ReplayResult summarizes a replay.
+type ReplayResult struct {
+	Statements int
+	Errors     int       // Statements that failed
+	Latency    Histogram // Including the time waited for connections
+}
+
+// Replay issues the statements in a recording made with DB.Record() on db,
+// keeping the pace at which they were issued, scaled as set. Statements are
+// run concurrently as needed, each on its own goroutine, so that the load on
+// the pool matches the original one; waits on db can be seen in its PoolStats()
+// afterwards. Query results are read and discarded. Replay returns once all
+// statements are done, or ctx is done, which cancels statements running.
+// Errors reading the recording are returned, but failed statements are just
+// counted, as in the recording.
+func Replay(ctx context.Context, recording io.Reader, db *DB, settings ReplaySettings) (ReplayResult, error) {
+	speed := settings.Speed
+	if speed == 0 {
+		speed = 1
+	}
+
+	var res ReplayResult
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	latency := new(histogram)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dec := json.NewDecoder(recording)
+	var first time.Time
+	began := time.Now()
+	var err error
+
+	for {
+		var s RecordedStatement
+		if err = dec.Decode(&s); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			break
+		}
+
+		if first.IsZero() {
+			first = s.Time
+		}
+		if speed > 0 {
+			due := began.Add(time.Duration(float64(s.Time.Sub(first)) / speed))
+			if err = sleep(ctx, time.Until(due)); err != nil {
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := db.replay(ctx, s, settings.Simulate)
+			latency.observe(time.Since(start))
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Statements++
+			if err != nil {
+				res.Errors++
+			}
+		}()
+	}
+
+	if err != nil {
+		cancel()
+	}
+	wg.Wait()
+	res.Latency = latency.snapshot()
+	return res, err
+}
+
+// replay runs a recorded statement, or simulates it.
+func (db *DB) replay(ctx context.Context, s RecordedStatement, simulate bool) error {
+	if simulate {
+		release, _, err := db.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return sleep(ctx, s.Duration)
+	}
+
+	if s.Exec {
+		_, err := db.ExecContext(ctx, s.Query, s.Args...)
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, s.Query, s.Args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	return rows.Close()
+}
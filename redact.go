@@ -0,0 +1,75 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"regexp"
+	"sync"
+)
+
+var (
+	redactor    func(string) string
+	redactorMux sync.RWMutex
+
+	userinfoRe = regexp.MustCompile(`([^\s:/@'"]+):[^\s/]\S*@`)
+	paramRe    = regexp.MustCompile(`(?i)\b(password|passwd|pwd|sslpassword|secret|token|access_token|auth_token|api_key)=('(?:[^'\\]|\\.)*'|[^\s&;]*)`)
+)
+
+// RedactDSN masks the passwords and other secrets found in DSNs within s. It
+// handles user:password@ prefixes (as found in URL-style and MySQL-style DSNs)
+// and parameters such as password=x (in URL queries and Postgres key/value
+// DSNs). This is the default redaction function; see SetRedactor().
+func RedactDSN(s string) string {
+	s = userinfoRe.ReplaceAllString(s, "$1:xxxxx@")
+	return paramRe.ReplaceAllString(s, "$1=xxxxx")
+}
+
+// SetRedactor sets the function used to mask sensitive information, such as
+// the password in a DSN, in errors reported by dbcontrol when opening
+// databases, and in errors carried by events. Setting it to nil restores the
+// default RedactDSN(). Note that errors returned by queries are passed through
+// unchanged.
+func SetRedactor(f func(string) string) {
+	redactorMux.Lock()
+	defer redactorMux.Unlock()
+	redactor = f
+}
+
+func redact(s string) string {
+	redactorMux.RLock()
+	f := redactor
+	redactorMux.RUnlock()
+
+	if f == nil {
+		f = RedactDSN
+	}
+	return f(s)
+}
+
+// redactedError is an error whose message was redacted.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with its message redacted. The error is returned as
+// is if there's nothing to redact, so that it can still be inspected.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	if r := redact(msg); r != msg {
+		return &redactedError{err: err, msg: r}
+	}
+	return err
+}
@@ -0,0 +1,511 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Register registers a driver with database/sql under the given name, wrapping
+// drv so that a plain *sql.DB opened with it (as in sql.Open("mysql-limited",
+// dsn)) caps the connections in use, for code and libraries that insist on
+// *sql.DB, such as ORMs and migration tools. Each *sql.DB gets its own limit,
+// as set with SetConcurrency() at the time it's opened, or shares the limit of
+// its host if host grouping is enabled (see SetHostGrouping()). A connection
+// takes a token while in use, that is, while running a statement or holding an
+// open result set or transaction, waiting for one as needed. The cap thus holds
+// regardless of the size of the pool, though idle connections handed out (as
+// with sql.DB.Conn()) don't count against it. Use RegisteredStats() to get the
+// wait metrics. Other
+// features of DB are not available this way. As with sql.Register(), it panics
+// if called twice with the same name.
+func Register(name string, drv driver.Driver) {
+	sql.Register(name, &limitedDriver{Driver: drv})
+}
+
+// DriverStats holds the statistics of a *sql.DB opened with a driver registered
+// with Register().
+type DriverStats struct {
+	Limit    int    // Connections allowed in use at once, or 0 for no limit
+	InUse    int    // Connections currently in use
+	Waiting  int    // Callers waiting for a connection
+	Waits    uint64 // Times a connection had to wait before use
+	WaitTime Histogram
+}
+
+// RegisteredStats returns the statistics of pool, as opened with a driver
+// registered with Register(). It returns false if pool was opened otherwise.
+func RegisteredStats(pool *sql.DB) (DriverStats, bool) {
+	l, ok := pool.Driver().(*limiter)
+	if !ok {
+		return DriverStats{}, false
+	}
+
+	s := DriverStats{
+		InUse:    int(atomic.LoadInt32(&l.inUse)),
+		Waits:    atomic.LoadUint64(&l.waits),
+		WaitTime: l.waitTime.snapshot(),
+	}
+	if l.sem != nil {
+		s.Limit = l.sem.limit()
+		s.Waiting = l.sem.waiting()
+	}
+	return s, true
+}
+
+// limitedDriver is the driver registered by Register().
+type limitedDriver struct {
+	driver.Driver
+}
+
+// Open opens a connection outside of any *sql.DB, that takes tokens from a
+// limit of its own.
+func (d *limitedDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector is called by database/sql once for each *sql.DB, so the limit
+// is kept by the connector.
+func (d *limitedDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	var base driver.Connector
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		var err error
+		if base, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	} else {
+		base = dsnConnector{driver: d.Driver, dsn: dsn}
+	}
+
+	l := &limiter{driver: d, waitTime: new(histogram)}
+	if c := Concurrency(); c > 0 {
+		if host := dsnHost(dsn); host != "" && HostGrouping() {
+			l.sem = hostLimitFor(host, c).sem
+		} else {
+			l.sem = newSemaphore(c)
+		}
+	}
+
+	return &limitedConnector{Connector: base, acquire: l.acquire, driver: l}, nil
+}
+
+// limiter keeps the limit of a *sql.DB opened with a registered driver. It's
+// also returned as the driver of the connector, so that RegisteredStats() can
+// get to it through sql.DB.Driver().
+type limiter struct {
+	inUse int32  // Accessed atomically
+	waits uint64 // Accessed atomically
+
+	driver   *limitedDriver
+	sem      *semaphore // Nil if not limited
+	waitTime *histogram
+}
+
+func (l *limiter) Open(dsn string) (driver.Conn, error) {
+	return l.driver.Open(dsn)
+}
+
+// acquire takes a token for a connection about to be used, returning the
+// function to give it back.
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	start := time.Now()
+	if l.sem != nil && !l.sem.tryAcquire(1) {
+		atomic.AddUint64(&l.waits, 1)
+		if err := l.sem.acquire(ctx, 1, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	l.waitTime.observe(time.Since(start))
+	atomic.AddInt32(&l.inUse, 1)
+	return l.release, nil
+}
+
+// release gives back the token of a connection no longer in use.
+func (l *limiter) release() {
+	atomic.AddInt32(&l.inUse, -1)
+	if l.sem != nil {
+		l.sem.release(1)
+	}
+}
+
+// limitedConnector makes connections that take a token while in use. See
+// limitedConn.
+type limitedConnector struct {
+	driver.Connector
+	acquire func(ctx context.Context) (release func(), err error)
+	driver  driver.Driver
+}
+
+func (c *limitedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, acquire: c.acquire}, nil
+}
+
+func (c *limitedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// limitedConn wraps a connection that takes a token while in use, that is,
+// while running a statement, or while a result set or a transaction on it is
+// open. Database/sql gives drivers no reliable notice of connections being
+// handed out or returned to the pool (connections it opens on its own go
+// straight to the idle pool, for instance), so tokens follow the work done on
+// the connection instead. Result sets, transactions and prepared statements
+// are wrapped for that purpose. Calls on a connection are serialized by
+// database/sql, so no locking is required. Like driverConn, it implements all
+// optional interfaces, falling back to the behavior of database/sql if the
+// underlying connection doesn't.
+type limitedConn struct {
+	driver.Conn
+	acquire func(ctx context.Context) (release func(), err error)
+	release func() // Nil if the connection holds no token
+	active  int    // Statements, result sets and transactions in progress
+}
+
+// begin accounts for work starting on the connection, taking a token unless
+// it holds one already.
+func (c *limitedConn) begin(ctx context.Context) error {
+	if c.active == 0 {
+		release, err := c.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		c.release = release
+	}
+	c.active++
+	return nil
+}
+
+// end accounts for work done on the connection, giving back the token once
+// there's none left.
+func (c *limitedConn) end() {
+	if c.active--; c.active == 0 {
+		c.releaseToken()
+	}
+}
+
+func (c *limitedConn) releaseToken() {
+	c.active = 0
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+func (c *limitedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *limitedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *limitedConn) Close() error {
+	// Closed with work in progress, as when a transaction is abandoned
+	c.releaseToken()
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) Ping(ctx context.Context) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	defer c.end()
+
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *limitedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *limitedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer c.end()
+
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else if stmt, err = c.Conn.Prepare(query); err == nil {
+		select {
+		case <-ctx.Done():
+			stmt.Close()
+			return nil, ctx.Err()
+		default:
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &limitedStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *limitedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	tx, err := beginTx(ctx, c.Conn, opts)
+	if err != nil {
+		c.end()
+		return nil, err
+	}
+	return &limitedTx{Tx: tx, conn: c}, nil
+}
+
+func (c *limitedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	e, _ := c.Conn.(driver.Execer)
+	if !ok && e == nil {
+		// Run as a prepared statement instead
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer c.end()
+
+	if ec != nil {
+		return ec.ExecContext(ctx, query, args)
+	}
+
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return e.Exec(query, values)
+}
+
+func (c *limitedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	q, _ := c.Conn.(driver.Queryer)
+	if !ok && q == nil {
+		// Run as a prepared statement instead
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	var err error
+	if qc != nil {
+		rows, err = qc.QueryContext(ctx, query, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				rows, err = q.Query(query, values)
+			}
+		}
+	}
+	return c.rows(rows, err)
+}
+
+// rows wraps the outcome of a query, so that the token is held until the
+// result set is closed.
+func (c *limitedConn) rows(rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		c.end()
+		return nil, err
+	}
+	return &limitedRows{Rows: rows, conn: c}, nil
+}
+
+// limitedTx wraps a transaction on a limitedConn, holding the token until
+// committed or rolled back.
+type limitedTx struct {
+	driver.Tx
+	conn *limitedConn
+	done bool
+}
+
+func (tx *limitedTx) Commit() error {
+	defer tx.end()
+	return tx.Tx.Commit()
+}
+
+func (tx *limitedTx) Rollback() error {
+	defer tx.end()
+	return tx.Tx.Rollback()
+}
+
+func (tx *limitedTx) end() {
+	if !tx.done {
+		tx.done = true
+		tx.conn.end()
+	}
+}
+
+// limitedStmt wraps a prepared statement on a limitedConn, taking a token while
+// running.
+type limitedStmt struct {
+	driver.Stmt
+	conn *limitedConn
+}
+
+func (s *limitedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.conn.begin(context.Background()); err != nil {
+		return nil, err
+	}
+	defer s.conn.end()
+	return s.Stmt.Exec(args)
+}
+
+func (s *limitedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.conn.begin(context.Background()); err != nil {
+		return nil, err
+	}
+	return s.conn.rows(s.Stmt.Query(args))
+}
+
+func (s *limitedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.conn.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer s.conn.end()
+
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return ec.ExecContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func (s *limitedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return s.conn.rows(qc.QueryContext(ctx, args))
+	}
+	values, err := namedValues(args)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return s.conn.rows(nil, err)
+	}
+	return s.conn.rows(s.Stmt.Query(values))
+}
+
+func (s *limitedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+func (s *limitedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if c, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return c.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// limitedRows wraps a result set on a limitedConn, holding the token until
+// closed.
+type limitedRows struct {
+	driver.Rows
+	conn   *limitedConn
+	closed bool
+}
+
+func (r *limitedRows) Close() error {
+	err := r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		r.conn.end()
+	}
+	return err
+}
+
+func (r *limitedRows) HasNextResultSet() bool {
+	if n, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return n.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *limitedRows) NextResultSet() error {
+	if n, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return n.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *limitedRows) ColumnTypeScanType(index int) reflect.Type {
+	if t, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return t.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *limitedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if t, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return t.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *limitedRows) ColumnTypeLength(index int) (int64, bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return t.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *limitedRows) ColumnTypeNullable(index int) (bool, bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return t.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *limitedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return t.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
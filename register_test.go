@@ -0,0 +1,156 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+const limitedDriverName = "dbcontroltest-limited"
+
+var registerOnce sync.Once
+
+// openLimited opens a plain *sql.DB on a new Fake, through the fake driver
+// wrapped with Register().
+func openLimited(t *testing.T, limit int) (*sql.DB, *dbcontroltest.Fake) {
+	t.Helper()
+
+	f := dbcontroltest.New()
+	t.Cleanup(f.Close)
+	registerOnce.Do(func() {
+		pool, err := sql.Open(dbcontroltest.DriverName, f.DSN())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbcontrol.Register(limitedDriverName, pool.Driver())
+		pool.Close()
+	})
+
+	prev := dbcontrol.Concurrency()
+	dbcontrol.SetConcurrency(limit)
+	defer dbcontrol.SetConcurrency(prev)
+
+	pool, err := sql.Open(limitedDriverName, f.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool, f
+}
+
+// inUse returns the connections in use on pool, according to its limit.
+func inUse(t *testing.T, pool *sql.DB) int {
+	t.Helper()
+
+	s, ok := dbcontrol.RegisteredStats(pool)
+	if !ok {
+		t.Fatal("not opened with a registered driver")
+	}
+	return s.InUse
+}
+
+func TestRegisterTokens(t *testing.T) {
+	pool, _ := openLimited(t, 2)
+	pool.SetMaxOpenConns(10)
+
+	// Transactions and result sets hold their token until done
+	tx, err := pool.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := pool.Query("SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := inUse(t, pool); n != 2 {
+		t.Fatalf("%d connections in use, want 2", n)
+	}
+	rows.Close()
+	tx.Commit()
+
+	// Statements run on their own, prepared or not
+	stmt, err := pool.Prepare("SELECT a FROM t WHERE b = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stmt.QueryRow(1).Scan(new(int)); err != sql.ErrNoRows {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+	stmt.Close()
+	if err := pool.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection handed out holds no token while idle
+	conn, err := pool.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := inUse(t, pool); n != 0 {
+		t.Fatalf("%d connections in use with an idle Conn, want 0", n)
+	}
+
+	// Tokens are all given back once the pool is closed
+	tx, err = conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := inUse(t, pool); n != 1 {
+		t.Fatalf("%d connections in use, want 1", n)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	pool.Close()
+	if n := inUse(t, pool); n != 0 {
+		t.Fatalf("%d connections in use after Close(), want 0", n)
+	}
+}
+
+func TestRegisterLimit(t *testing.T) {
+	pool, f := openLimited(t, 2)
+	f.SetDefault(dbcontroltest.Result{Delay: 5 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pool.Exec("UPDATE t SET a = 1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// No more than 2 statements ran at once
+	calls := f.Calls()
+	for _, c := range calls {
+		running := 0
+		for _, other := range calls {
+			if !other.Start.After(c.Start) && other.End.After(c.Start) {
+				running++
+			}
+		}
+		if running > 2 {
+			t.Fatalf("%d statements ran at once, want 2 at most", running)
+		}
+	}
+	if n := inUse(t, pool); n != 0 {
+		t.Fatalf("%d connections in use, want 0", n)
+	}
+	if s, _ := dbcontrol.RegisteredStats(pool); s.Waits == 0 {
+		t.Fatal("no waits for 10 statements on 2 connections")
+	}
+}
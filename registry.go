@@ -0,0 +1,173 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	registry    = make(map[string]*DB) // Named DBs, by name
+	registryMux sync.RWMutex
+)
+
+// OpenNamed opens a DB as Open() does, and registers it under name, so that
+// metrics exporters, debug handlers and admin tools can find it (see DBs() and
+// Lookup()). Names must be unique among open DBs.
+func OpenNamed(name, driver, dsn string) (*DB, error) {
+	db, err := Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.SetName(name); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SetName registers the DB under name, as OpenNamed() does, for DBs opened
+// otherwise. The DB is registered under the new name only, and an empty name
+// unregisters it. It fails with ErrNameInUse if another open DB has the name.
+// DBs are unregistered when closed.
+func (db *DB) SetName(name string) error {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+
+	if other, ok := registry[name]; ok && name != "" && other != db {
+		return ErrNameInUse
+	}
+
+	if db.name != "" {
+		delete(registry, db.name)
+	}
+	db.name = name
+	if name != "" {
+		registry[name] = db
+	}
+	return nil
+}
+
+// Name returns the name the DB is registered under, or an empty string if
+// not registered.
+func (db *DB) Name() string {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	return db.name
+}
+
+// unregister removes the DB from the registry, if there.
+func (db *DB) unregister() {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+
+	if db.name != "" && registry[db.name] == db {
+		delete(registry, db.name)
+	}
+}
+
+// DBs returns the open DBs registered with OpenNamed() or SetName(), by name.
+func DBs() map[string]*DB {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+
+	dbs := make(map[string]*DB, len(registry))
+	for name, db := range registry {
+		dbs[name] = db
+	}
+	return dbs
+}
+
+// Lookup returns the open DB registered under name, if any.
+func Lookup(name string) (*DB, bool) {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+
+	db, ok := registry[name]
+	return db, ok
+}
+
+// maxPings is the number of DBs pinged at once by PingAll().
+const maxPings = 8
+
+// PingResult is the outcome of pinging a DB with PingAll().
+type PingResult struct {
+	Latency    time.Duration // Time the ping took
+	Err        error         // Error pinging, if any
+	InUse      int           // Connections in use
+	Limit      int           // Connections allowed in use at once (zero if not limited)
+	Waiting    int           // Callers waiting for a connection
+	Saturation float64       // Ratio of the last minute all connections were busy
+}
+
+// PingAll pings all open DBs registered with OpenNamed() or SetName(), a few at
+// a time, returning the results by name, so that services can check all their
+// databases in one call, at startup or in health endpoints. Pings use
+// connections that don't count against the limit of each DB, so that busy DBs
+// can be told apart from unreachable ones; how busy they are is reported along.
+// The error returned joins those of all failed pings, each one prefixed by the
+// name of the DB, or is nil if all succeeded. Pings are canceled once ctx is
+// done.
+func PingAll(ctx context.Context) (map[string]PingResult, error) {
+	dbs := DBs()
+	results := make(map[string]PingResult, len(dbs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxPings)
+
+	for name, db := range dbs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			res := db.ping(ctx)
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if err := results[name].Err; err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", redact(name), err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// ping pings the DB on a connection outside of the limit, for PingAll().
+func (db *DB) ping(ctx context.Context) PingResult {
+	start := time.Now()
+	err := db.pool().PingContext(ctx)
+	s := db.PoolStats()
+
+	res := PingResult{
+		Latency:    time.Since(start),
+		Err:        err,
+		InUse:      s.InUse,
+		Waiting:    s.Waiting,
+		Saturation: s.Wait1m.Saturation,
+	}
+	if db.sem != nil {
+		res.Limit = db.sem.limit()
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures automatic retries of failed operations. See
+// SetRetryPolicy().
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts, including the first one
+	Backoff     time.Duration // Delay before the first retry
+	MaxBackoff  time.Duration // Upper bound for delays (zero for no bound)
+	Jitter      float64       // Random fraction of the delay to add or subtract
+}
+
+// SetRetryPolicy enables automatic retries for Exec(), Query() and QueryRow()
+// (and their context variants) when they fail with a transient error, such as
+// a broken connection or a deadlock (see SetRetryable()). Delays between
+// attempts start at policy.Backoff and double each time, up to
+// policy.MaxBackoff, with a random jitter applied so that clients don't retry
+// in lockstep. Each attempt gets a
+// connection of its own, so that others can run in the meantime. Retries stop
+// early if the context for the operation is done. Note that statements are
+// retried as a whole, so make sure they are idempotent before enabling this
+// feature. Setting MaxAttempts to one or less (the default) disables retries.
+func (db *DB) SetRetryPolicy(policy RetryPolicy) {
+	db.retryMux.Lock()
+	defer db.retryMux.Unlock()
+	db.retryPolicy = policy
+}
+
+func (db *DB) getRetryPolicy() RetryPolicy {
+	db.retryMux.RLock()
+	defer db.retryMux.RUnlock()
+	return db.retryPolicy
+}
+
+// maxDuration is the longest time.Duration.
+const maxDuration = time.Duration(math.MaxInt64)
+
+// backoff returns the delay before the given retry (starting at 1).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		if d > maxDuration/2 {
+			// Doubling would overflow
+			d = maxDuration
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		j := float64(d) + (rand.Float64()*2-1)*p.Jitter*float64(d)
+		if j >= float64(maxDuration) {
+			return maxDuration
+		}
+		d = time.Duration(j)
+	}
+	return d
+}
+
+// retry runs op according to the retry policy, until it succeeds, fails with
+// an error that's not transient, or runs out of attempts.
+func (db *DB) retry(ctx context.Context, op func() error) error {
+	policy := db.getRetryPolicy()
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if attempt >= policy.MaxAttempts || !db.isTransient(err) {
+			return err
+		}
+
+		if err := sleep(ctx, policy.backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d to elapse or ctx to be done, whatever happens first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
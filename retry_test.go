@@ -0,0 +1,38 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		retry  int
+		want   time.Duration
+	}{
+		{RetryPolicy{Backoff: 10 * time.Millisecond}, 1, 10 * time.Millisecond},
+		{RetryPolicy{Backoff: 10 * time.Millisecond}, 4, 80 * time.Millisecond},
+		{RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 4, 50 * time.Millisecond},
+		{RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 100, 50 * time.Millisecond},
+
+		// With no bound, delays stop growing before they overflow
+		{RetryPolicy{Backoff: time.Second}, 100, maxDuration},
+		{RetryPolicy{Backoff: time.Second, Jitter: 0.5}, 100, -1},
+	}
+
+	for _, test := range tests {
+		d := test.policy.backoff(test.retry)
+		if test.want < 0 {
+			if d <= 0 {
+				t.Errorf("%+v: retry %d: got %v, want a positive delay", test.policy, test.retry, d)
+			}
+			continue
+		}
+		if d != test.want {
+			t.Errorf("%+v: retry %d: got %v, want %v", test.policy, test.retry, d, test.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Retryable tells which errors are transient, i.e., likely to go away if the
+// operation is retried. It's consulted for retries (see SetRetryPolicy()) and
+// by the circuit breaker, which only counts transient errors as failures (see
+// SetCircuitBreaker()). Use SetRetryable() to plug in your own classification.
+type Retryable interface {
+	IsRetryable(err error) bool
+}
+
+// RetryableFunc adapts an ordinary function to the Retryable interface.
+type RetryableFunc func(err error) bool
+
+func (f RetryableFunc) IsRetryable(err error) bool {
+	return f(err)
+}
+
+var (
+	// MySQLRetryable classifies MySQL errors: deadlocks (1213), lock wait
+	// timeouts (1205), server gone away (2006) and lost connections (2013), as
+	// well as network errors.
+	MySQLRetryable Retryable = RetryableFunc(func(err error) bool {
+		switch n, _ := mysqlErrorNumber(err); n {
+		case 1205, 1213, 2006, 2013:
+			return true
+		}
+		return isNetworkError(err)
+	})
+
+	// PostgresRetryable classifies Postgres errors: serialization failures
+	// (40001), deadlocks (40P01), connection exceptions (class 08) and server
+	// shutdowns (57P01 to 57P03), as well as network errors.
+	PostgresRetryable Retryable = RetryableFunc(func(err error) bool {
+		code, _ := sqlState(err)
+		switch {
+		case code == "40001", code == "40P01", strings.HasPrefix(code, "08"),
+			code == "57P01", code == "57P02", code == "57P03":
+			return true
+		}
+		return isNetworkError(err)
+	})
+
+	// DefaultRetryable combines MySQLRetryable and PostgresRetryable. It's
+	// used unless changed with SetRetryable().
+	DefaultRetryable Retryable = RetryableFunc(func(err error) bool {
+		return MySQLRetryable.IsRetryable(err) || PostgresRetryable.IsRetryable(err)
+	})
+)
+
+// SetRetryable sets the classification of transient errors for the DB. Setting
+// it to nil restores DefaultRetryable.
+func (db *DB) SetRetryable(r Retryable) {
+	db.retryMux.Lock()
+	defer db.retryMux.Unlock()
+	db.retryable = r
+}
+
+// isTransient tells whether err is likely to go away by retrying.
+func (db *DB) isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	db.retryMux.RLock()
+	r := db.retryable
+	db.retryMux.RUnlock()
+
+	if r == nil {
+		r = DefaultRetryable
+	}
+	return r.IsRetryable(err)
+}
+
+// isNetworkError tells whether err signals a broken connection.
+func isNetworkError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset by peer") ||
+		strings.Contains(msg, "broken pipe")
+}
+
+// mysqlErrorNumber returns the MySQL error number for err, if any. Errors from
+// github.com/go-sql-driver/mysql are recognized by their Number field, or else
+// their message, so that no dependency on the driver is required.
+func mysqlErrorNumber(err error) (int, bool) {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		v := reflect.ValueOf(e)
+		if v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+			if f := v.Elem().FieldByName("Number"); f.IsValid() && f.Kind() == reflect.Uint16 {
+				return int(f.Uint()), true
+			}
+		}
+	}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "Error ") {
+		return 0, false
+	}
+
+	msg = msg[len("Error "):]
+	end := strings.IndexFunc(msg, func(r rune) bool { return r < '0' || r > '9' })
+	if end <= 0 {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(msg[:end])
+	return n, err == nil
+}
+
+// sqlState returns the SQLSTATE code for err, if any. Errors providing a
+// SQLState() method (as those from github.com/lib/pq and github.com/jackc/pgx)
+// are recognized, as well as messages including the code.
+func sqlState(err error) (string, bool) {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if s, ok := e.(interface{ SQLState() string }); ok {
+			return s.SQLState(), true
+		}
+	}
+
+	msg := err.Error()
+	if i := strings.Index(msg, "SQLSTATE "); i >= 0 && len(msg) >= i+14 {
+		return msg[i+9 : i+14], true
+	}
+	return "", false
+}
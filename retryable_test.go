@@ -0,0 +1,101 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+func TestRetry(t *testing.T) {
+	f := dbcontroltest.New()
+	defer f.Close()
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	busy, fatal := errors.New("busy"), errors.New("fatal")
+	db.SetRetryable(dbcontrol.RetryableFunc(func(err error) bool {
+		return err != nil && err.Error() == busy.Error()
+	}))
+	db.SetRetryPolicy(dbcontrol.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	tests := []struct {
+		name    string
+		results []dbcontroltest.Result
+		err     error
+		calls   int
+	}{
+		{"success", []dbcontroltest.Result{{}}, nil, 1},
+		{"recovers", []dbcontroltest.Result{{Err: busy}, {Err: busy}, {}}, nil, 3},
+		{"runs out", []dbcontroltest.Result{{Err: busy}}, busy, 3},
+		{"not retryable", []dbcontroltest.Result{{Err: fatal}}, fatal, 1},
+		{"not retryable later", []dbcontroltest.Result{{Err: busy}, {Err: fatal}}, fatal, 2},
+	}
+
+	for _, test := range tests {
+		f.Reset()
+		f.On("UPDATE t SET a = 1", test.results...)
+
+		_, err := db.Exec("UPDATE t SET a = 1")
+		if (err == nil) != (test.err == nil) || err != nil && err.Error() != test.err.Error() {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if n := len(f.Calls()); n != test.calls {
+			t.Errorf("%s: ran %d times, want %d", test.name, n, test.calls)
+		}
+	}
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("syntax error"), false},
+		{driver.ErrBadConn, true},
+		{&mysqlError{1213}, true},
+		{&mysqlError{1205}, true},
+		{&mysqlError{1062}, false},
+		{pqError{"40001"}, true},
+		{pqError{"08006"}, true},
+		{pqError{"23505"}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.err != nil && dbcontrol.DefaultRetryable.IsRetryable(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// mysqlError looks like the errors of github.com/go-sql-driver/mysql.
+type mysqlError struct {
+	Number uint16
+}
+
+func (e *mysqlError) Error() string {
+	return fmt.Sprintf("mysql error %d", e.Number)
+}
+
+// pqError looks like the errors of github.com/lib/pq.
+type pqError struct {
+	code string
+}
+
+func (e pqError) Error() string {
+	return "pq error " + e.code
+}
+
+func (e pqError) SQLState() string {
+	return e.code
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupLayout is the time format used to name rotated files. It sorts
+// lexically in time order and avoids characters not allowed in file names.
+const backupLayout = "20060102T150405.000000000"
+
+// RotateOptions control when a RotatingFile is rotated and how many rotated
+// files are kept. Zero values disable the corresponding limit.
+type RotateOptions struct {
+	MaxSize    int64         // Rotate before the file exceeds this many bytes
+	MaxAge     time.Duration // Rotate once the file has been written this long
+	MaxBackups int           // Keep at most this many rotated files
+	Retention  time.Duration // Delete rotated files older than this
+}
+
+// RotatingFile is an io.Writer appending to a file that is rotated according
+// to RotateOptions. Rotated files are renamed after the original, with the
+// UTC time of rotation appended (e.g., "slow.log.20240102T150405.000000000"),
+// and old ones are deleted as retention limits are exceeded. It's safe for
+// concurrent use. RotatingFile can be used with SetEventWriter(), although
+// SetSlowLogFile() is usually more convenient.
+type RotatingFile struct {
+	path   string
+	opts   RotateOptions
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it if
+// needed.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, opts: opts}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.prune()
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if due. Data written in a
+// single call is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.due(len(p)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// due tells whether the file should be rotated before writing n bytes. Empty
+// files are never rotated.
+func (rf *RotatingFile) due(n int) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.opts.MaxSize > 0 && rf.size+int64(n) > rf.opts.MaxSize {
+		return true
+	}
+	return rf.opts.MaxAge > 0 && time.Since(rf.opened) >= rf.opts.MaxAge
+}
+
+// Rotate rotates the file right away, as when responding to a signal.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+
+	backup := rf.path + "." + time.Now().UTC().Format(backupLayout)
+	if err := os.Rename(rf.path, backup); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.prune()
+	return nil
+}
+
+// prune deletes rotated files beyond the retention limits. It's best effort:
+// files that can't be deleted are left behind.
+func (rf *RotatingFile) prune() {
+	if rf.opts.MaxBackups <= 0 && rf.opts.Retention <= 0 {
+		return
+	}
+
+	backups := rf.backups()
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, name := range backups {
+		t, _ := time.Parse(backupLayout, name[len(filepath.Base(rf.path))+1:])
+		if (rf.opts.MaxBackups > 0 && i >= rf.opts.MaxBackups) ||
+			(rf.opts.Retention > 0 && time.Since(t) > rf.opts.Retention) {
+			os.Remove(filepath.Join(filepath.Dir(rf.path), name))
+		}
+	}
+}
+
+// backups returns the names of the rotated files, without their directory.
+func (rf *RotatingFile) backups() []string {
+	entries, err := os.ReadDir(filepath.Dir(rf.path))
+	if err != nil {
+		return nil
+	}
+
+	prefix := filepath.Base(rf.path) + "."
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(backupLayout, name[len(prefix):]); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Close closes the file. Further writes fail.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// RowLimit caps the number of rows a query may return. See SetRowLimit().
+type RowLimit struct {
+	Max      int  // Maximum number of rows (zero if unlimited)
+	Truncate bool // Whether to truncate the result instead of failing
+}
+
+// RowLimitError is reported by Rows.Err() when a result set exceeds the row
+// limit in effect and truncation is not enabled.
+type RowLimitError struct {
+	Limit int
+}
+
+func (e *RowLimitError) Error() string {
+	return fmt.Sprintf("dbcontrol: result set exceeds %d rows", e.Limit)
+}
+
+type rowLimitKey struct{}
+
+// WithRowLimit returns a context that makes queries run with it use the given
+// row limit, instead of the one set with SetRowLimit(). A zero limit lifts the
+// DB limit for those queries.
+func WithRowLimit(ctx context.Context, limit RowLimit) context.Context {
+	return context.WithValue(ctx, rowLimitKey{}, limit)
+}
+
+// SetRowLimit caps the number of rows queries may return, so that unbounded
+// result sets can't exhaust memory. Once the limit is exceeded, Rows.Next()
+// returns false and the rows are closed, releasing the connection. Rows.Err()
+// then reports a *RowLimitError, unless truncation is enabled; in that case no
+// error is reported and Rows.Truncated() returns true instead. Passing a zero
+// limit (the default) removes the cap. The limit applies to queries run
+// afterwards, and can be overridden per query with WithRowLimit().
+func (db *DB) SetRowLimit(limit RowLimit) {
+	db.rowLimitMux.Lock()
+	defer db.rowLimitMux.Unlock()
+	db.rowLimit = limit
+}
+
+// RowLimit returns the limit set with SetRowLimit().
+func (db *DB) RowLimit() RowLimit {
+	db.rowLimitMux.RLock()
+	defer db.rowLimitMux.RUnlock()
+	return db.rowLimit
+}
+
+// newRows wraps the result of a query run with ctx, applying the row limit.
+func (db *DB) newRows(ctx context.Context, rows *sql.Rows, release func()) *Rows {
+	limit, ok := ctx.Value(rowLimitKey{}).(RowLimit)
+	if !ok {
+		limit = db.RowLimit()
+	}
+	return &Rows{Rows: rows, release: release, limit: limit}
+}
+
+// Truncated tells whether the result set was cut short because it exceeded
+// the row limit, with truncation enabled. See SetRowLimit().
+func (rows *Rows) Truncated() bool {
+	return rows.truncated
+}
+
+// exceeded checks whether the row limit is exceeded by the row about to be
+// returned by Next(), already counted, recording the outcome.
+func (rows *Rows) exceeded() bool {
+	if rows.limit.Max <= 0 || rows.count <= rows.limit.Max {
+		return false
+	}
+
+	if rows.limit.Truncate {
+		rows.truncated = true
+	} else {
+		rows.err = &RowLimitError{Limit: rows.limit.Max}
+	}
+	return true
+}
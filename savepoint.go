@@ -0,0 +1,97 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"strconv"
+)
+
+// Savepoint is a point within a transaction that it can be rolled back to,
+// without aborting the whole transaction. This is useful to nest transactional
+// units of work; see Tx.Transact().
+type Savepoint struct {
+	tx   *Tx
+	name string
+	done bool
+}
+
+// Savepoint sets a new savepoint within the transaction, using the syntax
+// appropriate for the dialect of the database (see SetDialect()).
+func (tx *Tx) Savepoint(ctx context.Context) (*Savepoint, error) {
+	tx.savepoints++
+	sp := &Savepoint{tx: tx, name: "dbcontrol_sp_" + strconv.Itoa(tx.savepoints)}
+
+	stmt := "SAVEPOINT " + sp.name
+	if tx.db.Dialect() == SQLServerDialect {
+		stmt = "SAVE TRANSACTION " + sp.name
+	}
+
+	if _, err := tx.Tx.ExecContext(ctx, stmt); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// Release discards the savepoint, keeping all changes made since it was set as
+// part of the transaction. (Changes are only made permanent when the whole
+// transaction is committed, though.)
+func (sp *Savepoint) Release(ctx context.Context) error {
+	if sp.done {
+		return nil
+	}
+	sp.done = true
+
+	if sp.tx.db.Dialect() == SQLServerDialect {
+		// No such thing in SQL Server; savepoints last until the end of
+		// the transaction.
+		return nil
+	}
+
+	_, err := sp.tx.Tx.ExecContext(ctx, "RELEASE SAVEPOINT "+sp.name)
+	return err
+}
+
+// Rollback undoes all changes made to the transaction since the savepoint was
+// set.
+func (sp *Savepoint) Rollback(ctx context.Context) error {
+	if sp.done {
+		return nil
+	}
+	sp.done = true
+
+	stmt := "ROLLBACK TO SAVEPOINT " + sp.name
+	if sp.tx.db.Dialect() == SQLServerDialect {
+		stmt = "ROLLBACK TRANSACTION " + sp.name
+	}
+
+	_, err := sp.tx.Tx.ExecContext(ctx, stmt)
+	return err
+}
+
+// Transact runs fn as a nested unit of work within the transaction, by means of
+// a savepoint. If fn returns nil, the savepoint is released and its changes are
+// kept as part of the transaction. Otherwise (or if fn panics) the transaction
+// is rolled back to the savepoint, undoing only the changes made by fn. This
+// mirrors DB.Transact(), so code written as a function of a *Tx can be run
+// either as a transaction of its own or nested within another.
+func (tx *Tx) Transact(ctx context.Context, fn func(*Tx) error) error {
+	sp, err := tx.Savepoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			sp.Rollback(ctx)
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		sp.Rollback(ctx)
+		return err
+	}
+
+	return sp.Release(ctx)
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// columnKey identifies the mapping of a result set to a struct type.
+type columnKey struct {
+	t       reflect.Type
+	columns string
+}
+
+// columnPaths caches the field paths for each column of a result set, so that
+// they're computed once per query and type.
+var columnPaths sync.Map // Of columnKey to [][]int
+
+// fieldPaths returns the path of the field in t for each of the columns.
+func fieldPaths(t reflect.Type, columns []string) ([][]int, error) {
+	key := columnKey{t: t, columns: strings.Join(columns, "\x00")}
+	if paths, ok := columnPaths.Load(key); ok {
+		return paths.([][]int), nil
+	}
+
+	m := fieldMap(t)
+	paths := make([][]int, len(columns))
+	for i, col := range columns {
+		path, ok := m[col]
+		if !ok {
+			if path, ok = m[strings.ToLower(col)]; !ok {
+				return nil, fmt.Errorf("dbcontrol: no field for column %q in %v", col, t)
+			}
+		}
+		paths[i] = path
+	}
+
+	columnPaths.Store(key, paths)
+	return paths, nil
+}
+
+// scanStruct scans the current row into v, a struct, matching columns to
+// fields as fieldMap() does.
+func scanStruct(rows *sql.Rows, v reflect.Value) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	paths, err := fieldPaths(v.Type(), columns)
+	if err != nil {
+		return err
+	}
+
+	dest := make([]interface{}, len(paths))
+	for i, path := range paths {
+		dest[i] = fieldByPath(v, path, true).Addr().Interface()
+	}
+	return rows.Scan(dest...)
+}
+
+// scanInto scans the current row into dest, a pointer. Structs (and pointers to
+// structs) are scanned field by field, except for those implementing sql.Scanner (such as
+// sql.NullString) or time.Time, which are scanned as a single column like any
+// other type.
+func scanInto(rows *sql.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest).Elem()
+	if v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct {
+		// Pointer to struct: allocate it, unless scanned as a whole
+		p := reflect.New(v.Type().Elem())
+		if !isScalar(p) {
+			v.Set(p)
+			v = p.Elem()
+		}
+	}
+
+	if v.Kind() == reflect.Struct && !isScalar(v.Addr()) {
+		return scanStruct(rows, v)
+	}
+	return rows.Scan(dest)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isScalar tells whether p points to a value that's scanned as a single column.
+func isScalar(p reflect.Value) bool {
+	if _, ok := p.Interface().(sql.Scanner); ok {
+		return true
+	}
+	return p.Elem().Type() == timeType
+}
+
+// ScanStruct scans the current row into dest, a pointer to a struct. Columns
+// are matched to fields by their "db" tag, or else by their lowercased name, as
+// in NamedExec(). The mapping is computed once per query and type.
+func (rows *Rows) ScanStruct(dest interface{}) error {
+	v, err := structDest(dest)
+	if err != nil {
+		return err
+	}
+	return scanStruct(rows.Rows, v)
+}
+
+// ScanMap scans the current row into dest, keyed by column name. Values are
+// those returned by the driver, except that byte slices are copied, so they
+// remain valid after the next call to Next().
+func (rows *Rows) ScanMap(dest map[string]interface{}) error {
+	return scanMap(rows.Rows, dest)
+}
+
+// ScanStruct is like Rows.ScanStruct(), for the single row. It returns
+// sql.ErrNoRows if the query returned no rows.
+func (row *Row) ScanStruct(dest interface{}) error {
+	return row.scan(func() error {
+		v, err := structDest(dest)
+		if err != nil {
+			return err
+		}
+		return scanStruct(row.rows, v)
+	})
+}
+
+// ScanMap is like Rows.ScanMap(), for the single row. It returns sql.ErrNoRows
+// if the query returned no rows.
+func (row *Row) ScanMap(dest map[string]interface{}) error {
+	return row.scan(func() error { return scanMap(row.rows, dest) })
+}
+
+// structDest returns the struct dest points to, as scanned by ScanStruct().
+func structDest(dest interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("dbcontrol: ScanStruct needs a pointer to a struct, not %T", dest)
+	}
+	return v.Elem(), nil
+}
+
+// scanMap scans the current row into dest, as described for ScanMap().
+func scanMap(rows *sql.Rows, dest map[string]interface{}) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	rv := newRowValues(len(columns))
+	if err := rows.Scan(rv.ptrs...); err != nil {
+		return err
+	}
+
+	for i, col := range columns {
+		v := rv.values[i]
+		if b, ok := v.([]byte); ok {
+			v = append([]byte(nil), b...)
+		}
+		dest[col] = v
+	}
+	return nil
+}
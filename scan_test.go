@@ -0,0 +1,214 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+type user struct {
+	ID    int64  `db:"id"`
+	Name  string `db:"name"`
+	Email sql.NullString
+}
+
+// openUsers opens a DB on a Fake holding two users.
+func openUsers(t *testing.T) (*dbcontrol.DB, *dbcontroltest.Fake) {
+	t.Helper()
+
+	f := dbcontroltest.New()
+	f.On("SELECT id, name, email FROM users", dbcontroltest.Result{
+		Columns: []string{"id", "name", "Email"},
+		Rows: [][]driver.Value{
+			{int64(1), []byte("ann"), "ann@example.com"},
+			{int64(2), []byte("bob"), nil},
+		},
+	})
+	f.On("SELECT id, name, email FROM nobody", dbcontroltest.Result{
+		Columns: []string{"id", "name", "email"},
+	})
+
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		f.Close()
+	})
+	return db, f
+}
+
+func TestRowsScanStruct(t *testing.T) {
+	db, f := openUsers(t)
+
+	rows, err := db.Query("SELECT id, name, email FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []user
+	for rows.Next() {
+		var u user
+		if err := rows.ScanStruct(&u); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, u)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []user{
+		{1, "ann", sql.NullString{String: "ann@example.com", Valid: true}},
+		{2, "bob", sql.NullString{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if n := f.InUse(); n != 0 {
+		t.Fatalf("%d connections in use, want 0", n)
+	}
+}
+
+func TestRowsScanMap(t *testing.T) {
+	db, _ := openUsers(t)
+
+	rows, err := db.Query("SELECT id, name, email FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []map[string]interface{}
+	for rows.Next() {
+		m := make(map[string]interface{})
+		if err := rows.ScanMap(m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+
+	// Byte slices are copied, so they outlive the row
+	want := []map[string]interface{}{
+		{"id": int64(1), "name": []byte("ann"), "Email": "ann@example.com"},
+		{"id": int64(2), "name": []byte("bob"), "Email": nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestRowScanStruct(t *testing.T) {
+	db, f := openUsers(t)
+
+	var u user
+	if err := db.QueryRow("SELECT id, name, email FROM users").ScanStruct(&u); err != nil {
+		t.Fatal(err)
+	}
+	want := user{1, "ann", sql.NullString{String: "ann@example.com", Valid: true}}
+	if u != want {
+		t.Fatalf("got %+v, want %+v", u, want)
+	}
+
+	err := db.QueryRow("SELECT id, name, email FROM nobody").ScanStruct(&u)
+	if err != sql.ErrNoRows {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+
+	err = db.QueryRow("SELECT id, name, email FROM users").ScanStruct(u)
+	if err == nil {
+		t.Fatal("ScanStruct() succeeded on a non-pointer")
+	}
+
+	// The connection is released whatever the outcome
+	if n := f.InUse(); n != 0 {
+		t.Fatalf("%d connections in use, want 0", n)
+	}
+}
+
+func TestRowScanMap(t *testing.T) {
+	db, f := openUsers(t)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	m := make(map[string]interface{})
+	if err := tx.QueryRow("SELECT id, name, email FROM users").ScanMap(m); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": int64(1), "name": []byte("ann"), "Email": "ann@example.com"}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %v, want %v", m, want)
+	}
+
+	err = tx.QueryRow("SELECT id, name, email FROM nobody").ScanMap(m)
+	if err != sql.ErrNoRows {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+
+	// The transaction holds on to its connection
+	if n := f.InUse(); n != 1 {
+		t.Fatalf("%d connections in use, want 1", n)
+	}
+}
+
+func TestRowErr(t *testing.T) {
+	db, f := openUsers(t)
+	boom := errors.New("boom")
+	f.On("SELECT boom", dbcontroltest.Result{Err: boom})
+
+	row := db.QueryRow("SELECT boom")
+	if err := row.Err(); err == nil || err.Error() != boom.Error() {
+		t.Fatalf("Err() = %v, want %v", err, boom)
+	}
+	var id int64
+	if err := row.Scan(&id); err == nil || err.Error() != boom.Error() {
+		t.Fatalf("Scan() = %v, want %v", err, boom)
+	}
+
+	var raw sql.RawBytes
+	if err := db.QueryRow("SELECT id, name, email FROM users").Scan(&id, &raw, &raw); err == nil {
+		t.Fatal("Scan() succeeded into sql.RawBytes")
+	}
+	if n := f.InUse(); n != 0 {
+		t.Fatalf("%d connections in use, want 0", n)
+	}
+}
+
+// TestRowBreaker checks that each QueryRow() counts once for the circuit
+// breaker: a success and a failure reach a 50% failure rate.
+func TestRowBreaker(t *testing.T) {
+	db, f := openUsers(t)
+	boom := errors.New("boom")
+	f.On("SELECT boom", dbcontroltest.Result{Err: boom})
+
+	db.SetRetryable(dbcontrol.RetryableFunc(func(err error) bool {
+		return err != nil && err.Error() == boom.Error()
+	}))
+	db.SetCircuitBreaker(dbcontrol.BreakerSettings{
+		FailureRate: 0.5,
+		MinRequests: 2,
+		CoolDown:    time.Hour,
+	})
+
+	var u user
+	if err := db.QueryRow("SELECT id, name, email FROM users").ScanStruct(&u); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRow("SELECT boom").Scan(&u.ID)
+
+	if s := db.BreakerState(); s != dbcontrol.BreakerOpen {
+		t.Fatalf("breaker %v, want open", s)
+	}
+}
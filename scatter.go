@@ -0,0 +1,200 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// PartialFailure sets how QueryAllShards() handles shards that fail.
+type PartialFailure int32
+
+const (
+	// FailFast stops at the first shard that fails, canceling the queries
+	// on the others.
+	FailFast PartialFailure = iota
+
+	// CollectErrors returns the rows of the shards that succeed, and reports
+	// the errors of those that fail once all rows are read.
+	CollectErrors
+)
+
+// ShardError is the error of a shard in QueryAllShards().
+type ShardError struct {
+	Shard int // Index of the shard
+	Err   error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("dbcontrol: shard %d: %v", e.Shard, e.Err)
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// SetPartialFailure sets how QueryAllShards() handles shards that fail. The
+// default is FailFast.
+func (s *Sharded) SetPartialFailure(p PartialFailure) {
+	atomic.StoreInt32((*int32)(&s.partialFailure), int32(p))
+}
+
+// PartialFailure returns the policy set with SetPartialFailure().
+func (s *Sharded) PartialFailure() PartialFailure {
+	return PartialFailure(atomic.LoadInt32((*int32)(&s.partialFailure)))
+}
+
+// shardResult is the outcome of a query on a shard.
+type shardResult struct {
+	shard int
+	rows  *Rows
+	err   error
+}
+
+// ShardRows holds the results of QueryAllShards(), merged from all shards. Its
+// Next(), Scan() and Close() methods are used as those of Rows, and Shard()
+// tells which shard the current row comes from.
+type ShardRows struct {
+	policy  PartialFailure
+	cancel  context.CancelFunc
+	results chan shardResult
+	pending int   // Shards whose results were not received yet
+	cur     *Rows // Rows being read
+	shard   int
+	errs    []error
+	closed  bool
+}
+
+// QueryAllShards runs a query on all shards concurrently, each taking a
+// connection under its own limits, and returns their rows merged. Results are
+// streamed shard by shard, in the order they become available, so that rows
+// are never buffered; results of other shards keep their connections until
+// read, so make sure to read them all or close ShardRows promptly. Shards that
+// fail are handled according to SetPartialFailure(). Any error is reported by
+// ShardRows.Err(), as a *ShardError, or several joined with errors.Join() with
+// the CollectErrors policy.
+func (s *Sharded) QueryAllShards(ctx context.Context, query string, args ...interface{}) *ShardRows {
+	ctx, cancel := context.WithCancel(ctx)
+	shards := s.Shards()
+
+	rows := &ShardRows{
+		policy:  s.PartialFailure(),
+		cancel:  cancel,
+		results: make(chan shardResult, len(shards)),
+		pending: len(shards),
+		shard:   -1,
+	}
+
+	for i, db := range shards {
+		go func(i int, db *DB) {
+			r, err := db.QueryContext(ctx, query, args...)
+			rows.results <- shardResult{shard: i, rows: r, err: err}
+		}(i, db)
+	}
+
+	return rows
+}
+
+// Next prepares the next row for reading with Scan(), waiting for the results
+// of the next shard as needed. It returns false when there are no more rows,
+// or a shard failed with the FailFast policy.
+func (rows *ShardRows) Next() bool {
+	if rows.closed {
+		return false
+	}
+
+	for {
+		if rows.cur != nil {
+			if rows.cur.Next() {
+				return true
+			}
+			err := rows.cur.Err()
+			rows.cur.Close()
+			rows.cur = nil
+			if err != nil && !rows.fail(rows.shard, err) {
+				return false
+			}
+		}
+
+		if rows.pending == 0 {
+			rows.Close()
+			return false
+		}
+
+		r := <-rows.results
+		rows.pending--
+		if r.err != nil {
+			if !rows.fail(r.shard, r.err) {
+				return false
+			}
+			continue
+		}
+		rows.cur, rows.shard = r.rows, r.shard
+	}
+}
+
+// fail records the error of a shard, telling whether to carry on with others.
+func (rows *ShardRows) fail(shard int, err error) bool {
+	rows.errs = append(rows.errs, &ShardError{Shard: shard, Err: err})
+	if rows.policy == FailFast {
+		rows.Close()
+		return false
+	}
+	return true
+}
+
+// Shard returns the index of the shard the current row comes from.
+func (rows *ShardRows) Shard() int {
+	return rows.shard
+}
+
+// Columns returns the column names of the current shard.
+func (rows *ShardRows) Columns() ([]string, error) {
+	if rows.cur == nil {
+		return nil, errors.New("dbcontrol: no current shard")
+	}
+	return rows.cur.Columns()
+}
+
+// Scan copies the columns of the current row into dest, as in sql.Rows.
+func (rows *ShardRows) Scan(dest ...interface{}) error {
+	if rows.cur == nil {
+		return errors.New("dbcontrol: Scan called without calling Next")
+	}
+	return rows.cur.Scan(dest...)
+}
+
+// Err returns the errors of the shards that failed, if any. See
+// QueryAllShards().
+func (rows *ShardRows) Err() error {
+	switch len(rows.errs) {
+	case 0:
+		return nil
+	case 1:
+		return rows.errs[0]
+	}
+	return errors.Join(rows.errs...)
+}
+
+// Close closes the rows of all shards, canceling queries still running.
+func (rows *ShardRows) Close() error {
+	if rows.closed {
+		return nil
+	}
+	rows.closed = true
+	rows.cancel()
+
+	if rows.cur != nil {
+		rows.cur.Close()
+		rows.cur = nil
+	}
+	for ; rows.pending > 0; rows.pending-- {
+		if r := <-rows.results; r.rows != nil {
+			r.rows.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"time"
+)
+
+// Period is a daily time window with its own connection limit, as used by
+// SetSchedule(). Start and End are offsets from midnight. If End is before
+// Start, the period spans across midnight (e.g., from 22h to 6h).
+type Period struct {
+	Start, End time.Duration
+	Limit      int
+}
+
+func (p Period) contains(offset time.Duration) bool {
+	if p.Start <= p.End {
+		return offset >= p.Start && offset < p.End
+	}
+	return offset >= p.Start || offset < p.End
+}
+
+// SetSchedule sets a daily schedule for the connection limit of the DB. While
+// the current time of day in loc (or local time, if loc is nil) falls within
+// one of the periods, the limit for the first such period is enforced instead
+// of the limit set at the time the DB was opened (see SetConcurrency()). The
+// original limit applies outside all periods. Changes take effect on the open
+// DB as the schedule goes, and a LimitChangeEvent is sent each time (see
+// SetEventCh()). Lowering the limit doesn't affect connections already in
+// use, but new ones won't be granted until usage falls below the new limit.
+// Setting a schedule replaces the previous one, if any. This has no effect on
+// databases that are not limiting connections.
+func (db *DB) SetSchedule(loc *time.Location, periods ...Period) {
+	if db.sem == nil {
+		return
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+
+	db.limitMux.Lock()
+	db.schedule = make([]Period, 0, len(periods))
+	for _, p := range periods {
+		if p.Limit > 0 {
+			db.schedule = append(db.schedule, p)
+		}
+	}
+
+	db.scheduleLoc = loc
+	e := db.applySchedule()
+	db.limitMux.Unlock()
+
+	db.notifyLimit(e)
+}
+
+// ClearSchedule removes the schedule set with SetSchedule(), restoring the
+// original connection limit.
+func (db *DB) ClearSchedule() {
+	db.SetSchedule(nil)
+}
+
+// applySchedule sets the target limit according to the schedule, and arms a
+// timer to do it again at the next period boundary. It returns the change to
+// notify, if any, as setLimit() does. Must be called with db.limitMux held.
+func (db *DB) applySchedule() *LimitChangeEvent {
+	if db.scheduleTimer != nil {
+		db.scheduleTimer.Stop()
+		db.scheduleTimer = nil
+	}
+	db.scheduleGen++
+
+	now := db.Clock().Now().In(db.scheduleLoc)
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, db.scheduleLoc)
+	offset := now.Sub(midnight)
+
+	db.target = db.maxConns
+	for _, p := range db.schedule {
+		if p.contains(offset) {
+			db.target = p.Limit
+			break
+		}
+	}
+	e := db.updateLimit(nil)
+
+	if len(db.schedule) == 0 || db.closed() {
+		return e
+	}
+
+	var next time.Time
+	for _, p := range db.schedule {
+		for _, b := range []time.Duration{p.Start, p.End} {
+			t := midnight.Add(b)
+			if !t.After(now) {
+				t = midnight.AddDate(0, 0, 1).Add(b)
+			}
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+	}
+
+	gen := db.scheduleGen
+	db.scheduleTimer = db.Clock().AfterFunc(next.Sub(now), func() {
+		db.limitMux.Lock()
+		var e *LimitChangeEvent
+		if gen == db.scheduleGen && !db.closed() {
+			e = db.applySchedule()
+		}
+		db.limitMux.Unlock()
+
+		db.notifyLimit(e)
+	})
+
+	return e
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// semaphore is a weighted counting semaphore whose size can be changed while in
+// use. Waiters are granted tokens in the order set by its fairness policy.
+type semaphore struct {
+	mu          sync.Mutex
+	size        int
+	cur         int
+	fairness    Fairness
+	waiters     list.List // of *waiter
+	tracked     int       // Waiters with a non-nil moved channel
+	lastRelease time.Time
+	avgInterval time.Duration // Between releases, while there are waiters
+	busy        bool          // Whether all tokens are in use
+	windows     windowRing    // Tracks the time all tokens are in use
+}
+
+type waiter struct {
+	weight int
+	since  time.Time
+	ready  chan struct{}
+	moved  chan struct{} // Signaled when the waiter moves up the queue
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{size: size}
+}
+
+// tryAcquire gets n tokens if readily available, without blocking.
+func (s *semaphore) tryAcquire(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.available(n) {
+		s.cur += n
+		s.updateBusy()
+		return true
+	}
+
+	return false
+}
+
+// available tells whether n tokens can be granted to a new caller right away,
+// according to the fairness policy. Must be called with s.mu held.
+func (s *semaphore) available(n int) bool {
+	if !s.fits(n) {
+		return false
+	}
+	// Waiters left are those that don't fit, so others may only overtake
+	// them if the policy allows
+	return s.waiters.Len() == 0 || s.fairness != FIFO
+}
+
+// fits tells whether n tokens are available. Callers taking more tokens than
+// the size (as it may have shrunk meanwhile) fit only when all of them are
+// free. Must be called with s.mu held.
+func (s *semaphore) fits(n int) bool {
+	return s.cur+n <= s.size || (s.cur == 0 && s.size > 0)
+}
+
+// acquire gets n tokens, blocking until available or ctx is done. If
+// maxWaiters is positive and there are already that many callers waiting,
+// ErrTooManyWaiters is returned instead. If progress is not nil, it's called
+// with the position in the queue (starting at 1) when the caller starts
+// waiting, and again each time the position changes.
+func (s *semaphore) acquire(ctx context.Context, n, maxWaiters int, progress func(int)) error {
+	s.mu.Lock()
+	if s.available(n) {
+		s.cur += n
+		s.updateBusy()
+		s.mu.Unlock()
+		return nil
+	}
+	if maxWaiters > 0 && s.waiters.Len() >= maxWaiters {
+		s.mu.Unlock()
+		return ErrTooManyWaiters
+	}
+
+	w := &waiter{weight: n, since: time.Now(), ready: make(chan struct{})}
+	if progress != nil {
+		w.moved = make(chan struct{}, 1)
+		w.moved <- struct{}{}
+		s.tracked++
+	}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	last := 0
+	for {
+		select {
+		case <-w.ready:
+			s.untrack(w)
+			return nil
+		case <-w.moved:
+			if pos := s.position(elem); pos > 0 && pos != last {
+				progress(pos)
+				last = pos
+			}
+		case <-ctx.Done():
+			s.mu.Lock()
+			select {
+			case <-w.ready:
+				// Granted right after ctx was done. Give it back.
+				s.cur -= n
+			default:
+				s.waiters.Remove(elem)
+				s.signalMoved()
+			}
+			if w.moved != nil {
+				s.tracked--
+			}
+			s.notify()
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *semaphore) untrack(w *waiter) {
+	if w.moved != nil {
+		s.mu.Lock()
+		s.tracked--
+		s.mu.Unlock()
+	}
+}
+
+// position returns the 1-based position of elem in the queue, in the order
+// waiters are served, or zero if no longer waiting.
+func (s *semaphore) position(elem *list.Element) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pos := 1
+	for e := s.next(nil); e != nil; e = s.next(e) {
+		if e == elem {
+			return pos
+		}
+		pos++
+	}
+	return 0
+}
+
+// next returns the waiter to consider after e (or the first one, if e is nil)
+// in the order waiters are served. Must be called with s.mu held.
+func (s *semaphore) next(e *list.Element) *list.Element {
+	switch {
+	case s.fairness == LIFO && e == nil:
+		return s.waiters.Back()
+	case s.fairness == LIFO:
+		return e.Prev()
+	case e == nil:
+		return s.waiters.Front()
+	}
+	return e.Next()
+}
+
+// signalMoved lets tracked waiters know that their position changed. Must be
+// called with s.mu held.
+func (s *semaphore) signalMoved() {
+	if s.tracked == 0 {
+		return
+	}
+
+	for e := s.waiters.Front(); e != nil; e = e.Next() {
+		if w := e.Value.(*waiter); w.moved != nil {
+			select {
+			case w.moved <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// release gives back n tokens.
+func (s *semaphore) release(n int) {
+	s.mu.Lock()
+	s.cur -= n
+
+	if now := time.Now(); s.waiters.Len() > 0 {
+		if !s.lastRelease.IsZero() {
+			s.avgInterval += (now.Sub(s.lastRelease) - s.avgInterval) / 8
+		}
+		s.lastRelease = now
+	} else {
+		s.lastRelease = time.Time{}
+	}
+
+	s.notify()
+	s.mu.Unlock()
+}
+
+// releaseInterval returns the average time between releases while there were
+// callers waiting, or the time since the last release if longer, as happens
+// when the pool is stuck. It returns zero until tokens were released to
+// waiters at least twice.
+func (s *semaphore) releaseInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.waiters.Len() > 0 && !s.lastRelease.IsZero() {
+		if d := time.Since(s.lastRelease); d > s.avgInterval {
+			return d
+		}
+	}
+	return s.avgInterval
+}
+
+// resize changes the number of tokens. Shrinking below the number of tokens in
+// use doesn't affect current holders, but no new tokens will be granted until
+// enough of them are released.
+func (s *semaphore) resize(size int) {
+	s.mu.Lock()
+	s.size = size
+	s.notify()
+	s.mu.Unlock()
+}
+
+// waiting returns the number of callers waiting for a token.
+func (s *semaphore) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
+
+// longestWait returns the time the oldest caller still waiting has waited, or
+// zero if none are.
+func (s *semaphore) longestWait() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest time.Time
+	for e := s.waiters.Front(); e != nil; e = e.Next() {
+		if since := e.Value.(*waiter).since; oldest.IsZero() || since.Before(oldest) {
+			oldest = since
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+func (s *semaphore) limit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// setFairness changes the order waiters are served in.
+func (s *semaphore) setFairness(f Fairness) {
+	s.mu.Lock()
+	s.fairness = f
+	s.notify()
+	s.signalMoved()
+	s.mu.Unlock()
+}
+
+func (s *semaphore) getFairness() Fairness {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fairness
+}
+
+// notify grants tokens to waiters while available, in the order set by the
+// fairness policy. With FIFO and LIFO, a waiter whose weight doesn't fit
+// blocks those after it; with FirstFit, they are skipped. Must be called with
+// s.mu held.
+func (s *semaphore) notify() {
+	granted := false
+	for e := s.next(nil); e != nil && s.cur < s.size; {
+		w := e.Value.(*waiter)
+		if !s.fits(w.weight) {
+			if s.fairness != FirstFit {
+				break
+			}
+			e = s.next(e)
+			continue
+		}
+
+		next := s.next(e)
+		s.cur += w.weight
+		s.waiters.Remove(e)
+		close(w.ready)
+		granted = true
+		e = next
+	}
+
+	if granted {
+		s.signalMoved()
+	}
+	s.updateBusy()
+}
+
+// updateBusy records changes in whether all tokens are in use. Must be called
+// with s.mu held.
+func (s *semaphore) updateBusy() {
+	if busy := s.size > 0 && s.cur >= s.size; busy != s.busy {
+		s.busy = busy
+		s.windows.setBusy(busy)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// queue makes a caller wait on s for weight tokens, returning once it's
+// queued. The channel returned gets the error from acquire().
+func queue(t *testing.T, s *semaphore, ctx context.Context, weight int) <-chan error {
+	t.Helper()
+
+	queued := s.waiting()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.acquire(ctx, weight, 0, nil)
+	}()
+
+	waitFor(t, func() bool { return s.waiting() > queued })
+	return done
+}
+
+// waitFor waits until cond holds, failing the test if it takes too long.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSemaphoreFairness(t *testing.T) {
+	type step struct {
+		release int
+		granted []string
+	}
+
+	// Two tokens are held, one each, and a heavy caller taking both queues
+	// before two light ones. Tokens are then released as the steps go.
+	tests := []struct {
+		fairness Fairness
+		steps    []step
+	}{
+		{FIFO, []step{
+			{1, nil}, // The heavy caller holds up the light ones
+			{1, []string{"heavy"}},
+			{2, []string{"light1", "light2"}},
+		}},
+		{LIFO, []step{
+			{1, []string{"light2"}},
+			{1, []string{"light1"}},
+			{2, []string{"heavy"}},
+		}},
+		{FirstFit, []step{
+			{1, []string{"light1"}},
+			{1, []string{"light2"}},
+			{2, []string{"heavy"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fairness.String(), func(t *testing.T) {
+			s := newSemaphore(2)
+			s.setFairness(tt.fairness)
+			for i := 0; i < 2; i++ {
+				if !s.tryAcquire(1) {
+					t.Fatal("tryAcquire() failed on a free semaphore")
+				}
+			}
+
+			ctx := context.Background()
+			names := []string{"heavy", "light1", "light2"}
+			waiters := map[string]<-chan error{
+				"heavy":  queue(t, s, ctx, 2),
+				"light1": queue(t, s, ctx, 1),
+				"light2": queue(t, s, ctx, 1),
+			}
+			if s.tryAcquire(1) {
+				t.Fatal("tryAcquire() succeeded on a full semaphore")
+			}
+
+			for i, st := range tt.steps {
+				s.release(st.release)
+
+				var granted []string
+				for _, name := range names {
+					select {
+					case err := <-waiters[name]:
+						if err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						granted = append(granted, name)
+						delete(waiters, name)
+					case <-time.After(20 * time.Millisecond):
+					}
+				}
+
+				slices.Sort(granted)
+				if !slices.Equal(granted, st.granted) {
+					t.Fatalf("step %d: granted %q, want %q", i, granted, st.granted)
+				}
+				if got := s.waiting(); got != len(waiters) {
+					t.Fatalf("step %d: %d waiting, want %d", i, got, len(waiters))
+				}
+			}
+		})
+	}
+}
+
+func TestSemaphoreOversize(t *testing.T) {
+	s := newSemaphore(2)
+
+	// Taking more tokens than the size is allowed once all are free
+	if !s.tryAcquire(3) {
+		t.Fatal("oversize tryAcquire() failed on a free semaphore")
+	}
+	if s.tryAcquire(1) {
+		t.Fatal("tryAcquire() succeeded while oversize tokens were held")
+	}
+	s.release(3)
+
+	// A waiter left oversize by shrinking is served once all are free
+	s.tryAcquire(1)
+	done := queue(t, s, context.Background(), 2)
+	s.resize(1)
+	s.release(1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	s.release(2)
+	if !s.tryAcquire(1) {
+		t.Fatal("tryAcquire() failed on a free semaphore")
+	}
+}
+
+func TestSemaphoreCancel(t *testing.T) {
+	s := newSemaphore(1)
+	s.tryAcquire(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := queue(t, s, ctx, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if got := s.waiting(); got != 0 {
+		t.Fatalf("%d waiting after cancelation, want 0", got)
+	}
+
+	s.release(1)
+	if !s.tryAcquire(1) {
+		t.Fatal("token lost after cancelation")
+	}
+}
+
+// TestSemaphoreCancelRace cancels waiters while the token is being granted to
+// them. Those that fail must give it back to the waiter behind them.
+func TestSemaphoreCancelRace(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		s := newSemaphore(1)
+		s.tryAcquire(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		first := queue(t, s, ctx, 1)
+		second := queue(t, s, context.Background(), 1)
+
+		go cancel()
+		s.release(1)
+
+		if err := <-first; err != nil {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want context.Canceled", err)
+			}
+		} else {
+			s.release(1)
+		}
+
+		select {
+		case err := <-second:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("token not passed on after cancelation")
+		}
+		s.release(1)
+
+		if !s.tryAcquire(1) {
+			t.Fatal("token lost")
+		}
+		cancel()
+	}
+}
+
+func TestSemaphoreMaxWaiters(t *testing.T) {
+	s := newSemaphore(1)
+	s.tryAcquire(1)
+
+	done := queue(t, s, context.Background(), 1)
+	if err := s.acquire(context.Background(), 1, 1, nil); !errors.Is(err, ErrTooManyWaiters) {
+		t.Fatalf("got %v, want ErrTooManyWaiters", err)
+	}
+
+	s.release(1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkSemaphoreTryAcquire(b *testing.B) {
+	s := newSemaphore(1)
+	for i := 0; i < b.N; i++ {
+		if !s.tryAcquire(1) {
+			b.Fatal("tryAcquire() failed")
+		}
+		s.release(1)
+	}
+}
+
+func BenchmarkSemaphoreAcquire(b *testing.B) {
+	s := newSemaphore(1)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		if err := s.acquire(ctx, 1, 0, nil); err != nil {
+			b.Fatal(err)
+		}
+		s.release(1)
+	}
+}
+
+// BenchmarkSemaphoreContended has more callers than tokens, so that some of
+// them queue.
+func BenchmarkSemaphoreContended(b *testing.B) {
+	for _, fairness := range []Fairness{FIFO, LIFO} {
+		b.Run(fairness.String(), func(b *testing.B) {
+			s := newSemaphore(4)
+			s.fairness = fairness
+			ctx := context.Background()
+
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := s.acquire(ctx, 1, 0, nil); err != nil {
+						b.Fatal(err)
+					}
+					s.release(1)
+				}
+			})
+		})
+	}
+}
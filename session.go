@@ -0,0 +1,83 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// session tracks writes made on a Cluster on behalf of a context. See
+// WithSession().
+type session struct {
+	lastWrite int64 // Unix time in nanoseconds
+}
+
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx that groups the requests made with it on a
+// Cluster into a session, so that reads can observe previous writes of the same
+// session. See Cluster.SetReadYourWrites(). Requests with contexts derived from
+// the returned one belong to the same session.
+func WithSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, new(session))
+}
+
+func sessionFromContext(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+func (s *session) wrote() {
+	atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+}
+
+// since returns the time elapsed since the last write, and whether there was
+// any write at all.
+func (s *session) since() (time.Duration, bool) {
+	t := atomic.LoadInt64(&s.lastWrite)
+	if t == 0 {
+		return 0, false
+	}
+	return time.Duration(time.Now().UnixNano() - t), true
+}
+
+// SetReadYourWrites makes reads go to the primary for the given time after a
+// write in the same session (see WithSession()), so that applications don't
+// observe stale data while replicas catch up. Writes are statements run with
+// Exec(), non read-only queries and committed transactions. The window should
+// thus be set above the usual replication lag. A zero window (the default)
+// disables the feature. Requests not bound to a session are not affected.
+func (c *Cluster) SetReadYourWrites(window time.Duration) {
+	atomic.StoreInt64(&c.readYourWrites, int64(window))
+}
+
+// ReadYourWrites returns the window set with SetReadYourWrites().
+func (c *Cluster) ReadYourWrites() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.readYourWrites))
+}
+
+// recentWrite tells whether the session bound to ctx, if any, wrote within the
+// read-your-writes window.
+func (c *Cluster) recentWrite(ctx context.Context) bool {
+	window := c.ReadYourWrites()
+	if window <= 0 {
+		return false
+	}
+
+	s := sessionFromContext(ctx)
+	if s == nil {
+		return false
+	}
+
+	elapsed, ok := s.since()
+	return ok && elapsed < window
+}
+
+// markWrite records a write for the session bound to ctx, if any.
+func markWrite(ctx context.Context) {
+	if s := sessionFromContext(ctx); s != nil {
+		s.wrote()
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultVirtualNodes is the number of points per shard on the hash ring of
+// ConsistentHash(), if not set.
+const defaultVirtualNodes = 128
+
+// ShardFunc maps a shard key to the index of one of n shards. Indexes out of
+// range are wrapped around.
+type ShardFunc func(key string, n int) int
+
+// ConsistentHash returns a ShardFunc placing keys on a hash ring, where each
+// shard owns the given number of points (128 if not positive). Adding a shard
+// at the end only moves the keys it takes over from the others, roughly 1/n of
+// them, whereas plain modulo hashing would move most keys.
+func ConsistentHash(vnodes int) ShardFunc {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+
+	var rings sync.Map // Ring for each number of shards
+	return func(key string, n int) int {
+		if n <= 1 {
+			return 0
+		}
+
+		r, ok := rings.Load(n)
+		if !ok {
+			r, _ = rings.LoadOrStore(n, newHashRing(n, vnodes))
+		}
+		return r.(hashRing).lookup(hashKey(key))
+	}
+}
+
+// hashRing holds the points of all shards, sorted by hash.
+type hashRing []ringPoint
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+func newHashRing(n, vnodes int) hashRing {
+	ring := make(hashRing, 0, n*vnodes)
+	for shard := 0; shard < n; shard++ {
+		for v := 0; v < vnodes; v++ {
+			key := strconv.Itoa(shard) + "#" + strconv.Itoa(v)
+			ring = append(ring, ringPoint{hash: hashKey(key), shard: shard})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// lookup returns the shard owning the first point at or after h.
+func (r hashRing) lookup(h uint64) int {
+	i := sort.Search(len(r), func(i int) bool {
+		return r[i].hash >= h
+	})
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].shard
+}
+
+// hashKey hashes key, mixing the bits so that similar keys spread evenly.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+type shardKey struct{}
+
+// WithShardKey returns a copy of ctx that makes requests on a Sharded go to the
+// shard for key.
+func WithShardKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, shardKey{}, key)
+}
+
+// ShardKeyFromContext returns the shard key set on ctx with WithShardKey(), if
+// any.
+func ShardKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(shardKey{}).(string)
+	return key, ok
+}
+
+// Sharded routes requests among shards, according to a shard key provided by
+// the application. Each shard is a DB of its own, thus having its own
+// connection limit and settings. Requests take the key from their context (see
+// WithShardKey()), failing with ErrNoShardKey if not set; Shard() returns the
+// DB for an explicit key instead.
+type Sharded struct {
+	partialFailure PartialFailure // Accessed atomically
+
+	topology   atomic.Pointer[shardTopology]
+	fn         ShardFunc
+	open       func(dsn string) (*DB, error) // Set by OpenSharded()
+	reloadMux  sync.Mutex                    // Serializes topology changes
+	eventCh    chan<- Event
+	eventChMux sync.RWMutex
+}
+
+// shardTopology is the set of shards in effect. It's replaced as a whole on
+// topology changes.
+type shardTopology struct {
+	shards []*DB
+	dsns   []string // Set for shards opened by OpenSharded()
+}
+
+// NewSharded returns a Sharded for the given shards, in order, choosing among
+// them with fn. A nil fn defaults to ConsistentHash(0). It panics if no shards
+// are given.
+func NewSharded(fn ShardFunc, shards ...*DB) *Sharded {
+	if len(shards) == 0 {
+		panic("dbcontrol: no shards")
+	}
+	if fn == nil {
+		fn = ConsistentHash(0)
+	}
+
+	s := &Sharded{fn: fn}
+	s.topology.Store(&shardTopology{
+		shards: append([]*DB(nil), shards...),
+		dsns:   make([]string, len(shards)),
+	})
+	return s
+}
+
+// OpenSharded returns a Sharded with a shard for each DSN, in order, opened
+// with open, and choosing among them with fn (ConsistentHash(0) if nil). Open
+// is also used to open new shards on Reload(), so it should apply any settings
+// shards need. If any shard fails to open, those already opened are closed.
+func OpenSharded(open func(dsn string) (*DB, error), fn ShardFunc, dsns ...string) (*Sharded, error) {
+	if len(dsns) == 0 {
+		return nil, ErrNoShards
+	}
+
+	shards := make([]*DB, len(dsns))
+	for i, dsn := range dsns {
+		db, err := open(dsn)
+		if err != nil {
+			closeAll(shards[:i])
+			return nil, err
+		}
+		shards[i] = db
+	}
+
+	s := NewSharded(fn, shards...)
+	s.open = open
+	s.topology.Store(&shardTopology{
+		shards: shards,
+		dsns:   append([]string(nil), dsns...),
+	})
+	return s, nil
+}
+
+// Shards returns the DBs for the shards, in order.
+func (s *Sharded) Shards() []*DB {
+	return append([]*DB(nil), s.topology.Load().shards...)
+}
+
+// Shard returns the DB for the shard holding key.
+func (s *Sharded) Shard(key string) *DB {
+	shards := s.topology.Load().shards
+	n := len(shards)
+	i := s.fn(key, n) % n
+	if i < 0 {
+		i += n
+	}
+	return shards[i]
+}
+
+// shardFor returns the DB for the shard key in ctx.
+func (s *Sharded) shardFor(ctx context.Context) (*DB, error) {
+	key, ok := ShardKeyFromContext(ctx)
+	if !ok {
+		return nil, ErrNoShardKey
+	}
+	return s.Shard(key), nil
+}
+
+func (s *Sharded) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext runs a statement on the shard for the key in ctx.
+func (s *Sharded) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	db, err := s.shardFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecContext(ctx, query, args...)
+}
+
+func (s *Sharded) Query(query string, args ...interface{}) (*Rows, error) {
+	return s.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query on the shard for the key in ctx.
+func (s *Sharded) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	db, err := s.shardFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+func (s *Sharded) QueryRow(query string, args ...interface{}) *Row {
+	return s.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext runs a query returning a single row on the shard for the key
+// in ctx.
+func (s *Sharded) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	db, err := s.shardFor(ctx)
+	if err != nil {
+		return &Row{err: err, closed: true}
+	}
+	return db.QueryRowContext(ctx, query, args...)
+}
+
+func (s *Sharded) Begin() (*Tx, error) {
+	return s.BeginTx(context.Background(), nil)
+}
+
+// BeginTx begins a transaction on the shard for the key in ctx.
+func (s *Sharded) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	db, err := s.shardFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.BeginTx(ctx, opts)
+}
+
+func (s *Sharded) Ping() error {
+	return s.PingContext(context.Background())
+}
+
+// PingContext pings all shards, returning the first error found, if any.
+func (s *Sharded) PingContext(ctx context.Context) error {
+	for _, db := range s.Shards() {
+		if err := db.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all shards, returning the first error found, if any. Shards
+// being drained after a topology change are closed on their own.
+func (s *Sharded) Close() error {
+	return closeAll(s.Shards())
+}
+
+// closeAll closes dbs, returning the first error found, if any.
+func closeAll(dbs []*DB) error {
+	var err error
+	for _, db := range dbs {
+		if e := db.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetAutoShrink enables automatic reduction of the connection limit when the
+// database server refuses connections because it has too many of them (MySQL
+// error 1040, Postgres SQLSTATE 53300). Each such error reduces the limit by
+// one, down to a single connection, and a LimitChangeEvent is sent (see
+// SetEventCh()). The limit then recovers by one connection for every recovery
+// period elapsed without further errors, until reaching its original value.
+// Note that for databases sharing a limit with SetHostGrouping(), the shared
+// limit is the one affected: all of them see the same reduction, which recovers
+// at the pace set by the one that shrank it last. Setting recovery to zero (the
+// default) disables this feature, restoring the original limit at once. This
+// has no effect on databases that are not limiting connections (see
+// SetConcurrency()).
+func (db *DB) SetAutoShrink(recovery time.Duration) {
+	if db.sem == nil {
+		return
+	}
+
+	db.limitMux.Lock()
+	db.shrinkRecovery = recovery
+	db.limitMux.Unlock()
+
+	if recovery == 0 {
+		db.shrinking.reset()
+	}
+}
+
+// isTooManyConns tells whether err signals that the server has run out of
+// connections.
+func isTooManyConns(err error) bool {
+	if err == nil {
+		return false
+	}
+	if n, ok := mysqlErrorNumber(err); ok {
+		return n == 1040
+	}
+	if code, ok := sqlState(err); ok {
+		return code == "53300"
+	}
+	return strings.Contains(err.Error(), "too many clients already") // lib/pq
+}
+
+// shrinkState holds the connections taken from a limit by auto-shrinking. DBs
+// sharing a limit (see SetHostGrouping()) share it as well.
+type shrinkState struct {
+	shrunk int32 // Accessed atomically
+
+	mu       sync.Mutex
+	dbs      map[*DB]struct{} // DBs drawing from the limit
+	timer    Timer
+	clock    Clock         // Of the DB that shrank the limit last
+	recovery time.Duration // Likewise
+}
+
+func newShrinkState() *shrinkState {
+	return &shrinkState{dbs: make(map[*DB]struct{})}
+}
+
+// taken returns the number of connections taken from the limit.
+func (s *shrinkState) taken() int {
+	return int(atomic.LoadInt32(&s.shrunk))
+}
+
+// join adds db to those drawing from the limit.
+func (s *shrinkState) join(db *DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbs[db] = struct{}{}
+}
+
+// leave removes db from those drawing from the limit, stopping the recovery
+// if it was the last one.
+func (s *shrinkState) leave(db *DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.dbs, db)
+	if len(s.dbs) == 0 && s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// reset gives back all connections taken at once.
+func (s *shrinkState) reset() {
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if atomic.SwapInt32(&s.shrunk, 0) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	dbs := s.members()
+	s.mu.Unlock()
+
+	applyShrink(dbs, nil)
+}
+
+// members returns the DBs drawing from the limit. Must be called with s.mu
+// held.
+func (s *shrinkState) members() []*DB {
+	dbs := make([]*DB, 0, len(s.dbs))
+	for db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	return dbs
+}
+
+// shrink reduces the limit in response to err, a "too many connections" error.
+func (db *DB) shrink(err error) {
+	if db.sem == nil || db.closed() {
+		return
+	}
+
+	db.limitMux.Lock()
+	recovery, target := db.shrinkRecovery, db.target
+	db.limitMux.Unlock()
+
+	s := db.shrinking
+	s.mu.Lock()
+	if recovery == 0 || s.taken() >= target-1 {
+		s.mu.Unlock()
+		return
+	}
+
+	atomic.AddInt32(&s.shrunk, 1)
+	s.clock, s.recovery = db.Clock(), recovery
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = s.clock.AfterFunc(recovery, s.regrow)
+	dbs := s.members()
+	s.mu.Unlock()
+
+	applyShrink(dbs, err)
+}
+
+// regrow gives back one of the connections taken by shrink(), arming the timer
+// again for the next one.
+func (s *shrinkState) regrow() {
+	s.mu.Lock()
+	if s.taken() == 0 || len(s.dbs) == 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	if atomic.AddInt32(&s.shrunk, -1) > 0 {
+		s.timer = s.clock.AfterFunc(s.recovery, s.regrow)
+	}
+	dbs := s.members()
+	s.mu.Unlock()
+
+	applyShrink(dbs, nil)
+}
+
+// applyShrink updates the limit of the DBs after shrinking or regrowing,
+// notifying each of the change.
+func applyShrink(dbs []*DB, cause error) {
+	for _, db := range dbs {
+		db.limitMux.Lock()
+		e := db.updateLimit(cause)
+		db.limitMux.Unlock()
+
+		db.notifyLimit(e)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlowQuerySettings configures the slow query log. See SetSlowQueryLog().
+type SlowQuerySettings struct {
+	Threshold time.Duration // Execution time above which queries are reported
+	ShowArgs  bool          // Whether to report argument values, not just types
+	Explain   time.Duration // Minimum interval between EXPLAINs (zero to disable)
+}
+
+// SetSlowQueryLog enables reporting of statements run directly on the DB that
+// take longer than settings.Threshold to execute. A SlowQueryEvent is sent for
+// each one (see SetEventCh()), holding the query, its arguments, the time
+// waited for a connection, the number of rows returned (or affected) and the
+// caller that issued it, along with the tags set on its context (see
+// WithTag()). Events for queries returning rows are sent once the rows are
+// closed, so that they can be counted. Arguments are reported by type only,
+// unless settings.ShowArgs is set, in which case their values are reported
+// after going through the redactor (see SetRedactor()).
+//
+// If settings.Explain is set, the execution plan of slow queries is obtained
+// with the EXPLAIN statement of the DB dialect and attached to the event. Only
+// one query is explained per settings.Explain interval, to keep the extra load
+// bounded; events for queries not explained are sent without a plan. EXPLAIN
+// runs in the background, taking a connection under the limit of its own, so
+// events carrying a plan are sent once it's available.
+//
+// Passing zero settings (the default) disables the log.
+func (db *DB) SetSlowQueryLog(settings SlowQuerySettings) {
+	db.slowMux.Lock()
+	defer db.slowMux.Unlock()
+	db.slowSettings = settings
+}
+
+func (db *DB) getSlowQueryLog() SlowQuerySettings {
+	db.slowMux.RLock()
+	defer db.slowMux.RUnlock()
+	return db.slowSettings
+}
+
+// slowQuery holds the details of a slow query, until reported.
+type slowQuery struct {
+	event   SlowQueryEvent
+	args    []interface{}
+	explain bool // Whether to attach the plan
+}
+
+// slowQuery returns the details of the query if it's slow, or nil otherwise.
+// It must be called from the goroutine that ran the query, so that the caller
+// can be found.
+func (db *DB) slowQuery(ctx context.Context, query string, args []interface{}, wait, latency time.Duration) *slowQuery {
+	settings := db.getSlowQueryLog()
+	if settings.Threshold <= 0 || latency < settings.Threshold {
+		return nil
+	}
+
+	return &slowQuery{
+		event: SlowQueryEvent{
+			Query:    query,
+			Args:     formatArgs(args, settings.ShowArgs),
+			Duration: latency,
+			Wait:     wait,
+			Caller:   caller(),
+			Tags:     TagsFromContext(ctx),
+		},
+		args:    args,
+		explain: settings.Explain > 0 && db.explainDue(settings.Explain),
+	}
+}
+
+// report sends the event for the query, with the number of rows involved.
+func (sq *slowQuery) report(db *DB, rows int64) {
+	if sq == nil {
+		return
+	}
+
+	e := sq.event
+	e.Rows = rows
+	if !sq.explain {
+		e.Time = time.Now()
+		db.emit(e)
+		return
+	}
+
+	go func() {
+		e.Plan, e.ExplainErr = db.explain(e.Query, sq.args)
+		e.ExplainErr = redactError(e.ExplainErr)
+		e.Time = time.Now()
+		db.emit(e)
+	}()
+}
+
+// formatArgs describes the arguments of a query, either by type or by value.
+func formatArgs(args []interface{}, values bool) []string {
+	if len(args) == 0 {
+		return nil
+	}
+
+	s := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case arg == nil:
+			s[i] = "NULL"
+		case values:
+			if b, ok := arg.([]byte); ok {
+				arg = string(b)
+			}
+			s[i] = redact(fmt.Sprint(arg))
+		default:
+			s[i] = fmt.Sprintf("%T", arg)
+		}
+	}
+	return s
+}
+
+// caller returns the location of the first function in the stack outside this
+// package and database/sql, as "function (file:line)".
+func caller() string {
+	var pcs [32]uintptr
+	n := runtime.Callers(2, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+		if !internalFrame(frame.Function) {
+			return formatFrame(frame)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// formatFrame formats the function and location of a frame.
+func formatFrame(frame runtime.Frame) string {
+	return frame.Function + " (" + frame.File + ":" + strconv.Itoa(frame.Line) + ")"
+}
+
+const pkgPath = "github.com/VividCortex/dbcontrol."
+
+func internalFrame(function string) bool {
+	return strings.HasPrefix(function, pkgPath) || strings.HasPrefix(function, "database/sql.")
+}
+
+// onRelease wraps the release function of rows (or a row) to update digest
+// statistics and report slow queries, with the number of rows returned by
+// count. Either d or sq may be nil.
+func (db *DB) onRelease(release func(), d *digest, sq *slowQuery, count func() int) func() {
+	if d == nil && sq == nil {
+		return release
+	}
+
+	return func() {
+		release()
+		n := count()
+		d.addRows(n)
+		sq.report(db, int64(n))
+	}
+}
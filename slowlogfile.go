@@ -0,0 +1,45 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import "sync/atomic"
+
+// SetSlowLogFile makes the DB write SlowQueryEvents and UsageTimeoutEvents to
+// the file at path, in text format (see EncodeText()), rotating it as set by
+// opts. This provides durable diagnostics for services without a log pipeline.
+// Slow queries are only reported when enabled with SetSlowQueryLog(), and usage
+// timeouts when enabled with SetUsageTimeout(). As with SetEventWriter(),
+// events are written in the background and dropped if the file can't keep up.
+// An empty path stops writing, closing the file once pending events are
+// written. Any error opening the file is returned, leaving settings unchanged.
+func (db *DB) SetSlowLogFile(path string, opts RotateOptions) error {
+	var ew *eventWriter
+	if path != "" {
+		rf, err := OpenRotatingFile(path, opts)
+		if err != nil {
+			return err
+		}
+		ew = newEventWriter(rf, EncodeText)
+	}
+
+	db.eventChMux.Lock()
+	old := db.slowLog
+	db.slowLog = ew
+	db.eventChMux.Unlock()
+
+	if old != nil {
+		old.close()
+		old.w.(*RotatingFile).Close()
+		atomic.AddUint64(&db.eventsDropped, atomic.LoadUint64(&old.dropped))
+	}
+	return nil
+}
+
+// slowLogPath returns the path of the slow-log file, if any. The caller must
+// hold eventChMux.
+func (db *DB) slowLogPath() string {
+	if db.slowLog == nil {
+		return ""
+	}
+	return db.slowLog.w.(*RotatingFile).path
+}
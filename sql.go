@@ -3,8 +3,12 @@
 package dbcontrol
 
 import (
+	"context"
 	"database/sql"
-	"runtime/debug"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,11 +23,23 @@ func (db *DB) SetBlockDurationCh(c chan<- time.Duration) {
 	db.blockChMux.Lock()
 	defer db.blockChMux.Unlock()
 
+	if db.blockSub != nil {
+		db.bus.unsubscribe(db.blockSub)
+		db.blockSub = nil
+	}
 	if db.blockCh != nil {
 		close(db.blockCh)
 	}
 
 	db.blockCh = c
+	if c != nil {
+		db.blockSub = db.bus.subscribe(WaitEvents, func(e Event, done <-chan struct{}) {
+			select {
+			case c <- e.(WaitEvent).Wait:
+			case <-done:
+			}
+		})
+	}
 }
 
 // SetUsageTimeout sets a maximum time for connection usage since it was granted
@@ -52,65 +68,265 @@ func (db *DB) SetUsageTimeout(c chan<- string, timeout time.Duration) {
 	defer db.usageTimeoutMux.Unlock()
 	db.usageTimeoutCh = c
 
+	if db.usageSub != nil {
+		db.bus.unsubscribe(db.usageSub)
+		db.usageSub = nil
+	}
+
 	if c != nil {
 		db.usageTimeout = timeout
+		db.usageSub = db.bus.subscribe(UsageTimeoutEvents, func(e Event, done <-chan struct{}) {
+			select {
+			case c <- e.(UsageTimeoutEvent).Stack:
+			case <-done:
+			}
+		})
 	} else {
 		db.usageTimeout = 0
 	}
 }
 
-func (db *DB) conn() func() {
-	releaseLock := func() {}
+// SetSoftLimit sets a soft limit on the number of connections in use. Unlike
+// the limit set with SetConcurrency(), operations are never delayed when the
+// soft limit is exceeded. Instead, a SoftLimitEvent is sent (see SetEventCh())
+// and the breach is accounted for in PoolStats() each time the number of
+// connections rises above the limit. This provides early warning before the
+// hard limit is reached and requests start blocking. A typical setting would be
+// 80% of MaxConns(). Setting the limit to zero (the default) disables this
+// feature.
+func (db *DB) SetSoftLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&db.softLimit, int32(n))
+}
+
+// SetMaxWaiters sets the maximum number of callers that may be waiting for a
+// connection at any given time. Once reached, further requests fail right away
+// with ErrTooManyWaiters, instead of piling up behind the others. Note that the
+// limit applies to all callers waiting on the connection limit, so it would
+// include those of other DBs in case of SetHostGrouping(). Setting the maximum
+// to zero (the default) allows for any number of waiters.
+func (db *DB) SetMaxWaiters(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&db.maxWaiters, int32(n))
+}
+
+// SetBudgetAware enables or disables checking the deadline of the context
+// provided by callers (e.g., in QueryContext()) against the estimated time to
+// wait for a connection, in case none is readily available. When enabled, if
+// the estimated wait exceeds the time left to the deadline, the request fails
+// immediately with ErrInsufficientBudget, instead of taking a connection that
+// will most likely be of no use to the caller. The estimate is derived from the
+// number of callers waiting ahead, and the rate at which connections were
+// recently released to them. Until connections were released to waiters at
+// least twice, the usage timeout (see SetUsageTimeout()) or else the statement
+// timeout (see SetStatementTimeout()) is taken as the time each caller ahead
+// holds its connection; with neither set, requests are never rejected before
+// then. This feature is disabled by default.
+func (db *DB) SetBudgetAware(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&db.budgetAware, v)
+}
+
+// estimatedWait returns the expected time to wait for a connection, from the
+// callers queued ahead and the average time between releases, as for
+// WithWaitProgress(). It follows the queue as it is, so it doesn't go stale
+// once the pool is idle again. With no releases to go by yet, as on a cold
+// pool, each caller ahead is assumed to hold its connection for as long as
+// allowed (see holdLimit()).
+func (db *DB) estimatedWait() time.Duration {
+	interval := db.sem.releaseInterval()
+	if interval == 0 {
+		interval = db.holdLimit()
+	}
+	return time.Duration(db.sem.waiting()+1) * interval
+}
+
+// holdLimit returns the time a connection is expected to be held for at most:
+// the usage timeout if set (see SetUsageTimeout()), or else the statement
+// timeout (see SetStatementTimeout()). It returns zero if neither is set.
+func (db *DB) holdLimit() time.Duration {
+	db.usageTimeoutMux.RLock()
+	timeout := db.usageTimeout
+	db.usageTimeoutMux.RUnlock()
+
+	if timeout == 0 {
+		timeout = db.StatementTimeout()
+	}
+	return timeout
+}
+
+// check inspects the outcome of operations on the underlying database,
+// before handing errors (if any) to the caller.
+func (db *DB) check(err error) error {
+	db.breakerMux.RLock()
+	if db.breaker != nil {
+		db.breaker.record(err)
+	}
+	db.breakerMux.RUnlock()
+
+	if isTooManyConns(err) {
+		db.shrink(err)
+	}
+
+	return err
+}
+
+// observeWait accounts for the time waited for a connection, which blocked
+// unless it was readily available.
+func (db *DB) observeWait(ctx context.Context, wait time.Duration, blocked bool) {
+	if blocked {
+		db.emitExtra(WaitEvent{
+			Time: time.Now(),
+			Wait: wait,
+			Tags: TagsFromContext(ctx),
+		})
+	}
+
+	db.waitTime.Load().observe(wait)
+	db.waitWindows.observe(wait)
+	db.checkWait(wait)
+}
+
+func (db *DB) conn(ctx context.Context) (func(), error) {
+	release, _, err := db.acquire(ctx)
+	return release, err
+}
+
+// acquire is like conn(), but also returns the time waited for the connection.
+func (db *DB) acquire(ctx context.Context) (func(), time.Duration, error) {
+	release, wait, _, err := db.grant(ctx)
+	return release, wait, err
+}
+
+// grant is like acquire(), but also returns the usage timeout the connection
+// was granted with (see SetUsageTimeout()), or zero if none.
+func (db *DB) grant(ctx context.Context) (func(), time.Duration, time.Duration, error) {
+	probeDone, err := db.allow()
+	if err != nil {
+		return nil, 0, 0, err
+	}
 
-	if db.sem != nil {
-		select {
-		case <-db.sem:
-		default:
-			start := time.Now()
-			<-db.sem
+	if err := db.injectFaults(ctx); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err := db.throttle(ctx); err != nil {
+		return nil, 0, 0, err
+	}
 
-			db.blockChMux.RLock()
-			if db.blockCh != nil {
-				db.blockCh <- time.Now().Sub(start)
+	releaseQuotas, err := db.acquireQuotas(ctx)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var wait time.Duration
+
+	releaseLock := releaseQuotas
+
+	if ar := db.customTokens(); ar != nil {
+		if wait, err = db.acquireCustom(ctx, ar); err != nil {
+			releaseQuotas()
+			return nil, 0, 0, err
+		}
+		releaseLock = func() {
+			ar.Release()
+			releaseQuotas()
+		}
+	} else if db.sem != nil {
+		weight := db.weight(ctx)
+		blocked := false
+		if !db.sem.tryAcquire(weight) {
+			if deadline, ok := ctx.Deadline(); ok && atomic.LoadInt32(&db.budgetAware) != 0 {
+				if db.estimatedWait() > time.Until(deadline) {
+					releaseQuotas()
+					return nil, 0, 0, ErrInsufficientBudget
+				}
 			}
-			db.blockChMux.RUnlock()
+
+			start := db.now()
+			maxWaiters := int(atomic.LoadInt32(&db.maxWaiters))
+			if err := db.sem.acquire(ctx, weight, maxWaiters, db.progressFunc(ctx)); err != nil {
+				if err == ErrTooManyWaiters {
+					atomic.AddUint64(&db.shed, 1)
+				} else {
+					// Gave up waiting, which may have taken long enough
+					db.checkWait(db.since(start))
+				}
+				releaseQuotas()
+				return nil, 0, 0, err
+			}
+			wait, blocked = db.since(start), true
 		}
 
+		db.observeWait(ctx, wait, blocked)
 		releaseLock = func() {
-			db.sem <- true
+			db.sem.release(weight)
+			releaseQuotas()
 		}
 	}
 
+	inUse := atomic.AddInt32(&db.inUse, 1)
+	db.observeInUse(inUse)
+	if soft := atomic.LoadInt32(&db.softLimit); soft > 0 && inUse == soft+1 {
+		atomic.AddUint64(&db.softLimitBreaches, 1)
+		db.emit(SoftLimitEvent{
+			Time:      time.Now(),
+			InUse:     int(inUse),
+			SoftLimit: int(soft),
+		})
+	}
+
+	db.validate(ctx)
+
 	db.usageTimeoutMux.RLock()
 	usageTimeout := db.usageTimeout
 	db.usageTimeoutMux.RUnlock()
 	cancelUsageTimeout := func() {}
 
 	if usageTimeout != 0 {
-		cancelTimeoutCh := make(chan struct{}, 1)
+		stack := db.stack()
+		timer := db.Clock().AfterFunc(usageTimeout, func() {
+			db.log(slog.LevelWarn, "dbcontrol: connection held too long",
+				"timeout", usageTimeout, "stack", string(stack))
+			db.emitExtra(UsageTimeoutEvent{
+				Time:    time.Now(),
+				Timeout: usageTimeout,
+				Stack:   string(stack),
+				Tags:    TagsFromContext(ctx),
+			})
+		})
 		cancelUsageTimeout = func() {
-			cancelTimeoutCh <- struct{}{}
-			close(cancelTimeoutCh)
+			timer.Stop()
 		}
-		stack := debug.Stack()
-
-		go func() {
-			select {
-			case <-time.After(usageTimeout):
-				db.usageTimeoutMux.RLock()
-				if db.usageTimeoutCh != nil {
-					db.usageTimeoutCh <- string(stack)
-				}
-				db.usageTimeoutMux.RUnlock()
-			case <-cancelTimeoutCh:
-			}
-		}()
 	}
 
-	return func() {
+	release := db.track(func() {
+		db.touch()
+		atomic.AddInt32(&db.inUse, -1)
 		releaseLock()
 		cancelUsageTimeout()
+	})
+
+	if err := db.injectLatency(ctx); err != nil {
+		release()
+		return nil, 0, 0, err
+	}
+	if probeDone != nil {
+		releaseProbe := release
+		release = func() {
+			releaseProbe()
+			probeDone()
+		}
 	}
+
+	return db.callSite().acquired(wait, release), wait, usageTimeout, nil
 }
 
 // SetMaxIdleConns sets the maximum number of idle connections to the database.
@@ -121,38 +337,149 @@ func (db *DB) conn() func() {
 func (db *DB) SetMaxIdleConns(n int) {
 	if db.sem == nil {
 		// Not using tokens
-		db.DB.SetMaxIdleConns(n)
+		db.limitMux.Lock()
+		db.maxIdle, db.maxIdleSet = n, true
+		db.pool().SetMaxIdleConns(n)
+		db.limitMux.Unlock()
 	}
 }
 
 func (db *DB) Ping() error {
-	release := db.conn()
+	return db.PingContext(context.Background())
+}
+
+func (db *DB) PingContext(ctx context.Context) error {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return err
+	}
 	defer release()
-	return db.DB.Ping()
+	return db.check(db.pool().PingContext(ctx))
 }
 
 func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
-	release := db.conn()
-	defer release()
-	return db.DB.Exec(query, args...)
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+	if target := db.canaryTarget(ctx, query); target != nil {
+		return target.ExecContext(ctx, query, args...)
+	}
+	if pool, ctx := db.dryRunTarget(ctx, query, args); pool != nil {
+		return pool.ExecContext(ctx, query, args...)
+	}
+
+	var res sql.Result
+	d := db.digest(query)
+
+	err := db.retry(ctx, func() error {
+		release, wait, err := db.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		defer db.label(ctx, query)()
+
+		start := time.Now()
+		res, err = db.exec(ctx, query, args)
+		err = db.check(err)
+		latency := time.Since(start)
+		d.record(wait, latency, err)
+		db.recordStatement(start, query, args, true, wait, latency, err)
+
+		if sq := db.slowQuery(ctx, query, args, wait, latency); sq != nil {
+			var n int64
+			if err == nil {
+				n, _ = res.RowsAffected()
+			}
+			sq.report(db, n)
+		}
+		return err
+	})
+
+	if err == nil {
+		err = db.writeSecondary(ctx, query, args, res)
+	}
+	return res, err
 }
 
 type Rows struct {
 	*sql.Rows
-	closed  bool
-	release func()
+	closed    bool
+	release   func()
+	limit     RowLimit
+	count     int // Rows returned so far
+	truncated bool
+	drained   bool  // Whether all rows were read
+	err       error // Set if the row limit was exceeded
+	mirror    *mirroredQuery
 }
 
 func (db *DB) Query(query string, args ...interface{}) (*Rows, error) {
-	release := db.conn()
-	rows, err := db.DB.Query(query, args...)
+	return db.QueryContext(context.Background(), query, args...)
+}
 
-	if err != nil {
-		release()
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	if err := db.checkPolicy(ctx, query); err != nil {
 		return nil, err
 	}
+	if target := db.canaryTarget(ctx, query); target != nil {
+		return target.QueryContext(ctx, query, args...)
+	}
+	if pool, ctx := db.dryRunTarget(ctx, query, args); pool != nil {
+		r, err := pool.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		return db.newRows(ctx, r, func() {}), nil
+	}
+
+	var rows *Rows
+	d := db.digest(query)
+
+	err := db.retry(ctx, func() error {
+		release, wait, err := db.acquire(ctx)
+		if err != nil {
+			return err
+		}
 
-	return &Rows{Rows: rows, release: release}, nil
+		unlabel := db.label(ctx, query)
+		start := time.Now()
+		r, err := db.query(ctx, query, args)
+		unlabel()
+		err = db.check(err)
+		latency := time.Since(start)
+		d.record(wait, latency, err)
+		db.recordStatement(start, query, args, false, wait, latency, err)
+		sq := db.slowQuery(ctx, query, args, wait, latency)
+
+		if err != nil {
+			release()
+			sq.report(db, 0)
+			return err
+		}
+
+		rs := db.newRows(ctx, r, release)
+		rs.release = db.onRelease(release, d, sq, func() int { return rs.count })
+		if m := db.mirror(ctx, query, args, false, latency); m != nil {
+			done := rs.release
+			rs.mirror = m
+			rs.release = func() {
+				done()
+				m.finish(rs.count, rs.drained)
+			}
+		}
+		rows = rs
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
 }
 
 func (rows *Rows) Next() bool {
@@ -161,8 +488,17 @@ func (rows *Rows) Next() bool {
 	}
 
 	next := rows.Rows.Next()
-	if !next {
+	if next {
+		rows.count++
+		if rows.exceeded() {
+			rows.count--
+			rows.Close()
+			return false
+		}
+	}
+	if !next && rows.done() {
 		// EOF or error: the result set was closed by Rows.Next()
+		rows.drained = rows.Rows.Err() == nil
 		rows.release()
 		rows.closed = true
 	}
@@ -170,6 +506,44 @@ func (rows *Rows) Next() bool {
 	return next
 }
 
+// Scan copies the columns of the current row into dest, as in sql.Rows.
+func (rows *Rows) Scan(dest ...interface{}) error {
+	err := rows.Rows.Scan(dest...)
+	rows.mirror.scanned(dest, err)
+	return err
+}
+
+// done tells whether the underlying rows were closed when Next() returned
+// false. They are left open if there are further result sets to read.
+func (rows *Rows) done() bool {
+	_, err := rows.Rows.Columns()
+	return err != nil
+}
+
+// NextResultSet prepares the next result set for reading, as in sql.Rows. The
+// connection is only released after the last result set is consumed.
+func (rows *Rows) NextResultSet() bool {
+	if rows.closed {
+		return false
+	}
+
+	next := rows.Rows.NextResultSet()
+	if !next {
+		// No more result sets: the rows were closed by NextResultSet()
+		rows.release()
+		rows.closed = true
+	}
+
+	return next
+}
+
+func (rows *Rows) Err() error {
+	if rows.err != nil {
+		return rows.err
+	}
+	return rows.Rows.Err()
+}
+
 func (rows *Rows) Close() error {
 	err := rows.Rows.Close()
 
@@ -181,104 +555,488 @@ func (rows *Rows) Close() error {
 	return err
 }
 
+// Row is the result of QueryRow(). Unlike sql.Row, it holds the result set of
+// the query, so that the row can also be scanned by column name, with
+// ScanStruct() and ScanMap(). Note that Row used to embed *sql.Row, which is
+// no longer the case: Scan() and Err() work as they did, but code reaching for
+// the embedded sql.Row (as in row.Row.Scan()) must call them on Row instead.
 type Row struct {
-	*sql.Row
+	rows    *sql.Rows
+	db      *DB
+	err     error // Set if the query failed, or no connection could be obtained
 	closed  bool
 	release func()
+	found   bool // Whether Scan() found a row
+	mirror  *mirroredQuery
+}
+
+// newRow returns a Row for the result set of a query, which is closed once the
+// row is scanned. The outcome of the query is recorded when scanning, unless it
+// failed right away.
+func newRow(db *DB, rows *sql.Rows, err error, release func()) *Row {
+	if err != nil {
+		release()
+		return &Row{err: db.check(err), closed: true}
+	}
+	return &Row{rows: rows, db: db, release: release}
 }
 
 func (db *DB) QueryRow(query string, args ...interface{}) *Row {
-	release := db.conn()
-	row := db.DB.QueryRow(query, args...)
-	return &Row{Row: row, release: release}
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	if err := db.checkPolicy(ctx, query); err != nil {
+		return &Row{err: err, closed: true}
+	}
+	if target := db.canaryTarget(ctx, query); target != nil {
+		return target.QueryRowContext(ctx, query, args...)
+	}
+	if pool, ctx := db.dryRunTarget(ctx, query, args); pool != nil {
+		r, err := pool.QueryContext(ctx, query, args...)
+		return newRow(db, r, err, func() {})
+	}
+
+	var row *Row
+	d := db.digest(query)
+
+	err := db.retry(ctx, func() error {
+		release, wait, err := db.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		unlabel := db.label(ctx, query)
+		start := time.Now()
+		r, err := db.query(ctx, query, args)
+		unlabel()
+		latency := time.Since(start)
+		d.record(wait, latency, err)
+		db.recordStatement(start, query, args, false, wait, latency, err)
+		sq := db.slowQuery(ctx, query, args, wait, latency)
+
+		// Successful queries are accounted for by Scan(), once the row is
+		// read
+		if err != nil {
+			db.check(err)
+			release()
+			sq.report(db, 0)
+			return err
+		}
+
+		rw := &Row{rows: r, db: db}
+		rw.release = db.onRelease(release, d, sq, func() int {
+			if rw.found {
+				return 1
+			}
+			return 0
+		})
+		rw.mirror = db.mirror(ctx, query, args, true, latency)
+		row = rw
+		return nil
+	})
+
+	if err != nil {
+		return &Row{err: err, closed: true}
+	}
+	return row
 }
 
+// Scan copies the columns of the row into dest, as in sql.Row. It returns
+// sql.ErrNoRows if the query returned no rows.
 func (row *Row) Scan(dest ...interface{}) error {
-	err := row.Row.Scan(dest...)
+	return row.scan(func() error {
+		// The row is gone once the result set is closed
+		for _, d := range dest {
+			if _, ok := d.(*sql.RawBytes); ok {
+				return errors.New("sql: RawBytes isn't allowed on Row.Scan")
+			}
+		}
 
+		err := row.rows.Scan(dest...)
+		if err == nil {
+			row.mirror.scanned(dest, nil)
+		}
+		return err
+	})
+}
+
+// scan reads the first row with fn, then closes the result set and releases
+// the connection.
+func (row *Row) scan(fn func() error) error {
+	if row.err != nil {
+		return row.err
+	}
+
+	err := row.db.check(row.first(fn))
+	row.found = err == nil
+
+	if row.found {
+		row.mirror.finish(1, true)
+	} else {
+		row.mirror.finish(0, err == sql.ErrNoRows)
+	}
+
+	row.close()
+	return err
+}
+
+// first reads the first row of the result set with fn.
+func (row *Row) first(fn func() error) error {
+	defer row.rows.Close()
+
+	if !row.rows.Next() {
+		if err := row.rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return row.rows.Close()
+}
+
+// close discards the row, if not scanned yet, and releases the connection.
+func (row *Row) close() {
+	if row.rows != nil {
+		row.rows.Close()
+	}
 	if !row.closed {
 		row.release()
 		row.closed = true
 	}
+}
 
-	return err
+// Err returns the error of the query, if any, as in sql.Row.
+func (row *Row) Err() error {
+	return row.err
 }
 
 type Stmt struct {
 	*sql.Stmt
-	db *DB
+	db     *DB
+	tx     *Tx        // Set for transaction-specific statements
+	pinned bool       // Set for statements prepared on a Conn
+	stats  *stmtStats // Set for statements prepared on the DB, and derived ones
+}
+
+// conn gets a connection for a statement. Transaction-specific statements, as
+// well as those prepared on a Conn, run on the connection already held.
+func (s *Stmt) conn(ctx context.Context) (func(), error) {
+	if s.tx == nil && !s.pinned {
+		return s.db.conn(ctx)
+	}
+
+	if err := s.db.throttle(ctx); err != nil {
+		return nil, err
+	}
+	if s.tx != nil {
+		atomic.AddInt32(&s.tx.statements, 1)
+	}
+	return func() {}, nil
 }
 
 func (db *DB) Prepare(query string) (*Stmt, error) {
-	release := db.conn()
-	defer release()
+	return db.PrepareContext(context.Background(), query)
+}
+
+func (db *DB) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	if err := db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
 
-	stmt, err := db.DB.Prepare(query)
+	release, err := db.conn(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	return &Stmt{Stmt: stmt, db: db}, nil
+	stmt, err := db.pool().PrepareContext(ctx, query)
+	if err = db.check(err); err != nil {
+		return nil, err
+	}
+
+	return &Stmt{Stmt: stmt, db: db, stats: db.trackStmt(query)}, nil
 }
 
 func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
-	release := s.db.conn()
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	release, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer release()
-	return s.Stmt.Exec(args...)
+
+	start := time.Now()
+	res, err := s.Stmt.ExecContext(ctx, args...)
+	s.stats.record(time.Since(start), err)
+	return res, s.db.check(err)
 }
 
 func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
-	release := s.db.conn()
-	rows, err := s.Stmt.Query(args...)
+	return s.QueryContext(context.Background(), args...)
+}
 
+func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*Rows, error) {
+	release, err := s.conn(ctx)
 	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	rows, err := s.Stmt.QueryContext(ctx, args...)
+	s.stats.record(time.Since(start), err)
+
+	if err = s.db.check(err); err != nil {
 		release()
 		return nil, err
 	}
 
-	return &Rows{Rows: rows, release: release}, nil
+	return s.db.newRows(ctx, rows, release), nil
 }
 
 func (s *Stmt) QueryRow(args ...interface{}) *Row {
-	release := s.db.conn()
-	row := s.Stmt.QueryRow(args...)
-	return &Row{Row: row, release: release}
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+func (s *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *Row {
+	release, err := s.conn(ctx)
+	if err != nil {
+		return &Row{err: err, closed: true}
+	}
+
+	start := time.Now()
+	rows, err := s.Stmt.QueryContext(ctx, args...)
+	s.stats.record(time.Since(start), err)
+	return newRow(s.db, rows, err, release)
+}
+
+// Close closes the statement. It overrides sql.Stmt.Close(), so that the
+// statement is no longer reported by DB.StmtStats().
+func (s *Stmt) Close() error {
+	if s.tx == nil && s.stats != nil {
+		s.db.untrackStmt(s.stats)
+	}
+	return s.Stmt.Close()
 }
 
 type Tx struct {
 	*sql.Tx
-	closed  bool
-	release func()
+	db         *DB
+	mu         sync.Mutex
+	closed     bool
+	release    func()
+	timer      Timer // Set if the transaction has a timeout
+	savepoints int
+	start      time.Time
+	statements int32    // Accessed atomically
+	session    *session // Set for transactions begun on a Cluster session
 }
 
 func (db *DB) Begin() (*Tx, error) {
-	release := db.conn()
-	tx, err := db.DB.Begin()
+	return db.BeginTx(context.Background(), nil)
+}
 
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	release, err := db.conn(context.WithValue(ctx, txSubPoolKey{}, true))
 	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.pool().BeginTx(ctx, opts)
+
+	if err = db.check(err); err != nil {
 		release()
 		return nil, err
 	}
 
-	return &Tx{Tx: tx, release: release}, nil
+	return db.newTx(ctx, tx, release), nil
+}
+
+// newTx wraps a transaction just begun, holding a connection until released.
+func (db *DB) newTx(ctx context.Context, tx *sql.Tx, release func()) *Tx {
+	atomic.AddUint64(&db.txBegun, 1)
+	t := &Tx{Tx: tx, db: db, release: release, start: time.Now()}
+	if timeout := db.TxTimeout(); timeout > 0 {
+		stack, tags := db.stack(), TagsFromContext(ctx)
+		t.mu.Lock()
+		t.timer = db.Clock().AfterFunc(timeout, func() {
+			t.expire(timeout, stack, tags)
+		})
+		t.mu.Unlock()
+	}
+
+	if hooks := db.getTxHooks(); hooks.OnTxBegin != nil {
+		hooks.OnTxBegin(t.info())
+	}
+
+	return t
 }
 
 func (tx *Tx) Commit() error {
-	if !tx.closed {
-		defer func() {
-			tx.release()
-			tx.closed = true
-		}()
+	defer tx.done()
+	hooks := tx.db.getTxHooks()
+
+	if hooks.OnBeforeCommit != nil {
+		if err := hooks.OnBeforeCommit(tx.info()); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	start := time.Now()
+	err := tx.Tx.Commit()
+
+	if hooks.OnAfterCommit != nil && err != sql.ErrTxDone {
+		hooks.OnAfterCommit(tx.info(), err)
 	}
-	return tx.Tx.Commit()
+
+	switch err {
+	case nil:
+		tx.db.commitLatency.observe(time.Since(start))
+		atomic.AddUint64(&tx.db.txCommitted, 1)
+		if tx.session != nil {
+			tx.session.wrote()
+		}
+	case sql.ErrTxDone:
+	default:
+		atomic.AddUint64(&tx.db.txCommitFailures, 1)
+	}
+
+	return err
 }
 
 func (tx *Tx) Rollback() error {
+	defer tx.done()
+
+	err := tx.Tx.Rollback()
+	if err != sql.ErrTxDone {
+		atomic.AddUint64(&tx.db.txRolledBack, 1)
+
+		if hooks := tx.db.getTxHooks(); hooks.OnRollback != nil {
+			hooks.OnRollback(tx.info())
+		}
+	}
+
+	return err
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := tx.db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+	if err := tx.db.throttle(ctx); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&tx.statements, 1)
+	return tx.Tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	if err := tx.db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+	if err := tx.db.throttle(ctx); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&tx.statements, 1)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection is held by the transaction, not by the rows
+	return tx.db.newRows(ctx, rows, func() {}), nil
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	if err := tx.db.checkPolicy(ctx, query); err != nil {
+		return &Row{err: err, closed: true}
+	}
+	if err := tx.db.throttle(ctx); err != nil {
+		return &Row{err: err, closed: true}
+	}
+
+	atomic.AddInt32(&tx.statements, 1)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	return newRow(tx.db, rows, err, func() {})
+}
+
+// done releases the connection once the transaction is over.
+func (tx *Tx) done() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
 	if !tx.closed {
-		defer func() {
-			tx.release()
-			tx.closed = true
-		}()
+		if tx.timer != nil {
+			tx.timer.Stop()
+		}
+		tx.release()
+		tx.closed = true
 	}
-	return tx.Tx.Rollback()
+}
+
+// expire rolls back a transaction that has been open for too long.
+func (tx *Tx) expire(timeout time.Duration, stack []byte, tags map[string]string) {
+	tx.mu.Lock()
+	closed := tx.closed
+	tx.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	tx.Rollback()
+	tx.db.emit(TxTimeoutEvent{
+		Time:    time.Now(),
+		Timeout: timeout,
+		Stack:   string(stack),
+		Tags:    tags,
+	})
+}
+
+func (tx *Tx) Prepare(query string) (*Stmt, error) {
+	return tx.PrepareContext(context.Background(), query)
+}
+
+func (tx *Tx) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	if err := tx.db.checkPolicy(ctx, query); err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stmt{Stmt: stmt, db: tx.db, tx: tx}, nil
+}
+
+// Stmt returns a transaction-specific statement from an existing one, as
+// sql.Tx.Stmt() does. The statement runs on the connection held by the
+// transaction.
+func (tx *Tx) Stmt(stmt *Stmt) *Stmt {
+	return tx.StmtContext(context.Background(), stmt)
+}
+
+func (tx *Tx) StmtContext(ctx context.Context, stmt *Stmt) *Stmt {
+	return &Stmt{Stmt: tx.Tx.StmtContext(ctx, stmt.Stmt), db: tx.db, tx: tx, stats: stmt.stats}
 }
@@ -0,0 +1,63 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+	"github.com/VividCortex/dbcontrol/dbcontroltest"
+)
+
+// TestBudgetColdStart checks that requests are rejected on a pool that never
+// released a connection to a waiter, going by the usage timeout.
+func TestBudgetColdStart(t *testing.T) {
+	prev := dbcontrol.Concurrency()
+	dbcontrol.SetConcurrency(1)
+	defer dbcontrol.SetConcurrency(prev)
+
+	f := dbcontroltest.New()
+	defer f.Close()
+	db, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetBudgetAware(true)
+
+	// A transaction holds the only connection
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// With nothing to go by, callers wait until their deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "SELECT 1"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// Connections may be held for as long as the usage timeout
+	db.SetUsageTimeout(make(chan string, 1), time.Minute)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := db.ExecContext(ctx, "SELECT 1"); err != dbcontrol.ErrInsufficientBudget {
+		t.Fatalf("got %v, want ErrInsufficientBudget", err)
+	}
+	if wait := time.Since(start); wait > 500*time.Millisecond {
+		t.Fatalf("rejected after %v, want right away", wait)
+	}
+
+	// Deadlines beyond the usage timeout are let through
+	tx.Rollback()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// maxStackFrames is the number of frames looked at when capturing filtered or
+// limited stacks.
+const maxStackFrames = 128
+
+// StackSettings configures the stack traces captured for diagnostics, such as
+// those sent for usage timeouts, transaction timeouts and statement leaks. See
+// SetStackSettings().
+type StackSettings struct {
+	MaxDepth int                        // Frames kept (zero for all)
+	Filter   func(function string) bool // Tells whether to keep a frame (nil for all)
+}
+
+// ApplicationFrames is a stack frame filter that skips the frames of this
+// package and database/sql, so that stacks point straight at application code.
+func ApplicationFrames(function string) bool {
+	return !internalFrame(function)
+}
+
+// SetStackSettings sets how stack traces are captured for diagnostics. With
+// zero settings (the default), full stacks are captured, as with debug.Stack().
+// Otherwise, stacks hold at most settings.MaxDepth frames, among those for
+// which settings.Filter returns true, given the fully-qualified name of the
+// function (e.g., "main.main"). Such stacks are formatted as those of
+// debug.Stack(), without the goroutine header and program counter offsets.
+// Settings apply to stacks captured from then on.
+func (db *DB) SetStackSettings(settings StackSettings) {
+	db.stackMux.Lock()
+	defer db.stackMux.Unlock()
+	db.stackSettings = settings
+}
+
+func (db *DB) getStackSettings() StackSettings {
+	db.stackMux.RLock()
+	defer db.stackMux.RUnlock()
+	return db.stackSettings
+}
+
+// stack returns the stack trace of the calling goroutine, as set with
+// SetStackSettings(). The frame of stack() itself is never included.
+func (db *DB) stack() []byte {
+	settings := db.getStackSettings()
+	if settings.MaxDepth <= 0 && settings.Filter == nil {
+		return debug.Stack()
+	}
+
+	var pcs [maxStackFrames]uintptr
+	n := runtime.Callers(2, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b []byte
+	for depth := 0; settings.MaxDepth <= 0 || depth < settings.MaxDepth; {
+		frame, more := frames.Next()
+		if settings.Filter == nil || settings.Filter(frame.Function) {
+			b = append(b, frame.Function...)
+			b = append(b, "()\n\t"...)
+			b = append(b, frame.File...)
+			b = append(b, ':')
+			b = strconv.AppendInt(b, int64(frame.Line), 10)
+			b = append(b, '\n')
+			depth++
+		}
+		if !more {
+			break
+		}
+	}
+	return b
+}
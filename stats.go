@@ -0,0 +1,153 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStats extends sql.DBStats with statistics specific to this package.
+// Fields from sql.DBStats are promoted, so code reading them works the same.
+type PoolStats struct {
+	sql.DBStats
+	InUse             int    // Connections currently granted by the DB
+	Waiting           int    // Callers waiting for a connection (in the host group, if shared)
+	SoftLimitBreaches uint64 // Times the soft limit was exceeded
+	Shed              uint64 // Requests rejected with ErrTooManyWaiters
+	StmtCacheHits     uint64 // Queries run with a cached statement
+	StmtCacheMisses   uint64 // Queries that had to be prepared
+	StaleConns        uint64 // Times validation found stale connections
+	Reaped            uint64 // Idle connections closed by the reaper
+	Coalesced         uint64 // Queries served by an identical concurrent one
+	LimitGuarded      uint64 // Queries limited by SetLimitGuard()
+	DryRuns           uint64 // Statements run in dry-run mode
+	Mirrored          uint64 // Queries replayed by SetMirroring()
+	MirrorMismatches  uint64 // Replayed queries whose results differed
+	SecondaryFailures uint64 // Writes failed on the secondary (see SetDualWrite())
+	Divergences       uint64 // Writes affecting different rows on the secondary
+	DualWriteQueue    int    // Writes queued for the secondary
+	QuotaRejections   uint64 // Requests rejected with ErrQuotaExceeded
+	FaultsInjected    uint64 // Faults injected by SetFaults()
+	EventsDropped     uint64 // Events not written by SetEventWriter() in time
+	TxBegun           uint64 // Transactions begun
+	TxCommitted       uint64 // Transactions committed successfully
+	TxRolledBack      uint64 // Transactions rolled back (including timeouts)
+	TxCommitFailures  uint64 // Calls to Commit() that failed
+	CommitLatency     Histogram
+	WaitTime          Histogram  // Time waited for connections, including no wait
+	Wait1m            WaitWindow // Waits over the last minute
+	Wait5m            WaitWindow // Waits over the last 5 minutes
+	Wait15m           WaitWindow // Waits over the last 15 minutes
+
+	// LongestWait is the time waited so far by the caller waiting the
+	// longest for a connection, or zero if none are. As with Waiting, it
+	// covers all DBs in the host group, if the limit is shared.
+	LongestWait time.Duration
+}
+
+// Stats returns the statistics of the underlying sql.DB. It overrides
+// sql.DB.Stats(), so that it follows the pool when it's replaced (see
+// Reconfigure() and OpenFailover()). See PoolStats() for those on connection
+// limiting.
+func (db *DB) Stats() sql.DBStats {
+	return db.pool().Stats()
+}
+
+// PoolStats returns database statistics, including those of the underlying
+// sql.DB along with information on connection limiting.
+func (db *DB) PoolStats() PoolStats {
+	s := PoolStats{
+		DBStats:           db.pool().Stats(),
+		InUse:             int(atomic.LoadInt32(&db.inUse)),
+		SoftLimitBreaches: atomic.LoadUint64(&db.softLimitBreaches),
+		Shed:              atomic.LoadUint64(&db.shed),
+		StmtCacheHits:     atomic.LoadUint64(&db.stmtCacheHits),
+		StmtCacheMisses:   atomic.LoadUint64(&db.stmtCacheMisses),
+		StaleConns:        atomic.LoadUint64(&db.staleConns),
+		Reaped:            atomic.LoadUint64(&db.reaped),
+		Coalesced:         atomic.LoadUint64(&db.coalesced),
+		LimitGuarded:      atomic.LoadUint64(&db.limitGuarded),
+		DryRuns:           atomic.LoadUint64(&db.dryRuns),
+		Mirrored:          atomic.LoadUint64(&db.mirrored),
+		MirrorMismatches:  atomic.LoadUint64(&db.mirrorMismatches),
+		SecondaryFailures: atomic.LoadUint64(&db.secondaryFailures),
+		Divergences:       atomic.LoadUint64(&db.divergences),
+		QuotaRejections:   atomic.LoadUint64(&db.quotaRejections),
+		FaultsInjected:    atomic.LoadUint64(&db.faultsInjected),
+		EventsDropped:     db.eventsDroppedNow(),
+		TxBegun:           atomic.LoadUint64(&db.txBegun),
+		TxCommitted:       atomic.LoadUint64(&db.txCommitted),
+		TxRolledBack:      atomic.LoadUint64(&db.txRolledBack),
+		TxCommitFailures:  atomic.LoadUint64(&db.txCommitFailures),
+		CommitLatency:     db.commitLatency.snapshot(),
+		WaitTime:          db.waitTime.Load().snapshot(),
+	}
+
+	if w := db.dualWrite.Load(); w != nil {
+		s.DualWriteQueue = w.pending()
+	}
+
+	if db.sem != nil {
+		s.Waiting = db.sem.waiting()
+		s.LongestWait = db.sem.longestWait()
+		s.Wait1m = db.recentWaits(time.Minute)
+		s.Wait5m = db.recentWaits(5 * time.Minute)
+		s.Wait15m = db.recentWaits(15 * time.Minute)
+	}
+
+	return s
+}
+
+// ProcessStats combines the statistics of all named DBs in the process. See
+// AggregateStats(). Callers waiting on a limit shared by a host group (see
+// SetHostGrouping()) are counted once for the group, rather than once per DB.
+type ProcessStats struct {
+	InUse           int                  // Connections in use, in all DBs
+	Waiting         int                  // Callers waiting for a connection, in all DBs
+	LongestWait     time.Duration        // Of callers still waiting, in any DB
+	LongestWaitDB   string               // Name of the DB with the longest wait, if not shared
+	LongestWaitHost string               // Host group with the longest wait, if shared
+	DBs             map[string]PoolStats // Statistics of each DB, by name
+}
+
+// AggregateStats returns the statistics of all open DBs registered with
+// OpenNamed() or SetName(), along with totals for the process. DBs not named
+// aren't included.
+func AggregateStats() ProcessStats {
+	return aggregateStats(DBs())
+}
+
+// aggregateStats returns the statistics of the given DBs, by name, along with
+// their totals.
+func aggregateStats(dbs map[string]*DB) ProcessStats {
+	ps := ProcessStats{DBs: make(map[string]PoolStats, len(dbs))}
+	seen := make(map[string]bool) // Host groups counted
+
+	for name, db := range dbs {
+		s := db.PoolStats()
+		ps.DBs[name] = s
+		ps.InUse += s.InUse
+
+		// Waiters on a shared limit are reported by every DB in the group
+		if db.hostGroup != "" {
+			if seen[db.hostGroup] {
+				continue
+			}
+			seen[db.hostGroup] = true
+		}
+
+		ps.Waiting += s.Waiting
+		if s.LongestWait > ps.LongestWait {
+			ps.LongestWait = s.LongestWait
+			if db.hostGroup != "" {
+				ps.LongestWaitDB, ps.LongestWaitHost = "", db.hostGroup
+			} else {
+				ps.LongestWaitDB, ps.LongestWaitHost = name, ""
+			}
+		}
+	}
+
+	return ps
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var _ http.HandlerFunc = StatsHandler
+
+// statsReport is the document served by StatsHandler().
+type statsReport struct {
+	Time            time.Time                `json:"time"`
+	InUse           int                      `json:"in_use"`
+	Waiting         int                      `json:"waiting"`
+	LongestWait     time.Duration            `json:"longest_wait"`
+	LongestWaitDB   string                   `json:"longest_wait_db,omitempty"`
+	LongestWaitHost string                   `json:"longest_wait_host,omitempty"`
+	DBs             map[string]dbStatsReport `json:"dbs"`
+}
+
+// dbStatsReport holds the statistics of a DB in a statsReport.
+type dbStatsReport struct {
+	Driver          string                  `json:"driver"`
+	Limit           int                     `json:"limit"` // Zero if unlimited
+	InUse           int                     `json:"in_use"`
+	Waiting         int                     `json:"waiting"`
+	LongestWait     time.Duration           `json:"longest_wait"`
+	OpenConns       int                     `json:"open_conns"`
+	IdleConns       int                     `json:"idle_conns"`
+	Waits           uint64                  `json:"waits"`
+	WaitTime        time.Duration           `json:"wait_time"`
+	MeanWait        time.Duration           `json:"mean_wait"`
+	Shed            uint64                  `json:"shed"`
+	QuotaRejections uint64                  `json:"quota_rejections"`
+	TxBegun         uint64                  `json:"tx_begun"`
+	TxCommitted     uint64                  `json:"tx_committed"`
+	TxRolledBack    uint64                  `json:"tx_rolled_back"`
+	Windows         map[string]windowReport `json:"windows,omitempty"`
+}
+
+// windowReport holds a WaitWindow in a dbStatsReport.
+type windowReport struct {
+	Waits      uint64        `json:"waits"`
+	Mean       time.Duration `json:"mean"`
+	Max        time.Duration `json:"max"`
+	Saturation float64       `json:"saturation"`
+}
+
+func newWindowReport(w WaitWindow) windowReport {
+	return windowReport{Waits: w.Waits, Mean: w.Mean, Max: w.Max, Saturation: w.Saturation}
+}
+
+// StatsHandler serves the statistics of the DBs registered with OpenNamed() or
+// SetName() as JSON, for monitoring tools and scripts to scrape. The document
+// holds the totals in AggregateStats(), and for each DB, by name, the current
+// state of its pool, wait counters since it was opened (or the wait window
+// began; see SetWaitWindow()), and waits over the last 1, 5 and 15 minutes.
+// Durations are given in nanoseconds. The db query parameter, which may be
+// repeated, restricts the document to the DBs named; totals then cover those
+// only. Names are passed through the redactor (see SetRedactor()), in case
+// they hold DSNs; names that become the same are told apart by a numeric
+// suffix (e.g., "name#2"). Serve it on an internal address, as with
+// net/http/pprof.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	dbs := DBs()
+	if names := r.URL.Query()["db"]; len(names) > 0 {
+		selected := make(map[string]*DB, len(names))
+		for _, name := range names {
+			if db, ok := dbs[name]; ok {
+				selected[name] = db
+			}
+		}
+		dbs = selected
+	}
+
+	ps := aggregateStats(dbs)
+	report := statsReport{
+		Time:            time.Now(),
+		InUse:           ps.InUse,
+		Waiting:         ps.Waiting,
+		LongestWait:     ps.LongestWait,
+		LongestWaitHost: ps.LongestWaitHost,
+		DBs:             make(map[string]dbStatsReport, len(dbs)),
+	}
+
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := redact(name)
+		for n := 2; ; n++ {
+			if _, ok := report.DBs[key]; !ok {
+				break
+			}
+			key = redact(name) + "#" + strconv.Itoa(n)
+		}
+
+		report.DBs[key] = dbs[name].statsReport(ps.DBs[name])
+		if name == ps.LongestWaitDB {
+			report.LongestWaitDB = key
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// statsReport returns s, the statistics of the DB, as served by
+// StatsHandler().
+func (db *DB) statsReport(s PoolStats) dbStatsReport {
+	rep := dbStatsReport{
+		Driver:          db.driver,
+		InUse:           s.InUse,
+		Waiting:         s.Waiting,
+		LongestWait:     s.LongestWait,
+		OpenConns:       s.OpenConnections,
+		IdleConns:       s.Idle,
+		Waits:           s.WaitTime.Count,
+		WaitTime:        s.WaitTime.Sum,
+		MeanWait:        s.WaitTime.Mean(),
+		Shed:            s.Shed,
+		QuotaRejections: s.QuotaRejections,
+		TxBegun:         s.TxBegun,
+		TxCommitted:     s.TxCommitted,
+		TxRolledBack:    s.TxRolledBack,
+	}
+
+	if db.sem != nil {
+		rep.Limit = db.sem.limit()
+		rep.Windows = map[string]windowReport{
+			"1m":  newWindowReport(s.Wait1m),
+			"5m":  newWindowReport(s.Wait5m),
+			"15m": newWindowReport(s.Wait15m),
+		}
+	}
+
+	return rep
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// stmtCache keeps prepared statements by query, evicting the least recently
+// used ones once full.
+type stmtCache struct {
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // Of *stmtEntry, most recently used first
+	mu      sync.Mutex
+}
+
+type stmtEntry struct {
+	query string
+	stmt  *sql.Stmt
+}
+
+// SetStmtCache enables automatic preparation of the queries run with Exec(),
+// Query() and QueryRow(), and their context-aware versions. Each distinct query
+// is prepared on first use, and the statement is kept for later calls, up to
+// the given number of statements. The least recently used statement is closed
+// to make room for new ones. Statements that go bad, e.g., because the server
+// discarded them, are dropped and the query is run unprepared. Hits and misses
+// are reported in PoolStats(). Setting a non-positive size (the default)
+// disables the cache, closing all statements in it.
+func (db *DB) SetStmtCache(size int) {
+	var c *stmtCache
+	if size > 0 {
+		c = &stmtCache{
+			size:    size,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		}
+	}
+
+	db.stmtCacheMux.Lock()
+	old := db.stmtCache
+	db.stmtCache = c
+	db.stmtCacheMux.Unlock()
+
+	old.clear()
+}
+
+func (db *DB) getStmtCache() *stmtCache {
+	db.stmtCacheMux.RLock()
+	defer db.stmtCacheMux.RUnlock()
+	return db.stmtCache
+}
+
+// resetStmtCache drops all cached statements, e.g., when the underlying sql.DB
+// they were prepared on is replaced.
+func (db *DB) resetStmtCache() {
+	if c := db.getStmtCache(); c != nil {
+		db.SetStmtCache(c.size)
+	}
+}
+
+// stmt returns a cached statement for query, preparing it if needed. It returns
+// nil if the cache is disabled or the query can't be prepared, in which case
+// the query should run unprepared.
+func (db *DB) stmt(ctx context.Context, query string) *sql.Stmt {
+	c := db.getStmtCache()
+	if c == nil {
+		return nil
+	}
+
+	if stmt := c.get(query); stmt != nil {
+		atomic.AddUint64(&db.stmtCacheHits, 1)
+		return stmt
+	}
+	atomic.AddUint64(&db.stmtCacheMisses, 1)
+
+	stmt, err := db.pool().PrepareContext(ctx, query)
+	if err != nil {
+		return nil
+	}
+	return c.put(query, stmt)
+}
+
+// dropStmt removes a bad statement from the cache.
+func (db *DB) dropStmt(query string, stmt *sql.Stmt) {
+	if c := db.getStmtCache(); c != nil {
+		c.remove(query, stmt)
+	}
+}
+
+func (c *stmtCache) get(query string) *sql.Stmt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[query]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*stmtEntry).stmt
+	}
+	return nil
+}
+
+// put adds a statement, returning the one to use, which may have been added by
+// another caller in the meantime.
+func (c *stmtCache) put(query string, stmt *sql.Stmt) *sql.Stmt {
+	var evicted []*sql.Stmt
+
+	c.mu.Lock()
+	if e, ok := c.entries[query]; ok {
+		c.mu.Unlock()
+		stmt.Close()
+		return e.Value.(*stmtEntry).stmt
+	}
+
+	c.entries[query] = c.lru.PushFront(&stmtEntry{query: query, stmt: stmt})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*stmtEntry).query)
+		evicted = append(evicted, e.Value.(*stmtEntry).stmt)
+	}
+	c.mu.Unlock()
+
+	closeStmts(evicted)
+	return stmt
+}
+
+func (c *stmtCache) remove(query string, stmt *sql.Stmt) {
+	c.mu.Lock()
+	e, ok := c.entries[query]
+	if ok && e.Value.(*stmtEntry).stmt == stmt {
+		c.lru.Remove(e)
+		delete(c.entries, query)
+	} else {
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if ok {
+		closeStmts([]*sql.Stmt{stmt})
+	}
+}
+
+func (c *stmtCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	var stmts []*sql.Stmt
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		stmts = append(stmts, e.Value.(*stmtEntry).stmt)
+	}
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.mu.Unlock()
+
+	closeStmts(stmts)
+}
+
+// closeStmts closes statements in the background, since closing waits for
+// the statement to be done with, and the caller may still be using it (e.g.,
+// reading rows from it).
+func closeStmts(stmts []*sql.Stmt) {
+	if len(stmts) > 0 {
+		go func() {
+			for _, s := range stmts {
+				s.Close()
+			}
+		}()
+	}
+}
+
+// isBadStmt tells whether err means that a prepared statement can no longer be
+// used.
+func isBadStmt(err error) bool {
+	if err == nil {
+		return false
+	}
+	if n, ok := mysqlErrorNumber(err); ok && n == 1243 {
+		// Unknown prepared statement handler
+		return true
+	}
+	if code, ok := sqlState(err); ok && code == "26000" {
+		// Invalid SQL statement name
+		return true
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "statement is closed") ||
+		strings.Contains(msg, "database is closed") ||
+		(strings.Contains(msg, "prepared statement") && strings.Contains(msg, "does not exist"))
+}
+
+// exec runs a statement, prepared if caching is enabled.
+func (db *DB) exec(ctx context.Context, query string, args []interface{}) (sql.Result, error) {
+	if stmt := db.stmt(ctx, query); stmt != nil {
+		res, err := stmt.ExecContext(ctx, args...)
+		if !isBadStmt(err) {
+			return res, err
+		}
+		db.dropStmt(query, stmt)
+	}
+	return db.pool().ExecContext(ctx, query, args...)
+}
+
+// query runs a query, prepared if caching is enabled.
+func (db *DB) query(ctx context.Context, query string, args []interface{}) (*sql.Rows, error) {
+	if stmt := db.stmt(ctx, query); stmt != nil {
+		rows, err := stmt.QueryContext(ctx, args...)
+		if !isBadStmt(err) {
+			return rows, err
+		}
+		db.dropStmt(query, stmt)
+	}
+	return db.pool().QueryContext(ctx, query, args...)
+}
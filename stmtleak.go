@@ -0,0 +1,77 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"time"
+)
+
+// SetStmtLeakThreshold enables detection of leaked statements, i.e., those
+// prepared on the DB with Prepare() that are neither used nor closed for the
+// given time. Such statements hold resources on the server, which may run out
+// (e.g., max_prepared_stmt_count on MySQL). A StmtLeakEvent is sent for each
+// one, including the stack trace of the caller that prepared it, and it's not
+// reported again unless used and then left idle once more. Stacks are only
+// captured for statements prepared while detection is enabled. A zero threshold
+// (the default) disables detection.
+func (db *DB) SetStmtLeakThreshold(threshold time.Duration) {
+	db.stmtsMux.Lock()
+	defer db.stmtsMux.Unlock()
+
+	if db.stmtLeakStop != nil {
+		close(db.stmtLeakStop)
+		db.stmtLeakStop = nil
+	}
+
+	db.stmtLeakThreshold = threshold
+	if threshold <= 0 {
+		db.stmtLeakThreshold = 0
+		return
+	}
+
+	db.stmtLeakStop = make(chan struct{})
+	go db.detectStmtLeaks(threshold, db.stmtLeakStop)
+}
+
+func (db *DB) detectStmtLeaks(threshold time.Duration, stop <-chan struct{}) {
+	// Check often enough to report leaks shortly after crossing the threshold
+	ticker := time.NewTicker(threshold / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-db.done:
+			return
+		}
+
+		var leaks []StmtLeakEvent
+		now := time.Now()
+
+		db.stmtsMux.Lock()
+		for s := range db.stmts {
+			s.mu.Lock()
+			last := s.stats.LastUsed
+			if last.IsZero() {
+				last = s.stats.Prepared
+			}
+			if idle := now.Sub(last); idle >= threshold && !s.reported {
+				s.reported = true
+				leaks = append(leaks, StmtLeakEvent{
+					Time:  now,
+					Query: s.stats.Query,
+					Idle:  idle,
+					Stack: string(s.stack),
+				})
+			}
+			s.mu.Unlock()
+		}
+		db.stmtsMux.Unlock()
+
+		for _, e := range leaks {
+			db.emit(e)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StmtStats holds usage statistics for a prepared statement. See
+// DB.StmtStats().
+type StmtStats struct {
+	Query      string
+	Prepared   time.Time     // Time the statement was prepared
+	LastUsed   time.Time     // Time of the last execution (zero if never used)
+	Executions uint64        // Times the statement was run
+	Errors     uint64        // Executions that failed
+	Latency    time.Duration // Cumulative execution time
+}
+
+// Mean returns the average execution time, or zero if never run.
+func (s StmtStats) Mean() time.Duration {
+	if s.Executions == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(s.Executions)
+}
+
+// stmtStats tracks the usage of a statement prepared on the DB.
+type stmtStats struct {
+	mu       sync.Mutex
+	stats    StmtStats
+	stack    []byte // Set if leak detection was enabled when prepared
+	reported bool   // Whether reported as leaked since last used
+}
+
+func (s *stmtStats) record(latency time.Duration, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.LastUsed = time.Now()
+	s.reported = false
+	s.stats.Executions++
+	s.stats.Latency += latency
+	if err != nil {
+		s.stats.Errors++
+	}
+}
+
+func (s *stmtStats) snapshot() StmtStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// trackStmt starts tracking a statement just prepared on the DB.
+func (db *DB) trackStmt(query string) *stmtStats {
+	s := &stmtStats{stats: StmtStats{Query: query, Prepared: time.Now()}}
+
+	db.stmtsMux.Lock()
+	defer db.stmtsMux.Unlock()
+	if db.stmtLeakThreshold > 0 {
+		s.stack = db.stack()
+	}
+	if db.stmts == nil {
+		db.stmts = make(map[*stmtStats]struct{})
+	}
+	db.stmts[s] = struct{}{}
+	return s
+}
+
+func (db *DB) untrackStmt(s *stmtStats) {
+	db.stmtsMux.Lock()
+	defer db.stmtsMux.Unlock()
+	delete(db.stmts, s)
+}
+
+// StmtStats returns usage statistics for the statements prepared on the DB with
+// Prepare() that are still open, including executions made through derived
+// transaction statements (see Tx.Stmt()). Statements are sorted by execution
+// count, busiest first, so that hot statements come up first and unused ones
+// last.
+func (db *DB) StmtStats() []StmtStats {
+	db.stmtsMux.Lock()
+	stats := make([]StmtStats, 0, len(db.stmts))
+	for s := range db.stmts {
+		stats = append(stats, s.snapshot())
+	}
+	db.stmtsMux.Unlock()
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Executions != stats[j].Executions {
+			return stats[i].Executions > stats[j].Executions
+		}
+		return stats[i].Query < stats[j].Query
+	})
+	return stats
+}
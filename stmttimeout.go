@@ -0,0 +1,150 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type stmtTimeoutKey struct{}
+
+// WithStatementTimeout returns a copy of ctx that sets the server-side timeout
+// for statements using it, overriding that set with SetStatementTimeout(). A
+// zero timeout disables it for those statements.
+func WithStatementTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, stmtTimeoutKey{}, timeout)
+}
+
+// SetStatementTimeout sets a timeout for statements that is enforced by the
+// database server, so that runaway queries can't hold connections and server
+// resources indefinitely, even if the client gives up on them. The mechanism
+// depends on the dialect (see SetDialect()): on PostgreSQL, the
+// statement_timeout setting of the session is adjusted as needed before each
+// statement; on MySQL (5.7.8 or later), a MAX_EXECUTION_TIME optimizer hint is
+// added to SELECT statements, the only ones it applies to. Other dialects have
+// no suitable mechanism, so the timeout is ignored. Timeouts are rounded up to
+// whole milliseconds. The timeout can be overridden per statement with
+// WithStatementTimeout(). Zero (the default) disables it.
+func (db *DB) SetStatementTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	atomic.StoreInt64(&db.stmtTimeout, int64(timeout))
+}
+
+// StatementTimeout returns the timeout set with SetStatementTimeout().
+func (db *DB) StatementTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&db.stmtTimeout))
+}
+
+// statementTimeout returns the statement timeout for ctx, in milliseconds.
+func (db *DB) statementTimeout(ctx context.Context) int64 {
+	timeout, ok := ctx.Value(stmtTimeoutKey{}).(time.Duration)
+	if !ok {
+		timeout = db.StatementTimeout()
+	}
+	if timeout <= 0 {
+		return 0
+	}
+	return int64((timeout + time.Millisecond - 1) / time.Millisecond)
+}
+
+// applyTimeout applies the statement timeout for ctx to a statement about to
+// run on the connection, returning the query to run instead.
+func (c *driverConn) applyTimeout(ctx context.Context, query string) (string, error) {
+	ms := c.db.statementTimeout(ctx)
+
+	switch c.db.Dialect() {
+	case MySQLDialect:
+		if ms > 0 {
+			query = addExecutionTimeHint(query, ms)
+		}
+	case PostgresDialect:
+		// The setting stays with the session, so change it only as needed
+		if ms != c.stmtTimeout {
+			set := "SET statement_timeout = " + strconv.FormatInt(ms, 10)
+			if err := c.execRaw(ctx, set); err != nil {
+				return query, err
+			}
+			c.stmtTimeout = ms
+		}
+	}
+
+	return query, nil
+}
+
+// addExecutionTimeHint adds a MySQL MAX_EXECUTION_TIME hint to a SELECT
+// statement. Other statements are returned unchanged, as well as those
+// already holding the hint.
+func addExecutionTimeHint(query string, ms int64) string {
+	i := skipComments(query)
+	if len(query)-i < 6 || !strings.EqualFold(query[i:i+6], "SELECT") ||
+		strings.Contains(strings.ToUpper(query), "MAX_EXECUTION_TIME") {
+		return query
+	}
+
+	i += 6
+	return query[:i] + " /*+ MAX_EXECUTION_TIME(" + strconv.FormatInt(ms, 10) + ") */" + query[i:]
+}
+
+// skipComments returns the index of the first character of query after any
+// leading space and comments.
+func skipComments(query string) int {
+	i := 0
+	for i < len(query) {
+		switch {
+		case query[i] == ' ' || query[i] == '\t' || query[i] == '\r' || query[i] == '\n':
+			i++
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return len(query)
+			}
+			i += end + 4
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return len(query)
+			}
+			i += end + 1
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// execRaw runs a statement on the underlying connection, bypassing the
+// rewriting done by driverConn.
+func (c *driverConn) execRaw(ctx context.Context, query string) error {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		_, err := e.ExecContext(ctx, query, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	if e, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = e.ExecContext(ctx, nil)
+	} else {
+		_, err = stmt.Exec(nil)
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+/*
+Package stress provides scenarios to exercise dbcontrol under concurrency, so
+that users can check their own configuration and integration code against race
+conditions and connection leaks. Scenarios are meant to be run from tests with
+the race detector enabled, like so:
+
+	func TestStress(t *testing.T) {
+		db := openMyDB(t) // A *dbcontrol.DB set up as in production
+		if _, err := stress.Contention(db, stress.Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	$ go test -race
+
+All scenarios check that no connections are left in use nor callers waiting
+once they're done, returning ErrLeak otherwise.
+*/
+package stress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VividCortex/dbcontrol"
+)
+
+// ErrLeak is returned when connections remain in use after a scenario is done.
+var ErrLeak = errors.New("stress: connections leaked")
+
+// Options configures a scenario. Zero values are replaced by defaults.
+type Options struct {
+	Workers  int           // Concurrent goroutines (default 50)
+	Duration time.Duration // Time to run the scenario (default 1s)
+	Query    string        // Query run by workers (default "SELECT 1")
+}
+
+func (o *Options) setDefaults() {
+	if o.Workers <= 0 {
+		o.Workers = 50
+	}
+	if o.Duration <= 0 {
+		o.Duration = time.Second
+	}
+	if o.Query == "" {
+		o.Query = "SELECT 1"
+	}
+}
+
+// Result summarizes a scenario run.
+type Result struct {
+	Ops    uint64 // Operations completed
+	Errors uint64 // Operations that failed (including canceled ones)
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d ops, %d errors", r.Ops, r.Errors)
+}
+
+// run makes opts.Workers goroutines call op until opts.Duration elapses, while
+// the extra function, if any, runs in parallel.
+func run(db *dbcontrol.DB, opts Options, op func(rnd *rand.Rand) error, extra func(done <-chan struct{})) (Result, error) {
+	opts.setDefaults()
+	var res Result
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if err := op(rnd); err != nil {
+					atomic.AddUint64(&res.Errors, 1)
+				}
+				atomic.AddUint64(&res.Ops, 1)
+			}
+		}(int64(i))
+	}
+
+	if extra != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			extra(done)
+		}()
+	}
+
+	time.Sleep(opts.Duration)
+	close(done)
+	wg.Wait()
+
+	if s := db.PoolStats(); s.InUse != 0 || s.Waiting != 0 {
+		return res, fmt.Errorf("%w: %d in use, %d waiting", ErrLeak, s.InUse, s.Waiting)
+	}
+	return res, nil
+}
+
+// query runs q with every kind of operation in turn, consuming results.
+func query(ctx context.Context, db *dbcontrol.DB, q string, rnd *rand.Rand) error {
+	switch rnd.Intn(4) {
+	case 0:
+		_, err := db.ExecContext(ctx, q)
+		return err
+	case 1:
+		rows, err := db.QueryContext(ctx, q)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+		}
+		return rows.Close()
+	case 2:
+		var v interface{}
+		return db.QueryRowContext(ctx, q).Scan(&v)
+	default:
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+}
+
+// Contention runs many workers issuing queries as fast as they can, so that
+// they contend for connections all the time.
+func Contention(db *dbcontrol.DB, opts Options) (Result, error) {
+	return run(db, opts, func(rnd *rand.Rand) error {
+		return query(context.Background(), db, opts.Query, rnd)
+	}, nil)
+}
+
+// ChannelChurn runs queries like Contention(), while repeatedly setting and
+// removing the channels used for notifications (block durations, usage
+// timeouts and events). Note that channels previously set on db are replaced.
+func ChannelChurn(db *dbcontrol.DB, opts Options) (Result, error) {
+	return run(db, opts, func(rnd *rand.Rand) error {
+		return query(context.Background(), db, opts.Query, rnd)
+	}, func(done <-chan struct{}) {
+		defer func() {
+			db.SetBlockDurationCh(nil)
+			db.SetUsageTimeout(nil, 0)
+			db.SetEventCh(nil)
+		}()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			blockCh := make(chan time.Duration, 10)
+			usageCh := make(chan string, 10)
+			eventCh := make(chan dbcontrol.Event, 10)
+			stop := make(chan struct{})
+			go drain(blockCh, stop)
+			go drain(usageCh, stop)
+			go drain(eventCh, stop)
+
+			db.SetBlockDurationCh(blockCh)
+			db.SetUsageTimeout(usageCh, time.Duration(i%3)*time.Millisecond)
+			db.SetEventCh(eventCh)
+			time.Sleep(time.Millisecond)
+
+			db.SetUsageTimeout(nil, 0)
+			db.SetEventCh(nil)
+			db.SetBlockDurationCh(nil) // Closes blockCh
+			close(stop)
+		}
+	})
+}
+
+// drain consumes values from c until it's closed or stop is.
+func drain(c interface{}, stop <-chan struct{}) {
+	switch c := c.(type) {
+	case chan time.Duration:
+		for {
+			select {
+			case _, ok := <-c:
+				if !ok {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	case chan string:
+		for {
+			select {
+			case <-c:
+			case <-stop:
+				return
+			}
+		}
+	case chan dbcontrol.Event:
+		for {
+			select {
+			case <-c:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// TimeoutChurn runs queries like Contention(), but using contexts with short
+// random timeouts, so that many requests are canceled while waiting for a
+// connection or while running.
+func TimeoutChurn(db *dbcontrol.DB, opts Options) (Result, error) {
+	return run(db, opts, func(rnd *rand.Rand) error {
+		timeout := time.Duration(rnd.Intn(2000)) * time.Microsecond
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return query(ctx, db, opts.Query, rnd)
+	}, nil)
+}
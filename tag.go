@@ -0,0 +1,42 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import "context"
+
+type tagKey struct{}
+
+// tag is a key/value pair set with WithTag(), linked to those set on parent
+// contexts.
+type tag struct {
+	key, value string
+	parent     *tag
+}
+
+// WithTag returns a copy of ctx that tags operations using it with the given
+// key/value pair, such as the endpoint or tenant a query is run for. Tags are
+// carried by the events reporting on those operations (WaitEvent,
+// UsageTimeoutEvent, SlowQueryEvent and TxTimeoutEvent), so that pressure on
+// the pool can be attributed to product features. Setting a key already set on
+// ctx overrides it.
+func WithTag(ctx context.Context, key, value string) context.Context {
+	parent, _ := ctx.Value(tagKey{}).(*tag)
+	return context.WithValue(ctx, tagKey{}, &tag{key, value, parent})
+}
+
+// TagsFromContext returns the tags set on ctx with WithTag(), or nil if none
+// were.
+func TagsFromContext(ctx context.Context) map[string]string {
+	t, _ := ctx.Value(tagKey{}).(*tag)
+	if t == nil {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	for ; t != nil; t = t.parent {
+		if _, ok := tags[t.key]; !ok {
+			tags[t.key] = t.value
+		}
+	}
+	return tags
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx that accounts the connections taken with it
+// to the given tenant, as limited with SetTenantQuota().
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with WithTenant(), if any.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// SetTenantQuota limits the connections a tenant may hold at once, so that a
+// noisy tenant can't take the whole pool. Tenants are set on the context of
+// each request with WithTenant(); requests with no tenant are not limited.
+// Quotas are enforced before taking a connection from the DB, so requests
+// over quota don't hold up others. With OverflowReject, such requests fail
+// with ErrQuotaExceeded, and are counted in PoolStats().QuotaRejections. The
+// quota for the empty tenant applies to tenants with no quota of their own. A
+// zero MaxConns removes the quota.
+func (db *DB) SetTenantQuota(tenant string, q Quota) {
+	db.tenantQuotas.set(tenant, q)
+}
+
+// TenantQuotas returns the quotas set with SetTenantQuota(), or nil if none.
+func (db *DB) TenantQuotas() map[string]Quota {
+	return db.tenantQuotas.get()
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"time"
+)
+
+// AcquireReleaser is a pool of tokens limiting the connections in use, one per
+// connection. The built-in pool of each DB implements it, and others, such as
+// distributed semaphores or weighted schedulers, can be plugged in with
+// SetAcquireReleaser().
+type AcquireReleaser interface {
+	// Acquire takes a token, blocking until one is available or ctx is
+	// done, in which case an error is returned.
+	Acquire(ctx context.Context) error
+
+	// Release gives back a token taken with Acquire().
+	Release()
+}
+
+// TryAcquirer may be implemented by an AcquireReleaser to take a token only if
+// readily available, without blocking. See SetAcquireReleaser().
+type TryAcquirer interface {
+	TryAcquire() bool
+}
+
+var _ interface {
+	AcquireReleaser
+	TryAcquirer
+} = (*semaphore)(nil)
+
+// NewTokenPool returns an AcquireReleaser with the given number of tokens,
+// granted in FIFO order, as the built-in pool of a DB. It can be shared by
+// several DBs with SetAcquireReleaser(), to limit them as a whole.
+func NewTokenPool(size int) AcquireReleaser {
+	return newSemaphore(size)
+}
+
+func (s *semaphore) Acquire(ctx context.Context) error {
+	return s.acquire(ctx, 1, 0, nil)
+}
+
+func (s *semaphore) TryAcquire() bool {
+	return s.tryAcquire(1)
+}
+
+func (s *semaphore) Release() {
+	s.release(1)
+}
+
+// tokensRef holds the AcquireReleaser set with SetAcquireReleaser().
+type tokensRef struct {
+	AcquireReleaser
+}
+
+// SetAcquireReleaser replaces the built-in pool of tokens that limits the
+// connections in use with ar, while the rest of the DB works as usual. A nil ar
+// restores the built-in pool. Tokens taken before the change are given back
+// to the pool they came from. Waits are measured and reported as usual; if ar
+// implements TryAcquirer, it's tried first, and only acquisitions that fail it
+// are counted as waits, otherwise all of them are. Features that depend on the
+// internals of the built-in pool don't apply to others: PoolStats().Waiting,
+// the maximum number of waiters, queue positions, budget-aware waits, and
+// changes to the limit, such as those made by auto-shrinking and schedules.
+func (db *DB) SetAcquireReleaser(ar AcquireReleaser) {
+	if ar == nil {
+		db.tokens.Store(nil)
+		return
+	}
+	db.tokens.Store(&tokensRef{ar})
+}
+
+// customTokens returns the AcquireReleaser set with SetAcquireReleaser(), or
+// nil if the built-in pool is in use.
+func (db *DB) customTokens() AcquireReleaser {
+	if t := db.tokens.Load(); t != nil {
+		return t.AcquireReleaser
+	}
+	return nil
+}
+
+// acquireCustom takes a token from ar, returning the time waited.
+func (db *DB) acquireCustom(ctx context.Context, ar AcquireReleaser) (time.Duration, error) {
+	if t, ok := ar.(TryAcquirer); ok && t.TryAcquire() {
+		db.observeWait(ctx, 0, false)
+		return 0, nil
+	}
+
+	start := db.now()
+	if err := ar.Acquire(ctx); err != nil {
+		// Gave up waiting, which may have taken long enough
+		db.checkWait(db.since(start))
+		return 0, err
+	}
+
+	wait := db.since(start)
+	db.observeWait(ctx, wait, true)
+	return wait, nil
+}
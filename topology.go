@@ -0,0 +1,167 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// drainTimeout is the maximum time to wait for a shard removed from the
+	// topology to finish its requests, before closing it anyway.
+	drainTimeout = time.Minute
+
+	// drainInterval is how often draining shards are checked for requests.
+	drainInterval = 100 * time.Millisecond
+)
+
+// Reload changes the topology of shards opened with OpenSharded() to the given
+// DSNs, in order. Shards whose DSN is still in use are kept, possibly at a new
+// position, while new ones are opened as set up with OpenSharded(). The new
+// topology is swapped in atomically, so requests are routed according to
+// either the old or the new one, never a mix. Shards no longer in use are
+// drained in the background: they are closed once their requests finish, or
+// after a minute at most. A TopologyEvent is sent if the topology changes (see
+// SetEventCh()). If any new shard fails to open, the topology is left alone.
+func (s *Sharded) Reload(dsns ...string) error {
+	if s.open == nil {
+		return errors.New("dbcontrol: shards were not opened with OpenSharded()")
+	}
+	if len(dsns) == 0 {
+		return ErrNoShards
+	}
+
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	// Reuse shards for DSNs that are still in use
+	old := s.topology.Load()
+	reused := make([]bool, len(old.shards))
+	shards := make([]*DB, len(dsns))
+	var opened []*DB
+
+	for i, dsn := range dsns {
+		for j := range old.shards {
+			if !reused[j] && old.dsns[j] == dsn {
+				shards[i], reused[j] = old.shards[j], true
+				break
+			}
+		}
+		if shards[i] != nil {
+			continue
+		}
+
+		db, err := s.open(dsn)
+		if err != nil {
+			closeAll(opened)
+			return err
+		}
+		shards[i] = db
+		opened = append(opened, db)
+	}
+
+	s.swap(old, &shardTopology{shards: shards, dsns: append([]string(nil), dsns...)})
+	return nil
+}
+
+// SetShards replaces the shards with the given DBs, in order, as described for
+// Reload(). DBs that were shards and are no longer given are drained and
+// closed.
+func (s *Sharded) SetShards(shards ...*DB) error {
+	if len(shards) == 0 {
+		return ErrNoShards
+	}
+
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	old := s.topology.Load()
+	t := &shardTopology{
+		shards: append([]*DB(nil), shards...),
+		dsns:   make([]string, len(shards)),
+	}
+
+	// Keep the DSNs of shards opened by OpenSharded(), for Reload()
+	for i, db := range t.shards {
+		for j := range old.shards {
+			if old.shards[j] == db {
+				t.dsns[i] = old.dsns[j]
+				break
+			}
+		}
+	}
+
+	s.swap(old, t)
+	return nil
+}
+
+// swap replaces the old topology with t, draining shards no longer in use.
+// It must be called with reloadMux held.
+func (s *Sharded) swap(old, t *shardTopology) {
+	s.topology.Store(t)
+
+	kept := make(map[*DB]bool, len(t.shards))
+	for _, db := range t.shards {
+		kept[db] = true
+	}
+
+	var changed []int
+	for i := 0; i < len(old.shards) || i < len(t.shards); i++ {
+		if i >= len(old.shards) || i >= len(t.shards) || old.shards[i] != t.shards[i] {
+			changed = append(changed, i)
+		}
+	}
+
+	removed := 0
+	for _, db := range old.shards {
+		if !kept[db] {
+			removed++
+			go drain(db)
+		}
+	}
+
+	if len(changed) > 0 {
+		s.emit(TopologyEvent{
+			Time:      time.Now(),
+			OldShards: len(old.shards),
+			Shards:    len(t.shards),
+			Changed:   changed,
+			Draining:  removed,
+		})
+	}
+}
+
+// drain closes db once it's done with its requests, or the drain timeout
+// expires.
+func drain(db *DB) {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(drainTimeout)
+
+	for range ticker.C {
+		if s := db.PoolStats(); (s.InUse == 0 && s.Waiting == 0) || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	db.Close()
+}
+
+// SetEventCh sets a channel to receive events from the Sharded itself, as
+// opposed to those from the shards. Events are sent synchronously, as described
+// for DB.SetEventCh(). Setting the channel to nil disables notifications.
+func (s *Sharded) SetEventCh(c chan<- Event) {
+	s.eventChMux.Lock()
+	defer s.eventChMux.Unlock()
+	s.eventCh = c
+}
+
+func (s *Sharded) emit(e Event) {
+	s.eventChMux.RLock()
+	defer s.eventChMux.RUnlock()
+
+	if s.eventCh != nil {
+		s.eventCh <- e
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTxRetryPolicy is used by RunInTxRetry() unless a retry policy was set
+// with SetRetryPolicy().
+var defaultTxRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     10 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	Jitter:      0.2,
+}
+
+// SetTxTimeout sets a maximum duration for transactions. Transactions still
+// open after that time are automatically rolled back, thus releasing their
+// connection, and a TxTimeoutEvent is sent including the stack trace of the
+// caller that began the transaction (see SetEventCh()). Any further operation
+// on such a transaction will fail with sql.ErrTxDone. The timeout applies to
+// transactions begun after the call. Setting it to zero (the default)
+// disables this feature.
+func (db *DB) SetTxTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&db.txTimeout, int64(timeout))
+}
+
+// TxTimeout returns the timeout for transactions. See SetTxTimeout().
+func (db *DB) TxTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&db.txTimeout))
+}
+
+// isTxConflict tells whether err signals that a transaction was aborted due to
+// a conflict with others (deadlock or serialization failure), and can thus be
+// run again from the start.
+func isTxConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	if n, ok := mysqlErrorNumber(err); ok {
+		return n == 1213 || n == 1205
+	}
+	if code, ok := sqlState(err); ok {
+		return code == "40001" || code == "40P01"
+	}
+	return false
+}
+
+// runTx runs fn within a new transaction, committing if fn returns nil and
+// rolling back otherwise, even if fn panics.
+func (db *DB) runTx(ctx context.Context, opts *sql.TxOptions, fn func(*Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Transact runs fn within a transaction, committing it if fn returns nil and
+// rolling it back otherwise. The transaction is also rolled back if fn panics,
+// in which case the panic is propagated afterwards. Either way, the connection
+// is guaranteed to be released once Transact() returns. Errors from fn are
+// returned as is; otherwise the result from Commit() is returned.
+func (db *DB) Transact(ctx context.Context, fn func(*Tx) error) error {
+	return db.runTx(ctx, nil, fn)
+}
+
+// RunInTxRetry runs fn within a transaction, committing it if fn returns nil and
+// rolling it back otherwise (or if fn panics). If either fn or the commit fail
+// due to a deadlock or a serialization failure, the whole transaction is run
+// again, after a delay, using a new connection. Attempts and delays follow the
+// policy set with SetRetryPolicy(), or a default of 3 attempts if none was set.
+// Note that fn may thus be called several times, so it should have no side
+// effects other than those on the transaction. The error from the last attempt
+// is returned.
+func (db *DB) RunInTxRetry(ctx context.Context, opts *sql.TxOptions, fn func(*Tx) error) error {
+	policy := db.getRetryPolicy()
+	if policy.MaxAttempts <= 1 {
+		policy = defaultTxRetryPolicy
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := db.runTx(ctx, opts, fn)
+		if attempt >= policy.MaxAttempts || !isTxConflict(err) {
+			return err
+		}
+
+		if err := sleep(ctx, policy.backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TxInfo describes a transaction, as passed to TxHooks.
+type TxInfo struct {
+	Tx         *Tx
+	Duration   time.Duration // Time since the transaction began
+	Statements int           // Statements run so far, through Exec() or Query()
+}
+
+// TxHooks holds functions to be called at different points in the lifetime of
+// transactions, as set with SetTxHooks(). Any of them may be nil. Hooks are
+// called synchronously, from the goroutine operating on the transaction.
+type TxHooks struct {
+	// OnTxBegin is called right after a transaction begins.
+	OnTxBegin func(TxInfo)
+
+	// OnBeforeCommit is called when Commit() is requested, before actually
+	// committing. If it returns an error, the transaction is rolled back
+	// instead, and Commit() returns that error. This can be used to enforce
+	// invariants on transactions.
+	OnBeforeCommit func(TxInfo) error
+
+	// OnAfterCommit is called after committing, with the result from the
+	// database.
+	OnAfterCommit func(TxInfo, error)
+
+	// OnRollback is called after a transaction is rolled back, whether
+	// explicitly or due to a timeout (see SetTxTimeout()).
+	OnRollback func(TxInfo)
+}
+
+// SetTxHooks sets the hooks to call for transactions on the DB, replacing any
+// previous ones. Hooks take effect immediately, including for transactions
+// already in progress.
+func (db *DB) SetTxHooks(hooks TxHooks) {
+	db.txHooksMux.Lock()
+	defer db.txHooksMux.Unlock()
+	db.txHooks = hooks
+}
+
+func (db *DB) getTxHooks() TxHooks {
+	db.txHooksMux.RLock()
+	defer db.txHooksMux.RUnlock()
+	return db.txHooks
+}
+
+func (tx *Tx) info() TxInfo {
+	return TxInfo{
+		Tx:         tx,
+		Duration:   time.Since(tx.start),
+		Statements: int(atomic.LoadInt32(&tx.statements)),
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxIdleConns is the default number of idle connections kept by
+// database/sql.
+const defaultMaxIdleConns = 2
+
+// SetValidation enables validation of connections that may have gone stale,
+// e.g., because a firewall dropped them after some idle time. When a
+// connection is granted and the DB has been idle for longer than the given
+// threshold, the database is pinged first. If the ping fails, idle connections
+// are discarded, so that the caller gets a fresh one. Note that database/sql
+// already discards connections whose driver reports them as invalid (see
+// driver.Validator), but not all drivers can tell in advance. A zero threshold
+// (the default) disables validation.
+func (db *DB) SetValidation(idle time.Duration) {
+	atomic.StoreInt64(&db.validateIdle, int64(idle))
+}
+
+// Validation returns the threshold set with SetValidation().
+func (db *DB) Validation() time.Duration {
+	return time.Duration(atomic.LoadInt64(&db.validateIdle))
+}
+
+// touch records activity on the DB.
+func (db *DB) touch() {
+	atomic.StoreInt64(&db.lastActive, time.Now().UnixNano())
+}
+
+// validate checks the connections of a DB that has been idle for too long,
+// discarding them if broken.
+func (db *DB) validate(ctx context.Context) {
+	idle := db.Validation()
+	if idle <= 0 {
+		return
+	}
+
+	// Only the first caller after an idle period validates
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&db.lastActive)
+	if time.Duration(now-last) <= idle || !atomic.CompareAndSwapInt64(&db.lastActive, last, now) {
+		return
+	}
+
+	if err := db.pool().PingContext(ctx); err != nil {
+		atomic.AddUint64(&db.staleConns, 1)
+		db.flushIdle()
+	}
+}
+
+// flushIdle closes all idle connections.
+func (db *DB) flushIdle() {
+	db.limitMux.Lock()
+	defer db.limitMux.Unlock()
+
+	pool := db.pool()
+	pool.SetMaxIdleConns(0)
+	pool.SetMaxIdleConns(db.idleConns())
+}
+
+// idleConns returns the maximum number of idle connections for the DB. Must be
+// called with db.limitMux held.
+func (db *DB) idleConns() int {
+	switch {
+	case db.sem != nil:
+		return db.sem.limit()
+	case db.maxIdleSet:
+		return db.maxIdle
+	}
+	return defaultMaxIdleConns
+}
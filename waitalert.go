@@ -0,0 +1,73 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// waitAlertInterval is the minimum time between calls to the function set with
+// OnWaitExceeds().
+const waitAlertInterval = 10 * time.Second
+
+// WaitAlert describes a wait for a connection that exceeded the threshold set
+// with OnWaitExceeds(), together with the recent state of the pool.
+type WaitAlert struct {
+	Wait      time.Duration // Time waited (until given up, if not acquired)
+	Threshold time.Duration
+	InUse     int        // Connections in use
+	Waiting   int        // Callers waiting for a connection
+	Recent    WaitWindow // Waits over the last minute
+}
+
+type waitAlert struct {
+	threshold time.Duration
+	fn        func(WaitAlert)
+}
+
+// OnWaitExceeds sets a function to be called when a caller waits longer than
+// threshold for a connection, either until getting one or until giving up, so
+// that problems can be detected before the pool is exhausted altogether. The
+// function is called in a goroutine of its own, at most once every 10 seconds,
+// so it may take its time (e.g., to page someone) without delaying callers.
+// Setting a nil function removes it. This only applies to DBs limiting the
+// number of connections.
+func (db *DB) OnWaitExceeds(threshold time.Duration, fn func(WaitAlert)) {
+	db.waitAlertMux.Lock()
+	defer db.waitAlertMux.Unlock()
+
+	if fn == nil {
+		db.waitAlert = nil
+		return
+	}
+	db.waitAlert = &waitAlert{threshold: threshold, fn: fn}
+}
+
+// checkWait calls the function set with OnWaitExceeds(), if due.
+func (db *DB) checkWait(wait time.Duration) {
+	db.waitAlertMux.RLock()
+	alert := db.waitAlert
+	db.waitAlertMux.RUnlock()
+
+	if alert == nil || wait <= alert.threshold {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&db.lastWaitAlert)
+	if last != 0 && now-last < int64(waitAlertInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&db.lastWaitAlert, last, now) {
+		return
+	}
+
+	go alert.fn(WaitAlert{
+		Wait:      wait,
+		Threshold: alert.threshold,
+		InUse:     int(atomic.LoadInt32(&db.inUse)),
+		Waiting:   db.sem.waiting(),
+		Recent:    db.recentWaits(time.Minute),
+	})
+}
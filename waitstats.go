@@ -0,0 +1,52 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"time"
+)
+
+// SetWaitWindow makes the wait time histogram (see PoolStats.WaitTime) reset
+// periodically, so that it reflects recent waits only. The histogram is reset
+// when the window is set, and every window thereafter. Setting a zero window
+// (the default) stops resetting it, so that it covers all waits since the last
+// reset.
+func (db *DB) SetWaitWindow(window time.Duration) {
+	db.waitWindowMux.Lock()
+	defer db.waitWindowMux.Unlock()
+
+	if db.waitWindowStop != nil {
+		close(db.waitWindowStop)
+		db.waitWindowStop = nil
+	}
+
+	db.waitWindow = window
+	if window <= 0 {
+		return
+	}
+
+	db.ResetWaitTime()
+	db.waitWindowStop = make(chan struct{})
+	go db.rotateWaits(window, db.waitWindowStop)
+}
+
+// ResetWaitTime resets the wait time histogram, returning its contents.
+func (db *DB) ResetWaitTime() Histogram {
+	return db.waitTime.Swap(new(histogram)).snapshot()
+}
+
+func (db *DB) rotateWaits(window time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.ResetWaitTime()
+		case <-stop:
+			return
+		case <-db.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+package dbcontrol
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	windowBucket  = 10 * time.Second
+	windowBuckets = int64(15 * time.Minute / windowBucket)
+)
+
+// WaitWindow summarizes connection waits over a recent period of time. See
+// PoolStats.
+type WaitWindow struct {
+	Waits      uint64        // Connections acquired
+	Mean       time.Duration // Average time waited (zero if no waits)
+	Max        time.Duration // Longest time waited
+	Saturation float64       // Ratio of time all connections were busy
+}
+
+// windowBucketStats holds the statistics for a bucket of a windowRing.
+type windowBucketStats struct {
+	n     int64 // Number of the bucket since the epoch
+	waits uint64
+	sum   time.Duration
+	max   time.Duration
+	busy  time.Duration
+}
+
+// windowRing aggregates waits and saturation over rolling windows of up to 15
+// minutes, using buckets of 10 seconds. It's safe for concurrent use.
+type windowRing struct {
+	mu        sync.Mutex
+	buckets   [windowBuckets]windowBucketStats
+	busySince time.Time // Set while saturated
+}
+
+// bucket returns the bucket for t, resetting it if stale. Must be called with
+// r.mu held.
+func (r *windowRing) bucket(t time.Time) *windowBucketStats {
+	n := t.UnixNano() / int64(windowBucket)
+	b := &r.buckets[n%windowBuckets]
+	if b.n != n {
+		*b = windowBucketStats{n: n}
+	}
+	return b
+}
+
+func (r *windowRing) observe(wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.bucket(time.Now())
+	b.waits++
+	b.sum += wait
+	if wait > b.max {
+		b.max = wait
+	}
+}
+
+// setBusy records whether all connections are busy from now on.
+func (r *windowRing) setBusy(busy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+
+	switch {
+	case busy && r.busySince.IsZero():
+		r.busySince = now
+	case !busy && !r.busySince.IsZero():
+		r.addBusy(r.busySince, now)
+		r.busySince = time.Time{}
+	}
+}
+
+// addBusy accounts for the time all connections were busy between from and
+// to, splitting it among buckets. Must be called with r.mu held.
+func (r *windowRing) addBusy(from, to time.Time) {
+	if min := to.Add(-time.Duration(windowBuckets) * windowBucket); from.Before(min) {
+		from = min
+	}
+
+	for from.Before(to) {
+		end := from.Truncate(windowBucket).Add(windowBucket)
+		if end.After(to) {
+			end = to
+		}
+		r.bucket(from).busy += end.Sub(from)
+		from = end
+	}
+}
+
+// window summarizes the given period before now, which is rounded up to whole
+// buckets.
+func (r *windowRing) window(period time.Duration) WaitWindow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+
+	last := now.UnixNano() / int64(windowBucket)
+	count := int64((period + windowBucket - 1) / windowBucket)
+	if count > windowBuckets {
+		count = windowBuckets
+	}
+
+	var w WaitWindow
+	var sum, busy time.Duration
+	for n := last - count + 1; n <= last; n++ {
+		b := &r.buckets[n%windowBuckets]
+		if b.n != n {
+			continue
+		}
+		w.Waits += b.waits
+		sum += b.sum
+		busy += b.busy
+		if b.max > w.Max {
+			w.Max = b.max
+		}
+	}
+
+	// Include the ongoing busy period, without recording it yet
+	if !r.busySince.IsZero() {
+		from := r.busySince
+		if start := time.Unix(0, (last-count+1)*int64(windowBucket)); from.Before(start) {
+			from = start
+		}
+		busy += now.Sub(from)
+	}
+
+	if w.Waits > 0 {
+		w.Mean = sum / time.Duration(w.Waits)
+	}
+
+	// The current bucket is only partially elapsed
+	elapsed := time.Duration(count-1)*windowBucket + now.Sub(now.Truncate(windowBucket))
+	if elapsed > 0 {
+		w.Saturation = float64(busy) / float64(elapsed)
+	}
+	return w
+}
+
+// recentWaits summarizes waits for the DB over the given period before now.
+// Saturation is that of the semaphore, which may be shared with other DBs on
+// the same host.
+func (db *DB) recentWaits(period time.Duration) WaitWindow {
+	w := db.waitWindows.window(period)
+	w.Saturation = db.sem.windows.window(period).Saturation
+	return w
+}